@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"coral-counts/counts"
+)
+
+// connection is a connection to the --mongoDBURI. When the sites matching the
+// --siteFilter are processed, it's shared by the run of each site rather than
+// connecting again for each of them.
+type connection struct {
+	client *mongo.Client
+	db     *mongo.Database
+
+	// timeouts are the deadlines of the operations over the connection.
+	timeouts counts.PhaseTimeouts
+
+	// writes records the writes attempted over the connection, it's only set
+	// when the connection is read only.
+	writes *writeMonitor
+}
+
+// connect will connect to the --mongoDBURI and ping it with the read
+// preference. When readOnly is true the writes attempted over the connection
+// are recorded.
+func connect(c *cli.Context, readOnly bool, pingPreference *readpref.ReadPref) (*connection, error) {
+	// Parse the database name out of the path component of the uri.
+	databaseName, err := parseDatabaseName(c.String("mongoDBURI"))
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := parseTimeouts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a context for connecting to MongoDB.
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.Connect)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(c.String("mongoDBURI"))
+	if err := applyPoolOptions(c, clientOptions); err != nil {
+		return nil, err
+	}
+
+	// Watch for writes so we can assert that none were attempted.
+	var writes *writeMonitor
+	if readOnly {
+		writes = &writeMonitor{}
+		clientOptions.SetMonitor(writes.Monitor())
+	}
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, withExitCode(errors.Wrap(err, "cannot connect to mongo"), ExitConnection)
+	}
+
+	conn := &connection{
+		client:   client,
+		db:       client.Database(databaseName),
+		timeouts: timeouts,
+		writes:   writes,
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeouts.Ping)
+	defer cancel()
+
+	if err := client.Ping(ctx, pingPreference); err != nil {
+		conn.Close()
+		return nil, withExitCode(errors.Wrap(err, "cannot ping mongo"), ExitConnection)
+	}
+
+	return conn, nil
+}
+
+// pingPreference returns the read preference that the connection is pinged
+// with. Read only runs don't need the primary, so they're pinged with the read
+// preference used for the scans instead, or the client's when there isn't one.
+func pingPreference(c *cli.Context) (*readpref.ReadPref, error) {
+	if !c.Bool("readOnly") {
+		return readpref.Primary(), nil
+	}
+
+	return parseReadPreference(c)
+}
+
+// Close will disconnect from MongoDB.
+func (conn *connection) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), conn.timeouts.Disconnect)
+	defer cancel()
+
+	if err := conn.client.Disconnect(ctx); err != nil {
+		logrus.WithError(err).Warn("could not disconnect from mongo")
+	}
+}
@@ -0,0 +1,180 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// actionCountKey returns the key in a comment's actionCounts that an action with
+// the type and reason is counted under. Coral counts every action under its type
+// and, when it has a reason, under its type and reason.
+func actionCountKey(actionType, reason string) string {
+	return actionType + "__" + reason
+}
+
+// VerifyActionCounts will recount the actions on a random sample of the site's
+// comments from the commentActions collection and log each comment where the
+// recounted actions differ from the comment's actionCounts. Up to sampleSize
+// comments are sampled from each of the comments collections. It returns the
+// number of comments that were checked and the number that differed. This only
+// reads from the database.
+func (p *Processor) VerifyActionCounts(ctx context.Context, sampleSize int) (int, int, error) {
+	started := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"siteID":     p.SiteID,
+		"sampleSize": sampleSize,
+	}).Info("verifying comment action counts")
+
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Sample the comments to verify from each of the comments collections.
+	var comments []Comment
+	for _, collection := range collections {
+		cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+			bson.D{
+				primitive.E{Key: "$match", Value: bson.D{
+					primitive.E{Key: "tenantID", Value: p.TenantID},
+					primitive.E{Key: "siteID", Value: p.SiteID},
+				}},
+			},
+			bson.D{
+				primitive.E{Key: "$sample", Value: bson.D{
+					primitive.E{Key: "size", Value: sampleSize},
+				}},
+			},
+			bson.D{
+				primitive.E{Key: "$project", Value: bson.D{
+					primitive.E{Key: p.Rules.Fields.ID, Value: 1},
+					primitive.E{Key: p.Rules.Fields.ActionCounts, Value: 1},
+				}},
+			},
+		})
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "could not sample comments from %s", collection.Name())
+		}
+
+		var sampled []bson.Raw
+		if err := cursor.All(ctx, &sampled); err != nil {
+			return 0, 0, errors.Wrap(err, "could not decode sampled comments")
+		}
+
+		for _, raw := range sampled {
+			var comment Comment
+			if err := p.Rules.Fields.Decode(raw, &comment); err != nil {
+				return 0, 0, errors.Wrap(err, "could not decode sampled comments")
+			}
+
+			comments = append(comments, comment)
+		}
+	}
+
+	if len(comments) == 0 {
+		return 0, 0, nil
+	}
+
+	commentIDs := make([]string, 0, len(comments))
+	for _, comment := range comments {
+		commentIDs = append(commentIDs, comment.ID)
+	}
+
+	// Count the actions for the sampled comments.
+	cursor, err := p.DB.Collection("commentActions").Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.D{
+				primitive.E{Key: "tenantID", Value: p.TenantID},
+				primitive.E{Key: "commentID", Value: bson.D{
+					primitive.E{Key: "$in", Value: commentIDs},
+				}},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.D{
+				primitive.E{Key: "_id", Value: bson.D{
+					primitive.E{Key: "commentID", Value: "$commentID"},
+					primitive.E{Key: "actionType", Value: "$actionType"},
+					primitive.E{Key: "reason", Value: "$reason"},
+				}},
+				primitive.E{Key: "count", Value: bson.D{
+					primitive.E{Key: "$sum", Value: 1},
+				}},
+			}},
+		},
+	})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not count comment actions")
+	}
+
+	var groups []struct {
+		ID struct {
+			CommentID  string `bson:"commentID"`
+			ActionType string `bson:"actionType"`
+			Reason     string `bson:"reason"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return 0, 0, errors.Wrap(err, "could not decode comment action counts")
+	}
+
+	expected := make(map[string]map[string]int, len(comments))
+	for _, group := range groups {
+		counts, ok := expected[group.ID.CommentID]
+		if !ok {
+			counts = make(map[string]int)
+			expected[group.ID.CommentID] = counts
+		}
+
+		counts[group.ID.ActionType] += group.Count
+		if group.ID.Reason != "" {
+			counts[actionCountKey(group.ID.ActionType, group.ID.Reason)] += group.Count
+		}
+	}
+
+	// Compare the stored counts to the recounted ones.
+	var mismatched int
+	for _, comment := range comments {
+		drift := make(map[string]int)
+
+		for key, count := range expected[comment.ID] {
+			if comment.ActionCounts[key] != count {
+				drift[key] = comment.ActionCounts[key] - count
+			}
+		}
+
+		for key, count := range comment.ActionCounts {
+			if _, ok := expected[comment.ID][key]; !ok && count != 0 {
+				drift[key] = count
+			}
+		}
+
+		if len(drift) == 0 {
+			continue
+		}
+
+		mismatched++
+
+		logrus.WithFields(logrus.Fields{
+			"commentID":    comment.ID,
+			"actionCounts": comment.ActionCounts,
+			"actions":      expected[comment.ID],
+			"drift":        drift,
+		}).Warn("comment action counts do not match its actions")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"checked":    len(comments),
+		"mismatched": mismatched,
+		"took":       time.Since(started),
+	}).Info("verified comment action counts")
+
+	return len(comments), mismatched, nil
+}
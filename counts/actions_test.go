@@ -0,0 +1,64 @@
+package counts
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestVerifyActionCountsCollections(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(id string, flags int32) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "actionCounts", Value: bson.D{primitive.E{Key: "FLAG", Value: flags}}},
+		}
+	}
+	action := func(commentID string, count int32) bson.D {
+		return bson.D{
+			primitive.E{Key: "_id", Value: bson.D{
+				primitive.E{Key: "commentID", Value: commentID},
+				primitive.E{Key: "actionType", Value: "FLAG"},
+			}},
+			primitive.E{Key: "count", Value: count},
+		}
+	}
+
+	mt.Run("sampled from each collection", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1", 1)),
+			mtest.CreateCursorResponse(0, "coral.comments_archive", mtest.FirstBatch, comment("a1", 2)),
+			mtest.CreateCursorResponse(0, "coral.commentActions", mtest.FirstBatch, action("c1", 1), action("a1", 1)),
+		)
+
+		p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+		p.CommentsCollections = []string{"comments", "comments_archive"}
+
+		checked, mismatched, err := p.VerifyActionCounts(context.Background(), 10)
+		if err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+
+		if checked != 2 {
+			mt.Errorf("expected a comment from each collection to be checked, got %d", checked)
+		}
+		if mismatched != 1 {
+			mt.Errorf("expected the archived comment to be mismatched, got %d", mismatched)
+		}
+
+		var sampled []string
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "aggregate" {
+				sampled = append(sampled, event.Command.Lookup("aggregate").StringValue())
+			}
+		}
+		if len(sampled) != 3 || sampled[0] != "comments" || sampled[1] != "comments_archive" {
+			mt.Errorf("expected the comments and comments_archive collections to be sampled, got %v", sampled)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package counts
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CommentIterator returns the next comment to count. When there are no more
+// comments it returns false.
+type CommentIterator func() (*Comment, bool, error)
+
+// Aggregator counts comments into the counts for the stories they are on. It
+// doesn't depend on where the comments come from, so comments can be counted
+// from a Mongo cursor, a changestream replay, or a file of exported comments.
+type Aggregator struct {
+	stories map[string]*Story
+
+	// rules are the rules the comments are counted with.
+	rules *Rules
+
+	// limit when greater than zero is the most stories that are counted.
+	limit int
+}
+
+// NewAggregator will create a new Aggregator with no stories that counts the
+// comments with the rules.
+func NewAggregator(rules *Rules) *Aggregator {
+	return &Aggregator{
+		stories: make(map[string]*Story),
+		rules:   rules,
+	}
+}
+
+// NewLimitedAggregator will create a new Aggregator with no stories that counts
+// at most limit stories. Once it has counted the limit, comments on any other
+// stories are skipped.
+func NewLimitedAggregator(limit int, rules *Rules) *Aggregator {
+	a := NewAggregator(rules)
+	a.limit = limit
+
+	return a
+}
+
+// Accepts returns true when the comment will be counted by Add, which is
+// always unless the limit of stories has been reached and the comment isn't on
+// one of them.
+func (a *Aggregator) Accepts(comment *Comment) bool {
+	if a.limit <= 0 {
+		return true
+	}
+
+	if _, ok := a.stories[a.rules.normalizeStoryID(comment.StoryID)]; ok {
+		return true
+	}
+
+	return len(a.stories) < a.limit
+}
+
+// Add will count the comment on its story. The story is identified by the
+// comment's story ID after it's normalized by the StoryIDNormalizer.
+func (a *Aggregator) Add(comment *Comment) {
+	if !a.Accepts(comment) {
+		return
+	}
+
+	storyID := a.rules.normalizeStoryID(comment.StoryID)
+
+	// Create the story in the map if it isn't already.
+	story, ok := a.stories[storyID]
+	if !ok {
+		story = &Story{
+			ID: storyID,
+		}
+		a.stories[storyID] = story
+
+		story.CommentCounts.Action = make(map[string]int)
+	}
+
+	// Increment the story document based on this comment.
+	story.Increment(comment, a.rules)
+}
+
+// Aggregate will count every comment returned by next until it has no more
+// comments, and then return the stories keyed by their ID.
+func (a *Aggregator) Aggregate(next CommentIterator) (map[string]*Story, error) {
+	for {
+		comment, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		a.Add(comment)
+	}
+
+	return a.Stories(), nil
+}
+
+// Merge will add the counts of the stories to the stories that have been
+// counted.
+func (a *Aggregator) Merge(stories map[string]*Story) {
+	for storyID, story := range stories {
+		existing, ok := a.stories[storyID]
+		if !ok {
+			a.stories[storyID] = story
+			continue
+		}
+
+		existing.CommentCounts.Merge(&story.CommentCounts)
+		existing.StaleComments += story.StaleComments
+		existing.CreatedAt.Merge(&story.CreatedAt)
+
+		// The distinct authors can't be summed, so the sets of authors are
+		// combined instead.
+		for authorID := range story.authors {
+			if existing.authors == nil {
+				existing.authors = make(map[string]struct{})
+			}
+
+			existing.authors[authorID] = struct{}{}
+		}
+		if len(existing.authors) > 0 {
+			existing.CommentCounts.DistinctAuthors = len(existing.authors)
+		}
+	}
+}
+
+// Stories returns the stories that have been counted keyed by their ID.
+func (a *Aggregator) Stories() map[string]*Story {
+	return a.stories
+}
+
+// cursorComments returns an iterator over the comments from the cursor on the
+// collection. If a DeadLetterCollection is configured, comments that can't be
+// decoded are recorded there and skipped.
+func (p *Processor) cursorComments(ctx context.Context, collection string, cursor *mongo.Cursor) CommentIterator {
+	scanned := scanCounter{name: "comments.scanned", metrics: p.Metrics}
+
+	return func() (*Comment, bool, error) {
+		for p.nextTimed(ctx, cursor, collection) {
+			scanned.read(cursor)
+
+			var comment Comment
+			if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+				if p.DeadLetterCollection == "" {
+					return nil, false, errors.Wrap(err, "could not decode result")
+				}
+
+				recordDeadLetter(ctx, p.DB.Collection(p.DeadLetterCollection), p.DryRun, DeadLetter{
+					TenantID:   p.TenantID,
+					SiteID:     p.SiteID,
+					Collection: collection,
+					DocumentID: documentID(cursor.Current),
+					Error:      err.Error(),
+				})
+
+				continue
+			}
+
+			return &comment, true, nil
+		}
+
+		if err := cursor.Err(); err != nil {
+			return nil, false, errors.Wrap(err, "could not iterate on cursor")
+		}
+
+		return nil, false, nil
+	}
+}
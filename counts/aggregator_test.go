@@ -0,0 +1,217 @@
+package counts
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// sliceComments returns an iterator over the comments. When err is set it's
+// returned once the comments have been returned.
+func sliceComments(err error, comments ...Comment) CommentIterator {
+	return func() (*Comment, bool, error) {
+		if len(comments) == 0 {
+			if err != nil {
+				return nil, false, err
+			}
+
+			return nil, false, nil
+		}
+
+		comment := comments[0]
+		comments = comments[1:]
+
+		return &comment, true, nil
+	}
+}
+
+func TestAggregatorAggregate(t *testing.T) {
+	errCursor := errors.New("cursor failed")
+
+	tests := []struct {
+		name    string
+		next    CommentIterator
+		want    map[string]CommentStatusCounts
+		wantErr error
+	}{
+		{
+			name: "no comments",
+			next: sliceComments(nil),
+			want: map[string]CommentStatusCounts{},
+		},
+		{
+			name: "comments on stories",
+			next: sliceComments(nil,
+				Comment{StoryID: "a", Status: "APPROVED"},
+				Comment{StoryID: "b", Status: "NONE"},
+				Comment{StoryID: "a", Status: "REJECTED"},
+			),
+			want: map[string]CommentStatusCounts{
+				"a": {Approved: 1, Rejected: 1},
+				"b": {None: 1},
+			},
+		},
+		{
+			name: "cursor fails part way",
+			next: sliceComments(errCursor,
+				Comment{StoryID: "a", Status: "APPROVED"},
+			),
+			wantErr: errCursor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+
+			stories, err := NewAggregator(&rules).Aggregate(tt.next)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				if stories != nil {
+					t.Errorf("expected no stories from a failed iterator, got %d", len(stories))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(stories) != len(tt.want) {
+				t.Fatalf("expected %d stories, got %d", len(tt.want), len(stories))
+			}
+			for storyID, want := range tt.want {
+				story, ok := stories[storyID]
+				if !ok {
+					t.Fatalf("expected story %s to be counted", storyID)
+				}
+				if story.ID != storyID {
+					t.Errorf("expected the story ID %s, got %s", storyID, story.ID)
+				}
+				if story.CommentCounts.Status != want {
+					t.Errorf("expected story %s to have %+v, got %+v", storyID, want, story.CommentCounts.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards [][]Comment
+	}{
+		{
+			name: "shards with different stories",
+			shards: [][]Comment{
+				{{StoryID: "a", AuthorID: "u1", Status: "APPROVED"}, {StoryID: "a", AuthorID: "u2", Status: "NONE"}},
+				{{StoryID: "b", AuthorID: "u1", Status: "REJECTED"}},
+			},
+		},
+		{
+			name: "shards with the same story",
+			shards: [][]Comment{
+				{{StoryID: "a", AuthorID: "u1", Status: "APPROVED"}, {StoryID: "a", AuthorID: "u2", Status: "NONE"}},
+				{{StoryID: "a", AuthorID: "u2", Status: "APPROVED"}, {StoryID: "a", AuthorID: "u3", Status: "PREMOD"}},
+			},
+		},
+		{
+			name: "empty shard",
+			shards: [][]Comment{
+				{{StoryID: "a", AuthorID: "u1", Status: "APPROVED"}},
+				{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountDistinctAuthors = true
+
+			// Count every comment with a single aggregator, which the merged shards
+			// should match.
+			want := NewAggregator(&rules)
+			merged := NewAggregator(&rules)
+			for _, comments := range tt.shards {
+				shard := NewAggregator(&rules)
+				for i := range comments {
+					want.Add(&comments[i])
+					shard.Add(&comments[i])
+				}
+
+				merged.Merge(shard.Stories())
+			}
+
+			got := merged.Stories()
+			if len(got) != len(want.Stories()) {
+				t.Fatalf("expected %d stories, got %d", len(want.Stories()), len(got))
+			}
+			for storyID, story := range want.Stories() {
+				merged, ok := got[storyID]
+				if !ok {
+					t.Fatalf("expected story %s to be merged", storyID)
+				}
+				if d := Diff(story.CommentCounts, merged.CommentCounts); !d.Empty() {
+					t.Errorf("expected story %s to match a single scan, got %s", storyID, d)
+				}
+				if merged.CommentCounts.DistinctAuthors != story.CommentCounts.DistinctAuthors {
+					t.Errorf("expected story %s to have %d distinct authors, got %d", storyID, story.CommentCounts.DistinctAuthors, merged.CommentCounts.DistinctAuthors)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitedAggregator(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		storyIDs []string
+		want     map[string]int
+	}{
+		{
+			name:     "no limit",
+			storyIDs: []string{"a", "b", "c"},
+			want:     map[string]int{"a": 1, "b": 1, "c": 1},
+		},
+		{
+			name:     "stories over the limit skipped",
+			limit:    2,
+			storyIDs: []string{"a", "b", "c", "a"},
+			want:     map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:     "counted stories accepted after the limit",
+			limit:    1,
+			storyIDs: []string{"a", "b", "a", "c", "a"},
+			want:     map[string]int{"a": 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			aggregator := NewLimitedAggregator(tt.limit, &rules)
+
+			for _, storyID := range tt.storyIDs {
+				aggregator.Add(&Comment{StoryID: storyID, Status: "APPROVED"})
+			}
+
+			stories := aggregator.Stories()
+			if len(stories) != len(tt.want) {
+				t.Fatalf("expected %d stories, got %d", len(tt.want), len(stories))
+			}
+			for storyID, want := range tt.want {
+				story, ok := stories[storyID]
+				if !ok {
+					t.Fatalf("expected story %s to be counted", storyID)
+				}
+				if story.CommentCounts.Status.Approved != want {
+					t.Errorf("expected story %s to have %d comments, got %d", storyID, want, story.CommentCounts.Status.Approved)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package counts
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditRecord is a record of a count on a story or user that was changed.
+type AuditRecord struct {
+	TenantID   string    `bson:"tenantID"`
+	SiteID     string    `bson:"siteID"`
+	RunID      string    `bson:"runID"`
+	Collection string    `bson:"collection"`
+	DocumentID string    `bson:"documentID"`
+	Field      string    `bson:"field"`
+	Old        int64     `bson:"old"`
+	New        int64     `bson:"new"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// auditing returns true when changes to counts should be recorded. Dry runs
+// don't change any counts, so they're never audited.
+func (p *Processor) auditing() bool {
+	return p.AuditCollection != "" && !p.DryRun
+}
+
+// loadAuditCounts will load the counts that are currently stored on the
+// documents in the output collection, keyed by their ID, so they can be
+// compared to the counts that are written. Auditing
+// is best-effort, so if the counts can't be loaded the error is logged and nil
+// is returned.
+func (p *Processor) loadAuditCounts(ctx context.Context, collection string, ids []string) map[string]bson.Raw {
+	previous, err := p.loadStoredCounts(ctx, collection, ids)
+	if err != nil {
+		logrus.WithError(err).WithField("collection", collection).Error("could not load counts to audit, changes will not be recorded")
+		return nil
+	}
+
+	return previous
+}
+
+// loadStoredCounts will load the counts that are currently stored on the
+// documents with the ids in the output collection, keyed by their ID. Documents
+// that don't exist are left out.
+func (p *Processor) loadStoredCounts(ctx context.Context, collection string, ids []string) (map[string]bson.Raw, error) {
+	previous := make(map[string]bson.Raw, len(ids))
+
+	for start := 0; start < len(ids); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if err := p.loadCountsBatch(ctx, collection, ids[start:end], previous); err != nil {
+			return nil, err
+		}
+	}
+
+	return previous, nil
+}
+
+// loadCountsBatch will load the counts of the documents with the ids into
+// previous.
+func (p *Processor) loadCountsBatch(ctx context.Context, collection string, ids []string, previous map[string]bson.Raw) error {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+	}
+
+	// Users are shared by every site on the tenant.
+	if collection == "stories" {
+		filter = append(filter, primitive.E{Key: "siteID", Value: p.SiteID})
+	}
+
+	filter = append(filter, primitive.E{Key: "id", Value: bson.D{
+		primitive.E{Key: "$in", Value: ids},
+	}})
+
+	cursor, err := p.outputCollection(collection).Find(ctx, filter, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+		primitive.E{Key: "commentCounts", Value: 1},
+	}))
+	if err != nil {
+		return errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	for cursor.Next(ctx) {
+		var document countsDocument
+		if err := cursor.Decode(&document); err != nil {
+			return errors.Wrap(err, "could not decode result")
+		}
+
+		previous[document.ID] = document.CommentCounts
+	}
+
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	return nil
+}
+
+// recordAudit will write an AuditRecord for each count that differs between the
+// previous counts and the counts that were written, keyed by document ID.
+// Counts that are missing from either are treated as zero, but documents that
+// didn't exist are skipped unless the writes created them. Auditing is
+// best-effort, so failing to write the records is only logged.
+func (p *Processor) recordAudit(ctx context.Context, collection string, previous map[string]bson.Raw, written map[string]interface{}) {
+	now := time.Now()
+
+	// Documents that don't exist are only written when the writes are upserts.
+	upserted := p.shadowing()
+	if collection == "stories" {
+		upserted = p.upsertingStories()
+	}
+
+	var records []interface{}
+	for id, counts := range written {
+		old, ok := previous[id]
+		if !ok && !upserted {
+			continue
+		}
+
+		data, err := bson.Marshal(counts)
+		if err != nil {
+			logrus.WithError(err).WithField("id", id).Error("could not marshal counts to audit")
+			continue
+		}
+
+		deltas, err := diffCounts(old, data)
+		if err != nil {
+			logrus.WithError(err).WithField("id", id).Error("could not compare counts to audit")
+			continue
+		}
+
+		oldFields, err := flattenCounts(old)
+		if err != nil {
+			logrus.WithError(err).WithField("id", id).Error("could not compare counts to audit")
+			continue
+		}
+
+		fields := make([]string, 0, len(deltas))
+		for field := range deltas {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			records = append(records, AuditRecord{
+				TenantID:   p.TenantID,
+				SiteID:     p.SiteID,
+				RunID:      p.RunID,
+				Collection: collection,
+				DocumentID: id,
+				Field:      "commentCounts." + field,
+				Old:        oldFields[field],
+				New:        oldFields[field] + deltas[field],
+				CreatedAt:  now,
+			})
+		}
+	}
+
+	for start := 0; start < len(records); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		if _, err := p.DB.Collection(p.AuditCollection).InsertMany(ctx, records[start:end], options.InsertMany().SetOrdered(false)); err != nil {
+			logrus.WithError(err).WithField("collection", collection).Error("could not record count changes")
+			return
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": collection,
+		"changes":    len(records),
+	}).Info("recorded count changes")
+}
+
+// storyCounts returns the ID's of the stories and their counts as they are
+// written.
+func storyCounts(stories map[string]*Story) ([]string, map[string]interface{}) {
+	ids := make([]string, 0, len(stories))
+	written := make(map[string]interface{}, len(stories))
+	for storyID, story := range stories {
+		ids = append(ids, storyID)
+		written[storyID] = story.CommentCounts
+	}
+
+	return ids, written
+}
@@ -0,0 +1,145 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRecordAudit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	counts := func(approved, rejected int) bson.D {
+		return bson.D{
+			primitive.E{Key: "status", Value: bson.D{
+				primitive.E{Key: "APPROVED", Value: approved},
+				primitive.E{Key: "REJECTED", Value: rejected},
+			}},
+		}
+	}
+	raw := func(doc bson.D) bson.Raw {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return data
+	}
+
+	type change struct {
+		DocumentID string
+		Field      string
+		Old, New   int64
+	}
+
+	tests := []struct {
+		name     string
+		upsert   bool
+		previous map[string]bson.Raw
+		written  map[string]interface{}
+		want     []change
+	}{
+		{
+			name:     "unchanged",
+			previous: map[string]bson.Raw{"a": raw(counts(1, 0))},
+			written:  map[string]interface{}{"a": counts(1, 0)},
+		},
+		{
+			name:     "changed",
+			previous: map[string]bson.Raw{"a": raw(counts(1, 2))},
+			written:  map[string]interface{}{"a": counts(3, 0)},
+			want: []change{
+				{"a", "commentCounts.status.APPROVED", 1, 3},
+				{"a", "commentCounts.status.REJECTED", 2, 0},
+			},
+		},
+		{
+			name:    "missing document not upserted",
+			written: map[string]interface{}{"a": counts(1, 0)},
+		},
+		{
+			name:    "missing document upserted",
+			upsert:  true,
+			written: map[string]interface{}{"a": counts(1, 0)},
+			want: []change{
+				{"a", "commentCounts.status.APPROVED", 0, 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			if len(tt.want) > 0 {
+				mt.AddMockResponses(mtest.CreateSuccessResponse())
+			}
+
+			p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+			p.UpsertStories = tt.upsert
+			p.AuditCollection = "audit"
+			p.RunID = "run"
+			p.BatchSize = 100
+
+			p.recordAudit(context.Background(), "stories", tt.previous, tt.written)
+
+			var got []change
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName != "insert" {
+					mt.Fatalf("expected only inserts, got %s", event.CommandName)
+				}
+
+				docs, err := event.Command.LookupErr("documents")
+				if err != nil {
+					mt.Fatalf("unexpected error: %v", err)
+				}
+				values, err := docs.Array().Values()
+				if err != nil {
+					mt.Fatalf("unexpected error: %v", err)
+				}
+				for _, value := range values {
+					var record AuditRecord
+					if err := value.Unmarshal(&record); err != nil {
+						mt.Fatalf("unexpected error: %v", err)
+					}
+					if record.RunID != "run" || record.Collection != "stories" {
+						mt.Errorf("expected the record to be for run stories, got %s %s", record.RunID, record.Collection)
+					}
+
+					got = append(got, change{record.DocumentID, record.Field, record.Old, record.New})
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProcessorAuditing(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection string
+		dryRun     bool
+		want       bool
+	}{
+		{"no collection", "", false, false},
+		{"collection", "audit", false, true},
+		{"dry run", "audit", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", tt.dryRun, DefaultRules())
+			p.AuditCollection = tt.collection
+
+			if got := p.auditing(); got != tt.want {
+				t.Errorf("auditing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,119 @@
 package counts
 
-// Comment is a Comment in Coral.
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Comment is a Comment in Coral. It is decoded from the paths in the Fields of
+// the Rules, the struct tags are only the default paths.
 type Comment struct {
+	ID           string         `bson:"id"`
+	SiteID       string         `bson:"siteID"`
 	AuthorID     string         `bson:"authorID"`
 	StoryID      string         `bson:"storyID"`
 	Status       string         `bson:"status"`
 	ActionCounts map[string]int `bson:"actionCounts"`
+	Source       string         `bson:"source"`
+	CreatedAt    time.Time      `bson:"createdAt"`
+
+	// UpdatedAt is when the comment was last changed, which is zero when the
+	// comment doesn't have the field.
+	UpdatedAt time.Time `bson:"updatedAt"`
+
+	// OpenFlags is the number of flags on the comment that haven't been
+	// resolved. It is only read when the Fields have an OpenFlags path, and is
+	// nil when the comment doesn't have the field.
+	OpenFlags *int `bson:"-"`
+
+	// Rating is the star rating of the comment, which is nil when the comment
+	// doesn't have one.
+	Rating *int `bson:"rating"`
+}
+
+// The orders that the comments can be scanned in. Only one order can be used,
+// sorting by createdAt gives sequential reads on a {tenantID, siteID, createdAt}
+// index, while sorting by storyID keeps every comment on a story together.
+const (
+	ScanSortNatural   = ""
+	ScanSortCreatedAt = "createdAt"
+	ScanSortStoryID   = "storyID"
+)
+
+// scanSortOptions returns the sort for the ScanSort, or nil when the comments
+// are scanned in their natural order.
+func (p *Processor) scanSortOptions() bson.D {
+	switch p.ScanSort {
+	case ScanSortCreatedAt:
+		return bson.D{
+			primitive.E{Key: "tenantID", Value: 1},
+			primitive.E{Key: "siteID", Value: 1},
+			primitive.E{Key: p.Rules.Fields.CreatedAt, Value: 1},
+		}
+	case ScanSortStoryID:
+		return bson.D{
+			primitive.E{Key: "tenantID", Value: 1},
+			primitive.E{Key: "siteID", Value: 1},
+			primitive.E{Key: p.Rules.Fields.StoryID, Value: 1},
+		}
+	default:
+		return nil
+	}
+}
+
+// CommentStatuses are all the statuses that a Comment can have.
+var CommentStatuses = []string{"APPROVED", "NONE", "PREMOD", "REJECTED", "SYSTEM_WITHHELD"}
+
+// knownStatus returns true when the status is one of the CommentStatuses.
+func knownStatus(status string) bool {
+	for _, s := range CommentStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stale returns true when the comment has been waiting to be moderated for
+// longer than the MaxCommentAge, which suggests that comments are stuck in the
+// moderation queue.
+func (r *Rules) Stale(comment *Comment) bool {
+	if r.MaxCommentAge <= 0 || comment.CreatedAt.IsZero() {
+		return false
+	}
+
+	if comment.Status != "NONE" && comment.Status != "PREMOD" {
+		return false
+	}
+
+	return time.Since(comment.CreatedAt) > r.MaxCommentAge
+}
+
+// ActionCount returns the comment's count of the action key. When the
+// ActionKeyCase is set, the counts of every key with the same normalized key are
+// summed, so flag and FLAG are both counted as flags.
+func (r *Rules) ActionCount(comment *Comment, key string) int {
+	if r.ActionKeyCase == "" {
+		return comment.ActionCounts[key]
+	}
+
+	key = r.caseActionKey(key)
+
+	var count int
+	for k, n := range comment.ActionCounts {
+		if r.caseActionKey(k) == key {
+			count += n
+		}
+	}
+
+	return count
+}
+
+// Excluded returns true when the comment should not be counted.
+func (r *Rules) Excluded(comment *Comment) bool {
+	_, ok := r.ExcludedStatuses[comment.Status]
+	return ok
 }
@@ -0,0 +1,180 @@
+package counts
+
+import "testing"
+
+func TestRulesActionCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyCase string
+		counts  map[string]int
+		key     string
+		want    int
+	}{
+		{"exact key", "", map[string]int{"FLAG": 2}, "FLAG", 2},
+		{"other casing not normalized", "", map[string]int{"flag": 2}, "FLAG", 0},
+		{"lowercase key counted as upper", ActionKeysUpper, map[string]int{"flag": 2}, "FLAG", 2},
+		{"mixed keys summed", ActionKeysUpper, map[string]int{"flag": 2, "FLAG": 1, "Flag": 1}, "FLAG", 4},
+		{"lookup normalized too", ActionKeysLower, map[string]int{"FLAG": 3}, "FLAG", 3},
+		{"missing key", ActionKeysUpper, map[string]int{"REACTION": 3}, "FLAG", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.ActionKeyCase = tt.keyCase
+
+			comment := Comment{ActionCounts: tt.counts}
+			if got := rules.ActionCount(&comment, tt.key); got != tt.want {
+				t.Errorf("ActionCount(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizedActionKeysPerRules(t *testing.T) {
+	rules := DefaultRules()
+	rules.ActionKeyCase = ActionKeysUpper
+	other := DefaultRules()
+	other.ActionKeyCase = ActionKeysUpper
+
+	if got := rules.normalizeActionKey("flag"); got != "FLAG" {
+		t.Fatalf("normalizeActionKey(%q) = %q, want %q", "flag", got, "FLAG")
+	}
+
+	// Copies of the rules share the keys that were logged, other rules don't.
+	copied := rules
+	if _, logged := copied.normalizedActionKeys.Load("flag"); !logged {
+		t.Errorf("expected the key to be logged for the copy of the rules")
+	}
+	if _, logged := other.normalizedActionKeys.Load("flag"); logged {
+		t.Errorf("expected the key not to be logged for the other rules")
+	}
+}
+
+func TestReportedQueueNormalizesActionKeys(t *testing.T) {
+	rules := DefaultRules()
+	rules.ActionKeyCase = ActionKeysUpper
+	rules.AutomatedFlagKeys = []string{"FLAG__COMMENT_DETECTED_TOXIC"}
+
+	var queue CommentModerationQueue
+	queue.Increment(&Comment{
+		Status: "NONE",
+		ActionCounts: map[string]int{
+			"flag":                         2,
+			"flag__comment_detected_toxic": 1,
+		},
+	}, &rules)
+
+	if queue.Queues.Reported != 1 {
+		t.Errorf("expected the lowercase flag to be reported, got %d", queue.Queues.Reported)
+	}
+	if queue.Queues.ReportedAutomated != 1 || queue.Queues.ReportedUser != 1 {
+		t.Errorf("expected 1 automated and 1 user report, got %d and %d", queue.Queues.ReportedAutomated, queue.Queues.ReportedUser)
+	}
+}
+
+func TestReportedQueueResolvedFlags(t *testing.T) {
+	open := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		policy    QueuePolicy
+		status    string
+		openFlags *int
+		want      int
+	}{
+		{"unmoderated with open flags", QueuePolicyCoralV7, "NONE", open(1), 1},
+		{"unmoderated with resolved flags", QueuePolicyCoralV7, "NONE", open(0), 0},
+		{"unmoderated without an open flags count", QueuePolicyCoralV7, "NONE", nil, 1},
+		{"approved with open flags", QueuePolicyCoralV8, "APPROVED", open(1), 1},
+		{"approved with resolved flags", QueuePolicyCoralV8, "APPROVED", open(0), 0},
+		{"withheld with resolved flags", QueuePolicyCoralV8, "SYSTEM_WITHHELD", open(0), 0},
+		{"resolved flags counted by legacy", QueuePolicyLegacy, "NONE", open(0), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.ReportedPolicy = tt.policy
+
+			var queue CommentModerationQueue
+			queue.Increment(&Comment{
+				Status:       tt.status,
+				ActionCounts: map[string]int{"FLAG": 2},
+				OpenFlags:    tt.openFlags,
+			}, &rules)
+
+			if queue.Queues.Reported != tt.want {
+				t.Errorf("expected %d reported, got %d", tt.want, queue.Queues.Reported)
+			}
+		})
+	}
+}
+
+func TestReportedQueueReporters(t *testing.T) {
+	tests := []struct {
+		name          string
+		automatedKeys []string
+		counts        map[string]int
+		wantReported  int
+		wantAutomated int
+		wantUser      int
+	}{
+		{
+			name:         "not broken down without automated keys",
+			counts:       map[string]int{"FLAG": 2, "FLAG__COMMENT_DETECTED_TOXIC": 1},
+			wantReported: 1,
+		},
+		{
+			name:          "user reports",
+			automatedKeys: []string{"FLAG__COMMENT_DETECTED_TOXIC"},
+			counts:        map[string]int{"FLAG": 2, "FLAG__OFFENSIVE": 2},
+			wantReported:  1,
+			wantUser:      1,
+		},
+		{
+			name:          "automated reports",
+			automatedKeys: []string{"FLAG__COMMENT_DETECTED_TOXIC"},
+			counts:        map[string]int{"FLAG": 1, "FLAG__COMMENT_DETECTED_TOXIC": 1},
+			wantReported:  1,
+			wantAutomated: 1,
+		},
+		{
+			name:          "automated and user reports",
+			automatedKeys: []string{"FLAG__COMMENT_DETECTED_TOXIC"},
+			counts:        map[string]int{"FLAG": 2, "FLAG__COMMENT_DETECTED_TOXIC": 1, "FLAG__SPAM": 1},
+			wantReported:  1,
+			wantAutomated: 1,
+			wantUser:      1,
+		},
+		{
+			name:          "several automated keys",
+			automatedKeys: []string{"FLAG__COMMENT_DETECTED_TOXIC", "FLAG__COMMENT_DETECTED_SPAM"},
+			counts:        map[string]int{"FLAG": 2, "FLAG__COMMENT_DETECTED_TOXIC": 1, "FLAG__COMMENT_DETECTED_SPAM": 1},
+			wantReported:  1,
+			wantAutomated: 1,
+		},
+		{
+			name:          "not reported",
+			automatedKeys: []string{"FLAG__COMMENT_DETECTED_TOXIC"},
+			counts:        map[string]int{"REACTION": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.AutomatedFlagKeys = tt.automatedKeys
+
+			var queue CommentModerationQueue
+			queue.Increment(&Comment{Status: "NONE", ActionCounts: tt.counts}, &rules)
+
+			if queue.Queues.Reported != tt.wantReported {
+				t.Errorf("expected %d reported, got %d", tt.wantReported, queue.Queues.Reported)
+			}
+			if queue.Queues.ReportedAutomated != tt.wantAutomated || queue.Queues.ReportedUser != tt.wantUser {
+				t.Errorf("expected %d automated and %d user reports, got %d and %d", tt.wantAutomated, tt.wantUser, queue.Queues.ReportedAutomated, queue.Queues.ReportedUser)
+			}
+		})
+	}
+}
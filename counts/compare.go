@@ -0,0 +1,229 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CompareResult describes the outcome of comparing the counts in a collection
+// with the counts in its suffixed collection.
+type CompareResult struct {
+	Collection string
+	Compared   int
+	Mismatched int
+
+	// Missing is the number of documents in the suffixed collection that do not
+	// have a matching document in the original collection.
+	Missing int
+}
+
+// countsDocument is a document with counts that are compared without decoding
+// them, so that every count, including ones we don't know about, is compared.
+type countsDocument struct {
+	ID            string   `bson:"id"`
+	CommentCounts bson.Raw `bson:"commentCounts"`
+}
+
+// flattenCounts will return each integer field within the raw counts keyed by
+// its dotted path.
+func flattenCounts(raw bson.Raw) (map[string]int64, error) {
+	fields := make(map[string]int64)
+	if len(raw) == 0 {
+		return fields, nil
+	}
+
+	var flat bson.D
+	if err := flattenRaw("", raw, &flat); err != nil {
+		return nil, err
+	}
+
+	for _, field := range flat {
+		fields[field.Key] = field.Value.(int64)
+	}
+
+	return fields, nil
+}
+
+// diffCounts will return the difference between the new and old counts for each
+// field that differs.
+func diffCounts(old, new bson.Raw) (map[string]int64, error) {
+	oldFields, err := flattenCounts(old)
+	if err != nil {
+		return nil, err
+	}
+
+	newFields, err := flattenCounts(new)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make(map[string]int64)
+	for key, value := range newFields {
+		if delta := value - oldFields[key]; delta != 0 {
+			deltas[key] = delta
+		}
+	}
+
+	for key, value := range oldFields {
+		if _, ok := newFields[key]; !ok && value != 0 {
+			deltas[key] = -value
+		}
+	}
+
+	return deltas, nil
+}
+
+// CompareCollections will compare the counts on the stories, users, and sites
+// written to the collections with the suffix against the counts in the original
+// collections, and log the differences. Only documents in the suffixed
+// collections are compared as those are the ones a run will have written. Both
+// collections are streamed in ID order so memory use does not grow with the
+// number of documents. The cursors are closed within the cursorClose timeout.
+func CompareCollections(ctx context.Context, db *mongo.Database, tenantID, siteID, suffix string, cursorClose time.Duration) ([]CompareResult, error) {
+	filters := []struct {
+		collection string
+		filter     bson.D
+	}{
+		{
+			collection: "stories",
+			filter: bson.D{
+				primitive.E{Key: "tenantID", Value: tenantID},
+				primitive.E{Key: "siteID", Value: siteID},
+			},
+		},
+		{
+			collection: "users",
+			filter: bson.D{
+				primitive.E{Key: "tenantID", Value: tenantID},
+			},
+		},
+		{
+			collection: "sites",
+			filter: bson.D{
+				primitive.E{Key: "tenantID", Value: tenantID},
+				primitive.E{Key: "id", Value: siteID},
+			},
+		},
+	}
+
+	results := make([]CompareResult, 0, len(filters))
+	for _, f := range filters {
+		result, err := compareCollection(ctx, db.Collection(f.collection), db.Collection(f.collection+suffix), f.filter, cursorClose)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not compare %s", f.collection)
+		}
+
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+func compareCollection(ctx context.Context, original, suffixed *mongo.Collection, filter bson.D, cursorClose time.Duration) (*CompareResult, error) {
+	opts := options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+		primitive.E{Key: "commentCounts", Value: 1},
+	}).SetSort(bson.D{
+		primitive.E{Key: "id", Value: 1},
+	}).SetAllowDiskUse(true)
+
+	originalCursor, err := original.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(originalCursor, cursorClose)
+
+	suffixedCursor, err := suffixed.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(suffixedCursor, cursorClose)
+
+	result := CompareResult{
+		Collection: original.Name(),
+	}
+
+	started := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"collection": original.Name(),
+		"suffixed":   suffixed.Name(),
+	}).Info("comparing counts")
+
+	// next will advance the original cursor and decode the next document, it
+	// returns nil when the cursor is exhausted.
+	next := func() (*countsDocument, error) {
+		if !originalCursor.Next(ctx) {
+			return nil, originalCursor.Err()
+		}
+
+		var doc countsDocument
+		if err := originalCursor.Decode(&doc); err != nil {
+			return nil, errors.Wrap(err, "could not decode result")
+		}
+
+		return &doc, nil
+	}
+
+	current, err := next()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	for suffixedCursor.Next(ctx) {
+		var doc countsDocument
+		if err := suffixedCursor.Decode(&doc); err != nil {
+			return nil, errors.Wrap(err, "could not decode result")
+		}
+
+		// Advance the original cursor until it's at or past this document.
+		for current != nil && current.ID < doc.ID {
+			if current, err = next(); err != nil {
+				return nil, errors.Wrap(err, "could not iterate on cursor")
+			}
+		}
+
+		if current == nil || current.ID != doc.ID {
+			result.Missing++
+
+			logrus.WithField("id", doc.ID).Warn("document does not exist in the original collection")
+			continue
+		}
+
+		result.Compared++
+
+		deltas, err := diffCounts(current.CommentCounts, doc.CommentCounts)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not compare counts")
+		}
+
+		if len(deltas) > 0 {
+			result.Mismatched++
+
+			logrus.WithFields(logrus.Fields{
+				"id":     doc.ID,
+				"deltas": deltas,
+			}).Warn("counts differ")
+		}
+	}
+
+	if err := suffixedCursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": original.Name(),
+		"compared":   result.Compared,
+		"mismatched": result.Mismatched,
+		"missing":    result.Missing,
+		"took":       time.Since(started),
+	}).Info("compared counts")
+
+	return &result, nil
+}
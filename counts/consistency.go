@@ -0,0 +1,60 @@
+package counts
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// approvedOnStories returns the number of approved comments on the stories. The
+// comments without a story are counted under a story with an empty ID, which
+// isn't included.
+func approvedOnStories(stories map[string]*Story) int {
+	var approved int
+	for storyID, story := range stories {
+		if storyID == "" {
+			continue
+		}
+
+		approved += story.CommentCounts.Status.Approved
+	}
+
+	return approved
+}
+
+// approvedByUsers returns the number of approved comments by the users. The
+// comments without an author are counted under a user with an empty ID, which
+// isn't included.
+func approvedByUsers(users map[string]*User) int {
+	var approved int
+	for userID, user := range users {
+		if userID == "" {
+			continue
+		}
+
+		approved += user.CommentCounts.Status.Approved
+	}
+
+	return approved
+}
+
+// CheckApprovedTotals will compare the number of approved comments counted on
+// every story on the site with the number counted for every user, and return
+// the difference between them. Every approved comment belongs to both a story
+// and a user, so a difference means that some comments are missing their story
+// or their author. Both results must be from processing every story and user
+// on the site.
+func (p *Processor) CheckApprovedTotals(stories *StoriesResult, users *UsersResult) int {
+	mismatch := users.Approved - stories.Approved
+	if mismatch == 0 {
+		return 0
+	}
+
+	p.Metrics.Gauge("approved_mismatch", float64(mismatch))
+
+	logrus.WithFields(logrus.Fields{
+		"storiesApproved": stories.Approved,
+		"usersApproved":   users.Approved,
+		"mismatch":        mismatch,
+	}).Warn("the approved comments counted on stories and users differ, some comments are missing their story or author")
+
+	return mismatch
+}
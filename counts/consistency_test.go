@@ -0,0 +1,54 @@
+package counts
+
+import "testing"
+
+func TestCheckApprovedTotals(t *testing.T) {
+	story := func(approved int) *Story {
+		return &Story{CommentCounts: StoryCommentCounts{Status: CommentStatusCounts{Approved: approved}}}
+	}
+	user := func(approved int) *User {
+		return &User{CommentCounts: UserCommentCounts{Status: CommentStatusCounts{Approved: approved}}}
+	}
+
+	tests := []struct {
+		name    string
+		stories map[string]*Story
+		users   map[string]*User
+		want    int
+	}{
+		{
+			name:    "nothing counted",
+			stories: map[string]*Story{},
+			users:   map[string]*User{},
+		},
+		{
+			name:    "totals agree",
+			stories: map[string]*Story{"a": story(2), "b": story(3)},
+			users:   map[string]*User{"u1": user(4), "u2": user(1)},
+		},
+		{
+			name:    "comments without an author",
+			stories: map[string]*Story{"a": story(3)},
+			users:   map[string]*User{"u1": user(2), "": user(1)},
+			want:    -1,
+		},
+		{
+			name:    "comments without a story",
+			stories: map[string]*Story{"a": story(1), "": story(2)},
+			users:   map[string]*User{"u1": user(3)},
+			want:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stories := StoriesResult{Approved: approvedOnStories(tt.stories)}
+			users := UsersResult{Approved: approvedByUsers(tt.users)}
+
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			if got := p.CheckApprovedTotals(&stories, &users); got != tt.want {
+				t.Errorf("CheckApprovedTotals() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
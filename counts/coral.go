@@ -1,4 +1,14 @@
 package counts
 
-// MaxBatchWriteSize is the maximum size of batch write operations.
-var MaxBatchWriteSize = 1000
+// DefaultBatchSize is the Processor's BatchSize when it isn't configured.
+const DefaultBatchSize = 1000
+
+// MaxBatchWriteBytes is the maximum estimated size in bytes of the updates in a
+// batch write operation. Batches are written early when the next update would
+// take them over this size, even if they have fewer than the BatchSize
+// updates. It is the largest document that Mongo accepts.
+const MaxBatchWriteBytes = 16 * 1024 * 1024
+
+// MaxBatchWriteOperations is the most operations that Mongo accepts in a
+// single batch write, and so the largest BatchSize.
+const MaxBatchWriteOperations = 100000
@@ -0,0 +1,129 @@
+package counts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CoralAPISink is a Sink that sends the counts to an admin endpoint of Coral
+// rather than writing them to the database, so Coral can invalidate its caches
+// and fire its own events as the counts change. The counts are POSTed as JSON
+// in batches of the Processor's BatchSize.
+type CoralAPISink struct {
+	url     string
+	token   string
+	retries int
+	client  *http.Client
+}
+
+// CoralAPIPayload is the body of each request made to the Coral API.
+type CoralAPIPayload struct {
+	// Counts are the counts of the stories or users in the same shape as the
+	// events that are published.
+	Counts []CountEvent `json:"counts"`
+}
+
+// NewCoralAPISink will create a Sink that POSTs the counts to the url, with the
+// token as the bearer token. Each request is limited to the timeout and retried
+// up to retries times if it fails.
+func NewCoralAPISink(url, token string, timeout time.Duration, retries int) *CoralAPISink {
+	return &CoralAPISink{
+		url:     url,
+		token:   token,
+		retries: retries,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (s *CoralAPISink) Write(ctx context.Context, p *Processor, kind string, counts map[string]interface{}) (*WriteResult, error) {
+	events, err := p.countEvents(kind, counts)
+	if err != nil {
+		return nil, err
+	}
+
+	var res WriteResult
+	for start := 0; start < len(events); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		res.Batches++
+		res.Updates += end - start
+
+		if p.DryRun {
+			logrus.WithField("updates", end-start).Infof("not sending %s counts to the coral api as --dryRun is enabled", kind)
+			continue
+		}
+
+		data, err := json.Marshal(CoralAPIPayload{
+			Counts: events[start:end],
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not encode the %s counts", kind)
+		}
+
+		if err := s.send(ctx, data); err != nil {
+			p.Metrics.Count(kind+".write_failed", int64(len(events)-start))
+
+			return nil, errors.Wrapf(err, "could not send %s counts to the coral api", kind)
+		}
+
+		res.Modified += int64(end - start)
+	}
+
+	return &res, nil
+}
+
+// send will POST the data, retrying with a backoff if it fails.
+func (s *CoralAPISink) send(ctx context.Context, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := s.post(ctx, data)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= s.retries {
+			return err
+		}
+
+		logrus.WithError(err).WithField("attempt", attempt+1).Warn("could not send counts to the coral api, retrying")
+
+		select {
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *CoralAPISink) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "could not create the request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not send the request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("coral api responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
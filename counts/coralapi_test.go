@@ -0,0 +1,101 @@
+package counts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoralAPISinkWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		counts       int
+		batchSize    int
+		dryRun       bool
+		token        string
+		statuses     []int
+		retries      int
+		wantRequests int
+		wantBatches  int
+		wantModified int64
+		wantErr      bool
+	}{
+		{name: "one batch", counts: 2, batchSize: 10, statuses: []int{http.StatusOK}, wantRequests: 1, wantBatches: 1, wantModified: 2},
+		{name: "batches", counts: 5, batchSize: 2, statuses: []int{http.StatusOK, http.StatusOK, http.StatusOK}, wantRequests: 3, wantBatches: 3, wantModified: 5},
+		{name: "with a token", counts: 1, batchSize: 10, token: "secret", statuses: []int{http.StatusNoContent}, wantRequests: 1, wantBatches: 1, wantModified: 1},
+		{name: "dry run", counts: 3, batchSize: 2, dryRun: true, wantBatches: 2},
+		{name: "retried", counts: 1, batchSize: 10, retries: 1, statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, wantRequests: 2, wantBatches: 1, wantModified: 1},
+		{name: "failed", counts: 3, batchSize: 2, statuses: []int{http.StatusOK, http.StatusUnauthorized}, wantRequests: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mux      sync.Mutex
+				requests int
+				counted  int
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				defer mux.Unlock()
+
+				requests++
+
+				if got, want := r.Header.Get("Authorization"), "Bearer "+tt.token; tt.token != "" && got != want {
+					t.Errorf("expected the authorization %q, got %q", want, got)
+				} else if tt.token == "" && got != "" {
+					t.Errorf("expected no authorization, got %q", got)
+				}
+
+				var payload CoralAPIPayload
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("could not decode the payload: %v", err)
+				}
+				if len(payload.Counts) > tt.batchSize {
+					t.Errorf("expected at most %d counts, got %d", tt.batchSize, len(payload.Counts))
+				}
+
+				status := tt.statuses[requests-1]
+				if status < 300 {
+					counted += len(payload.Counts)
+				}
+
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			p := NewProcessor(nil, "tenant", "site", tt.dryRun, DefaultRules())
+			p.BatchSize = tt.batchSize
+
+			counts := make(map[string]interface{}, tt.counts)
+			for i := 0; i < tt.counts; i++ {
+				counts[string(rune('a'+i))] = StoryCommentCounts{Status: CommentStatusCounts{Approved: i}}
+			}
+
+			sink := NewCoralAPISink(srv.URL, tt.token, time.Second, tt.retries)
+
+			res, err := sink.Write(context.Background(), p, "story", counts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if requests != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, requests)
+			}
+			if err != nil {
+				return
+			}
+
+			if res.Batches != tt.wantBatches || res.Modified != tt.wantModified {
+				t.Errorf("expected %d batches and %d modified, got %d and %d", tt.wantBatches, tt.wantModified, res.Batches, res.Modified)
+			}
+			if int64(counted) != tt.wantModified {
+				t.Errorf("expected %d counts to be received, got %d", tt.wantModified, counted)
+			}
+		})
+	}
+}
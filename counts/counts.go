@@ -1,5 +1,14 @@
 package counts
 
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
 type CommentStatusCounts struct {
 	Approved       int `bson:"APPROVED"`
 	None           int `bson:"NONE"`
@@ -23,16 +32,149 @@ func (csc *CommentStatusCounts) Increment(comment *Comment) {
 	}
 }
 
+// Total returns the number of comments with any status.
+func (csc *CommentStatusCounts) Total() int {
+	return csc.Approved + csc.None + csc.Premod + csc.Rejected + csc.SystemWithheld
+}
+
+// ActionQueueRule describes a moderation queue that unmoderated comments will be
+// counted in when the count of an action on them exceeds a threshold.
+type ActionQueueRule struct {
+	QueueName string
+	ActionKey string
+	Threshold int
+}
+
+// ParseActionQueueRule will parse a rule in the form
+// `queueName:actionKey:threshold`.
+func ParseActionQueueRule(rule string) (ActionQueueRule, error) {
+	parts := strings.Split(rule, ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return ActionQueueRule{}, errors.Errorf("expected rule in the form queueName:actionKey:threshold, found %s", rule)
+	}
+
+	if builtinQueue(parts[0]) {
+		return ActionQueueRule{}, errors.Errorf("rule can not replace the built-in %s queue", parts[0])
+	}
+
+	threshold, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return ActionQueueRule{}, errors.Wrapf(err, "could not parse the threshold for rule %s", rule)
+	}
+
+	return ActionQueueRule{
+		QueueName: parts[0],
+		ActionKey: parts[1],
+		Threshold: threshold,
+	}, nil
+}
+
+// builtinQueue returns true when the name is one of the built-in queues. The
+// custom queues are stored alongside them, so a rule with the same name would
+// fail to be written.
+func builtinQueue(name string) bool {
+	queues := reflect.TypeOf(CommentModerationQueue{}.Queues)
+	for i := 0; i < queues.NumField(); i++ {
+		tag := strings.Split(queues.Field(i).Tag.Get("bson"), ",")[0]
+		if tag != "" && tag == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StatusQueueRule describes a moderation queue that comments with any of the
+// statuses will be counted in. When the rule has an ActionKey, the comments are
+// only counted when the count of that action on them also exceeds the
+// threshold.
+type StatusQueueRule struct {
+	QueueName string
+	Statuses  map[string]struct{}
+	ActionKey string
+	Threshold int
+}
+
+// ParseStatusQueueRule will parse a rule in the form `queueName:statuses` or
+// `queueName:statuses:actionKey:threshold`, where the statuses are separated by
+// a |, such as `featured:APPROVED:FEATURED:0`.
+func ParseStatusQueueRule(rule string) (StatusQueueRule, error) {
+	parts := strings.Split(rule, ":")
+	if (len(parts) != 2 && len(parts) != 4) || parts[0] == "" || parts[1] == "" {
+		return StatusQueueRule{}, errors.Errorf("expected rule in the form queueName:statuses or queueName:statuses:actionKey:threshold, found %s", rule)
+	}
+
+	if builtinQueue(parts[0]) {
+		return StatusQueueRule{}, errors.Errorf("rule can not replace the built-in %s queue", parts[0])
+	}
+
+	statuses := make(map[string]struct{})
+	for _, status := range strings.Split(parts[1], "|") {
+		status = strings.ToUpper(strings.TrimSpace(status))
+		if !knownStatus(status) {
+			return StatusQueueRule{}, errors.Errorf("rule %s has an unknown status %s", rule, status)
+		}
+
+		statuses[status] = struct{}{}
+	}
+
+	r := StatusQueueRule{
+		QueueName: parts[0],
+		Statuses:  statuses,
+	}
+
+	if len(parts) == 4 {
+		if parts[2] == "" {
+			return StatusQueueRule{}, errors.Errorf("expected rule in the form queueName:statuses:actionKey:threshold, found %s", rule)
+		}
+
+		threshold, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return StatusQueueRule{}, errors.Wrapf(err, "could not parse the threshold for rule %s", rule)
+		}
+
+		r.ActionKey = parts[2]
+		r.Threshold = threshold
+	}
+
+	return r, nil
+}
+
+// Matches returns true when the comment should be counted in the rule's queue.
+// The rule's action is counted with the ActionKeyCase of the rules.
+func (r StatusQueueRule) Matches(comment *Comment, rules *Rules) bool {
+	if _, ok := r.Statuses[comment.Status]; !ok {
+		return false
+	}
+
+	return r.ActionKey == "" || rules.ActionCount(comment, r.ActionKey) > r.Threshold
+}
+
 type CommentModerationQueue struct {
 	Total  int `bson:"total"`
 	Queues struct {
 		Unmoderated int `bson:"unmoderated"`
 		Reported    int `bson:"reported"`
 		Pending     int `bson:"pending"`
+
+		// ReportedApproved is the number of the reported comments that are
+		// approved, which are only counted when CountReportedApproved is enabled.
+		ReportedApproved int `bson:"reportedApproved,omitempty"`
+
+		// ReportedAutomated and ReportedUser are the number of the reported
+		// comments with flags from automated detection and with flags from users,
+		// which are only counted when AutomatedFlagKeys are set. A comment with
+		// both is counted in each.
+		ReportedAutomated int `bson:"reportedAutomated,omitempty"`
+		ReportedUser      int `bson:"reportedUser,omitempty"`
+
+		// Custom contains the counts for the queues from the ActionQueueRules
+		// and the StatusQueueRules.
+		Custom map[string]int `bson:",inline"`
 	} `bson:"queues"`
 }
 
-func (cmq *CommentModerationQueue) Increment(comment *Comment) {
+func (cmq *CommentModerationQueue) Increment(comment *Comment, rules *Rules) {
 	switch comment.Status {
 	case "NONE":
 		cmq.Total++
@@ -40,8 +182,29 @@ func (cmq *CommentModerationQueue) Increment(comment *Comment) {
 
 		// If this comment has a flag on it, then it should also be in the reported
 		// queue.
-		if count, ok := comment.ActionCounts["FLAG"]; ok && count > 0 {
+		if rules.Reported(comment) {
 			cmq.Queues.Reported++
+			cmq.incrementReporters(comment, rules)
+		}
+
+		// If this comment matches any of the additional queue rules, then it
+		// should also be in those queues.
+		for _, rule := range rules.ActionQueueRules {
+			if rules.ActionCount(comment, rule.ActionKey) > rule.Threshold {
+				if cmq.Queues.Custom == nil {
+					cmq.Queues.Custom = make(map[string]int)
+				}
+
+				cmq.Queues.Custom[rule.QueueName]++
+			}
+		}
+	case "APPROVED":
+		// Approved comments are only in the reported queue, and only when they
+		// still have open flags and the policy counts them.
+		if rules.countsApproved() && rules.Reported(comment) {
+			cmq.Queues.Reported++
+			cmq.Queues.ReportedApproved++
+			cmq.incrementReporters(comment, rules)
 		}
 	case "PREMOD":
 		cmq.Total++
@@ -51,13 +214,116 @@ func (cmq *CommentModerationQueue) Increment(comment *Comment) {
 		cmq.Total++
 		cmq.Queues.Unmoderated++
 		cmq.Queues.Pending++
+
+		// Withheld comments with flags are also in the reported queue when the
+		// policy counts them.
+		if rules.ReportedPolicy.ReportedWithheld && rules.Reported(comment) {
+			cmq.Queues.Reported++
+			cmq.incrementReporters(comment, rules)
+		}
+	}
+
+	// If this comment matches any of the status queue rules, then it should also
+	// be in those queues.
+	for _, rule := range rules.StatusQueueRules {
+		if rule.Matches(comment, rules) {
+			if cmq.Queues.Custom == nil {
+				cmq.Queues.Custom = make(map[string]int)
+			}
+
+			cmq.Queues.Custom[rule.QueueName]++
+		}
 	}
 }
 
+// incrementReporters will count the reported comment by who reported it. The
+// FLAG count is every flag, so the flags that aren't from automated detection
+// are from users.
+func (cmq *CommentModerationQueue) incrementReporters(comment *Comment, rules *Rules) {
+	if len(rules.AutomatedFlagKeys) == 0 {
+		return
+	}
+
+	var automated int
+	for _, key := range rules.AutomatedFlagKeys {
+		automated += rules.ActionCount(comment, key)
+	}
+
+	if automated > 0 {
+		cmq.Queues.ReportedAutomated++
+	}
+	if rules.ActionCount(comment, "FLAG") > automated {
+		cmq.Queues.ReportedUser++
+	}
+}
+
+const (
+	// ActionKeysUpper will uppercase the action keys, which is the casing that
+	// Coral uses.
+	ActionKeysUpper = "upper"
+
+	// ActionKeysLower will lowercase the action keys.
+	ActionKeysLower = "lower"
+)
+
+// caseActionKey will return the key in the ActionKeyCase.
+func (r *Rules) caseActionKey(key string) string {
+	switch r.ActionKeyCase {
+	case ActionKeysUpper:
+		return strings.ToUpper(key)
+	case ActionKeysLower:
+		return strings.ToLower(key)
+	default:
+		return key
+	}
+}
+
+// normalizeActionKey will return the key in the ActionKeyCase. The first time a
+// key is changed it's logged, as it means the comments have inconsistent keys.
+// Rules that weren't created with DefaultRules log it every time.
+func (r *Rules) normalizeActionKey(key string) string {
+	normalized := r.caseActionKey(key)
+	if normalized != key {
+		logged := false
+		if r.normalizedActionKeys != nil {
+			_, logged = r.normalizedActionKeys.LoadOrStore(key, struct{}{})
+		}
+
+		if !logged {
+			logrus.WithFields(logrus.Fields{
+				"key":        key,
+				"normalized": normalized,
+			}).Warn("comments have an action key with inconsistent casing, counting it under the normalized key")
+		}
+	}
+
+	return normalized
+}
+
 type CommentActionCounts map[string]int
 
-func (cac CommentActionCounts) Increment(comment *Comment) {
+func (cac CommentActionCounts) Increment(comment *Comment, rules *Rules) {
 	for key, count := range comment.ActionCounts {
+		if rules.ActionKeyCase != "" {
+			key = rules.normalizeActionKey(key)
+		}
+
 		cac[key] += count
 	}
 }
+
+// UnknownSource is the source that comments without a source are counted under.
+const UnknownSource = "unknown"
+
+// CommentSourceCounts are the counts of comments keyed by the source (such as
+// web, AMP, or app) they were submitted from.
+type CommentSourceCounts map[string]int
+
+func (csc CommentSourceCounts) Increment(comment *Comment) {
+	source := comment.Source
+	if source == "" {
+		source = UnknownSource
+	}
+
+	csc[source]++
+}
@@ -0,0 +1,267 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseActionQueueRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    ActionQueueRule
+		wantErr bool
+	}{
+		{rule: "toxic:FLAG__TOXIC:0", want: ActionQueueRule{QueueName: "toxic", ActionKey: "FLAG__TOXIC", Threshold: 0}},
+		{rule: "spam:FLAG__SPAM:2", want: ActionQueueRule{QueueName: "spam", ActionKey: "FLAG__SPAM", Threshold: 2}},
+		{rule: "toxic:FLAG__TOXIC", wantErr: true},
+		{rule: ":FLAG:0", wantErr: true},
+		{rule: "toxic::0", wantErr: true},
+		{rule: "toxic:FLAG:many", wantErr: true},
+		{rule: "unmoderated:FLAG:0", wantErr: true},
+		{rule: "reported:FLAG:0", wantErr: true},
+		{rule: "pending:FLAG:0", wantErr: true},
+		{rule: "reportedApproved:FLAG:0", wantErr: true},
+		{rule: "reportedAutomated:FLAG:0", wantErr: true},
+		{rule: "reportedUser:FLAG:0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := ParseActionQueueRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseActionQueueRule(%q) error = %v, wantErr %v", tt.rule, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ParseActionQueueRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStatusQueueRule(t *testing.T) {
+	tests := []struct {
+		rule      string
+		statuses  []string
+		actionKey string
+		threshold int
+		wantErr   bool
+	}{
+		{rule: "withheld:SYSTEM_WITHHELD", statuses: []string{"SYSTEM_WITHHELD"}},
+		{rule: "held:premod| system_withheld", statuses: []string{"PREMOD", "SYSTEM_WITHHELD"}},
+		{rule: "featured:APPROVED:FEATURED:0", statuses: []string{"APPROVED"}, actionKey: "FEATURED"},
+		{rule: "featured:APPROVED::0", wantErr: true},
+		{rule: "featured:APPROVED:FEATURED", wantErr: true},
+		{rule: "featured:APPROVED:FEATURED:x", wantErr: true},
+		{rule: "featured:PUBLISHED", wantErr: true},
+		{rule: "featured", wantErr: true},
+		{rule: "unmoderated:NONE", wantErr: true},
+		{rule: "reported:NONE", wantErr: true},
+		{rule: "pending:PREMOD", wantErr: true},
+		{rule: "reportedApproved:APPROVED", wantErr: true},
+		{rule: "reportedAutomated:NONE", wantErr: true},
+		{rule: "reportedUser:NONE", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := ParseStatusQueueRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseStatusQueueRule(%q) error = %v, wantErr %v", tt.rule, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(got.Statuses) != len(tt.statuses) {
+				t.Errorf("expected statuses %v, got %v", tt.statuses, got.Statuses)
+			}
+			for _, status := range tt.statuses {
+				if _, ok := got.Statuses[status]; !ok {
+					t.Errorf("expected status %s in %v", status, got.Statuses)
+				}
+			}
+			if got.ActionKey != tt.actionKey || got.Threshold != tt.threshold {
+				t.Errorf("expected action %s > %d, got %s > %d", tt.actionKey, tt.threshold, got.ActionKey, got.Threshold)
+			}
+		})
+	}
+}
+
+func TestStatusQueues(t *testing.T) {
+	rule := func(value string) StatusQueueRule {
+		r, err := ParseStatusQueueRule(value)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		rules    []string
+		comments []Comment
+		want     map[string]int
+	}{
+		{
+			name:     "no rules",
+			comments: []Comment{{Status: "APPROVED"}},
+		},
+		{
+			name:  "by status",
+			rules: []string{"withheld:SYSTEM_WITHHELD|PREMOD"},
+			comments: []Comment{
+				{Status: "SYSTEM_WITHHELD"},
+				{Status: "PREMOD"},
+				{Status: "NONE"},
+			},
+			want: map[string]int{"withheld": 2},
+		},
+		{
+			name:  "featured over the threshold",
+			rules: []string{"featured:APPROVED:FEATURED:0"},
+			comments: []Comment{
+				{Status: "APPROVED", ActionCounts: map[string]int{"FEATURED": 1}},
+				{Status: "APPROVED", ActionCounts: map[string]int{"FEATURED": 0}},
+				{Status: "APPROVED"},
+				{Status: "REJECTED", ActionCounts: map[string]int{"FEATURED": 1}},
+			},
+			want: map[string]int{"featured": 1},
+		},
+		{
+			name:  "comment in several queues",
+			rules: []string{"featured:APPROVED:FEATURED:0", "published:APPROVED|NONE"},
+			comments: []Comment{
+				{Status: "APPROVED", ActionCounts: map[string]int{"FEATURED": 2}},
+				{Status: "NONE"},
+			},
+			want: map[string]int{"featured": 1, "published": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			for _, value := range tt.rules {
+				rules.StatusQueueRules = append(rules.StatusQueueRules, rule(value))
+			}
+
+			var queue CommentModerationQueue
+			for i := range tt.comments {
+				queue.Increment(&tt.comments[i], &rules)
+			}
+
+			if !reflect.DeepEqual(queue.Queues.Custom, tt.want) {
+				t.Errorf("expected queues %v, got %v", tt.want, queue.Queues.Custom)
+			}
+		})
+	}
+}
+
+// TestReportedApproved checks that an approved comment that still has flags is
+// counted in the reported queue without being counted as unmoderated.
+func TestReportedApproved(t *testing.T) {
+	openFlags := func(n int) *int { return &n }
+
+	tests := []struct {
+		name                  string
+		countReportedApproved bool
+		comment               Comment
+		wantReported          int
+	}{
+		{
+			name:    "flagged and disabled",
+			comment: Comment{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 2}},
+		},
+		{
+			name:                  "flagged and enabled",
+			countReportedApproved: true,
+			comment:               Comment{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 2}},
+			wantReported:          1,
+		},
+		{
+			name:                  "not flagged",
+			countReportedApproved: true,
+			comment:               Comment{Status: "APPROVED"},
+		},
+		{
+			name:                  "flags resolved",
+			countReportedApproved: true,
+			comment:               Comment{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 2}, OpenFlags: openFlags(0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountReportedApproved = tt.countReportedApproved
+
+			var queue CommentModerationQueue
+			queue.Increment(&tt.comment, &rules)
+
+			if queue.Queues.Reported != tt.wantReported {
+				t.Errorf("expected %d reported, got %d", tt.wantReported, queue.Queues.Reported)
+			}
+			if queue.Queues.ReportedApproved != tt.wantReported {
+				t.Errorf("expected %d reported approved, got %d", tt.wantReported, queue.Queues.ReportedApproved)
+			}
+
+			// Approved comments are published, so they're never in the total or
+			// the unmoderated queue.
+			if queue.Total != 0 {
+				t.Errorf("expected the total to be 0, got %d", queue.Total)
+			}
+			if queue.Queues.Unmoderated != 0 {
+				t.Errorf("expected 0 unmoderated, got %d", queue.Queues.Unmoderated)
+			}
+		})
+	}
+}
+
+// TestCustomQueuesMarshal checks that every queue a rule is allowed to create
+// can be written alongside the built-in queues.
+func TestCustomQueuesMarshal(t *testing.T) {
+	var queue CommentModerationQueue
+	queue.Queues.Custom = map[string]int{"toxic": 1, "featured": 2}
+
+	if _, err := bson.Marshal(queue); err != nil {
+		t.Fatalf("could not marshal the custom queues: %v", err)
+	}
+
+	// A custom queue named like a built-in one is what the parsers reject.
+	queue.Queues.Custom = map[string]int{"reportedUser": 1}
+	if _, err := bson.Marshal(queue); err == nil {
+		t.Fatal("expected a custom queue with a built-in name to fail to marshal")
+	}
+}
+
+func TestCountBySource(t *testing.T) {
+	tests := []struct {
+		name          string
+		countBySource bool
+		sources       []string
+		want          CommentSourceCounts
+	}{
+		{name: "disabled", sources: []string{"web"}},
+		{name: "by source", countBySource: true, sources: []string{"web", "amp", "web"}, want: CommentSourceCounts{"web": 2, "amp": 1}},
+		{name: "unknown source", countBySource: true, sources: []string{""}, want: CommentSourceCounts{UnknownSource: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountBySource = tt.countBySource
+
+			story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+			for _, source := range tt.sources {
+				story.Increment(&Comment{Status: "APPROVED", Source: source}, &rules)
+			}
+
+			if !reflect.DeepEqual(story.CommentCounts.Source, tt.want) {
+				t.Errorf("expected the source counts %v, got %v", tt.want, story.CommentCounts.Source)
+			}
+		})
+	}
+}
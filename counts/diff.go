@@ -0,0 +1,101 @@
+package counts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CountsDiff is the change in each count from one StoryCommentCounts to another,
+// keyed by the path of the count within the commentCounts (such as
+// status.APPROVED or action.FLAG). Only the counts that changed are included.
+type CountsDiff map[string]int
+
+// Diff will return the change in each count from a to b. Action, custom queue,
+// and source keys that are only in one of them are treated as zero in the
+// other.
+func Diff(a, b StoryCommentCounts) CountsDiff {
+	before, after := a.fields(), b.fields()
+
+	diff := make(CountsDiff)
+	for key, value := range after {
+		if delta := value - before[key]; delta != 0 {
+			diff[key] = delta
+		}
+	}
+
+	for key, value := range before {
+		if _, ok := after[key]; !ok && value != 0 {
+			diff[key] = -value
+		}
+	}
+
+	return diff
+}
+
+// Empty returns true when none of the counts changed.
+func (d CountsDiff) Empty() bool {
+	return len(d) == 0
+}
+
+// String returns the changes sorted by the path of the count, such as
+// "action.FLAG: +2, status.NONE: -1".
+func (d CountsDiff) String() string {
+	if len(d) == 0 {
+		return "no changes"
+	}
+
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		changes = append(changes, fmt.Sprintf("%s: %+d", key, d[key]))
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// fields returns each of the counts keyed by its path within the commentCounts.
+func (scc StoryCommentCounts) fields() map[string]int {
+	fields := map[string]int{
+		"status.APPROVED":                          scc.Status.Approved,
+		"status.NONE":                              scc.Status.None,
+		"status.PREMOD":                            scc.Status.Premod,
+		"status.REJECTED":                          scc.Status.Rejected,
+		"status.SYSTEM_WITHHELD":                   scc.Status.SystemWithheld,
+		"moderationQueue.total":                    scc.ModerationQueue.Total,
+		"moderationQueue.queues.unmoderated":       scc.ModerationQueue.Queues.Unmoderated,
+		"moderationQueue.queues.reported":          scc.ModerationQueue.Queues.Reported,
+		"moderationQueue.queues.pending":           scc.ModerationQueue.Queues.Pending,
+		"moderationQueue.queues.reportedApproved":  scc.ModerationQueue.Queues.ReportedApproved,
+		"moderationQueue.queues.reportedAutomated": scc.ModerationQueue.Queues.ReportedAutomated,
+		"moderationQueue.queues.reportedUser":      scc.ModerationQueue.Queues.ReportedUser,
+		"distinctAuthors":                          scc.DistinctAuthors,
+	}
+
+	for key, count := range scc.Action {
+		fields["action."+key] = count
+	}
+
+	for key, count := range scc.ModerationQueue.Queues.Custom {
+		fields["moderationQueue.queues."+key] = count
+	}
+
+	for key, count := range scc.Source {
+		fields["source."+key] = count
+	}
+
+	if scc.Ratings != nil {
+		fields["ratings.count"] = scc.Ratings.Count
+		fields["ratings.sum"] = scc.Ratings.Sum
+		for key, count := range scc.Ratings.Histogram {
+			fields["ratings.histogram."+key] = count
+		}
+	}
+
+	return fields
+}
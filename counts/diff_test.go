@@ -0,0 +1,92 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+)
+
+// customQueueCounts returns the counts with n comments in the custom queue.
+func customQueueCounts(queue string, n int) StoryCommentCounts {
+	var counts StoryCommentCounts
+	counts.ModerationQueue.Queues.Custom = map[string]int{queue: n}
+
+	return counts
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b StoryCommentCounts
+		want CountsDiff
+	}{
+		{
+			name: "no changes",
+			a:    StoryCommentCounts{Status: CommentStatusCounts{Approved: 2}},
+			b:    StoryCommentCounts{Status: CommentStatusCounts{Approved: 2}},
+			want: CountsDiff{},
+		},
+		{
+			name: "status changed",
+			a:    StoryCommentCounts{Status: CommentStatusCounts{Approved: 2, None: 1}},
+			b:    StoryCommentCounts{Status: CommentStatusCounts{Approved: 3}},
+			want: CountsDiff{"status.APPROVED": 1, "status.NONE": -1},
+		},
+		{
+			name: "action only before",
+			a:    StoryCommentCounts{Action: map[string]int{"FLAG": 2}},
+			b:    StoryCommentCounts{},
+			want: CountsDiff{"action.FLAG": -2},
+		},
+		{
+			name: "action only after",
+			a:    StoryCommentCounts{Action: map[string]int{"REACTION": 0}},
+			b:    StoryCommentCounts{Action: map[string]int{"FLAG": 1}},
+			want: CountsDiff{"action.FLAG": 1},
+		},
+		{
+			name: "source",
+			a:    StoryCommentCounts{Source: map[string]int{"web": 1}},
+			b:    StoryCommentCounts{Source: map[string]int{"web": 1, "app": 2}},
+			want: CountsDiff{"source.app": 2},
+		},
+		{
+			name: "custom queue",
+			a:    StoryCommentCounts{},
+			b:    customQueueCounts("toxic", 1),
+			want: CountsDiff{"moderationQueue.queues.toxic": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %v, want %v", got, tt.want)
+			}
+			if got.Empty() != (len(tt.want) == 0) {
+				t.Errorf("Empty() = %v, want %v", got.Empty(), len(tt.want) == 0)
+			}
+		})
+	}
+}
+
+func TestCountsDiffString(t *testing.T) {
+	tests := []struct {
+		name string
+		diff CountsDiff
+		want string
+	}{
+		{"no changes", CountsDiff{}, "no changes"},
+		{"nil", nil, "no changes"},
+		{"one change", CountsDiff{"status.NONE": -1}, "status.NONE: -1"},
+		{"sorted by path", CountsDiff{"status.NONE": -1, "action.FLAG": 2}, "action.FLAG: +2, status.NONE: -1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.diff.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeadLetter is a record of a document that could not be processed.
+type DeadLetter struct {
+	TenantID   string      `bson:"tenantID"`
+	SiteID     string      `bson:"siteID"`
+	Collection string      `bson:"collection"`
+	DocumentID interface{} `bson:"documentID"`
+	Error      string      `bson:"error"`
+	CreatedAt  time.Time   `bson:"createdAt"`
+}
+
+// recordDeadLetter will record that a document could not be processed in the
+// dead letter collection. Failing to record the document is logged but will not
+// abort the run.
+func recordDeadLetter(ctx context.Context, deadLetters *mongo.Collection, dryRun bool, letter DeadLetter) {
+	letter.CreatedAt = time.Now()
+
+	logger := logrus.WithFields(logrus.Fields{
+		"collection": letter.Collection,
+		"documentID": letter.DocumentID,
+		"error":      letter.Error,
+	})
+
+	if dryRun {
+		logger.Warn("not recording failed document as --dryRun is enabled")
+		return
+	}
+
+	if _, err := deadLetters.InsertOne(ctx, letter); err != nil {
+		logger.WithError(err).Error("could not record failed document")
+		return
+	}
+
+	logger.Warn("recorded failed document")
+}
+
+// documentID will return the _id of the raw document if it can be found.
+func documentID(raw bson.Raw) interface{} {
+	value, err := raw.LookupErr("_id")
+	if err != nil {
+		return nil
+	}
+
+	return value
+}
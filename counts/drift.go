@@ -0,0 +1,131 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// drifted will return the ID's of the documents in the output collection whose
+// stored counts differ from the counts that were computed for them, keyed by
+// their ID. Each drifted document is logged with the difference in its counts,
+// at the debug level when quiet.
+func (p *Processor) drifted(ctx context.Context, collection string, computed map[string]interface{}, quiet bool) (map[string]struct{}, error) {
+	started := time.Now()
+
+	ids := make([]string, 0, len(computed))
+	for id := range computed {
+		ids = append(ids, id)
+	}
+
+	stored, err := p.loadStoredCounts(ctx, collection, ids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load the stored %s counts", collection)
+	}
+
+	drifted := make(map[string]struct{})
+	for id, counts := range computed {
+		data, err := bson.Marshal(counts)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not marshal computed counts")
+		}
+
+		deltas, err := diffCounts(stored[id], data)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not compare counts")
+		}
+
+		if len(deltas) == 0 {
+			continue
+		}
+
+		drifted[id] = struct{}{}
+
+		entry := logrus.WithFields(logrus.Fields{
+			"collection": collection,
+			"id":         id,
+			"drift":      deltas,
+		})
+		if quiet {
+			entry.Debug("counts drifted")
+		} else {
+			entry.Warn("counts drifted")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": collection,
+		"checked":    len(computed),
+		"drifted":    len(drifted),
+		"took":       time.Since(started),
+	}).Info("compared the computed counts with the stored counts")
+
+	return drifted, nil
+}
+
+// estimateChanges returns true when the dry run should estimate how many of
+// the documents would change. When only drifted documents are written, every
+// document that would be written would change, so there's nothing to estimate.
+func (p *Processor) estimateChanges() bool {
+	return p.EstimateChanges && p.DryRun && !p.OnlyDrift
+}
+
+// changed will return how many of the documents in the output collection have
+// stored counts that differ from the counts that were computed for them.
+func (p *Processor) changed(ctx context.Context, collection string, computed map[string]interface{}) (int, error) {
+	drifted, err := p.drifted(ctx, collection, computed, true)
+	if err != nil {
+		return 0, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": collection,
+		"updates":    len(computed),
+		"changed":    len(drifted),
+		"unchanged":  len(computed) - len(drifted),
+	}).Info("estimated the documents a real run would change")
+
+	return len(drifted), nil
+}
+
+// driftedStories will return only the stories whose stored counts have drifted
+// from the computed counts.
+func (p *Processor) driftedStories(ctx context.Context, stories map[string]*Story) (map[string]*Story, error) {
+	_, computed := storyCounts(stories)
+
+	drifted, err := p.drifted(ctx, "stories", computed, false)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(map[string]*Story, len(drifted))
+	for storyID := range drifted {
+		filtered[storyID] = stories[storyID]
+	}
+
+	return filtered, nil
+}
+
+// driftedUsers will return only the users whose stored counts have drifted from
+// the computed counts.
+func (p *Processor) driftedUsers(ctx context.Context, users map[string]*User) (map[string]*User, error) {
+	computed := make(map[string]interface{}, len(users))
+	for userID, user := range users {
+		computed[userID] = user.CommentCounts
+	}
+
+	drifted, err := p.drifted(ctx, "users", computed, false)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(map[string]*User, len(drifted))
+	for userID := range drifted {
+		filtered[userID] = users[userID]
+	}
+
+	return filtered, nil
+}
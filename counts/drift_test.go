@@ -0,0 +1,179 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestDriftedUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	stored := func(id string, approved, rejected int) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "commentCounts", Value: bson.D{
+				primitive.E{Key: "status", Value: bson.D{
+					primitive.E{Key: "APPROVED", Value: int32(approved)},
+					primitive.E{Key: "REJECTED", Value: int32(rejected)},
+				}},
+			}},
+		}
+	}
+	user := func(approved, rejected int) *User {
+		return &User{CommentCounts: UserCommentCounts{Status: CommentStatusCounts{Approved: approved, Rejected: rejected}}}
+	}
+
+	tests := []struct {
+		name   string
+		stored []bson.D
+		users  map[string]*User
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			stored: []bson.D{stored("u1", 2, 1)},
+			users:  map[string]*User{"u1": user(2, 1)},
+			want:   []string{},
+		},
+		{
+			name:   "drifted",
+			stored: []bson.D{stored("u1", 2, 1), stored("u2", 1, 0)},
+			users:  map[string]*User{"u1": user(3, 1), "u2": user(1, 0)},
+			want:   []string{"u1"},
+		},
+		{
+			name:  "missing document with counts",
+			users: map[string]*User{"u1": user(1, 0)},
+			want:  []string{"u1"},
+		},
+		{
+			name:  "missing document without counts",
+			users: map[string]*User{"u1": user(0, 0)},
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.users", mtest.FirstBatch, tt.stored...))
+
+			p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+			p.BatchSize = 100
+
+			drifted, err := p.driftedUsers(context.Background(), tt.users)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make([]string, 0, len(drifted))
+			for userID, user := range drifted {
+				if user != tt.users[userID] {
+					mt.Errorf("expected the drifted user %s to be the computed user", userID)
+				}
+
+				got = append(got, userID)
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected %v to have drifted, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEstimateChanges(t *testing.T) {
+	tests := []struct {
+		name            string
+		estimateChanges bool
+		dryRun          bool
+		onlyDrift       bool
+		want            bool
+	}{
+		{"disabled", false, true, false, false},
+		{"dry run", true, true, false, true},
+		{"real run", true, false, false, false},
+		{"only drift", true, true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", tt.dryRun, DefaultRules())
+			p.EstimateChanges = tt.estimateChanges
+			p.OnlyDrift = tt.onlyDrift
+
+			if got := p.estimateChanges(); got != tt.want {
+				t.Errorf("expected estimateChanges() = %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	stored := func(id string, approved int) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "commentCounts", Value: bson.D{
+				primitive.E{Key: "status", Value: bson.D{
+					primitive.E{Key: "APPROVED", Value: int32(approved)},
+				}},
+			}},
+		}
+	}
+	counts := func(approved int) interface{} {
+		return UserCommentCounts{Status: CommentStatusCounts{Approved: approved}}
+	}
+
+	tests := []struct {
+		name     string
+		stored   []bson.D
+		computed map[string]interface{}
+		want     int
+	}{
+		{
+			name:     "nothing changes",
+			stored:   []bson.D{stored("u1", 1), stored("u2", 2)},
+			computed: map[string]interface{}{"u1": counts(1), "u2": counts(2)},
+			want:     0,
+		},
+		{
+			name:     "some change",
+			stored:   []bson.D{stored("u1", 1), stored("u2", 2), stored("u3", 3)},
+			computed: map[string]interface{}{"u1": counts(1), "u2": counts(3), "u3": counts(0)},
+			want:     2,
+		},
+		{
+			name:     "new documents",
+			computed: map[string]interface{}{"u1": counts(1), "u2": counts(0)},
+			want:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.users", mtest.FirstBatch, tt.stored...))
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.BatchSize = 100
+
+			changed, err := p.changed(context.Background(), "users", tt.computed)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if changed != tt.want {
+				mt.Errorf("expected %d changed, got %d", tt.want, changed)
+			}
+		})
+	}
+}
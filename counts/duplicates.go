@@ -0,0 +1,79 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DetectDuplicateStories will find the stories on the site that have more than
+// one story document with the same ID and log each of them. It returns the
+// number of stories that have duplicates.
+func (p *Processor) DetectDuplicateStories(ctx context.Context) (int, error) {
+
+	started := time.Now()
+	logrus.WithField("siteID", p.SiteID).Info("detecting duplicate stories")
+
+	cursor, err := p.outputCollection("stories").Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.D{
+				primitive.E{Key: "tenantID", Value: p.TenantID},
+				primitive.E{Key: "siteID", Value: p.SiteID},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.D{
+				primitive.E{Key: "_id", Value: "$id"},
+				primitive.E{Key: "count", Value: bson.D{
+					primitive.E{Key: "$sum", Value: 1},
+				}},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.D{
+				primitive.E{Key: "count", Value: bson.D{
+					primitive.E{Key: "$gt", Value: 1},
+				}},
+			}},
+		},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, errors.Wrap(err, "could not group stories")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	var duplicates int
+	for cursor.Next(ctx) {
+		var group struct {
+			ID    string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return 0, errors.Wrap(err, "could not decode result")
+		}
+
+		duplicates++
+
+		logrus.WithFields(logrus.Fields{
+			"storyID":   group.ID,
+			"documents": group.Count,
+		}).Warn("story has duplicate story documents")
+	}
+
+	if err := cursor.Err(); err != nil {
+		return 0, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"duplicates": duplicates,
+		"took":       time.Since(started),
+	}).Info("detected duplicate stories")
+
+	return duplicates, nil
+}
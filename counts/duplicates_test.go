@@ -0,0 +1,89 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestDetectDuplicateStories(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	group := func(storyID string, count int) bson.D {
+		return bson.D{
+			primitive.E{Key: "_id", Value: storyID},
+			primitive.E{Key: "count", Value: int32(count)},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		groups   []bson.D
+		fail     bool
+		want     int
+		wantFail bool
+	}{
+		{name: "no duplicates", want: 0},
+		{name: "duplicate stories", groups: []bson.D{group("a", 2), group("b", 3)}, want: 2},
+		{name: "aggregate fails", fail: true, wantFail: true},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			if tt.fail {
+				mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+					Code:    2,
+					Message: "bad pipeline",
+				}))
+			} else {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, tt.groups...))
+			}
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+
+			got, err := p.DetectDuplicateStories(context.Background())
+			if tt.wantFail {
+				if err == nil {
+					mt.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tt.want {
+				mt.Errorf("expected %d duplicate stories, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewStoryUpdateDuplicates(t *testing.T) {
+	tests := []struct {
+		name       string
+		duplicates bool
+		want       mongo.WriteModel
+	}{
+		{name: "only one story document", want: &mongo.UpdateOneModel{}},
+		{name: "every story document", duplicates: true, want: &mongo.UpdateManyModel{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.UpdateDuplicateStories = tt.duplicates
+
+			model := p.newStoryUpdate("story", bson.D{})
+			if reflect.TypeOf(model) != reflect.TypeOf(tt.want) {
+				t.Errorf("expected %T, got %T", tt.want, model)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package counts
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// eventLogBuffer is the number of events that can be waiting to be written to
+// an EventLog before events are dropped.
+const eventLogBuffer = 4096
+
+// eventLogFlushInterval is how often the buffered events are written out.
+const eventLogFlushInterval = time.Second
+
+// EventLogEntry is a line of an EventLog.
+type EventLogEntry struct {
+	ReceivedAt    time.Time `json:"receivedAt"`
+	OperationType string    `json:"operationType"`
+
+	// CommentID, StoryID, AuthorID, and Status are from the comment after the
+	// change, and are empty when the event didn't include it.
+	CommentID string `json:"commentID,omitempty"`
+	StoryID   string `json:"storyID,omitempty"`
+	AuthorID  string `json:"authorID,omitempty"`
+	Status    string `json:"status,omitempty"`
+
+	// Before is the comment before the change, which is only included when the
+	// Watcher's UserDeltas is enabled and the event had a pre-image.
+	Before *EventLogComment `json:"before,omitempty"`
+}
+
+// EventLogComment is a comment as it was before a change.
+type EventLogComment struct {
+	StoryID  string `json:"storyID"`
+	AuthorID string `json:"authorID"`
+	Status   string `json:"status"`
+}
+
+// EventLog records watch events to a file as newline delimited JSON, in the
+// order they were received. Events are written in the background so a slow disk
+// doesn't hold up the change stream, and are dropped rather than blocking if too
+// many are waiting to be written.
+type EventLog struct {
+	file    *os.File
+	entries chan EventLogEntry
+	done    chan struct{}
+	dropped int64
+	err     error
+
+	// closed is true once the log is closed, and mux prevents events from being
+	// queued while it's closing.
+	closed bool
+	mux    sync.RWMutex
+}
+
+// NewEventLog will open the file at path, appending to it if it already exists,
+// and start writing events to it.
+func NewEventLog(path string) (*EventLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the event log")
+	}
+
+	l := &EventLog{
+		file:    file,
+		entries: make(chan EventLogEntry, eventLogBuffer),
+		done:    make(chan struct{}),
+	}
+
+	go l.write()
+
+	return l, nil
+}
+
+// Record will queue the event to be written.
+func (l *EventLog) Record(event *WatchEvent) {
+	entry := EventLogEntry{
+		ReceivedAt:    time.Now(),
+		OperationType: event.OperationType,
+	}
+
+	if comment := event.FullDocument; comment != nil {
+		entry.CommentID = comment.ID
+		entry.StoryID = comment.StoryID
+		entry.AuthorID = comment.AuthorID
+		entry.Status = comment.Status
+	}
+
+	if before := event.FullDocumentBeforeChange; before != nil {
+		entry.Before = &EventLogComment{
+			StoryID:  before.StoryID,
+			AuthorID: before.AuthorID,
+			Status:   before.Status,
+		}
+	}
+
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.entries <- entry:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// write will write the queued events until the log is closed, flushing them
+// every eventLogFlushInterval.
+func (l *EventLog) write() {
+	defer close(l.done)
+
+	w := bufio.NewWriter(l.file)
+	encoder := json.NewEncoder(w)
+
+	ticker := time.NewTicker(eventLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				if err := w.Flush(); err != nil && l.err == nil {
+					l.err = err
+				}
+
+				return
+			}
+
+			if l.err != nil {
+				continue
+			}
+
+			if err := encoder.Encode(entry); err != nil {
+				l.err = err
+				logrus.WithError(err).Error("could not write to the watcher event log, no more events will be recorded")
+			}
+		case <-ticker.C:
+			if l.err != nil {
+				continue
+			}
+
+			if err := w.Flush(); err != nil {
+				l.err = err
+				logrus.WithError(err).Error("could not write to the watcher event log, no more events will be recorded")
+			}
+		}
+	}
+}
+
+// Close will write the queued events and close the file. Events recorded after
+// the log is closed are ignored.
+func (l *EventLog) Close() error {
+	l.mux.Lock()
+	l.closed = true
+	close(l.entries)
+	l.mux.Unlock()
+
+	<-l.done
+
+	if dropped := atomic.LoadInt64(&l.dropped); dropped > 0 {
+		logrus.WithField("dropped", dropped).Warn("events were dropped from the watcher event log as they could not be written fast enough")
+	}
+
+	if err := l.file.Close(); err != nil && l.err == nil {
+		l.err = err
+	}
+
+	if l.err != nil {
+		return errors.Wrap(l.err, "could not write the event log")
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package counts
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing int
+		events   []WatchEvent
+		want     []EventLogEntry
+	}{
+		{
+			name: "no events",
+		},
+		{
+			name: "events in order",
+			events: []WatchEvent{
+				{OperationType: "insert", FullDocument: &Comment{ID: "c1", StoryID: "s1", AuthorID: "u1", Status: "NONE"}},
+				{OperationType: "update", FullDocument: &Comment{ID: "c1", StoryID: "s1", AuthorID: "u1", Status: "APPROVED"}, FullDocumentBeforeChange: &Comment{StoryID: "s1", AuthorID: "u1", Status: "NONE"}},
+				{OperationType: "delete"},
+			},
+			want: []EventLogEntry{
+				{OperationType: "insert", CommentID: "c1", StoryID: "s1", AuthorID: "u1", Status: "NONE"},
+				{OperationType: "update", CommentID: "c1", StoryID: "s1", AuthorID: "u1", Status: "APPROVED", Before: &EventLogComment{StoryID: "s1", AuthorID: "u1", Status: "NONE"}},
+				{OperationType: "delete"},
+			},
+		},
+		{
+			name:     "appended to an existing log",
+			existing: 2,
+			events:   []WatchEvent{{OperationType: "insert", FullDocument: &Comment{ID: "c3"}}},
+			want:     []EventLogEntry{{OperationType: "insert", CommentID: "c3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.ndjson")
+
+			// Write the entries that are already in the log.
+			for i := 0; i < tt.existing; i++ {
+				l, err := NewEventLog(path)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				l.Record(&WatchEvent{OperationType: "replace"})
+				if err := l.Close(); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			l, err := NewEventLog(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for i := range tt.events {
+				l.Record(&tt.events[i])
+			}
+			if err := l.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Events recorded after the log is closed are ignored.
+			l.Record(&WatchEvent{OperationType: "insert"})
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer file.Close()
+
+			var entries []EventLogEntry
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var entry EventLogEntry
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					t.Fatalf("could not decode %q: %v", scanner.Text(), err)
+				}
+				if entry.ReceivedAt.IsZero() {
+					t.Errorf("expected the entry to have when it was received")
+				}
+
+				entries = append(entries, entry)
+			}
+
+			if len(entries) != tt.existing+len(tt.want) {
+				t.Fatalf("expected %d entries, got %d", tt.existing+len(tt.want), len(entries))
+			}
+			for i, want := range tt.want {
+				got := entries[tt.existing+i]
+				got.ReceivedAt = want.ReceivedAt
+				if got.Before != nil && want.Before != nil && *got.Before == *want.Before {
+					got.Before = want.Before
+				}
+				if got != want {
+					t.Errorf("expected entry %d to be %+v, got %+v", i, want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package counts
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Publisher publishes the counts computed for stories and users to downstream
+// consumers. Implementations must be safe to use from multiple goroutines.
+type Publisher interface {
+	// Publish will publish each of the events.
+	Publish(ctx context.Context, events []CountEvent) error
+}
+
+const (
+	// PublishFailureWarn will log the events that could not be published and
+	// continue processing.
+	PublishFailureWarn = "warn"
+
+	// PublishFailureFail will stop processing when events could not be
+	// published.
+	PublishFailureFail = "fail"
+)
+
+// CountEvent is the counts of a story or user as they were computed.
+type CountEvent struct {
+	// Type is either "story" or "user".
+	Type     string `json:"type"`
+	TenantID string `json:"tenantID"`
+	SiteID   string `json:"siteID"`
+	ID       string `json:"id"`
+	RunID    string `json:"runID"`
+
+	// CommentCounts are the counts in the same shape as they're stored on the
+	// story or user.
+	CommentCounts json.RawMessage `json:"commentCounts"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+// publishing returns true when the counts should be published. Dry runs don't
+// publish any counts unless they're only publishing them.
+func (p *Processor) publishing() bool {
+	return p.Events != nil && (!p.DryRun || p.PublishOnly)
+}
+
+// publishCounts will publish an event for each of the counts, keyed by the ID of
+// the story or user, in batches. When the events can't be published the error
+// is only returned if the PublishFailurePolicy is PublishFailureFail.
+func (p *Processor) publishCounts(ctx context.Context, kind string, counts map[string]interface{}) error {
+	events, err := p.countEvents(kind, counts)
+	if err != nil {
+		return err
+	}
+
+	var published int
+	for start := 0; start < len(events); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		if err := p.Events.Publish(ctx, events[start:end]); err != nil {
+			p.Metrics.Count(kind+".publish_failed", int64(len(events)-start))
+
+			if p.PublishFailurePolicy == PublishFailureFail {
+				return errors.Wrapf(err, "could not publish %s counts", kind)
+			}
+
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"published": published,
+				"failed":    len(events) - start,
+			}).Warnf("could not publish %s counts", kind)
+
+			return nil
+		}
+
+		published += end - start
+	}
+
+	p.Metrics.Count(kind+".published", int64(published))
+
+	logrus.WithField("published", published).Infof("published %s counts", kind)
+
+	return nil
+}
+
+// countEvents will create an event for each of the counts, keyed by the ID of
+// the story or user.
+func (p *Processor) countEvents(kind string, counts map[string]interface{}) ([]CountEvent, error) {
+	now := time.Now()
+
+	events := make([]CountEvent, 0, len(counts))
+	for id, count := range counts {
+		// The counts are encoded with their bson names so they match the stored
+		// documents.
+		data, err := bson.MarshalExtJSON(count, false, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not encode the %s counts", kind)
+		}
+
+		events = append(events, CountEvent{
+			Type:          kind,
+			TenantID:      p.TenantID,
+			SiteID:        p.SiteID,
+			ID:            id,
+			RunID:         p.RunID,
+			CommentCounts: data,
+			CreatedAt:     now,
+		})
+	}
+
+	return events, nil
+}
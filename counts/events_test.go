@@ -0,0 +1,137 @@
+package counts
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// recordingPublisher is a Publisher that records the batches of events that are
+// published to it, and fails every batch after the first failAfter of them.
+type recordingPublisher struct {
+	mux       sync.Mutex
+	batches   [][]CountEvent
+	failAfter int
+}
+
+func (r *recordingPublisher) Publish(ctx context.Context, events []CountEvent) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.failAfter >= 0 && len(r.batches) >= r.failAfter {
+		return errors.New("broker unavailable")
+	}
+
+	r.batches = append(r.batches, events)
+
+	return nil
+}
+
+func TestPublishCounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		counts      int
+		batchSize   int
+		failAfter   int
+		policy      string
+		wantBatches int
+		wantErr     bool
+	}{
+		{name: "no counts", counts: 0, batchSize: 2, failAfter: -1, policy: PublishFailureWarn, wantBatches: 0},
+		{name: "one batch", counts: 2, batchSize: 2, failAfter: -1, policy: PublishFailureWarn, wantBatches: 1},
+		{name: "batches", counts: 5, batchSize: 2, failAfter: -1, policy: PublishFailureWarn, wantBatches: 3},
+		{name: "failure warns", counts: 5, batchSize: 2, failAfter: 1, policy: PublishFailureWarn, wantBatches: 1},
+		{name: "failure fails", counts: 5, batchSize: 2, failAfter: 1, policy: PublishFailureFail, wantBatches: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &recordingPublisher{failAfter: tt.failAfter}
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.Events = publisher
+			p.PublishFailurePolicy = tt.policy
+			p.BatchSize = tt.batchSize
+			p.RunID = "run"
+
+			counts := make(map[string]interface{}, tt.counts)
+			for i := 0; i < tt.counts; i++ {
+				counts[string(rune('a'+i))] = UserCommentCounts{Status: CommentStatusCounts{Approved: i}}
+			}
+
+			err := p.publishCounts(context.Background(), "user", counts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishCounts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(publisher.batches) != tt.wantBatches {
+				t.Errorf("expected %d batches, got %d", tt.wantBatches, len(publisher.batches))
+			}
+			for _, batch := range publisher.batches {
+				if len(batch) > tt.batchSize {
+					t.Errorf("expected at most %d events in a batch, got %d", tt.batchSize, len(batch))
+				}
+			}
+		})
+	}
+}
+
+func TestCountEvents(t *testing.T) {
+	p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+	p.RunID = "run"
+
+	events, err := p.countEvents("user", map[string]interface{}{
+		"u1": UserCommentCounts{Status: CommentStatusCounts{Approved: 2, Rejected: 1}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+
+	event := events[0]
+	if event.Type != "user" || event.ID != "u1" || event.TenantID != "tenant" || event.SiteID != "site" || event.RunID != "run" {
+		t.Errorf("expected the event for user u1 of run, got %+v", event)
+	}
+
+	// The counts are encoded with the names they're stored with.
+	var counts struct {
+		Status map[string]int `json:"status"`
+	}
+	if err := json.Unmarshal(event.CommentCounts, &counts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if counts.Status["APPROVED"] != 2 || counts.Status["REJECTED"] != 1 {
+		t.Errorf("expected 2 approved and 1 rejected, got %v", counts.Status)
+	}
+}
+
+func TestProcessorPublishing(t *testing.T) {
+	tests := []struct {
+		name        string
+		events      Publisher
+		dryRun      bool
+		publishOnly bool
+		want        bool
+	}{
+		{"no publisher", nil, false, false, false},
+		{"publisher", &recordingPublisher{}, false, false, true},
+		{"dry run", &recordingPublisher{}, true, false, false},
+		{"dry run publishing only", &recordingPublisher{}, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", tt.dryRun, DefaultRules())
+			p.Events = tt.events
+			p.PublishOnly = tt.publishOnly
+
+			if got := p.publishing(); got != tt.want {
+				t.Errorf("publishing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package counts
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// exportFlushLines is how many lines are written to the export before it's
+// flushed, so a reader of the export sees it progress.
+const exportFlushLines = 1000
+
+// ExportSink is a Sink that writes the counts as newline delimited JSON rather
+// than writing them to the database, one CountEvent per line. Each line is
+// encoded and written as it's produced, so memory doesn't grow with the size of
+// the export.
+type ExportSink struct {
+	mux sync.Mutex
+
+	file    io.Closer
+	gzip    *gzip.Writer
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	lines   int
+}
+
+// NewExportSink will create a Sink that writes the counts to the file at path,
+// or to stdout when the path is -. When compress is true the export is gzipped.
+func NewExportSink(path string, compress bool) (*ExportSink, error) {
+	var (
+		out  io.Writer = os.Stdout
+		file io.Closer
+	)
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create the export")
+		}
+
+		out, file = f, f
+	}
+
+	s := ExportSink{
+		file: file,
+	}
+
+	if compress {
+		s.gzip = gzip.NewWriter(out)
+		out = s.gzip
+	}
+
+	s.writer = bufio.NewWriter(out)
+	s.encoder = json.NewEncoder(s.writer)
+
+	return &s, nil
+}
+
+func (s *ExportSink) Write(ctx context.Context, p *Processor, kind string, counts map[string]interface{}) (*WriteResult, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := time.Now()
+
+	var res WriteResult
+	for id, count := range counts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// The counts are encoded with their bson names so they match the stored
+		// documents.
+		data, err := bson.MarshalExtJSON(count, false, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not encode the %s counts", kind)
+		}
+
+		if err := s.encoder.Encode(CountEvent{
+			Type:          kind,
+			TenantID:      p.TenantID,
+			SiteID:        p.SiteID,
+			ID:            id,
+			RunID:         p.RunID,
+			CommentCounts: data,
+			CreatedAt:     now,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "could not export the %s counts", kind)
+		}
+
+		res.Updates++
+
+		s.lines++
+		if s.lines%exportFlushLines == 0 {
+			if err := s.flush(); err != nil {
+				return nil, err
+			}
+
+			res.Batches++
+		}
+	}
+
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+
+	res.Batches++
+
+	logrus.WithField("updates", res.Updates).Infof("exported %s counts", kind)
+
+	return &res, nil
+}
+
+// flush will write the buffered lines through to the export.
+func (s *ExportSink) flush() error {
+	if err := s.writer.Flush(); err != nil {
+		return errors.Wrap(err, "could not write the export")
+	}
+
+	if s.gzip != nil {
+		if err := s.gzip.Flush(); err != nil {
+			return errors.Wrap(err, "could not write the export")
+		}
+	}
+
+	return nil
+}
+
+// Close will write any buffered lines and close the export.
+func (s *ExportSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	if s.gzip != nil {
+		if err := s.gzip.Close(); err != nil {
+			return errors.Wrap(err, "could not close the export")
+		}
+	}
+
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return errors.Wrap(err, "could not close the export")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package counts
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestExportSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		compress    bool
+		updates     int
+		wantBatches int
+	}{
+		{name: "empty", updates: 0, wantBatches: 1},
+		{name: "plain", updates: 3, wantBatches: 1},
+		{name: "gzipped", compress: true, updates: 3, wantBatches: 1},
+		{name: "flushed every 1000 lines", updates: 2500, wantBatches: 3},
+		{name: "gzipped and flushed every 1000 lines", compress: true, updates: 2500, wantBatches: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "export.ndjson")
+
+			sink, err := NewExportSink(path, tt.compress)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			computed := make(map[string]interface{}, tt.updates)
+			for i := 0; i < tt.updates; i++ {
+				computed[strconv.Itoa(i)] = UserCommentCounts{Status: CommentStatusCounts{Approved: i}}
+			}
+
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.RunID = "run"
+
+			res, err := sink.Write(context.Background(), p, "user", computed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatalf("could not close the export: %v", err)
+			}
+
+			if res.Updates != tt.updates || res.Batches != tt.wantBatches {
+				t.Errorf("expected %d updates in %d batches, got %d in %d", tt.updates, tt.wantBatches, res.Updates, res.Batches)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var r io.Reader = file
+			if tt.compress {
+				gz, err := gzip.NewReader(file)
+				if err != nil {
+					t.Fatalf("expected a gzipped export: %v", err)
+				}
+				defer gz.Close()
+
+				r = gz
+			}
+
+			lines := 0
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				lines++
+
+				var event CountEvent
+				if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					t.Fatalf("could not decode line %d: %v", lines, err)
+				}
+
+				if event.Type != "user" || event.TenantID != "tenant" || event.SiteID != "site" || event.RunID != "run" {
+					t.Errorf("unexpected event %+v", event)
+				}
+
+				// The counts keep the names they're stored with.
+				var counts struct {
+					Status map[string]int `json:"status"`
+				}
+				if err := json.Unmarshal(event.CommentCounts, &counts); err != nil {
+					t.Fatalf("could not decode the counts of line %d: %v", lines, err)
+				}
+				if want, _ := strconv.Atoi(event.ID); counts.Status["APPROVED"] != want {
+					t.Errorf("expected %s to have %d approved, got %v", event.ID, want, counts.Status)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if lines != tt.updates {
+				t.Errorf("expected %d lines, got %d", tt.updates, lines)
+			}
+		})
+	}
+}
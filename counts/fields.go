@@ -0,0 +1,73 @@
+package counts
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// flatten will marshal the value to BSON and return each of the integer fields
+// within it keyed by their dotted path under prefix. This lets us address every
+// count within a nested counts document, including the dynamic keys of maps.
+func flatten(prefix string, v interface{}) (bson.D, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal counts")
+	}
+
+	var fields bson.D
+	if err := flattenRaw(prefix, bson.Raw(raw), &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+func flattenRaw(prefix string, raw bson.Raw, fields *bson.D) error {
+	elements, err := raw.Elements()
+	if err != nil {
+		return errors.Wrap(err, "could not read counts")
+	}
+
+	for _, element := range elements {
+		key := element.Key()
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		value := element.Value()
+		switch value.Type {
+		case bsontype.EmbeddedDocument:
+			if err := flattenRaw(key, value.Document(), fields); err != nil {
+				return err
+			}
+		case bsontype.Int32:
+			*fields = append(*fields, primitive.E{Key: key, Value: int64(value.Int32())})
+		case bsontype.Int64:
+			*fields = append(*fields, primitive.E{Key: key, Value: value.Int64()})
+		}
+	}
+
+	return nil
+}
+
+// incDocument will return the $inc document that will apply the non-zero counts
+// in v to the document fields under prefix.
+func incDocument(prefix string, v interface{}) (bson.D, error) {
+	fields, err := flatten(prefix, v)
+	if err != nil {
+		return nil, err
+	}
+
+	inc := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		if field.Value.(int64) == 0 {
+			continue
+		}
+
+		inc = append(inc, field)
+	}
+
+	return inc, nil
+}
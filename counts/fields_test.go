@@ -0,0 +1,103 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIncDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		delta func(scc *StoryCommentCounts)
+		want  bson.D
+	}{
+		{
+			name:  "no change",
+			delta: func(scc *StoryCommentCounts) {},
+			want:  bson.D{},
+		},
+		{
+			name: "status and queues",
+			delta: func(scc *StoryCommentCounts) {
+				scc.Status.None = -1
+				scc.Status.Approved = 1
+				scc.ModerationQueue.Total = -1
+				scc.ModerationQueue.Queues.Unmoderated = -1
+			},
+			want: bson.D{
+				primitive.E{Key: "commentCounts.status.APPROVED", Value: int64(1)},
+				primitive.E{Key: "commentCounts.status.NONE", Value: int64(-1)},
+				primitive.E{Key: "commentCounts.moderationQueue.total", Value: int64(-1)},
+				primitive.E{Key: "commentCounts.moderationQueue.queues.unmoderated", Value: int64(-1)},
+			},
+		},
+		{
+			name: "dynamic keys",
+			delta: func(scc *StoryCommentCounts) {
+				scc.Action["FLAG"] = 2
+				scc.Action["REACTION"] = 0
+				scc.ModerationQueue.Queues.Custom = map[string]int{"toxic": 1}
+			},
+			want: bson.D{
+				primitive.E{Key: "commentCounts.action.FLAG", Value: int64(2)},
+				primitive.E{Key: "commentCounts.moderationQueue.queues.toxic", Value: int64(1)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := StoryCommentCounts{Action: make(CommentActionCounts)}
+			tt.delta(&delta)
+
+			got, err := incDocument("commentCounts", &delta)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("incDocument() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStoryCommentCountsSubtract checks that the delta between the stored and
+// computed counts of a story, merged into the site's counts, gives the same
+// counts as summing every story again.
+func TestStoryCommentCountsSubtract(t *testing.T) {
+	rules := DefaultRules()
+
+	count := func(comments ...Comment) StoryCommentCounts {
+		story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+		for i := range comments {
+			story.Increment(&comments[i], &rules)
+		}
+
+		return story.CommentCounts
+	}
+
+	other := count(Comment{Status: "APPROVED"}, Comment{Status: "NONE"})
+	stored := count(Comment{Status: "NONE", ActionCounts: map[string]int{"FLAG": 1}})
+	computed := count(Comment{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 1}}, Comment{Status: "PREMOD"})
+
+	// The site's counts before the story changed.
+	site := StoryCommentCounts{Action: make(CommentActionCounts)}
+	site.Merge(&other)
+	site.Merge(&stored)
+
+	delta := StoryCommentCounts{Action: make(CommentActionCounts)}
+	delta.Merge(&computed)
+	delta.Subtract(&stored)
+	site.Merge(&delta)
+
+	want := StoryCommentCounts{Action: make(CommentActionCounts)}
+	want.Merge(&other)
+	want.Merge(&computed)
+
+	if d := Diff(want, site); !d.Empty() {
+		t.Errorf("expected the site counts from the delta to match the summed counts, got %s", d)
+	}
+}
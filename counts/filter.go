@@ -0,0 +1,32 @@
+package counts
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ParseFilter will parse a filter from its extended JSON, so dates and
+// ObjectID's can be matched with {"$date": ...} and {"$oid": ...}.
+func ParseFilter(filter string) (bson.D, error) {
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(filter), false, &doc); err != nil {
+		return nil, errors.Wrap(err, "could not parse the filter")
+	}
+
+	return doc, nil
+}
+
+// mergeCommentFilter will return the filter that matches the comments matching
+// both the filter and the CommentFilter. The filters are combined with $and so
+// the CommentFilter can't replace any of the conditions of the filter, such as
+// the tenantID or siteID.
+func (p *Processor) mergeCommentFilter(filter bson.D) bson.D {
+	if len(p.CommentFilter) == 0 {
+		return filter
+	}
+
+	return bson.D{
+		primitive.E{Key: "$and", Value: bson.A{filter, p.CommentFilter}},
+	}
+}
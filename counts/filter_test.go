@@ -0,0 +1,123 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestParseFilter(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b2c3d4e5f6a7b8c9d0e1f")
+
+	tests := []struct {
+		name    string
+		filter  string
+		want    bson.D
+		wantErr bool
+	}{
+		{
+			name:   "string",
+			filter: `{"importBatchID": "2021-01"}`,
+			want:   bson.D{primitive.E{Key: "importBatchID", Value: "2021-01"}},
+		},
+		{
+			name:   "date",
+			filter: `{"createdAt": {"$gte": {"$date": "2021-01-01T00:00:00Z"}}}`,
+			want: bson.D{primitive.E{Key: "createdAt", Value: bson.D{
+				primitive.E{Key: "$gte", Value: primitive.NewDateTimeFromTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+			}}},
+		},
+		{
+			name:   "object id",
+			filter: `{"_id": {"$oid": "5f1b2c3d4e5f6a7b8c9d0e1f"}}`,
+			want:   bson.D{primitive.E{Key: "_id", Value: oid}},
+		},
+		{
+			name:    "invalid",
+			filter:  `{"importBatchID": `,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilter(tt.filter)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseFilter(%q) expected an error", tt.filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFilter(%q) unexpected error: %v", tt.filter, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindCommentsFilter(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	commentFilter := bson.D{primitive.E{Key: "importBatchID", Value: "2021-01"}}
+
+	tests := []struct {
+		name          string
+		commentFilter bson.D
+		wantAnd       bool
+	}{
+		{"without a comment filter", nil, false},
+		{"with a comment filter", commentFilter, true},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch))
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.CommentFilter = tt.commentFilter
+
+			if err := p.findComments(context.Background(), bson.D{
+				primitive.E{Key: "tenantID", Value: "tenant"},
+				primitive.E{Key: "siteID", Value: "site"},
+			}, nil, func(string, *mongo.Cursor) error { return nil }); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+
+			and, err := filter.LookupErr("$and")
+			if tt.wantAnd != (err == nil) {
+				mt.Fatalf("expected $and %v, got filter %s", tt.wantAnd, filter)
+			}
+			if !tt.wantAnd {
+				if tenantID := filter.Lookup("tenantID").StringValue(); tenantID != "tenant" {
+					mt.Errorf("expected the tenantID to be filtered, got %s", filter)
+				}
+				return
+			}
+
+			// The site's conditions are kept alongside the comment filter.
+			values, _ := and.Array().Values()
+			if len(values) != 2 {
+				mt.Fatalf("expected 2 conditions, got %d", len(values))
+			}
+			if siteID := values[0].Document().Lookup("siteID").StringValue(); siteID != "site" {
+				mt.Errorf("expected the siteID to be kept, got %s", values[0])
+			}
+			if batch := values[1].Document().Lookup("importBatchID").StringValue(); batch != "2021-01" {
+				mt.Errorf("expected the comment filter, got %s", values[1])
+			}
+		})
+	}
+}
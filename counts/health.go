@@ -0,0 +1,84 @@
+package counts
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxCreatedAtSamples is the most ID's of comments with an implausible createdAt
+// that are kept as samples.
+const maxCreatedAtSamples = 10
+
+// CreatedAtHealth counts the comments whose createdAt is implausible, with a
+// sample of their ID's.
+type CreatedAtHealth struct {
+	// Zero is the number of comments without a createdAt.
+	Zero int
+
+	// Future is the number of comments created after they were counted.
+	Future int
+
+	// Early is the number of comments created before the EarliestCreatedAt.
+	Early int
+
+	// Samples are the ID's of some of the comments with an implausible
+	// createdAt.
+	Samples []string
+}
+
+// Check will count the comment when its createdAt is implausible, including
+// when it's before the earliest.
+func (h *CreatedAtHealth) Check(comment *Comment, earliest time.Time) {
+	switch {
+	case comment.CreatedAt.IsZero():
+		h.Zero++
+	case comment.CreatedAt.After(time.Now()):
+		h.Future++
+	case comment.CreatedAt.Before(earliest):
+		h.Early++
+	default:
+		return
+	}
+
+	h.sample(comment.ID)
+}
+
+// Merge will add the comments counted by other to these.
+func (h *CreatedAtHealth) Merge(other *CreatedAtHealth) {
+	h.Zero += other.Zero
+	h.Future += other.Future
+	h.Early += other.Early
+
+	for _, id := range other.Samples {
+		h.sample(id)
+	}
+}
+
+// Total returns the number of comments with an implausible createdAt.
+func (h *CreatedAtHealth) Total() int {
+	return h.Zero + h.Future + h.Early
+}
+
+// sample will keep the comment's ID as a sample if there's still room for it.
+func (h *CreatedAtHealth) sample(id string) {
+	if len(h.Samples) < maxCreatedAtSamples {
+		h.Samples = append(h.Samples, id)
+	}
+}
+
+// logCreatedAtHealth will warn about the comments with an implausible createdAt
+// when there are any.
+func logCreatedAtHealth(h *CreatedAtHealth, earliest time.Time) {
+	if h.Total() == 0 {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"zero":              h.Zero,
+		"future":            h.Future,
+		"early":             h.Early,
+		"earliestCreatedAt": earliest,
+		"samples":           h.Samples,
+	}).Warn("comments have an implausible createdAt, they may have been imported with the wrong timestamps")
+}
@@ -0,0 +1,105 @@
+package counts
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCreatedAtHealthCheck(t *testing.T) {
+	earliest := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		createdAt   time.Time
+		wantZero    int
+		wantFuture  int
+		wantEarly   int
+		wantSampled bool
+	}{
+		{"zero", time.Time{}, 1, 0, 0, true},
+		{"epoch", time.Unix(0, 0), 0, 0, 1, true},
+		{"future", time.Now().Add(time.Hour), 0, 1, 0, true},
+		{"just before the earliest", earliest.Add(-time.Second), 0, 0, 1, true},
+		{"at the earliest", earliest, 0, 0, 0, false},
+		{"normal", time.Now().Add(-time.Hour), 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h CreatedAtHealth
+			h.Check(&Comment{ID: "comment", CreatedAt: tt.createdAt}, earliest)
+
+			if h.Zero != tt.wantZero || h.Future != tt.wantFuture || h.Early != tt.wantEarly {
+				t.Errorf("expected zero %d, future %d and early %d, got %d, %d and %d", tt.wantZero, tt.wantFuture, tt.wantEarly, h.Zero, h.Future, h.Early)
+			}
+
+			if sampled := len(h.Samples) == 1; sampled != tt.wantSampled {
+				t.Errorf("expected sampled %v, got samples %v", tt.wantSampled, h.Samples)
+			}
+		})
+	}
+}
+
+func TestCreatedAtHealthMerge(t *testing.T) {
+	var site CreatedAtHealth
+	for i := 0; i < 3; i++ {
+		var story CreatedAtHealth
+		for j := 0; j < 4; j++ {
+			story.Check(&Comment{ID: fmt.Sprintf("%d-%d", i, j)}, time.Time{})
+		}
+
+		site.Merge(&story)
+	}
+
+	if site.Total() != 12 || site.Zero != 12 {
+		t.Errorf("expected 12 zero comments, got %d of %d", site.Zero, site.Total())
+	}
+
+	// The samples are capped, keeping the first that were found.
+	if len(site.Samples) != maxCreatedAtSamples {
+		t.Fatalf("expected %d samples, got %d", maxCreatedAtSamples, len(site.Samples))
+	}
+	if site.Samples[0] != "0-0" || site.Samples[maxCreatedAtSamples-1] != "2-1" {
+		t.Errorf("expected the first samples to be kept, got %v", site.Samples)
+	}
+}
+
+func TestStoryIncrementCreatedAt(t *testing.T) {
+	comments := []Comment{
+		{ID: "zero", Status: "APPROVED"},
+		{ID: "future", Status: "APPROVED", CreatedAt: time.Now().Add(24 * time.Hour)},
+		{ID: "normal", Status: "APPROVED", CreatedAt: time.Now().Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		name           string
+		checkCreatedAt bool
+		want           CreatedAtHealth
+	}{
+		{"disabled", false, CreatedAtHealth{}},
+		{"enabled", true, CreatedAtHealth{Zero: 1, Future: 1, Samples: []string{"zero", "future"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CheckCreatedAt = tt.checkCreatedAt
+
+			story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+			for i := range comments {
+				story.Increment(&comments[i], &rules)
+			}
+
+			if !reflect.DeepEqual(story.CreatedAt, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, story.CreatedAt)
+			}
+
+			// The createdAt doesn't change what's counted.
+			if story.CommentCounts.Status.Approved != len(comments) {
+				t.Errorf("expected %d approved, got %d", len(comments), story.CommentCounts.Status.Approved)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HistoryCollection is the collection that the snapshots of the site's counts
+// are recorded in.
+const HistoryCollection = "site_count_history"
+
+// historyDateLayout is the layout of the date that snapshots are recorded for.
+const historyDateLayout = "2006-01-02"
+
+// SiteCountSnapshot is the counts of a site on a day. There's only one snapshot
+// for each day, which is replaced by each run on that day.
+type SiteCountSnapshot struct {
+	TenantID      string             `bson:"tenantID"`
+	SiteID        string             `bson:"siteID"`
+	Date          string             `bson:"date"`
+	CommentCounts StoryCommentCounts `bson:"commentCounts"`
+	RunID         string             `bson:"runID"`
+	UpdatedAt     time.Time          `bson:"updatedAt"`
+}
+
+// recordHistory will record the site's counts as the snapshot for the current
+// day in UTC, replacing any snapshot already recorded for the day.
+func (p *Processor) recordHistory(ctx context.Context, counts *StoryCommentCounts) error {
+	now := time.Now().UTC()
+	date := now.Format(historyDateLayout)
+
+	if p.DryRun {
+		logrus.WithField("date", date).Info("not recording site count history as --dryRun is enabled")
+		return nil
+	}
+
+	collection := p.outputCollection(HistoryCollection)
+
+	// The unique index ensures that reruns on the same day replace the snapshot
+	// even when they race.
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			primitive.E{Key: "tenantID", Value: 1},
+			primitive.E{Key: "siteID", Value: 1},
+			primitive.E{Key: "date", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return errors.Wrap(err, "could not create the site count history index")
+	}
+
+	if _, err := collection.ReplaceOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: "date", Value: date},
+	}, SiteCountSnapshot{
+		TenantID:      p.TenantID,
+		SiteID:        p.SiteID,
+		Date:          date,
+		CommentCounts: *counts,
+		RunID:         p.RunID,
+		UpdatedAt:     now,
+	}, options.Replace().SetUpsert(true)); err != nil {
+		return errors.Wrap(err, "could not record the site count history")
+	}
+
+	logrus.WithField("date", date).Info("recorded site count history")
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRecordHistory(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name         string
+		dryRun       bool
+		responses    []bson.D
+		wantCommands []string
+		wantErr      bool
+	}{
+		{
+			name:   "dry run",
+			dryRun: true,
+		},
+		{
+			name:         "recorded",
+			responses:    []bson.D{mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse()},
+			wantCommands: []string{"createIndexes", "update"},
+		},
+		{
+			name: "index not created",
+			responses: []bson.D{mtest.CreateCommandErrorResponse(mtest.CommandError{
+				Code:    13,
+				Message: "not authorized",
+			})},
+			wantCommands: []string{"createIndexes"},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", "site", tt.dryRun, DefaultRules())
+			p.RunID = "run"
+
+			counts := StoryCommentCounts{Status: CommentStatusCounts{Approved: 2}}
+
+			err := p.recordHistory(context.Background(), &counts)
+			if (err != nil) != tt.wantErr {
+				mt.Fatalf("recordHistory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var commands []string
+			for _, event := range mt.GetAllStartedEvents() {
+				commands = append(commands, event.CommandName)
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				mt.Fatalf("expected the commands %v, got %v", tt.wantCommands, commands)
+			}
+
+			if tt.wantErr || len(commands) == 0 {
+				return
+			}
+
+			// The snapshot replaces any from the same day.
+			update := mt.GetAllStartedEvents()[1].Command
+			date, _ := update.Lookup("updates", "0", "q", "date").StringValueOK()
+			if want := time.Now().UTC().Format(historyDateLayout); date != want {
+				mt.Errorf("expected the snapshot for %s, got %s", want, date)
+			}
+			if upsert, _ := update.Lookup("updates", "0", "upsert").BooleanOK(); !upsert {
+				mt.Errorf("expected the snapshot to be upserted")
+			}
+
+			var snapshot SiteCountSnapshot
+			if err := update.Lookup("updates", "0", "u").Unmarshal(&snapshot); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+			if snapshot.RunID != "run" || snapshot.CommentCounts.Status.Approved != 2 {
+				mt.Errorf("expected the snapshot of run with 2 approved, got %+v", snapshot)
+			}
+		})
+	}
+}
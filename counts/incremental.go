@@ -0,0 +1,334 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StateCollection is the collection that the high-water marks used by
+// incremental processing are stored in.
+const StateCollection = "coral_counts_state"
+
+// HighWaterMark is how far the comments on a site have been counted.
+type HighWaterMark struct {
+	// CreatedAt is the createdAt time of the newest comment that has been
+	// counted for the site.
+	CreatedAt time.Time `bson:"highWaterMark"`
+
+	// CommentIDs are the comments created at the CreatedAt that have been
+	// counted. Comments can share a createdAt time, so the next run counts the
+	// comments created at the CreatedAt too, skipping these ones.
+	CommentIDs []string `bson:"highWaterMarkIDs,omitempty"`
+}
+
+// counted returns true if the comment has already been counted.
+func (m *HighWaterMark) counted(comment *Comment) bool {
+	if comment.CreatedAt.Before(m.CreatedAt) {
+		return true
+	}
+
+	if comment.CreatedAt.Equal(m.CreatedAt) {
+		for _, id := range m.CommentIDs {
+			if id == comment.ID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// advance will move the mark up to the comment when it's the newest comment
+// that has been counted.
+func (m *HighWaterMark) advance(comment *Comment) {
+	switch {
+	case comment.CreatedAt.After(m.CreatedAt):
+		m.CreatedAt = comment.CreatedAt
+		m.CommentIDs = []string{comment.ID}
+	case comment.CreatedAt.Equal(m.CreatedAt):
+		m.CommentIDs = append(m.CommentIDs, comment.ID)
+	}
+}
+
+// State is the incremental processing state for a site.
+type State struct {
+	TenantID string `bson:"tenantID"`
+	SiteID   string `bson:"siteID"`
+
+	HighWaterMark `bson:",inline"`
+	UpdatedAt     time.Time `bson:"updatedAt"`
+}
+
+// LoadHighWaterMark will load the high-water mark for the site. If the site has
+// not been processed before, nil is returned.
+func LoadHighWaterMark(ctx context.Context, db *mongo.Database, tenantID, siteID string) (*HighWaterMark, error) {
+	var state State
+	if err := db.Collection(StateCollection).FindOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "siteID", Value: siteID},
+	}).Decode(&state); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "could not load the high-water mark")
+	}
+
+	return &state.HighWaterMark, nil
+}
+
+// saveHighWaterMark will store the high-water mark for the site.
+func saveHighWaterMark(ctx context.Context, db *mongo.Database, tenantID, siteID string, mark *HighWaterMark) error {
+	if _, err := db.Collection(StateCollection).UpdateOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "siteID", Value: siteID},
+	}, bson.D{
+		primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "highWaterMark", Value: mark.CreatedAt},
+			primitive.E{Key: "highWaterMarkIDs", Value: mark.CommentIDs},
+			primitive.E{Key: "updatedAt", Value: time.Now()},
+		}},
+	}, options.Update().SetUpsert(true)); err != nil {
+		return errors.Wrap(err, "could not save the high-water mark")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"highWaterMark": mark.CreatedAt,
+		"comments":      len(mark.CommentIDs),
+	}).Info("saved high-water mark")
+
+	return nil
+}
+
+// LatestHighWaterMark will find the newest comments on the site across each of
+// the comments collections, returning nil when the site has no comments. It's
+// found before all of the site's comments are counted and saved with
+// SaveHighWaterMark once they have been, so every comment created after the
+// mark was found is left for the next incremental run.
+func (p *Processor) LatestHighWaterMark(ctx context.Context) (*HighWaterMark, error) {
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	site := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+	}
+
+	// Find the newest createdAt time in each of the collections.
+	var mark *HighWaterMark
+	for _, collection := range collections {
+		raw, err := collection.FindOne(ctx, site, options.FindOne().SetSort(bson.D{
+			primitive.E{Key: p.Rules.Fields.CreatedAt, Value: -1},
+		}).SetProjection(commentProjection(p.Rules.Fields.CreatedAt))).DecodeBytes()
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue
+			}
+
+			return nil, errors.Wrapf(err, "could not find the newest comment in %s", collection.Name())
+		}
+
+		var comment Comment
+		if err := p.Rules.Fields.Decode(raw, &comment); err != nil {
+			return nil, errors.Wrap(err, "could not decode the newest comment")
+		}
+
+		if mark == nil || comment.CreatedAt.After(mark.CreatedAt) {
+			mark = &HighWaterMark{CreatedAt: comment.CreatedAt}
+		}
+	}
+
+	if mark == nil {
+		return nil, nil
+	}
+
+	// Find every comment created at that time, as they will have been counted.
+	filter := append(site, primitive.E{Key: p.Rules.Fields.CreatedAt, Value: mark.CreatedAt})
+	for _, collection := range collections {
+		if err := func() error {
+			cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(commentProjection(p.Rules.Fields.ID)))
+			if err != nil {
+				return errors.Wrapf(err, "could not find the newest comments in %s", collection.Name())
+			}
+			defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+			for cursor.Next(ctx) {
+				var comment Comment
+				if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+					return errors.Wrap(err, "could not decode the newest comment")
+				}
+
+				mark.CommentIDs = append(mark.CommentIDs, comment.ID)
+			}
+
+			return errors.Wrap(cursor.Err(), "could not iterate on cursor")
+		}(); err != nil {
+			return nil, err
+		}
+	}
+
+	return mark, nil
+}
+
+// SaveHighWaterMark will store the mark found with LatestHighWaterMark as the
+// site's high-water mark once all of the site's comments have been counted, so
+// future runs can process incrementally.
+func (p *Processor) SaveHighWaterMark(ctx context.Context, mark *HighWaterMark) error {
+	if mark == nil {
+		logrus.Info("site has no comments, not saving high-water mark")
+		return nil
+	}
+
+	if p.DryRun {
+		logrus.WithField("highWaterMark", mark.CreatedAt).Info("not saving high-water mark as --dryRun is enabled")
+		return nil
+	}
+
+	return saveHighWaterMark(ctx, p.DB, p.TenantID, p.SiteID, mark)
+}
+
+// ProcessIncremental will count the comments that have been created since the
+// high-water mark and add their counts to the stored story and site counts
+// using $inc, and then advance the high-water mark.
+func ProcessIncremental(ctx context.Context, db *mongo.Database, tenantID, siteID string, since HighWaterMark, dryRun bool) error {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).Incremental(ctx, since)
+}
+
+// Incremental will count the comments that have been created since the
+// high-water mark and add their counts to the stored story and site counts
+// using $inc, and then advance the high-water mark. The comments created at the
+// mark are counted too, unless they were counted when the mark was saved.
+//
+// This only accounts for new comments. Changes to the status or actions of
+// comments that were already counted are not reflected, so a full run is still
+// required periodically to correct any drift.
+func (p *Processor) Incremental(ctx context.Context, since HighWaterMark) error {
+	// Create the filter that will limit the documents processed to the ones that
+	// were created at or after the high-water mark.
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: p.Rules.Fields.CreatedAt, Value: bson.D{
+			primitive.E{Key: "$gte", Value: since.CreatedAt},
+		}},
+	}
+
+	// Configure the projection to only get fields we care about, the ID and
+	// createdAt are always needed to advance the high-water mark.
+	projection := commentProjection(append(p.Rules.storyFields(), p.Rules.Fields.ID, p.Rules.Fields.CreatedAt)...)
+
+	// Count the new comments on their stories.
+	aggregator := NewAggregator(&p.Rules)
+
+	// Track the newest comments that we've seen, which will be the next
+	// high-water mark.
+	mark := HighWaterMark{
+		CreatedAt:  since.CreatedAt,
+		CommentIDs: append([]string(nil), since.CommentIDs...),
+	}
+
+	started := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"siteID":        p.SiteID,
+		"highWaterMark": since.CreatedAt,
+	}).Info("loading stories from new comments")
+
+	// Start querying each of the comments collections.
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		// While there is still results to handle, decode the results.
+		for p.nextTimed(ctx, cursor, collection) {
+			var comment Comment
+			if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+				return errors.Wrap(err, "could not decode result")
+			}
+
+			// Skip the comments created at the mark that were already counted.
+			if since.counted(&comment) {
+				continue
+			}
+
+			aggregator.Add(&comment)
+			mark.advance(&comment)
+		}
+
+		if err := cursor.Err(); err != nil {
+			return errors.Wrap(err, "could not iterate on cursor")
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	stories := aggregator.Stories()
+
+	logrus.WithFields(logrus.Fields{
+		"stories": len(stories),
+		"took":    time.Since(started),
+	}).Info("loaded stories from new comments")
+
+	if len(stories) == 0 {
+		logrus.Info("no new comments were found")
+		return nil
+	}
+
+	// Sum up the change to the site.
+	site := StoryCommentCounts{
+		Action: make(map[string]int),
+	}
+
+	writer := p.newBatchWriter("stories", "story")
+
+	res, err := writer.write(ctx, func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+		for storyID, story := range stories {
+			inc, err := incDocument("commentCounts", &story.CommentCounts)
+			if err != nil {
+				return errors.Wrap(err, "could not create the story update")
+			}
+
+			// Comments with excluded statuses won't have changed any counts.
+			if len(inc) == 0 {
+				continue
+			}
+
+			site.Merge(&story.CommentCounts)
+
+			if err := emit(storyID, p.newStoryUpdate(storyID, p.incUpdate(inc))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not write story updates")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"failed":   res.Failed,
+	}).Info("finished writing story updates")
+
+	// Add the new comments to the site.
+	if err := p.SiteDelta(ctx, &site); err != nil {
+		return errors.Wrap(err, "could not process site")
+	}
+
+	if p.DryRun {
+		logrus.WithField("highWaterMark", mark.CreatedAt).Info("not saving high-water mark as --dryRun is enabled")
+		return nil
+	}
+
+	return saveHighWaterMark(ctx, p.DB, p.TenantID, p.SiteID, &mark)
+}
@@ -0,0 +1,165 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestLatestHighWaterMark(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newest := older.Add(time.Hour)
+
+	comment := func(id string, createdAt time.Time) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "createdAt", Value: createdAt},
+		}
+	}
+
+	mt.Run("across collections", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// The newest comment in each collection.
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1", older)),
+			mtest.CreateCursorResponse(0, "coral.comments_archive", mtest.FirstBatch, comment("a1", newest)),
+			// The comments created at the newest time in each collection.
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, "coral.comments_archive", mtest.FirstBatch, comment("a1", newest), comment("a2", newest)),
+		)
+
+		p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+		p.CommentsCollections = []string{"comments", "comments_archive"}
+
+		mark, err := p.LatestHighWaterMark(context.Background())
+		if err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+
+		if mark == nil || !mark.CreatedAt.Equal(newest) {
+			mt.Fatalf("expected the mark at %s, got %v", newest, mark)
+		}
+		if want := []string{"a1", "a2"}; !reflect.DeepEqual(mark.CommentIDs, want) {
+			mt.Errorf("expected the comments %v at the mark, got %v", want, mark.CommentIDs)
+		}
+	})
+
+	mt.Run("no comments", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch))
+
+		p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+
+		mark, err := p.LatestHighWaterMark(context.Background())
+		if err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+		if mark != nil {
+			mt.Errorf("expected no mark, got %v", mark)
+		}
+	})
+}
+
+func TestHighWaterMarkTies(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mark := HighWaterMark{CreatedAt: at, CommentIDs: []string{"c1"}}
+
+	tests := []struct {
+		name        string
+		comment     Comment
+		wantCounted bool
+		wantMark    HighWaterMark
+	}{
+		{
+			name:        "counted at the mark",
+			comment:     Comment{ID: "c1", CreatedAt: at},
+			wantCounted: true,
+			wantMark:    HighWaterMark{CreatedAt: at, CommentIDs: []string{"c1"}},
+		},
+		{
+			name:     "created at the mark",
+			comment:  Comment{ID: "c2", CreatedAt: at},
+			wantMark: HighWaterMark{CreatedAt: at, CommentIDs: []string{"c1", "c2"}},
+		},
+		{
+			name:     "created after the mark",
+			comment:  Comment{ID: "c3", CreatedAt: at.Add(time.Millisecond)},
+			wantMark: HighWaterMark{CreatedAt: at.Add(time.Millisecond), CommentIDs: []string{"c3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if counted := mark.counted(&tt.comment); counted != tt.wantCounted {
+				t.Fatalf("counted() = %v, want %v", counted, tt.wantCounted)
+			}
+			if tt.wantCounted {
+				return
+			}
+
+			next := HighWaterMark{CreatedAt: mark.CreatedAt, CommentIDs: append([]string(nil), mark.CommentIDs...)}
+			next.advance(&tt.comment)
+
+			if !reflect.DeepEqual(next, tt.wantMark) {
+				t.Errorf("expected the mark %v, got %v", tt.wantMark, next)
+			}
+		})
+	}
+}
+
+func TestIncrementalTies(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	comment := func(id string) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "storyID", Value: "story"},
+			primitive.E{Key: "status", Value: "APPROVED"},
+			primitive.E{Key: "createdAt", Value: at},
+		}
+	}
+
+	mt.Run("counted at the mark", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1"), comment("c2")),
+			updated(1),
+			updated(1),
+			updated(1),
+		)
+
+		p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+		if err := p.Incremental(context.Background(), HighWaterMark{CreatedAt: at, CommentIDs: []string{"c1"}}); err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+
+		events := mt.GetAllStartedEvents()
+
+		// The comments created at the mark are found, not only the newer ones.
+		if got := events[0].Command.Lookup("filter", "createdAt", "$gte").Time(); !got.Equal(at) {
+			mt.Errorf("expected the comments created from %s to be found, got %s", at, got)
+		}
+
+		// Only the comment that wasn't counted at the mark is added to the story.
+		story := events[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		if approved := story.Lookup("u", "$inc", "commentCounts.status.APPROVED").Int64(); approved != 1 {
+			mt.Errorf("expected 1 approved comment to be added, got %d", approved)
+		}
+
+		// Both comments at the mark are saved with it.
+		state := lastUpdate(mt)
+		ids, _ := state.Lookup("u", "$set", "highWaterMarkIDs").Array().Values()
+		if len(ids) != 2 || ids[0].StringValue() != "c1" || ids[1].StringValue() != "c2" {
+			mt.Errorf("expected c1 and c2 to be saved with the mark, got %v", ids)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package counts
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher is a Publisher that produces each event as a JSON message to a
+// Kafka topic. Messages are keyed by the type and ID of the story or user, so
+// the events for each are kept in order on the same partition.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher will create a Publisher that produces events to the topic
+// on the brokers.
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (k *KafkaPublisher) Publish(ctx context.Context, events []CountEvent) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrap(err, "could not encode the event")
+		}
+
+		messages = append(messages, kafka.Message{
+			Key:   []byte(event.Type + ":" + event.ID),
+			Value: value,
+		})
+	}
+
+	if err := k.writer.WriteMessages(ctx, messages...); err != nil {
+		return errors.Wrap(err, "could not write messages to kafka")
+	}
+
+	return nil
+}
+
+// Close will flush any pending messages and close the connections to the
+// brokers.
+func (k *KafkaPublisher) Close() error {
+	return k.writer.Close()
+}
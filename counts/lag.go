@@ -0,0 +1,182 @@
+package counts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// LagSource returns the current replication lag.
+type LagSource func(ctx context.Context) (time.Duration, error)
+
+// ReplicationLag returns a LagSource that reads the replication lag from the
+// replSetGetStatus command, which is the difference between the optime of the
+// primary and the optime of the secondary that is furthest behind. The command
+// needs the clusterMonitor role.
+func ReplicationLag(client *mongo.Client) LagSource {
+	return func(ctx context.Context) (time.Duration, error) {
+		var status struct {
+			Members []struct {
+				StateStr   string    `bson:"stateStr"`
+				OptimeDate time.Time `bson:"optimeDate"`
+			} `bson:"members"`
+		}
+		if err := client.Database("admin").RunCommand(ctx, bson.D{
+			primitive.E{Key: "replSetGetStatus", Value: 1},
+		}).Decode(&status); err != nil {
+			return 0, errors.Wrap(err, "could not get the replica set status")
+		}
+
+		var (
+			primary time.Time
+			oldest  time.Time
+		)
+		for _, member := range status.Members {
+			switch member.StateStr {
+			case "PRIMARY":
+				primary = member.OptimeDate
+			case "SECONDARY":
+				if oldest.IsZero() || member.OptimeDate.Before(oldest) {
+					oldest = member.OptimeDate
+				}
+			}
+		}
+
+		if primary.IsZero() || oldest.IsZero() || oldest.After(primary) {
+			return 0, nil
+		}
+
+		return primary.Sub(oldest), nil
+	}
+}
+
+// LagMonitor periodically checks the replication lag, and pauses writers that
+// Wait on it while the lag is more than the max.
+type LagMonitor struct {
+	// Metrics is the Recorder that the lag, and how long the writes were paused
+	// for, are recorded with.
+	Metrics Recorder
+
+	source   LagSource
+	max      time.Duration
+	interval time.Duration
+
+	// resumed is closed while the writers aren't paused, and replaced with an
+	// open channel when they're paused. pausedAt is when they were paused.
+	resumed  chan struct{}
+	pausedAt time.Time
+	mux      sync.Mutex
+}
+
+// NewLagMonitor will create a monitor that checks the lag from the source every
+// interval, pausing writes while it's more than max.
+func NewLagMonitor(source LagSource, max, interval time.Duration) *LagMonitor {
+	resumed := make(chan struct{})
+	close(resumed)
+
+	return &LagMonitor{
+		Metrics:  noopRecorder{},
+		source:   source,
+		max:      max,
+		interval: interval,
+		resumed:  resumed,
+	}
+}
+
+// Run will check the lag every interval until the context is canceled. When the
+// lag can't be checked, writes are left as they are.
+func (m *LagMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			m.resume()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check will check the lag once, and pause or resume the writes.
+func (m *LagMonitor) check(ctx context.Context) {
+	lag, err := m.source(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.WithError(err).Warn("could not check the replication lag")
+		}
+
+		return
+	}
+
+	m.Metrics.Timing("replication_lag", lag)
+
+	if lag > m.max {
+		m.pause(lag)
+	} else {
+		m.resume()
+	}
+}
+
+func (m *LagMonitor) pause(lag time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	select {
+	case <-m.resumed:
+	default:
+		// Already paused.
+		return
+	}
+
+	m.resumed = make(chan struct{})
+	m.pausedAt = time.Now()
+
+	logrus.WithFields(logrus.Fields{
+		"lag": lag,
+		"max": m.max,
+	}).Warn("pausing writes as the replication lag is too high")
+}
+
+func (m *LagMonitor) resume() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	select {
+	case <-m.resumed:
+		// Not paused.
+		return
+	default:
+	}
+
+	close(m.resumed)
+
+	paused := time.Since(m.pausedAt)
+	m.Metrics.Timing("replication_lag_paused", paused)
+
+	logrus.WithField("paused", paused).Info("resuming writes as the replication lag has recovered")
+}
+
+// Wait will block while the writes are paused, or until the context is
+// canceled.
+func (m *LagMonitor) Wait(ctx context.Context) error {
+	m.mux.Lock()
+	resumed := m.resumed
+	m.mux.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,156 @@
+package counts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestReplicationLag(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	member := func(state string, behind time.Duration) bson.D {
+		return bson.D{
+			primitive.E{Key: "stateStr", Value: state},
+			primitive.E{Key: "optimeDate", Value: now.Add(-behind)},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		members bson.A
+		want    time.Duration
+	}{
+		{
+			name:    "furthest secondary",
+			members: bson.A{member("PRIMARY", 0), member("SECONDARY", time.Second), member("SECONDARY", 5*time.Second)},
+			want:    5 * time.Second,
+		},
+		{
+			name:    "ignores arbiters",
+			members: bson.A{member("PRIMARY", 0), member("SECONDARY", time.Second), member("ARBITER", time.Hour)},
+			want:    time.Second,
+		},
+		{
+			name:    "no secondaries",
+			members: bson.A{member("PRIMARY", 0)},
+		},
+		{
+			name:    "no primary",
+			members: bson.A{member("SECONDARY", time.Second)},
+		},
+		{
+			name:    "secondary ahead of the primary",
+			members: bson.A{member("PRIMARY", time.Second), member("SECONDARY", 0)},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(primitive.E{Key: "members", Value: tt.members}))
+
+			lag, err := ReplicationLag(mt.Client)(context.Background())
+			if err != nil {
+				mt.Fatalf("expected no error, got %v", err)
+			}
+
+			if lag != tt.want {
+				mt.Errorf("expected lag %s, got %s", tt.want, lag)
+			}
+		})
+	}
+
+	mt.Run("command failed", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+			Code:    13,
+			Message: "not authorized",
+		}))
+
+		if _, err := ReplicationLag(mt.Client)(context.Background()); err == nil {
+			mt.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestLagMonitorCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		lags       []time.Duration
+		err        error
+		wantPaused bool
+	}{
+		{"under the max", []time.Duration{time.Second}, nil, false},
+		{"at the max", []time.Duration{10 * time.Second}, nil, false},
+		{"over the max", []time.Duration{11 * time.Second}, nil, true},
+		{"stays paused", []time.Duration{time.Minute, time.Minute}, nil, true},
+		{"recovered", []time.Duration{time.Minute, time.Second}, nil, false},
+		{"paused again", []time.Duration{time.Minute, time.Second, time.Minute}, nil, true},
+		{"unknown lag leaves writes paused", []time.Duration{time.Minute, 0}, errors.New("failed"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checks int
+			m := NewLagMonitor(func(ctx context.Context) (time.Duration, error) {
+				lag := tt.lags[checks]
+				checks++
+
+				// The error is only returned from the last check.
+				if checks == len(tt.lags) {
+					return lag, tt.err
+				}
+
+				return lag, nil
+			}, 10*time.Second, time.Second)
+
+			for range tt.lags {
+				m.check(context.Background())
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err := m.Wait(ctx)
+			if paused := err != nil; paused != tt.wantPaused {
+				t.Errorf("expected paused %v, got %v", tt.wantPaused, paused)
+			}
+		})
+	}
+}
+
+func TestLagMonitorRunResumesWhenCanceled(t *testing.T) {
+	m := NewLagMonitor(func(ctx context.Context) (time.Duration, error) {
+		return time.Hour, nil
+	}, time.Second, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	// Wait for the first check to pause the writes.
+	for {
+		check, stop := context.WithTimeout(context.Background(), time.Millisecond)
+		err := m.Wait(check)
+		stop()
+		if err != nil {
+			break
+		}
+	}
+
+	cancel()
+	<-done
+
+	if err := m.Wait(context.Background()); err != nil {
+		t.Fatalf("expected the writes to be resumed, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package counts
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// storedCountsDocument is a story or site with its stored counts left undecoded,
+// so their shape can be checked before they're read.
+type storedCountsDocument struct {
+	ID            string   `bson:"id"`
+	CommentCounts bson.Raw `bson:"commentCounts"`
+}
+
+// errUnknownCountsShape is returned when stored counts are in a shape that
+// can't be read.
+var errUnknownCountsShape = errors.New("stored counts are in an unknown shape")
+
+// decodeStoredCounts will decode stored counts. Older documents stored the
+// status counts at the top level of the commentCounts (such as
+// commentCounts.APPROVED) rather than under commentCounts.status, which would
+// otherwise be read as zeros, so those are read into the Status and legacy is
+// returned as true. Counts in a shape that isn't recognized at all return
+// errUnknownCountsShape.
+func decodeStoredCounts(raw bson.Raw) (counts StoryCommentCounts, legacy bool, err error) {
+	counts.Action = make(map[string]int)
+
+	if len(raw) == 0 {
+		return counts, false, nil
+	}
+
+	elements, err := raw.Elements()
+	if err != nil {
+		return counts, false, errors.Wrap(err, "could not read the stored counts")
+	}
+
+	if len(elements) == 0 {
+		return counts, false, nil
+	}
+
+	// Any of the other counts are still where they're expected.
+	if err := bson.Unmarshal(raw, &counts); err != nil {
+		return counts, false, errors.Wrap(err, "could not decode the stored counts")
+	}
+	if counts.Action == nil {
+		counts.Action = make(map[string]int)
+	}
+
+	if _, err := raw.LookupErr("status"); err == nil {
+		return counts, false, nil
+	}
+
+	keys := make([]string, 0, len(elements))
+	for _, element := range elements {
+		key := element.Key()
+		keys = append(keys, key)
+
+		if !knownStatus(key) {
+			continue
+		}
+
+		value, ok := element.Value().AsInt64OK()
+		if !ok {
+			return counts, false, errors.Wrapf(errUnknownCountsShape, "the %s count is a %s", key, element.Value().Type)
+		}
+
+		legacy = true
+		switch key {
+		case "APPROVED":
+			counts.Status.Approved = int(value)
+		case "NONE":
+			counts.Status.None = int(value)
+		case "PREMOD":
+			counts.Status.Premod = int(value)
+		case "REJECTED":
+			counts.Status.Rejected = int(value)
+		case "SYSTEM_WITHHELD":
+			counts.Status.SystemWithheld = int(value)
+		}
+	}
+
+	if !legacy {
+		return counts, false, errors.Wrapf(errUnknownCountsShape, "found the keys %s", strings.Join(keys, ", "))
+	}
+
+	return counts, true, nil
+}
@@ -0,0 +1,108 @@
+package counts
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeStoredCounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		counts      interface{}
+		wantLegacy  bool
+		wantUnknown bool
+		wantStatus  CommentStatusCounts
+		wantTotal   int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "empty document",
+			counts: bson.D{},
+		},
+		{
+			name: "current shape",
+			counts: bson.D{
+				primitive.E{Key: "status", Value: bson.D{
+					primitive.E{Key: "APPROVED", Value: int32(2)},
+					primitive.E{Key: "NONE", Value: int32(1)},
+				}},
+				primitive.E{Key: "moderationQueue", Value: bson.D{
+					primitive.E{Key: "total", Value: int32(1)},
+				}},
+			},
+			wantStatus: CommentStatusCounts{Approved: 2, None: 1},
+			wantTotal:  1,
+		},
+		{
+			name: "legacy shape",
+			counts: bson.D{
+				primitive.E{Key: "APPROVED", Value: int32(3)},
+				primitive.E{Key: "REJECTED", Value: int64(2)},
+				primitive.E{Key: "SYSTEM_WITHHELD", Value: int32(1)},
+				primitive.E{Key: "moderationQueue", Value: bson.D{
+					primitive.E{Key: "total", Value: int32(1)},
+				}},
+			},
+			wantLegacy: true,
+			wantStatus: CommentStatusCounts{Approved: 3, Rejected: 2, SystemWithheld: 1},
+			wantTotal:  1,
+		},
+		{
+			name: "legacy count that isn't a number",
+			counts: bson.D{
+				primitive.E{Key: "APPROVED", Value: "3"},
+			},
+			wantUnknown: true,
+		},
+		{
+			name: "unknown shape",
+			counts: bson.D{
+				primitive.E{Key: "approvedCount", Value: int32(3)},
+			},
+			wantUnknown: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw bson.Raw
+			if tt.counts != nil {
+				data, err := bson.Marshal(tt.counts)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				raw = data
+			}
+
+			counts, legacy, err := decodeStoredCounts(raw)
+			if tt.wantUnknown {
+				if !errors.Is(err, errUnknownCountsShape) {
+					t.Fatalf("expected errUnknownCountsShape, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if legacy != tt.wantLegacy {
+				t.Errorf("expected legacy %v, got %v", tt.wantLegacy, legacy)
+			}
+			if counts.Status != tt.wantStatus {
+				t.Errorf("expected status %+v, got %+v", tt.wantStatus, counts.Status)
+			}
+			if counts.ModerationQueue.Total != tt.wantTotal {
+				t.Errorf("expected moderationQueue.total %d, got %d", tt.wantTotal, counts.ModerationQueue.Total)
+			}
+			if counts.Action == nil {
+				t.Error("expected the action counts to be initialized")
+			}
+		})
+	}
+}
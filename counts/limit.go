@@ -0,0 +1,6 @@
+package counts
+
+// Limiting returns true when the stories or users counted are limited.
+func (p *Processor) Limiting() bool {
+	return p.LimitStories > 0 || p.LimitUsers > 0
+}
@@ -0,0 +1,210 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LockCollection is the collection that the locks preventing concurrent runs
+// on the same site are stored in.
+const LockCollection = "coral_counts_locks"
+
+// DefaultLockTTL is how long a lock is held for without a heartbeat before it's
+// considered stale and can be taken over by another run, when it isn't
+// configured.
+const DefaultLockTTL = time.Minute
+
+// lockPollInterval is how often a held lock is retried while waiting for it.
+const lockPollInterval = 5 * time.Second
+
+// ErrLockHeld is returned when another run holds the lock for the site.
+var ErrLockHeld = errors.New("another run holds the lock for the site")
+
+// lockDocument is a lock on a site stored in the LockCollection.
+type lockDocument struct {
+	TenantID   string    `bson:"tenantID"`
+	SiteID     string    `bson:"siteID"`
+	Owner      string    `bson:"owner"`
+	RunID      string    `bson:"runID"`
+	AcquiredAt time.Time `bson:"acquiredAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// SiteLock is a held lock on a site. The lock's expiry is extended in the
+// background until it's released.
+type SiteLock struct {
+	collection *mongo.Collection
+	tenantID   string
+	siteID     string
+	runID      string
+	owner      string
+	ttl        time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// AcquireLock will acquire the lock for the site, preventing another run from
+// processing it at the same time. If another run holds the lock, this will
+// retry until wait has elapsed before returning ErrLockHeld. A lock that hasn't
+// been extended within the ttl is stale, and will be taken over. The lock
+// records the ID of the run that holds it.
+func AcquireLock(ctx context.Context, db *mongo.Database, runID, tenantID, siteID string, ttl, wait time.Duration) (*SiteLock, error) {
+	collection := db.Collection(LockCollection)
+
+	// Ensure there can only be one lock for each site, and that stale locks are
+	// eventually removed.
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				primitive.E{Key: "tenantID", Value: 1},
+				primitive.E{Key: "siteID", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{
+				primitive.E{Key: "expiresAt", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not create the lock indexes")
+	}
+
+	hostname, _ := os.Hostname()
+	lock := &SiteLock{
+		collection: collection,
+		tenantID:   tenantID,
+		siteID:     siteID,
+		runID:      runID,
+		owner:      fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		ttl:        ttl,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := lock.tryAcquire(ctx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLockHeld) || time.Now().Add(lockPollInterval).After(deadline) {
+			return nil, err
+		}
+
+		logrus.WithField("wait", time.Until(deadline)).Info("waiting for the lock for the site")
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	logrus.WithField("owner", lock.owner).Info("acquired the lock for the site")
+
+	go lock.heartbeat()
+
+	return lock, nil
+}
+
+// tryAcquire will attempt to acquire the lock once. The lock is inserted if it
+// doesn't exist, or taken over if it has expired. If it exists and hasn't
+// expired, the filter won't match and the upsert will fail on the unique index.
+func (l *SiteLock) tryAcquire(ctx context.Context) error {
+	now := time.Now()
+	if _, err := l.collection.UpdateOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: l.tenantID},
+		primitive.E{Key: "siteID", Value: l.siteID},
+		primitive.E{Key: "expiresAt", Value: bson.D{
+			primitive.E{Key: "$lt", Value: now},
+		}},
+	}, bson.D{
+		primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "owner", Value: l.owner},
+			primitive.E{Key: "runID", Value: l.runID},
+			primitive.E{Key: "acquiredAt", Value: now},
+			primitive.E{Key: "expiresAt", Value: now.Add(l.ttl)},
+		}},
+	}, options.Update().SetUpsert(true)); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return errors.Wrap(err, "could not acquire the lock")
+		}
+
+		var held lockDocument
+		if err := l.collection.FindOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: l.tenantID},
+			primitive.E{Key: "siteID", Value: l.siteID},
+		}).Decode(&held); err != nil {
+			return ErrLockHeld
+		}
+
+		return errors.Wrapf(ErrLockHeld, "held by %s for run %s since %s until %s", held.Owner, held.RunID, held.AcquiredAt.Format(time.RFC3339), held.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// heartbeat will extend the lock's expiry until the lock is released.
+func (l *SiteLock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		res, err := l.collection.UpdateOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: l.tenantID},
+			primitive.E{Key: "siteID", Value: l.siteID},
+			primitive.E{Key: "owner", Value: l.owner},
+		}, bson.D{
+			primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: "expiresAt", Value: time.Now().Add(l.ttl)},
+			}},
+		})
+		cancel()
+
+		if err != nil {
+			logrus.WithError(err).Warn("could not extend the lock for the site")
+		} else if res.MatchedCount == 0 {
+			logrus.Error("lost the lock for the site, another run may be processing it")
+		}
+	}
+}
+
+// Release will stop extending the lock and remove it so another run can
+// acquire it.
+func (l *SiteLock) Release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+
+	if _, err := l.collection.DeleteOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: l.tenantID},
+		primitive.E{Key: "siteID", Value: l.siteID},
+		primitive.E{Key: "owner", Value: l.owner},
+	}); err != nil {
+		return errors.Wrap(err, "could not release the lock")
+	}
+
+	logrus.Info("released the lock for the site")
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package counts
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAcquireLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	duplicateKey := mtest.CreateWriteErrorsResponse(mtest.WriteError{
+		Index:   0,
+		Code:    11000,
+		Message: "E11000 duplicate key error",
+	})
+	held := mtest.CreateCursorResponse(0, "coral.coral_counts_locks", mtest.FirstBatch, bson.D{
+		primitive.E{Key: "tenantID", Value: "tenant"},
+		primitive.E{Key: "siteID", Value: "site"},
+		primitive.E{Key: "owner", Value: "other-host:1:1"},
+		primitive.E{Key: "runID", Value: "other-run"},
+	})
+
+	tests := []struct {
+		name      string
+		responses []bson.D
+		wantErr   string
+	}{
+		{
+			name: "acquired",
+			responses: []bson.D{
+				mtest.CreateSuccessResponse(),
+				mtest.CreateSuccessResponse(primitive.E{Key: "n", Value: 1}),
+			},
+		},
+		{
+			name: "held by another run",
+			responses: []bson.D{
+				mtest.CreateSuccessResponse(),
+				duplicateKey,
+				held,
+			},
+			wantErr: "held by other-host:1:1 for run other-run",
+		},
+		{
+			name: "held by a run that released it while checking",
+			responses: []bson.D{
+				mtest.CreateSuccessResponse(),
+				duplicateKey,
+				mtest.CreateCursorResponse(0, "coral.coral_counts_locks", mtest.FirstBatch),
+			},
+			wantErr: ErrLockHeld.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			lock, err := AcquireLock(context.Background(), mt.DB, "run-1", "tenant", "site", DefaultLockTTL, 0)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrLockHeld) || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected ErrLockHeld containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse(primitive.E{Key: "n", Value: 1}))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			if err := lock.Release(ctx); err != nil {
+				mt.Fatalf("unexpected error releasing the lock: %v", err)
+			}
+
+			if started := mt.GetAllStartedEvents(); len(started) == 0 || started[len(started)-1].CommandName != "delete" {
+				mt.Errorf("expected the lock to be deleted when it's released")
+			}
+		})
+	}
+}
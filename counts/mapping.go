@@ -0,0 +1,126 @@
+package counts
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// CommentFields are the dotted paths of the fields on comment documents. The
+// names of these fields have changed across versions of Coral, so they can be
+// configured rather than being fixed by the Comment's struct tags.
+type CommentFields struct {
+	ID           string
+	AuthorID     string
+	StoryID      string
+	Status       string
+	ActionCounts string
+	CreatedAt    string
+	UpdatedAt    string
+	Source       string
+	Rating       string
+
+	// OpenFlags is the path of the count of the comment's unresolved flags. It
+	// isn't read when empty.
+	OpenFlags string
+}
+
+// DefaultCommentFields are the paths of the fields on comment documents in the
+// current version of Coral.
+var DefaultCommentFields = CommentFields{
+	ID:           "id",
+	AuthorID:     "authorID",
+	StoryID:      "storyID",
+	Status:       "status",
+	ActionCounts: "actionCounts",
+	CreatedAt:    "createdAt",
+	UpdatedAt:    "updatedAt",
+	Source:       "source",
+	Rating:       "rating",
+}
+
+// Set will parse a mapping in the form `field=path`, where field is the name of
+// the field in the current version of Coral (such as storyID), and set the path
+// that the field will be read from.
+func (f *CommentFields) Set(mapping string) error {
+	parts := strings.SplitN(mapping, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.Errorf("expected mapping in the form field=path, found %s", mapping)
+	}
+
+	field, path := parts[0], parts[1]
+	switch field {
+	case DefaultCommentFields.ID:
+		f.ID = path
+	case DefaultCommentFields.AuthorID:
+		f.AuthorID = path
+	case DefaultCommentFields.StoryID:
+		f.StoryID = path
+	case DefaultCommentFields.Status:
+		f.Status = path
+	case DefaultCommentFields.ActionCounts:
+		f.ActionCounts = path
+	case DefaultCommentFields.CreatedAt:
+		f.CreatedAt = path
+	case DefaultCommentFields.UpdatedAt:
+		f.UpdatedAt = path
+	case DefaultCommentFields.Source:
+		f.Source = path
+	case DefaultCommentFields.Rating:
+		f.Rating = path
+	default:
+		return errors.Errorf("unknown comment field %s", field)
+	}
+
+	return nil
+}
+
+// Decode will decode the comment from the paths in the fields. Missing and null
+// fields are left as their zero value.
+func (f *CommentFields) Decode(raw bson.Raw, c *Comment) error {
+	fields := map[string]interface{}{
+		f.ID:           &c.ID,
+		"siteID":       &c.SiteID,
+		f.AuthorID:     &c.AuthorID,
+		f.StoryID:      &c.StoryID,
+		f.Status:       &c.Status,
+		f.ActionCounts: &c.ActionCounts,
+		f.CreatedAt:    &c.CreatedAt,
+		f.UpdatedAt:    &c.UpdatedAt,
+		f.Source:       &c.Source,
+		f.Rating:       &c.Rating,
+	}
+	if f.OpenFlags != "" {
+		fields[f.OpenFlags] = &c.OpenFlags
+	}
+
+	for path, v := range fields {
+		value, err := raw.LookupErr(strings.Split(path, ".")...)
+		if err != nil {
+			if errors.Is(err, bsoncore.ErrElementNotFound) {
+				continue
+			}
+
+			return errors.Wrapf(err, "could not read comment field %s", path)
+		}
+
+		if value.Type == bsontype.Null {
+			continue
+		}
+
+		if err := value.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "could not decode comment field %s", path)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalBSON will decode the comment from the DefaultCommentFields. The
+// comments that are counted are decoded from the Fields of the Rules instead.
+func (c *Comment) UnmarshalBSON(data []byte) error {
+	return DefaultCommentFields.Decode(bson.Raw(data), c)
+}
@@ -0,0 +1,104 @@
+package counts
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCommentFieldsSet(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    func(f *CommentFields)
+		wantErr bool
+	}{
+		{mapping: "storyID=story.id", want: func(f *CommentFields) { f.StoryID = "story.id" }},
+		{mapping: "actionCounts=counts.actions", want: func(f *CommentFields) { f.ActionCounts = "counts.actions" }},
+		{mapping: "createdAt=created_at", want: func(f *CommentFields) { f.CreatedAt = "created_at" }},
+		{mapping: "storyID", wantErr: true},
+		{mapping: "storyID=", wantErr: true},
+		{mapping: "siteID=site.id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mapping, func(t *testing.T) {
+			got := DefaultCommentFields
+			err := got.Set(tt.mapping)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) error = %v, wantErr %v", tt.mapping, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want := DefaultCommentFields
+			tt.want(&want)
+			if got != want {
+				t.Errorf("Set(%q) = %+v, want %+v", tt.mapping, got, want)
+			}
+		})
+	}
+}
+
+func TestCommentFieldsDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []string
+		doc      bson.D
+		want     Comment
+	}{
+		{
+			name: "default fields",
+			doc: bson.D{
+				primitive.E{Key: "id", Value: "c1"},
+				primitive.E{Key: "storyID", Value: "s1"},
+				primitive.E{Key: "status", Value: "APPROVED"},
+			},
+			want: Comment{ID: "c1", StoryID: "s1", Status: "APPROVED"},
+		},
+		{
+			name:     "nested story ID",
+			mappings: []string{"storyID=story.id", "status=moderation.status"},
+			doc: bson.D{
+				primitive.E{Key: "id", Value: "c1"},
+				primitive.E{Key: "story", Value: bson.D{primitive.E{Key: "id", Value: "s1"}}},
+				primitive.E{Key: "moderation", Value: bson.D{primitive.E{Key: "status", Value: "NONE"}}},
+			},
+			want: Comment{ID: "c1", StoryID: "s1", Status: "NONE"},
+		},
+		{
+			name: "missing and null fields",
+			doc: bson.D{
+				primitive.E{Key: "id", Value: "c1"},
+				primitive.E{Key: "storyID", Value: nil},
+			},
+			want: Comment{ID: "c1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := DefaultCommentFields
+			for _, mapping := range tt.mappings {
+				if err := fields.Set(mapping); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			data, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got Comment
+			if err := fields.Decode(data, &got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.ID != tt.want.ID || got.StoryID != tt.want.StoryID || got.Status != tt.want.Status {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
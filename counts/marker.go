@@ -0,0 +1,81 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// RecomputeAtField is the field set to the time the counts were written.
+	RecomputeAtField = "lastCountRecomputeAt"
+
+	// RecomputeRunIDField is the field set to the RunID of the run that wrote
+	// the counts.
+	RecomputeRunIDField = "lastCountRecomputeRunID"
+)
+
+// stampMarker will return the update with the recompute marker fields added to
+// it when StampRecomputeMarker is enabled. Updates with operators have the
+// fields added to their $set, and pipelines have a stage added that sets them.
+func (p *Processor) stampMarker(update interface{}) interface{} {
+	if !p.StampRecomputeMarker {
+		return update
+	}
+
+	marker := bson.D{
+		primitive.E{Key: RecomputeAtField, Value: primitive.NewDateTimeFromTime(time.Now())},
+		primitive.E{Key: RecomputeRunIDField, Value: p.RunID},
+	}
+
+	switch u := update.(type) {
+	case bson.D:
+		stamped := make(bson.D, 0, len(u)+1)
+		set := false
+		for _, element := range u {
+			if fields, ok := element.Value.(bson.D); ok && element.Key == "$set" {
+				element.Value = append(append(bson.D{}, fields...), marker...)
+				set = true
+			}
+
+			stamped = append(stamped, element)
+		}
+
+		if !set {
+			stamped = append(stamped, primitive.E{Key: "$set", Value: marker})
+		}
+
+		return stamped
+	case mongo.Pipeline:
+		return append(append(mongo.Pipeline{}, u...), bson.D{
+			primitive.E{Key: "$set", Value: marker},
+		})
+	default:
+		return update
+	}
+}
+
+// unstampedCounts will return how many documents in the output collection have
+// counts that weren't stamped with the RunID of this run.
+func (p *Processor) unstampedCounts(ctx context.Context, collection string) (int64, error) {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "commentCounts", Value: bson.D{
+			primitive.E{Key: "$exists", Value: true},
+		}},
+		primitive.E{Key: RecomputeRunIDField, Value: bson.D{
+			primitive.E{Key: "$ne", Value: p.RunID},
+		}},
+	}
+
+	count, err := p.outputCollection(collection).CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not count the unstamped %s", collection)
+	}
+
+	return count, nil
+}
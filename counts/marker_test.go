@@ -0,0 +1,175 @@
+package counts
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// markerOf returns the recompute marker fields set by the $set of the update,
+// or by the last stage of the pipeline.
+func markerOf(t *testing.T, update interface{}) bson.Raw {
+	t.Helper()
+
+	var set interface{}
+	switch u := update.(type) {
+	case bson.D:
+		for _, element := range u {
+			if element.Key == "$set" {
+				set = element.Value
+			}
+		}
+	case mongo.Pipeline:
+		set = u[len(u)-1].Map()["$set"]
+	}
+	if set == nil {
+		return nil
+	}
+
+	raw, err := bson.Marshal(set)
+	if err != nil {
+		t.Fatalf("could not marshal the $set: %v", err)
+	}
+
+	return raw
+}
+
+func TestStampMarker(t *testing.T) {
+	counts := bson.D{primitive.E{Key: "commentCounts.status.APPROVED", Value: 1}}
+
+	tests := []struct {
+		name       string
+		stamp      bool
+		update     interface{}
+		wantMarker bool
+		wantSet    []string
+	}{
+		{
+			name:    "disabled",
+			update:  bson.D{primitive.E{Key: "$set", Value: counts}},
+			wantSet: []string{"commentCounts.status.APPROVED"},
+		},
+		{
+			name:       "added to the $set",
+			stamp:      true,
+			update:     bson.D{primitive.E{Key: "$set", Value: counts}},
+			wantMarker: true,
+			wantSet:    []string{"commentCounts.status.APPROVED", RecomputeAtField, RecomputeRunIDField},
+		},
+		{
+			name:       "added as a $set to other operators",
+			stamp:      true,
+			update:     bson.D{primitive.E{Key: "$inc", Value: counts}},
+			wantMarker: true,
+			wantSet:    []string{RecomputeAtField, RecomputeRunIDField},
+		},
+		{
+			name:  "added as a stage of a pipeline",
+			stamp: true,
+			update: mongo.Pipeline{
+				bson.D{primitive.E{Key: "$set", Value: counts}},
+			},
+			wantMarker: true,
+			wantSet:    []string{RecomputeAtField, RecomputeRunIDField},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Processor{RunID: "run-1", StampRecomputeMarker: tt.stamp}
+			set := markerOf(t, p.stampMarker(tt.update))
+
+			elements, err := set.Elements()
+			if err != nil {
+				t.Fatalf("could not read the $set: %v", err)
+			}
+			if len(elements) != len(tt.wantSet) {
+				t.Fatalf("expected the $set to have %v, got %s", tt.wantSet, set)
+			}
+			for i, element := range elements {
+				if element.Key() != tt.wantSet[i] {
+					t.Errorf("expected the $set to have %v, got %s", tt.wantSet, set)
+				}
+			}
+
+			runID, ok := set.Lookup(RecomputeRunIDField).StringValueOK()
+			if ok != tt.wantMarker {
+				t.Fatalf("expected the marker to be set %v, got %s", tt.wantMarker, set)
+			}
+			if ok && runID != "run-1" {
+				t.Errorf("expected the run ID run-1, got %s", runID)
+			}
+			if _, ok := set.Lookup(RecomputeAtField).DateTimeOK(); ok != tt.wantMarker {
+				t.Errorf("expected %s to be a time, got %s", RecomputeAtField, set)
+			}
+		})
+	}
+
+	// The original update isn't changed by stamping it.
+	update := bson.D{primitive.E{Key: "$set", Value: counts}}
+	(&Processor{RunID: "run-1", StampRecomputeMarker: true}).stampMarker(update)
+	if len(update[0].Value.(bson.D)) != 1 {
+		t.Errorf("expected the original update to be unchanged, got %v", update)
+	}
+}
+
+func TestNewUserUpdateStampsMarker(t *testing.T) {
+	p := &Processor{TenantID: "tenant", RunID: "run-1", StampRecomputeMarker: true}
+	model := p.newUserUpdate("u1", bson.D{
+		primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "commentCounts", Value: bson.D{}}}},
+	}).(*mongo.UpdateOneModel)
+
+	set := markerOf(t, model.Update)
+	if runID := set.Lookup(RecomputeRunIDField).StringValue(); runID != "run-1" {
+		t.Errorf("expected the user update stamped with run-1, got %s", set)
+	}
+}
+
+func TestUnstampedCounts(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		suffix    string
+		n         int
+		wantCount int64
+		wantColl  string
+	}{
+		{name: "every document stamped", wantColl: "stories"},
+		{name: "unstamped documents", n: 3, wantCount: 3, wantColl: "stories"},
+		{name: "suffixed collection", suffix: "_shadow", n: 1, wantCount: 1, wantColl: "stories_shadow"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(countResponse("coral."+tt.wantColl, tt.n))
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.RunID = "run-1"
+			p.OutputCollectionSuffix = tt.suffix
+
+			count, err := p.unstampedCounts(context.Background(), "stories")
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+			if count != tt.wantCount {
+				mt.Errorf("expected %d unstamped, got %d", tt.wantCount, count)
+			}
+
+			command := mt.GetStartedEvent().Command
+			if coll := command.Lookup("aggregate").StringValue(); coll != tt.wantColl {
+				mt.Errorf("expected the %s collection counted, got %s", tt.wantColl, coll)
+			}
+
+			match := command.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match").Document()
+			if runID := match.Lookup(RecomputeRunIDField, "$ne").StringValue(); runID != "run-1" {
+				mt.Errorf("expected the documents not stamped with run-1 counted, got %s", match)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package counts
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Recorder records metrics about processing. Implementations must be safe to
+// use from multiple goroutines.
+type Recorder interface {
+	// Count will add the value to the counter with the name.
+	Count(name string, value int64)
+
+	// Gauge will set the gauge with the name to the value.
+	Gauge(name string, value float64)
+
+	// Timing will record a duration for the timer with the name.
+	Timing(name string, d time.Duration)
+}
+
+// noopRecorder is a Recorder that discards every metric.
+type noopRecorder struct{}
+
+func (noopRecorder) Count(string, int64)          {}
+func (noopRecorder) Gauge(string, float64)        {}
+func (noopRecorder) Timing(string, time.Duration) {}
+
+// MultiRecorder is a Recorder that records every metric with each of its
+// Recorders, so metrics can be sent to statsd and scraped by Prometheus.
+type MultiRecorder []Recorder
+
+func (m MultiRecorder) Count(name string, value int64) {
+	for _, r := range m {
+		r.Count(name, value)
+	}
+}
+
+func (m MultiRecorder) Gauge(name string, value float64) {
+	for _, r := range m {
+		r.Gauge(name, value)
+	}
+}
+
+func (m MultiRecorder) Timing(name string, d time.Duration) {
+	for _, r := range m {
+		r.Timing(name, d)
+	}
+}
+
+// scanCounter counts the documents read from a cursor. They're recorded with
+// the metrics each time the cursor's batch is used up rather than for every
+// document.
+type scanCounter struct {
+	name    string
+	metrics Recorder
+	scanned int64
+}
+
+// read will count a document read from the cursor.
+func (s *scanCounter) read(cursor *mongo.Cursor) {
+	s.scanned++
+	if cursor.RemainingBatchLength() == 0 {
+		s.metrics.Count(s.name, s.scanned)
+		s.scanned = 0
+	}
+}
+
+// StatsdRecorder is a Recorder that sends metrics to a statsd server over UDP.
+// Metrics are sent as they're recorded, and failures to send them are only
+// logged as metrics shouldn't stop processing.
+type StatsdRecorder struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsdRecorder will create a Recorder that sends metrics to the statsd
+// server at addr with each metric name prefixed by prefix.
+func NewStatsdRecorder(addr, prefix string) (*StatsdRecorder, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to statsd")
+	}
+
+	return &StatsdRecorder{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+func (r *StatsdRecorder) Count(name string, value int64) {
+	r.send(name, fmt.Sprintf("%d|c", value))
+}
+
+func (r *StatsdRecorder) Gauge(name string, value float64) {
+	r.send(name, fmt.Sprintf("%g|g", value))
+}
+
+func (r *StatsdRecorder) Timing(name string, d time.Duration) {
+	r.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()))
+}
+
+func (r *StatsdRecorder) send(name, value string) {
+	if r.prefix != "" {
+		name = r.prefix + "." + name
+	}
+
+	if _, err := fmt.Fprintf(r.conn, "%s:%s", name, value); err != nil {
+		logrus.WithError(err).WithField("metric", name).Debug("could not send metric to statsd")
+	}
+}
+
+// Close will close the connection to the statsd server.
+func (r *StatsdRecorder) Close() error {
+	return r.conn.Close()
+}
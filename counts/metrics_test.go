@@ -0,0 +1,70 @@
+package counts
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdRecorder(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	tests := []struct {
+		name   string
+		prefix string
+		record func(r Recorder)
+		want   string
+	}{
+		{
+			name:   "count",
+			record: func(r Recorder) { r.Count("stories.updates", 3) },
+			want:   "stories.updates:3|c",
+		},
+		{
+			name:   "gauge",
+			record: func(r Recorder) { r.Gauge("dirty_passes", 1.5) },
+			want:   "dirty_passes:1.5|g",
+		},
+		{
+			name:   "timing",
+			record: func(r Recorder) { r.Timing("run", 1500*time.Millisecond) },
+			want:   "run:1500|ms",
+		},
+		{
+			name:   "prefixed",
+			prefix: "coral_counts",
+			record: func(r Recorder) { r.Count("site.updates", 1) },
+			want:   "coral_counts.site.updates:1|c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, err := NewStatsdRecorder(listener.LocalAddr().String(), tt.prefix)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer recorder.Close()
+
+			// Each metric is recorded by every recorder.
+			tt.record(MultiRecorder{noopRecorder{}, recorder})
+
+			buf := make([]byte, 512)
+			if err := listener.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("expected a metric to be sent: %v", err)
+			}
+
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package counts
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// normalizeStoryID returns the story ID normalized by the StoryIDNormalizer, or
+// the story ID when there isn't one.
+func (r *Rules) normalizeStoryID(storyID string) string {
+	if r.StoryIDNormalizer == nil {
+		return storyID
+	}
+
+	return r.StoryIDNormalizer(storyID)
+}
+
+// NewStoryIDNormalizer will create a StoryIDNormalizer that replaces each match
+// of the pattern in the story ID with the replacement (which can refer to the
+// pattern's groups like regexp.ReplaceAllString), and then maps the result
+// using the mappings, in the form from=to. The pattern and mappings are both
+// optional.
+func NewStoryIDNormalizer(pattern, replacement string, mappings []string) (func(string) string, error) {
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not compile the story ID pattern")
+		}
+	}
+
+	mapped := make(map[string]string, len(mappings))
+	for _, mapping := range mappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("expected story ID mapping in the form from=to, found %s", mapping)
+		}
+
+		mapped[parts[0]] = parts[1]
+	}
+
+	return func(storyID string) string {
+		if re != nil {
+			storyID = re.ReplaceAllString(storyID, replacement)
+		}
+
+		if to, ok := mapped[storyID]; ok {
+			return to
+		}
+
+		return storyID
+	}, nil
+}
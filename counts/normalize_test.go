@@ -0,0 +1,69 @@
+package counts
+
+import "testing"
+
+func TestNewStoryIDNormalizer(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		replacement string
+		mappings    []string
+		storyID     string
+		want        string
+		wantErr     bool
+	}{
+		{name: "nothing to normalize", storyID: "a", want: "a"},
+		{name: "suffix removed", pattern: `\?.*$`, storyID: "a?utm=1", want: "a"},
+		{name: "group replaced", pattern: `^legacy-(\w+)$`, replacement: "$1", storyID: "legacy-a", want: "a"},
+		{name: "pattern not matched", pattern: `^legacy-(\w+)$`, replacement: "$1", storyID: "b", want: "b"},
+		{name: "mapped", mappings: []string{"old=new"}, storyID: "old", want: "new"},
+		{name: "mapped after the pattern", pattern: `-draft$`, mappings: []string{"old=new"}, storyID: "old-draft", want: "new"},
+		{name: "not mapped", mappings: []string{"old=new"}, storyID: "other", want: "other"},
+		{name: "invalid pattern", pattern: `(`, wantErr: true},
+		{name: "mapping without a target", mappings: []string{"old="}, wantErr: true},
+		{name: "mapping without a separator", mappings: []string{"old"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalizer, err := NewStoryIDNormalizer(tt.pattern, tt.replacement, tt.mappings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewStoryIDNormalizer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := normalizer(tt.storyID); got != tt.want {
+				t.Errorf("normalizer(%q) = %q, want %q", tt.storyID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregatorNormalizesStoryIDs(t *testing.T) {
+	normalizer, err := NewStoryIDNormalizer(`\?.*$`, "", []string{"old=a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rules := DefaultRules()
+	rules.StoryIDNormalizer = normalizer
+
+	stories, err := NewAggregator(&rules).Aggregate(sliceComments(nil,
+		Comment{StoryID: "a", Status: "APPROVED"},
+		Comment{StoryID: "a?utm=1", Status: "APPROVED"},
+		Comment{StoryID: "old", Status: "NONE"},
+		Comment{StoryID: "b", Status: "APPROVED"},
+	))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(stories) != 2 {
+		t.Fatalf("expected 2 stories, got %d", len(stories))
+	}
+	if got := stories["a"].CommentCounts.Status; got.Approved != 2 || got.None != 1 {
+		t.Errorf("expected the comments on story a to be counted together, got %+v", got)
+	}
+}
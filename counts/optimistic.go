@@ -0,0 +1,163 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// optimistic returns true when the stories are written with optimistic
+// concurrency. Only writes to the database can be made conditional.
+func (p *Processor) optimistic() bool {
+	if !p.OptimisticWrites || p.DryRun {
+		return false
+	}
+
+	_, ok := p.Destination.(MongoSink)
+	return ok
+}
+
+// loadStoryVersions will read the counts currently stored for the stories, which
+// are the versions that the stories are written over, keyed by the story's ID.
+// When `storyID`'s are specified only those stories are read. Stories without
+// counts have a value with no type.
+func (p *Processor) loadStoryVersions(ctx context.Context, storyIDs []string) (map[string]bson.RawValue, error) {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+	}
+	if len(storyIDs) > 0 {
+		filter = append(filter, primitive.E{Key: "id", Value: bson.D{
+			primitive.E{Key: "$in", Value: storyIDs},
+		}})
+	}
+
+	cursor, err := p.outputCollection("stories").Find(ctx, filter, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+		primitive.E{Key: "commentCounts", Value: 1},
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load the story versions")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	versions := make(map[string]bson.RawValue)
+	for cursor.Next(ctx) {
+		id, ok := cursor.Current.Lookup("id").StringValueOK()
+		if !ok {
+			continue
+		}
+
+		// The counts are copied as the cursor's buffer is reused.
+		version := cursor.Current.Lookup("commentCounts")
+		version.Value = append([]byte(nil), version.Value...)
+
+		versions[id] = version
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	return versions, nil
+}
+
+// writeOptimistic will write the counts of each story when its stored counts are
+// still the version that was read before counting. It returns the ID's of the
+// stories that weren't written as their counts had changed, and the change to
+// the counts of the stories that were written. Stories that didn't exist when
+// the versions were read are only written when they're upserted. The versions
+// are the ones read for these stories, as another call may be counting other
+// stories at the same time.
+func (p *Processor) writeOptimistic(ctx context.Context, stories map[string]*Story, versions map[string]bson.RawValue) (*WriteResult, []string, *StoryCommentCounts, error) {
+	var (
+		res        WriteResult
+		conflicted []string
+	)
+
+	delta := &StoryCommentCounts{
+		Action: make(map[string]int),
+	}
+
+	collection := p.outputCollection("stories")
+	started := time.Now()
+
+	for storyID, story := range stories {
+		version, existed := versions[storyID]
+		if !existed && !p.upsertingStories() {
+			continue
+		}
+
+		// Wait while the replication lag is too high before each batch worth of
+		// writes.
+		if p.Lag != nil && res.Updates%p.BatchSize == 0 {
+			if err := p.Lag.Wait(ctx); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+		update, err := p.countsUpdate(story.CommentCounts)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "could not create the story update")
+		}
+
+		filter := bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "siteID", Value: p.SiteID},
+			primitive.E{Key: "id", Value: storyID},
+		}
+		if existed && version.Type == 0 {
+			filter = append(filter, primitive.E{Key: "commentCounts", Value: bson.D{
+				primitive.E{Key: "$exists", Value: false},
+			}})
+		} else if existed {
+			filter = append(filter, primitive.E{Key: "commentCounts", Value: version})
+		}
+
+		opts := options.FindOneAndUpdate().
+			SetProjection(bson.D{primitive.E{Key: "_id", Value: 1}}).
+			SetReturnDocument(options.After).
+			SetUpsert(!existed)
+
+		res.Updates++
+		if err := collection.FindOneAndUpdate(ctx, filter, p.stampMarker(update), opts).Err(); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				logrus.WithField("storyID", storyID).Debug("story counts changed while its comments were counted, not writing them")
+				conflicted = append(conflicted, storyID)
+				continue
+			}
+
+			return nil, nil, nil, errors.Wrapf(err, "could not write the counts of story %s", storyID)
+		}
+
+		res.Modified++
+
+		delta.Merge(&story.CommentCounts)
+		if existed && version.Type == bsontype.EmbeddedDocument {
+			previous, _, err := decodeStoredCounts(version.Document())
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "could not read the previous counts of story %s", storyID)
+			}
+
+			delta.Subtract(&previous)
+		}
+	}
+
+	p.Metrics.Count("story.conflicts", int64(len(conflicted)))
+
+	logrus.WithFields(logrus.Fields{
+		"updates":    res.Updates,
+		"written":    res.Modified,
+		"conflicted": len(conflicted),
+		"took":       time.Since(started),
+	}).Info("finished writing story updates that hadn't changed")
+
+	return &res, conflicted, delta, nil
+}
@@ -0,0 +1,237 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestProcessorOptimistic(t *testing.T) {
+	tests := []struct {
+		name             string
+		optimisticWrites bool
+		dryRun           bool
+		destination      Sink
+		want             bool
+	}{
+		{"disabled", false, false, MongoSink{}, false},
+		{"enabled", true, false, MongoSink{}, true},
+		{"dry run", true, true, MongoSink{}, false},
+		{"exported", true, false, &ExportSink{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", tt.dryRun, DefaultRules())
+			p.OptimisticWrites = tt.optimisticWrites
+			p.Destination = tt.destination
+
+			if got := p.optimistic(); got != tt.want {
+				t.Errorf("optimistic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStoryVersions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("versions", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch,
+			bson.D{
+				primitive.E{Key: "id", Value: "counted"},
+				primitive.E{Key: "commentCounts", Value: bson.D{primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "APPROVED", Value: 2}}}}},
+			},
+			bson.D{primitive.E{Key: "id", Value: "uncounted"}},
+		))
+
+		p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+		versions, err := p.loadStoryVersions(context.Background(), []string{"counted", "uncounted"})
+		if err != nil {
+			mt.Fatalf("expected no error, got %v", err)
+		}
+
+		if len(versions) != 2 {
+			mt.Fatalf("expected 2 versions, got %d", len(versions))
+		}
+		if versions["uncounted"].Type != 0 {
+			mt.Errorf("expected a story without counts to have no version, got %s", versions["uncounted"].Type)
+		}
+		if approved := versions["counted"].Document().Lookup("status", "APPROVED").Int32(); approved != 2 {
+			mt.Errorf("expected the counted story's version to have 2 approved, got %d", approved)
+		}
+
+		// Only the stories that were asked for are read.
+		if in := mt.GetStartedEvent().Command.Lookup("filter", "id", "$in"); in.Type == 0 {
+			mt.Errorf("expected the stories to be filtered by their ID")
+		}
+	})
+}
+
+func TestWriteOptimistic(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	version := func(approved int32) bson.RawValue {
+		raw, err := bson.Marshal(bson.D{primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "APPROVED", Value: approved}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return bson.RawValue{Type: bson.TypeEmbeddedDocument, Value: raw}
+	}
+
+	written := mtest.CreateSuccessResponse(primitive.E{Key: "value", Value: bson.D{primitive.E{Key: "_id", Value: 1}}})
+	changed := mtest.CreateSuccessResponse(primitive.E{Key: "value", Value: nil})
+
+	tests := []struct {
+		name           string
+		versions       map[string]bson.RawValue
+		upsertStories  bool
+		responses      []bson.D
+		wantUpdates    int
+		wantConflicted []string
+		wantApproved   int
+	}{
+		{
+			name:         "unchanged",
+			versions:     map[string]bson.RawValue{"story": version(1)},
+			responses:    []bson.D{written},
+			wantUpdates:  1,
+			wantApproved: 2,
+		},
+		{
+			name:           "changed between the read and the write",
+			versions:       map[string]bson.RawValue{"story": version(1)},
+			responses:      []bson.D{changed},
+			wantUpdates:    1,
+			wantConflicted: []string{"story"},
+		},
+		{
+			name:         "without counts",
+			versions:     map[string]bson.RawValue{"story": {}},
+			responses:    []bson.D{written},
+			wantUpdates:  1,
+			wantApproved: 3,
+		},
+		{
+			name:     "missing and not upserted",
+			versions: map[string]bson.RawValue{},
+		},
+		{
+			name:          "missing and upserted",
+			versions:      map[string]bson.RawValue{},
+			upsertStories: true,
+			responses:     []bson.D{written},
+			wantUpdates:   1,
+			wantApproved:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+			p.UpsertStories = tt.upsertStories
+
+			story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+			story.CommentCounts.Status.Approved = 3
+
+			res, conflicted, delta, err := p.writeOptimistic(context.Background(), map[string]*Story{"story": &story}, tt.versions)
+			if err != nil {
+				mt.Fatalf("expected no error, got %v", err)
+			}
+
+			if res.Updates != tt.wantUpdates {
+				mt.Errorf("expected %d updates, got %d", tt.wantUpdates, res.Updates)
+			}
+
+			if !reflect.DeepEqual(conflicted, tt.wantConflicted) {
+				mt.Errorf("expected conflicted %v, got %v", tt.wantConflicted, conflicted)
+			}
+
+			// The delta is the change from the version that was overwritten.
+			if delta.Status.Approved != tt.wantApproved {
+				mt.Errorf("expected a delta of %d approved, got %d", tt.wantApproved, delta.Status.Approved)
+			}
+
+			// Stories that were read are only written over the version that was read.
+			if _, ok := tt.versions["story"]; ok && tt.wantUpdates > 0 {
+				filter := mt.GetStartedEvent().Command.Lookup("query")
+				if _, err := filter.Document().LookupErr("commentCounts"); err != nil {
+					mt.Errorf("expected the write to be conditional on the counts, got %s", filter)
+				}
+			}
+		})
+	}
+}
+
+// TestOptimisticStoriesWithFlush checks that the stories of the initial pass are
+// written over their own versions when the dirty stories are counted and written
+// part way through it, as they are by the dirty flusher.
+func TestOptimisticStoriesWithFlush(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	story := func(id string, approved int32) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "commentCounts", Value: bson.D{primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "APPROVED", Value: approved}}}}},
+		}
+	}
+	comment := func(id, storyID string) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "storyID", Value: storyID},
+			primitive.E{Key: "status", Value: "APPROVED"},
+		}
+	}
+	written := mtest.CreateSuccessResponse(primitive.E{Key: "value", Value: bson.D{primitive.E{Key: "_id", Value: 1}}})
+
+	mt.Run("flushed during the initial pass", func(mt *mtest.T) {
+		p := NewProcessor(mt.DB, "tenant", "site", false, DefaultRules())
+		p.OptimisticWrites = true
+		ctx := context.Background()
+
+		// The initial pass reads the versions of every story and counts them.
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, story("s1", 1), story("s2", 1)),
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1", "s1"), comment("c2", "s2")),
+		)
+		stories, versions, err := p.loadStories(ctx, nil)
+		if err != nil {
+			mt.Fatalf("unexpected error loading the stories: %v", err)
+		}
+
+		// The flusher counts and writes one of the dirty stories before the initial
+		// pass writes.
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, story("s1", 1)),
+			mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1", "s1")),
+			written,
+		)
+		dirty, dirtyVersions, err := p.loadStories(ctx, []string{"s1"})
+		if err != nil {
+			mt.Fatalf("unexpected error loading the dirty stories: %v", err)
+		}
+		if _, _, _, err := p.writeOptimistic(ctx, dirty, dirtyVersions); err != nil {
+			mt.Fatalf("unexpected error writing the dirty stories: %v", err)
+		}
+
+		// Every story of the initial pass is still written.
+		mt.AddMockResponses(written, written)
+		res, conflicted, _, err := p.writeOptimistic(ctx, stories, versions)
+		if err != nil {
+			mt.Fatalf("unexpected error writing the stories: %v", err)
+		}
+		if res.Updates != 2 || len(conflicted) != 0 {
+			mt.Errorf("expected both stories to be written, got %d updates and %v conflicted", res.Updates, conflicted)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package counts
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// orphanedUserSamples is the most orphaned authors that are logged.
+const orphanedUserSamples = 10
+
+// orphanedUsers will return the ID's of the users that have comments but no user
+// document, sorted. Comments without an author are not included.
+func (p *Processor) orphanedUsers(ctx context.Context, users map[string]*User) ([]string, error) {
+	started := time.Now()
+
+	ids := make([]string, 0, len(users))
+	for userID := range users {
+		if userID != "" {
+			ids = append(ids, userID)
+		}
+	}
+
+	// The user documents are always read from the users collection as the
+	// output collection may not have been written yet.
+	found := make(map[string]struct{}, len(ids))
+	for start := 0; start < len(ids); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		cursor, err := p.DB.Collection("users").Find(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "id", Value: bson.D{
+				primitive.E{Key: "$in", Value: ids[start:end]},
+			}},
+		}, options.Find().SetProjection(bson.D{
+			primitive.E{Key: "id", Value: 1},
+		}))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find users")
+		}
+
+		for cursor.Next(ctx) {
+			var user struct {
+				ID string `bson:"id"`
+			}
+			if err := cursor.Decode(&user); err != nil {
+				closeCursor(cursor, p.Timeouts.CursorClose)
+				return nil, errors.Wrap(err, "could not decode result")
+			}
+
+			found[user.ID] = struct{}{}
+		}
+
+		err = cursor.Err()
+		closeCursor(cursor, p.Timeouts.CursorClose)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not iterate on cursor")
+		}
+	}
+
+	var orphaned []string
+	for _, userID := range ids {
+		if _, ok := found[userID]; !ok {
+			orphaned = append(orphaned, userID)
+		}
+	}
+	sort.Strings(orphaned)
+
+	samples := orphaned
+	if len(samples) > orphanedUserSamples {
+		samples = samples[:orphanedUserSamples]
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"checked":  len(ids),
+		"orphaned": len(orphaned),
+		"took":     time.Since(started),
+	})
+	if len(orphaned) > 0 {
+		entry.WithField("samples", samples).Warn("authors have comments but no user document, their counts will not be written")
+	} else {
+		entry.Info("every author has a user document")
+	}
+
+	p.Metrics.Count("users.orphaned", int64(len(orphaned)))
+
+	return orphaned, nil
+}
@@ -0,0 +1,85 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestOrphanedUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	found := func(ids ...string) bson.D {
+		docs := make([]bson.D, 0, len(ids))
+		for _, id := range ids {
+			docs = append(docs, bson.D{primitive.E{Key: "id", Value: id}})
+		}
+
+		return mtest.CreateCursorResponse(0, "coral.users", mtest.FirstBatch, docs...)
+	}
+
+	tests := []struct {
+		name      string
+		users     []string
+		batchSize int
+		responses []bson.D
+		want      []string
+	}{
+		{
+			name:      "every user found",
+			users:     []string{"u1", "u2"},
+			batchSize: 10,
+			responses: []bson.D{found("u1", "u2")},
+		},
+		{
+			name:      "users without a document",
+			users:     []string{"u1", "u2", "u3"},
+			batchSize: 10,
+			responses: []bson.D{found("u2")},
+			want:      []string{"u1", "u3"},
+		},
+		{
+			name:      "comments without an author",
+			users:     []string{"", "u1"},
+			batchSize: 10,
+			responses: []bson.D{found("u1")},
+		},
+		{
+			name:      "users in batches",
+			users:     []string{"u1", "u2", "u3"},
+			batchSize: 2,
+			responses: []bson.D{found("u1"), found("u3")},
+			want:      []string{"u2"},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.BatchSize = tt.batchSize
+
+			// The users found by every batch are combined, so it doesn't matter which
+			// batch each of them is found by.
+			users := make(map[string]*User, len(tt.users))
+			for _, userID := range tt.users {
+				users[userID] = &User{}
+			}
+
+			got, err := p.orphanedUsers(context.Background(), users)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected %v to be orphaned, got %v", tt.want, got)
+			}
+		})
+	}
+}
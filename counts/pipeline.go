@@ -0,0 +1,353 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AggregationUnsupported returns the names of the enabled options that the
+// AggregationMode can't count with, which is empty when it can be used with the
+// Processor's rules and options.
+func (p *Processor) AggregationUnsupported() []string {
+	rules := &p.Rules
+
+	var unsupported []string
+	if rules.CountBySource {
+		unsupported = append(unsupported, "countBySource")
+	}
+	if rules.CountRatings {
+		unsupported = append(unsupported, "countRatings")
+	}
+	if rules.CountDistinctAuthors {
+		unsupported = append(unsupported, "countDistinctAuthors")
+	}
+	if rules.MaxCommentAge > 0 {
+		unsupported = append(unsupported, "maxCommentAge")
+	}
+	if rules.CheckCreatedAt {
+		unsupported = append(unsupported, "checkCreatedAt")
+	}
+	if rules.ActionKeyCase != "" {
+		unsupported = append(unsupported, "actionKeyCase")
+	}
+	if rules.StoryIDNormalizer != nil {
+		unsupported = append(unsupported, "storyIDPattern")
+	}
+	if p.LimitStories > 0 {
+		unsupported = append(unsupported, "limitStories")
+	}
+	if !p.AtClusterTime.IsZero() {
+		unsupported = append(unsupported, "atClusterTime")
+	}
+
+	return unsupported
+}
+
+// aggregatedStory is a story's counts as they're grouped by the pipeline. The
+// counts are keyed by the names of the storyCountExpressions, and the action
+// counts are keyed by the action, which is nil for the comments without any
+// actions.
+type aggregatedStory struct {
+	ID      string `bson:"_id"`
+	Actions []struct {
+		Key   *string `bson:"k"`
+		Count int     `bson:"v"`
+	} `bson:"actions"`
+	Counts map[string]int `bson:",inline"`
+}
+
+// countExpression is a count that the pipeline sums for each story, of the
+// comments matching the condition.
+type countExpression struct {
+	name      string
+	condition interface{}
+	increment func(counts *StoryCommentCounts, count int)
+}
+
+// aggregateStories will count the comments matching the filter on their stories
+// with an aggregation on each of the comments collections.
+func (p *Processor) aggregateStories(ctx context.Context, filter bson.D) (map[string]*Story, error) {
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expressions := p.Rules.storyCountExpressions()
+	pipeline := p.Rules.storyPipeline(p.mergeCommentFilter(filter), expressions)
+
+	// The comments on a story can be spread across the collections, so the
+	// counts from each of them are added together.
+	aggregator := NewAggregator(&p.Rules)
+	for _, collection := range collections {
+		stories, err := p.aggregateCollection(ctx, collection, pipeline, expressions)
+		if err != nil {
+			return nil, err
+		}
+
+		aggregator.Merge(stories)
+	}
+
+	return aggregator.Stories(), nil
+}
+
+// aggregateCollection will run the pipeline on the collection, and decode the
+// counts of each story it returns.
+func (p *Processor) aggregateCollection(ctx context.Context, collection *mongo.Collection, pipeline mongo.Pipeline, expressions []countExpression) (map[string]*Story, error) {
+	started := time.Now()
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not aggregate the comments in %s", collection.Name())
+	}
+	p.checkSlowBatch("aggregate", collection.Name(), cursor.RemainingBatchLength(), time.Since(started))
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	stories := make(map[string]*Story)
+	for p.nextTimed(ctx, cursor, collection.Name()) {
+		var aggregated aggregatedStory
+		if err := cursor.Decode(&aggregated); err != nil {
+			return nil, errors.Wrap(err, "could not decode the story counts")
+		}
+
+		story := &Story{
+			ID: aggregated.ID,
+		}
+		story.CommentCounts.Action = make(map[string]int)
+
+		for _, action := range aggregated.Actions {
+			if action.Key != nil {
+				story.CommentCounts.Action[*action.Key] += action.Count
+			}
+		}
+
+		for _, expression := range expressions {
+			expression.increment(&story.CommentCounts, aggregated.Counts[expression.name])
+		}
+
+		stories[story.ID] = story
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": collection.Name(),
+		"stories":    len(stories),
+		"took":       time.Since(started),
+	}).Debug("aggregated the comments on the stories")
+
+	return stories, nil
+}
+
+// storyPipeline returns the pipeline that counts the comments matching the
+// filter for each story. Each comment is unwound into one document for each of
+// its actions, so the actions can be summed by their key, and the rest of the
+// counts are only taken from the first of them. The comments that are
+// excluded still have their story counted, like they do in memory, but
+// without a status or actions.
+func (r *Rules) storyPipeline(filter bson.D, expressions []countExpression) mongo.Pipeline {
+	status := "$" + r.Fields.Status
+
+	excluded := make(bson.A, 0, len(r.ExcludedStatuses))
+	for excludedStatus := range r.ExcludedStatuses {
+		excluded = append(excluded, excludedStatus)
+	}
+
+	counted := bson.D{
+		primitive.E{Key: "$not", Value: bson.A{
+			bson.D{primitive.E{Key: "$in", Value: bson.A{status, excluded}}},
+		}},
+	}
+
+	// Project the status and actions of each comment, along with the fields the
+	// counts depend on.
+	project := bson.D{
+		primitive.E{Key: "storyID", Value: "$" + r.Fields.StoryID},
+		primitive.E{Key: "status", Value: bson.D{
+			primitive.E{Key: "$cond", Value: bson.A{counted, status, nil}},
+		}},
+		primitive.E{Key: "actionCounts", Value: "$" + r.Fields.ActionCounts},
+		primitive.E{Key: "actions", Value: bson.D{
+			primitive.E{Key: "$cond", Value: bson.A{
+				counted,
+				bson.D{primitive.E{Key: "$objectToArray", Value: bson.D{
+					primitive.E{Key: "$ifNull", Value: bson.A{"$" + r.Fields.ActionCounts, bson.D{}}},
+				}}},
+				bson.A{},
+			}},
+		}},
+	}
+	if r.Fields.OpenFlags != "" {
+		project = append(project, primitive.E{Key: "openFlags", Value: "$" + r.Fields.OpenFlags})
+	}
+
+	// Sum the counts of the comments for each action on each story.
+	first := bson.D{
+		primitive.E{Key: "$eq", Value: bson.A{
+			bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$index", 0}}},
+			0,
+		}},
+	}
+
+	groupActions := bson.D{
+		primitive.E{Key: "_id", Value: bson.D{
+			primitive.E{Key: "storyID", Value: "$storyID"},
+			primitive.E{Key: "key", Value: "$actions.k"},
+		}},
+		primitive.E{Key: "count", Value: bson.D{primitive.E{Key: "$sum", Value: "$actions.v"}}},
+	}
+
+	groupStories := bson.D{
+		primitive.E{Key: "_id", Value: "$_id.storyID"},
+		primitive.E{Key: "actions", Value: bson.D{
+			primitive.E{Key: "$push", Value: bson.D{
+				primitive.E{Key: "k", Value: "$_id.key"},
+				primitive.E{Key: "v", Value: "$count"},
+			}},
+		}},
+	}
+
+	for _, expression := range expressions {
+		groupActions = append(groupActions, primitive.E{Key: expression.name, Value: bson.D{
+			primitive.E{Key: "$sum", Value: bson.D{
+				primitive.E{Key: "$cond", Value: bson.A{
+					bson.D{primitive.E{Key: "$and", Value: bson.A{first, expression.condition}}},
+					1,
+					0,
+				}},
+			}},
+		}})
+
+		groupStories = append(groupStories, primitive.E{Key: expression.name, Value: bson.D{
+			primitive.E{Key: "$sum", Value: "$" + expression.name},
+		}})
+	}
+
+	return mongo.Pipeline{
+		bson.D{primitive.E{Key: "$match", Value: filter}},
+		bson.D{primitive.E{Key: "$project", Value: project}},
+		bson.D{primitive.E{Key: "$unwind", Value: bson.D{
+			primitive.E{Key: "path", Value: "$actions"},
+			primitive.E{Key: "includeArrayIndex", Value: "index"},
+			primitive.E{Key: "preserveNullAndEmptyArrays", Value: true},
+		}}},
+		bson.D{primitive.E{Key: "$group", Value: groupActions}},
+		bson.D{primitive.E{Key: "$group", Value: groupStories}},
+	}
+}
+
+// storyCountExpressions returns the counts that the pipeline sums for each
+// story, which follow the same rules as the Increment methods of the counts.
+func (r *Rules) storyCountExpressions() []countExpression {
+	statusIn := func(statuses ...string) bson.D {
+		return bson.D{primitive.E{Key: "$in", Value: bson.A{"$status", statuses}}}
+	}
+
+	action := func(key string) bson.D {
+		return bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$actionCounts." + key, 0}}}
+	}
+
+	gt := func(a, b interface{}) bson.D {
+		return bson.D{primitive.E{Key: "$gt", Value: bson.A{a, b}}}
+	}
+
+	and := func(conditions ...interface{}) bson.D {
+		return bson.D{primitive.E{Key: "$and", Value: conditions}}
+	}
+
+	// A comment is reported when it has open flags, or any flags when the open
+	// flags aren't known or the policy counts resolved flags.
+	flags := interface{}(action("FLAG"))
+	if r.Fields.OpenFlags != "" && !r.ReportedPolicy.ResolvedFlags {
+		flags = bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$openFlags", flags}}}
+	}
+	reported := and(gt(flags, 0), statusIn(r.reportedStatuses()...))
+
+	expressions := []countExpression{
+		{"statusApproved", statusIn("APPROVED"), func(scc *StoryCommentCounts, n int) { scc.Status.Approved = n }},
+		{"statusNone", statusIn("NONE"), func(scc *StoryCommentCounts, n int) { scc.Status.None = n }},
+		{"statusPremod", statusIn("PREMOD"), func(scc *StoryCommentCounts, n int) { scc.Status.Premod = n }},
+		{"statusRejected", statusIn("REJECTED"), func(scc *StoryCommentCounts, n int) { scc.Status.Rejected = n }},
+		{"statusSystemWithheld", statusIn("SYSTEM_WITHHELD"), func(scc *StoryCommentCounts, n int) { scc.Status.SystemWithheld = n }},
+		{"queueUnmoderated", statusIn("NONE", "PREMOD", "SYSTEM_WITHHELD"), func(scc *StoryCommentCounts, n int) {
+			scc.ModerationQueue.Total = n
+			scc.ModerationQueue.Queues.Unmoderated = n
+		}},
+		{"queuePending", statusIn("PREMOD", "SYSTEM_WITHHELD"), func(scc *StoryCommentCounts, n int) { scc.ModerationQueue.Queues.Pending = n }},
+		{"queueReported", reported, func(scc *StoryCommentCounts, n int) { scc.ModerationQueue.Queues.Reported = n }},
+	}
+
+	if r.countsApproved() {
+		expressions = append(expressions, countExpression{"queueReportedApproved", and(reported, statusIn("APPROVED")), func(scc *StoryCommentCounts, n int) {
+			scc.ModerationQueue.Queues.ReportedApproved = n
+		}})
+	}
+
+	if len(r.AutomatedFlagKeys) > 0 {
+		automated := make(bson.A, 0, len(r.AutomatedFlagKeys))
+		for _, key := range r.AutomatedFlagKeys {
+			automated = append(automated, action(key))
+		}
+		sum := bson.D{primitive.E{Key: "$add", Value: automated}}
+
+		expressions = append(expressions,
+			countExpression{"queueReportedAutomated", and(reported, gt(sum, 0)), func(scc *StoryCommentCounts, n int) {
+				scc.ModerationQueue.Queues.ReportedAutomated = n
+			}},
+			countExpression{"queueReportedUser", and(reported, gt(action("FLAG"), sum)), func(scc *StoryCommentCounts, n int) {
+				scc.ModerationQueue.Queues.ReportedUser = n
+			}},
+		)
+	}
+
+	// The custom queues are only set when a comment is counted in them.
+	custom := func(queue string) func(*StoryCommentCounts, int) {
+		return func(scc *StoryCommentCounts, n int) {
+			if n == 0 {
+				return
+			}
+
+			if scc.ModerationQueue.Queues.Custom == nil {
+				scc.ModerationQueue.Queues.Custom = make(map[string]int)
+			}
+
+			scc.ModerationQueue.Queues.Custom[queue] += n
+		}
+	}
+
+	for i, rule := range r.ActionQueueRules {
+		expressions = append(expressions, countExpression{
+			fmt.Sprintf("actionQueue%d", i),
+			and(statusIn("NONE"), gt(action(rule.ActionKey), rule.Threshold)),
+			custom(rule.QueueName),
+		})
+	}
+
+	for i, rule := range r.StatusQueueRules {
+		statuses := make([]string, 0, len(rule.Statuses))
+		for status := range rule.Statuses {
+			statuses = append(statuses, status)
+		}
+
+		condition := statusIn(statuses...)
+		if rule.ActionKey != "" {
+			condition = and(condition, gt(action(rule.ActionKey), rule.Threshold))
+		}
+
+		expressions = append(expressions, countExpression{
+			fmt.Sprintf("statusQueue%d", i),
+			condition,
+			custom(rule.QueueName),
+		})
+	}
+
+	return expressions
+}
@@ -0,0 +1,545 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// pipelineDoc is a document as it passes through the stages of a pipeline run
+// by runPipeline.
+type pipelineDoc map[string]interface{}
+
+// toPipelineValue will convert the decoded BSON value into the maps, slices,
+// and float64 numbers that the pipeline is evaluated with.
+func toPipelineValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		doc := make(pipelineDoc, len(v))
+		for _, e := range v {
+			doc[e.Key] = toPipelineValue(e.Value)
+		}
+		return doc
+	case bson.M:
+		doc := make(pipelineDoc, len(v))
+		for key, value := range v {
+			doc[key] = toPipelineValue(value)
+		}
+		return doc
+	case bson.A:
+		values := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			values = append(values, toPipelineValue(value))
+		}
+		return values
+	case []string:
+		values := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			values = append(values, value)
+		}
+		return values
+	case []interface{}:
+		return toPipelineValue(bson.A(v))
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	default:
+		return v
+	}
+}
+
+// lookupPath returns the value at the dotted path in the document, or nil when
+// it's missing.
+func lookupPath(doc pipelineDoc, path string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		d, ok := value.(pipelineDoc)
+		if !ok {
+			return nil
+		}
+		value = d[key]
+	}
+
+	return value
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	default:
+		return true
+	}
+}
+
+func number(value interface{}) float64 {
+	n, _ := value.(float64)
+	return n
+}
+
+// evalExpression will evaluate the aggregation expression against the
+// document. Only the operators used by the storyPipeline are supported.
+func evalExpression(t *testing.T, expression interface{}, doc pipelineDoc) interface{} {
+	t.Helper()
+
+	args := func(value interface{}) []interface{} {
+		var values []interface{}
+		switch v := value.(type) {
+		case bson.A:
+			values = v
+		case []interface{}:
+			values = v
+		default:
+			values = []interface{}{v}
+		}
+
+		evaluated := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			evaluated = append(evaluated, evalExpression(t, value, doc))
+		}
+		return evaluated
+	}
+
+	switch e := expression.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			return lookupPath(doc, e[1:])
+		}
+		return e
+	case bson.D:
+		if len(e) == 0 || !strings.HasPrefix(e[0].Key, "$") {
+			// A document of expressions.
+			evaluated := make(pipelineDoc, len(e))
+			for _, element := range e {
+				evaluated[element.Key] = evalExpression(t, element.Value, doc)
+			}
+			return evaluated
+		}
+
+		op, value := e[0].Key, e[0].Value
+		switch op {
+		case "$cond":
+			a := value.(bson.A)
+			if truthy(evalExpression(t, a[0], doc)) {
+				return evalExpression(t, a[1], doc)
+			}
+			return evalExpression(t, a[2], doc)
+		case "$not":
+			return !truthy(args(value)[0])
+		case "$and":
+			for _, arg := range args(value) {
+				if !truthy(arg) {
+					return false
+				}
+			}
+			return true
+		case "$in":
+			a := args(value)
+			for _, candidate := range toPipelineValue(a[1]).([]interface{}) {
+				if candidate == a[0] {
+					return true
+				}
+			}
+			return false
+		case "$ifNull":
+			a := args(value)
+			if a[0] != nil {
+				return a[0]
+			}
+			return a[1]
+		case "$eq":
+			a := args(value)
+			return a[0] == a[1]
+		case "$gt":
+			a := args(value)
+			return number(a[0]) > number(a[1])
+		case "$add":
+			var sum float64
+			for _, arg := range args(value) {
+				sum += number(arg)
+			}
+			return sum
+		case "$objectToArray":
+			object, _ := args(value)[0].(pipelineDoc)
+			keys := make([]string, 0, len(object))
+			for key := range object {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			pairs := make([]interface{}, 0, len(keys))
+			for _, key := range keys {
+				pairs = append(pairs, pipelineDoc{"k": key, "v": object[key]})
+			}
+			return pairs
+		}
+
+		t.Fatalf("unsupported expression operator %s", op)
+	default:
+		return toPipelineValue(e)
+	}
+
+	return nil
+}
+
+// runPipeline will run the stages of the pipeline over the documents, as the
+// server would. The $match stage is skipped, so every document must match it.
+func runPipeline(t *testing.T, pipeline mongo.Pipeline, docs []bson.D) []bson.D {
+	t.Helper()
+
+	current := make([]pipelineDoc, 0, len(docs))
+	for _, doc := range docs {
+		current = append(current, toPipelineValue(doc).(pipelineDoc))
+	}
+
+	for _, stage := range pipeline {
+		name, spec := stage[0].Key, stage[0].Value.(bson.D)
+
+		var next []pipelineDoc
+		switch name {
+		case "$match":
+			next = current
+		case "$project":
+			for _, doc := range current {
+				projected := pipelineDoc{"_id": doc["_id"]}
+				for _, field := range spec {
+					projected[field.Key] = evalExpression(t, field.Value, doc)
+				}
+				next = append(next, projected)
+			}
+		case "$unwind":
+			options := spec.Map()
+			path := options["path"].(string)[1:]
+			index := options["includeArrayIndex"].(string)
+			for _, doc := range current {
+				values, _ := doc[path].([]interface{})
+				if len(values) == 0 {
+					unwound := pipelineDoc{}
+					for key, value := range doc {
+						unwound[key] = value
+					}
+					delete(unwound, path)
+					unwound[index] = nil
+					next = append(next, unwound)
+					continue
+				}
+
+				for i, value := range values {
+					unwound := pipelineDoc{}
+					for key, value := range doc {
+						unwound[key] = value
+					}
+					unwound[path] = value
+					unwound[index] = float64(i)
+					next = append(next, unwound)
+				}
+			}
+		case "$group":
+			groups := make(map[string]pipelineDoc)
+			var order []string
+			for _, doc := range current {
+				id := evalExpression(t, spec[0].Value, doc)
+				key := fmt.Sprint(id)
+
+				group, ok := groups[key]
+				if !ok {
+					group = pipelineDoc{"_id": id}
+					groups[key] = group
+					order = append(order, key)
+				}
+
+				for _, field := range spec[1:] {
+					accumulator := field.Value.(bson.D)[0]
+					value := evalExpression(t, accumulator.Value, doc)
+					switch accumulator.Key {
+					case "$sum":
+						group[field.Key] = number(group[field.Key]) + number(value)
+					case "$push":
+						pushed, _ := group[field.Key].([]interface{})
+						group[field.Key] = append(pushed, value)
+					default:
+						t.Fatalf("unsupported accumulator %s", accumulator.Key)
+					}
+				}
+			}
+			for _, key := range order {
+				next = append(next, groups[key])
+			}
+		default:
+			t.Fatalf("unsupported stage %s", name)
+		}
+
+		current = next
+	}
+
+	results := make([]bson.D, 0, len(current))
+	for _, doc := range current {
+		results = append(results, fromPipelineValue(doc).(bson.D))
+	}
+
+	return results
+}
+
+// fromPipelineValue will convert the value back into BSON, with the numbers as
+// integers.
+func fromPipelineValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case pipelineDoc:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		doc := make(bson.D, 0, len(v))
+		for _, key := range keys {
+			doc = append(doc, primitive.E{Key: key, Value: fromPipelineValue(v[key])})
+		}
+		return doc
+	case []interface{}:
+		values := make(bson.A, 0, len(v))
+		for _, value := range v {
+			values = append(values, fromPipelineValue(value))
+		}
+		return values
+	case float64:
+		return int64(v)
+	default:
+		return v
+	}
+}
+
+// writtenCounts returns the counts as they're written, and decoded.
+func writtenCounts(t *testing.T, counts *StoryCommentCounts) (bson.Raw, bson.M) {
+	t.Helper()
+
+	raw, err := bson.Marshal(counts)
+	if err != nil {
+		t.Fatalf("could not marshal the counts: %v", err)
+	}
+
+	var decoded bson.M
+	if err := bson.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("could not unmarshal the counts: %v", err)
+	}
+
+	return raw, decoded
+}
+
+func TestAggregationModeEquivalence(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(id, storyID, status string, actions bson.D, extra ...primitive.E) bson.D {
+		doc := bson.D{
+			primitive.E{Key: "_id", Value: id},
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "tenantID", Value: "tenant"},
+			primitive.E{Key: "siteID", Value: "site"},
+			primitive.E{Key: "storyID", Value: storyID},
+			primitive.E{Key: "authorID", Value: "author-" + id},
+			primitive.E{Key: "status", Value: status},
+		}
+		if actions != nil {
+			doc = append(doc, primitive.E{Key: "actionCounts", Value: actions})
+		}
+
+		return append(doc, extra...)
+	}
+	actions := func(counts ...interface{}) bson.D {
+		doc := bson.D{}
+		for i := 0; i < len(counts); i += 2 {
+			doc = append(doc, primitive.E{Key: counts[i].(string), Value: int32(counts[i+1].(int))})
+		}
+		return doc
+	}
+	revisions := func(n int) primitive.E {
+		revisions := bson.A{}
+		for i := 0; i < n; i++ {
+			revisions = append(revisions, bson.D{
+				primitive.E{Key: "id", Value: fmt.Sprintf("revision-%d", i)},
+				primitive.E{Key: "body", Value: fmt.Sprintf("edit %d", i)},
+				primitive.E{Key: "actionCounts", Value: actions("FLAG", 7)},
+			})
+		}
+		return primitive.E{Key: "revisions", Value: revisions}
+	}
+	openFlags := func(n int) primitive.E {
+		return primitive.E{Key: "openFlags", Value: int32(n)}
+	}
+
+	fixtures := []bson.D{
+		// Comments without any actions.
+		comment("c1", "a", "APPROVED", nil),
+		comment("c2", "a", "NONE", actions()),
+		comment("c3", "a", "PREMOD", nil, revisions(2)),
+		// Comments with multiple flags and other actions, only the first unwound
+		// action of each counts the comment.
+		comment("c4", "a", "NONE", actions("FLAG", 3, "FLAG__COMMENT_DETECTED_TOXIC", 2, "DONT_AGREE", 1), revisions(3)),
+		comment("c5", "a", "APPROVED", actions("FLAG", 2, "FLAG__COMMENT_DETECTED_SPAM", 2, "REACTION", 5)),
+		comment("c6", "b", "SYSTEM_WITHHELD", actions("FLAG", 1, "FLAG__COMMENT_DETECTED_TOXIC", 1), revisions(1)),
+		comment("c7", "b", "REJECTED", actions("FLAG", 4, "DONT_AGREE", 2)),
+		comment("c8", "b", "NONE", actions("REACTION", 12, "FEATURED", 1)),
+		comment("c9", "b", "APPROVED", actions("FEATURED", 1, "REACTION", 3), revisions(4)),
+		comment("c10", "c", "NONE", actions("FLAG", 2, "DONT_AGREE", 1), openFlags(0)),
+		comment("c11", "c", "NONE", actions("FLAG", 1), openFlags(1), revisions(2)),
+		comment("c12", "c", "APPROVED", actions("FLAG", 5), openFlags(2)),
+		comment("c13", "c", "PREMOD", actions("FLAG", 2, "FLAG__COMMENT_DETECTED_TOXIC", 2)),
+	}
+
+	statusQueue, err := ParseStatusQueueRule("featured:APPROVED|NONE:FEATURED:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allStatuses, err := ParseStatusQueueRule("everything:APPROVED|NONE|PREMOD|REJECTED|SYSTEM_WITHHELD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rules     func(rules *Rules)
+		openFlags bool
+	}{
+		{name: "default rules"},
+		{name: "reported approved", rules: func(rules *Rules) { rules.CountReportedApproved = true }},
+		{name: "coral v8 policy", rules: func(rules *Rules) { rules.ReportedPolicy = QueuePolicyCoralV8 }},
+		{name: "legacy policy with open flags", rules: func(rules *Rules) { rules.ReportedPolicy = QueuePolicyLegacy }, openFlags: true},
+		{name: "open flags", openFlags: true},
+		{name: "open flags and reported approved", rules: func(rules *Rules) { rules.CountReportedApproved = true }, openFlags: true},
+		{name: "excluded statuses", rules: func(rules *Rules) {
+			rules.ExcludedStatuses = map[string]struct{}{"REJECTED": {}, "PREMOD": {}}
+		}},
+		{name: "automated flags", rules: func(rules *Rules) {
+			rules.AutomatedFlagKeys = []string{"FLAG__COMMENT_DETECTED_TOXIC", "FLAG__COMMENT_DETECTED_SPAM"}
+			rules.ReportedPolicy = QueuePolicyCoralV8
+		}},
+		{name: "action queues", rules: func(rules *Rules) {
+			rules.ActionQueueRules = []ActionQueueRule{
+				{QueueName: "disagreed", ActionKey: "DONT_AGREE", Threshold: 0},
+				{QueueName: "popular", ActionKey: "REACTION", Threshold: 10},
+			}
+		}},
+		{name: "status queues", rules: func(rules *Rules) {
+			rules.StatusQueueRules = []StatusQueueRule{statusQueue, allStatuses}
+		}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			rules := DefaultRules()
+			if tt.openFlags {
+				rules.Fields.OpenFlags = "openFlags"
+			}
+			if tt.rules != nil {
+				tt.rules(&rules)
+			}
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, rules)
+			ctx := context.Background()
+
+			// Count the comments in memory.
+			p.AggregationMode = false
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, fixtures...))
+
+			scanned, _, err := p.loadStories(ctx, nil)
+			if err != nil {
+				mt.Fatalf("unexpected error counting in memory: %v", err)
+			}
+
+			// Count the same comments with the pipeline.
+			p.AggregationMode = true
+			pipeline := rules.storyPipeline(bson.D{}, rules.storyCountExpressions())
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, runPipeline(mt.T, pipeline, fixtures)...))
+
+			aggregated, _, err := p.loadStories(ctx, nil)
+			if err != nil {
+				mt.Fatalf("unexpected error counting with the aggregation: %v", err)
+			}
+
+			if len(aggregated) != len(scanned) {
+				mt.Fatalf("expected %d stories, got %d", len(scanned), len(aggregated))
+			}
+
+			for storyID, story := range scanned {
+				other, ok := aggregated[storyID]
+				if !ok {
+					mt.Errorf("expected story %s to be aggregated", storyID)
+					continue
+				}
+
+				// The counts are compared as they're written, the maps are decoded
+				// so the order of their keys doesn't matter.
+				want, wantCounts := writtenCounts(mt.T, &story.CommentCounts)
+				got, gotCounts := writtenCounts(mt.T, &other.CommentCounts)
+
+				if !reflect.DeepEqual(wantCounts, gotCounts) {
+					mt.Errorf("story %s counts differ\nin memory:   %s\naggregation: %s", storyID, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregationUnsupported(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         func(rules *Rules)
+		limit         int
+		atClusterTime time.Time
+		want          []string
+	}{
+		{name: "default rules"},
+		{name: "supported rules", rules: func(rules *Rules) {
+			rules.CountReportedApproved = true
+			rules.AutomatedFlagKeys = []string{"FLAG__COMMENT_DETECTED_TOXIC"}
+			rules.ExcludedStatuses = map[string]struct{}{"REJECTED": {}}
+			rules.ActionQueueRules = []ActionQueueRule{{QueueName: "q", ActionKey: "FLAG", Threshold: 1}}
+		}},
+		{name: "by source", rules: func(rules *Rules) { rules.CountBySource = true }, want: []string{"countBySource"}},
+		{name: "normalized story IDs", rules: func(rules *Rules) {
+			rules.StoryIDNormalizer = func(storyID string) string { return storyID }
+		}, want: []string{"storyIDPattern"}},
+		{name: "limited stories", limit: 10, want: []string{"limitStories"}},
+		{name: "at a cluster time", atClusterTime: time.Unix(1600000000, 0), want: []string{"atClusterTime"}},
+		{name: "several", rules: func(rules *Rules) {
+			rules.CountRatings = true
+			rules.CountDistinctAuthors = true
+			rules.CheckCreatedAt = true
+			rules.ActionKeyCase = ActionKeysUpper
+		}, limit: 1, want: []string{"countRatings", "countDistinctAuthors", "checkCreatedAt", "actionKeyCase", "limitStories"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			if tt.rules != nil {
+				tt.rules(&rules)
+			}
+
+			p := NewProcessor(nil, "tenant", "site", false, rules)
+			p.LimitStories = tt.limit
+			p.AtClusterTime = tt.atClusterTime
+
+			if got := p.AggregationUnsupported(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package counts
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// QueuePolicy are the rules for which flagged comments are counted in the
+// reported queue. Versions of Coral differ in how they treat flagged comments
+// that were approved or withheld, so the policy matching the version of Coral
+// that's being counted for is selected with --queuePolicy. Every policy counts
+// comments without a status decision that have flags in the reported queue,
+// and comments that are premod or withheld in the pending queue.
+type QueuePolicy struct {
+	// Name is the name the policy is selected by.
+	Name string
+
+	// ReportedApproved when true counts approved comments with flags in the
+	// reported queue, as well as in the reportedApproved count.
+	ReportedApproved bool
+
+	// ReportedWithheld when true counts system withheld comments with flags in
+	// the reported queue, as well as in the pending queue.
+	ReportedWithheld bool
+
+	// ResolvedFlags when true counts comments in the reported queue by every
+	// flag they've had, ignoring the count of their open flags.
+	ResolvedFlags bool
+}
+
+// The policies that can be selected. QueuePolicyCoralV7 is the default, where
+// approved comments are only counted in the reported queue when
+// CountReportedApproved is enabled. QueuePolicyCoralV8 also counts approved and
+// system withheld comments with flags in the reported queue. QueuePolicyLegacy
+// is for versions of Coral that don't resolve flags, where comments stay in the
+// reported queue as long as they've ever been flagged.
+var (
+	QueuePolicyCoralV7 = QueuePolicy{
+		Name: "coral-v7",
+	}
+	QueuePolicyCoralV8 = QueuePolicy{
+		Name:             "coral-v8",
+		ReportedApproved: true,
+		ReportedWithheld: true,
+	}
+	QueuePolicyLegacy = QueuePolicy{
+		Name:          "legacy",
+		ResolvedFlags: true,
+	}
+)
+
+// QueuePolicies are the policies that can be selected.
+var QueuePolicies = []QueuePolicy{
+	QueuePolicyCoralV7,
+	QueuePolicyCoralV8,
+	QueuePolicyLegacy,
+}
+
+// ParseQueuePolicy will return the policy with the name.
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	names := make([]string, 0, len(QueuePolicies))
+	for _, policy := range QueuePolicies {
+		if policy.Name == name {
+			return policy, nil
+		}
+
+		names = append(names, policy.Name)
+	}
+
+	return QueuePolicy{}, errors.Errorf("expected the queue policy to be one of %s, found %s", strings.Join(names, ","), name)
+}
+
+// countsApproved returns true when approved comments with flags are counted in
+// the reported queue, either by the ReportedPolicy or as CountReportedApproved
+// is enabled.
+func (r *Rules) countsApproved() bool {
+	return r.ReportedPolicy.ReportedApproved || r.CountReportedApproved
+}
+
+// Reported returns true when the comment's flags place it in the reported
+// queue, its status isn't considered. When the comment has a count of its open
+// flags, resolved flags are ignored unless the ReportedPolicy counts them,
+// otherwise every flag is counted.
+func (r *Rules) Reported(comment *Comment) bool {
+	if comment.OpenFlags != nil && !r.ReportedPolicy.ResolvedFlags {
+		return *comment.OpenFlags > 0
+	}
+
+	return r.ActionCount(comment, "FLAG") > 0
+}
+
+// reportedStatuses returns the statuses of the comments that can be counted in
+// the reported queue.
+func (r *Rules) reportedStatuses() []string {
+	statuses := []string{"NONE"}
+	if r.countsApproved() {
+		statuses = append(statuses, "APPROVED")
+	}
+	if r.ReportedPolicy.ReportedWithheld {
+		statuses = append(statuses, "SYSTEM_WITHHELD")
+	}
+
+	return statuses
+}
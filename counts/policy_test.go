@@ -0,0 +1,122 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueuePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    QueuePolicy
+		wantErr bool
+	}{
+		{"coral-v7", QueuePolicyCoralV7, false},
+		{"coral-v8", QueuePolicyCoralV8, false},
+		{"legacy", QueuePolicyLegacy, false},
+		{"", QueuePolicy{}, true},
+		{"Coral-V8", QueuePolicy{}, true},
+		{"coral-v9", QueuePolicy{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseQueuePolicy(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQueuePolicy(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParseQueuePolicy(%q) = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueuePolicyQueues(t *testing.T) {
+	open := func(n int) *int { return &n }
+
+	// Every policy counts the same comments, which each have flags.
+	comments := []Comment{
+		{Status: "NONE", ActionCounts: map[string]int{"FLAG": 1}, OpenFlags: open(1)},
+		{Status: "NONE", ActionCounts: map[string]int{"FLAG": 1}, OpenFlags: open(0)},
+		{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 1}, OpenFlags: open(1)},
+		{Status: "APPROVED", ActionCounts: map[string]int{"FLAG": 1}},
+		{Status: "SYSTEM_WITHHELD", ActionCounts: map[string]int{"FLAG": 1}, OpenFlags: open(1)},
+		{Status: "PREMOD", ActionCounts: map[string]int{"FLAG": 1}},
+	}
+
+	tests := []struct {
+		name                  string
+		policy                QueuePolicy
+		countReportedApproved bool
+		wantStatuses          []string
+		wantReported          int
+		wantReportedApproved  int
+	}{
+		{
+			name:         "coral-v7",
+			policy:       QueuePolicyCoralV7,
+			wantStatuses: []string{"NONE"},
+			wantReported: 1,
+		},
+		{
+			name:                  "coral-v7 counting approved",
+			policy:                QueuePolicyCoralV7,
+			countReportedApproved: true,
+			wantStatuses:          []string{"NONE", "APPROVED"},
+			wantReported:          3,
+			wantReportedApproved:  2,
+		},
+		{
+			name:                 "coral-v8",
+			policy:               QueuePolicyCoralV8,
+			wantStatuses:         []string{"NONE", "APPROVED", "SYSTEM_WITHHELD"},
+			wantReported:         4,
+			wantReportedApproved: 2,
+		},
+		{
+			name:         "legacy",
+			policy:       QueuePolicyLegacy,
+			wantStatuses: []string{"NONE"},
+			wantReported: 2,
+		},
+		{
+			name:                  "legacy counting approved",
+			policy:                QueuePolicyLegacy,
+			countReportedApproved: true,
+			wantStatuses:          []string{"NONE", "APPROVED"},
+			wantReported:          4,
+			wantReportedApproved:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.ReportedPolicy = tt.policy
+			rules.CountReportedApproved = tt.countReportedApproved
+
+			if got := rules.reportedStatuses(); !reflect.DeepEqual(got, tt.wantStatuses) {
+				t.Errorf("expected reported statuses %v, got %v", tt.wantStatuses, got)
+			}
+
+			var queue CommentModerationQueue
+			for i := range comments {
+				queue.Increment(&comments[i], &rules)
+			}
+
+			// The policy only changes the reported queue, approved comments are never
+			// in the total.
+			if queue.Total != 4 || queue.Queues.Unmoderated != 4 || queue.Queues.Pending != 2 {
+				t.Errorf("expected a total of 4 with 4 unmoderated and 2 pending, got %d with %d and %d", queue.Total, queue.Queues.Unmoderated, queue.Queues.Pending)
+			}
+			if queue.Queues.Reported != tt.wantReported {
+				t.Errorf("expected %d reported, got %d", tt.wantReported, queue.Queues.Reported)
+			}
+			if queue.Queues.ReportedApproved != tt.wantReportedApproved {
+				t.Errorf("expected %d reported approved, got %d", tt.wantReportedApproved, queue.Queues.ReportedApproved)
+			}
+		})
+	}
+}
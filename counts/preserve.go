@@ -0,0 +1,90 @@
+package counts
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// countsUpdate returns the update that replaces the stored commentCounts with
+// the counts. When PreserveExtraFields is enabled, each of the known fields is
+// set on its own instead, and the known fields that are left out of the counts
+// (as they're empty) are unset so they aren't left stale.
+func (p *Processor) countsUpdate(counts interface{}) (bson.D, error) {
+	if !p.PreserveExtraFields {
+		return bson.D{
+			primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: "commentCounts", Value: counts},
+			}},
+		}, nil
+	}
+
+	data, err := bson.Marshal(counts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal the counts")
+	}
+
+	elements, err := bson.Raw(data).Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the counts")
+	}
+
+	set := make(bson.D, 0, len(elements))
+	present := make(map[string]struct{}, len(elements))
+	for _, element := range elements {
+		set = append(set, primitive.E{Key: "commentCounts." + element.Key(), Value: element.Value()})
+		present[element.Key()] = struct{}{}
+	}
+
+	var unset bson.D
+	for _, field := range countsFields(counts) {
+		if _, ok := present[field]; !ok {
+			unset = append(unset, primitive.E{Key: "commentCounts." + field, Value: ""})
+		}
+	}
+
+	update := bson.D{
+		primitive.E{Key: "$set", Value: set},
+	}
+	if len(unset) > 0 {
+		update = append(update, primitive.E{Key: "$unset", Value: unset})
+	}
+
+	return update, nil
+}
+
+// countsFields returns the names of the fields of the counts struct as they're
+// stored.
+func countsFields(counts interface{}) []string {
+	t := reflect.TypeOf(counts)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("bson"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fields = append(fields, name)
+	}
+
+	return fields
+}
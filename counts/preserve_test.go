@@ -0,0 +1,123 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCountsUpdate(t *testing.T) {
+	keys := func(value interface{}) []string {
+		doc, ok := value.(bson.D)
+		if !ok {
+			return nil
+		}
+
+		keys := make([]string, 0, len(doc))
+		for _, e := range doc {
+			keys = append(keys, e.Key)
+		}
+
+		return keys
+	}
+
+	tests := []struct {
+		name      string
+		preserve  bool
+		counts    interface{}
+		wantSet   []string
+		wantUnset []string
+	}{
+		{
+			name:    "replaces the user counts",
+			counts:  UserCommentCounts{Status: CommentStatusCounts{Approved: 1}},
+			wantSet: []string{"commentCounts"},
+		},
+		{
+			name:    "replaces the story counts",
+			counts:  StoryCommentCounts{Action: CommentActionCounts{}, DistinctAuthors: 2},
+			wantSet: []string{"commentCounts"},
+		},
+		{
+			name:     "sets each of the user counts",
+			preserve: true,
+			counts:   UserCommentCounts{Status: CommentStatusCounts{Approved: 1}},
+			wantSet:  []string{"commentCounts.status"},
+		},
+		{
+			name:      "unsets the empty story counts",
+			preserve:  true,
+			counts:    StoryCommentCounts{Action: CommentActionCounts{}},
+			wantSet:   []string{"commentCounts.action", "commentCounts.status", "commentCounts.moderationQueue"},
+			wantUnset: []string{"commentCounts.source", "commentCounts.distinctAuthors", "commentCounts.ratings"},
+		},
+		{
+			name:     "sets the optional story counts",
+			preserve: true,
+			counts: &StoryCommentCounts{
+				Action:          CommentActionCounts{},
+				Source:          CommentSourceCounts{"web": 1},
+				DistinctAuthors: 2,
+				Ratings:         &CommentRatingCounts{Count: 1, Sum: 5, Average: 5},
+			},
+			wantSet: []string{"commentCounts.action", "commentCounts.status", "commentCounts.moderationQueue", "commentCounts.source", "commentCounts.distinctAuthors", "commentCounts.ratings"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.PreserveExtraFields = tt.preserve
+
+			update, err := p.countsUpdate(tt.counts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var set, unset []string
+			for _, e := range update {
+				switch e.Key {
+				case "$set":
+					set = keys(e.Value)
+				case "$unset":
+					unset = keys(e.Value)
+				default:
+					t.Errorf("unexpected operator %s", e.Key)
+				}
+			}
+
+			if !reflect.DeepEqual(set, tt.wantSet) {
+				t.Errorf("expected $set of %v, got %v", tt.wantSet, set)
+			}
+			if !reflect.DeepEqual(unset, tt.wantUnset) {
+				t.Errorf("expected $unset of %v, got %v", tt.wantUnset, unset)
+			}
+		})
+	}
+}
+
+func TestCountsFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts interface{}
+		want   []string
+	}{
+		{"user counts", UserCommentCounts{}, []string{"status"}},
+		{"pointer to story counts", &StoryCommentCounts{}, []string{"action", "status", "moderationQueue", "source", "distinctAuthors", "ratings"}},
+		{"not a struct", map[string]int{}, nil},
+		{"untagged and unexported fields", struct {
+			Total   int
+			skipped int
+			Ignored int `bson:"-"`
+		}{}, []string{"total"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countsFields(tt.counts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("countsFields(%T) = %v, want %v", tt.counts, got, tt.want)
+			}
+		})
+	}
+}
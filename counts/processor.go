@@ -0,0 +1,457 @@
+package counts
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Processor processes the counts for a site. It holds the rules for how the
+// comments are counted, and the configuration for how they're read and the
+// counts are written, so it can be constructed once and used for each step of
+// processing.
+type Processor struct {
+	DB       *mongo.Database
+	TenantID string
+	SiteID   string
+
+	// DryRun when true will prevent any writes from being made.
+	DryRun bool
+
+	// Rules are the rules for how the comments are counted.
+	Rules Rules
+
+	// BatchSize is the maximum number of updates in a bulk write.
+	BatchSize int
+
+	// TargetBatchBytes when greater than zero will tune the number of updates in
+	// each bulk write to the number that keeps the batch at around this size in
+	// bytes, based on the average size of the updates in the first batch, rather
+	// than using the BatchSize after the first batch.
+	TargetBatchBytes int
+
+	// WriteQueueDepth is the number of full batches that can be waiting to be
+	// written before producing more updates blocks.
+	WriteQueueDepth int
+
+	// WriteConcurrency is the number of writers that will concurrently issue
+	// bulk writes.
+	WriteConcurrency int
+
+	// OutputCollectionSuffix when set will redirect all writes to collections
+	// with this suffix appended to their name. Reads are still made against the
+	// original collections.
+	OutputCollectionSuffix string
+
+	// ReadConcern and ReadPreference are used when scanning the comments, when
+	// nil the ones configured on the client are used.
+	ReadConcern    *readconcern.ReadConcern
+	ReadPreference *readpref.ReadPref
+
+	// AtClusterTime when set is the cluster time that the comments are scanned
+	// at with the snapshot read concern, instead of the ReadConcern.
+	AtClusterTime time.Time
+
+	// CommentsCollections are the names or glob patterns of the collections
+	// that the comments are scanned from, when empty the comments collection is
+	// scanned.
+	CommentsCollections []string
+
+	// CommentFilter when set is an additional filter that the comments must
+	// match to be counted.
+	CommentFilter bson.D
+
+	// ScanSort is the order that the comments are scanned in when counting
+	// stories, one of ScanSortNatural, ScanSortCreatedAt, or ScanSortStoryID.
+	ScanSort string
+
+	// ScanShards is the number of parallel cursors the scan of the site's
+	// comments is split into. When less than 2, the comments are scanned with a
+	// single cursor.
+	ScanShards int
+
+	// AggregationMode when true will count the stories with an aggregation on
+	// the server rather than decoding and counting every comment, so the memory
+	// used grows with the number of stories instead of the number of comments.
+	// Only some of the rules can be counted this way, see
+	// AggregationUnsupported.
+	AggregationMode bool
+
+	// StrictInvariants when true will cause processing to fail when the computed
+	// counts fail validation instead of just logging a warning.
+	StrictInvariants bool
+
+	// AuditCollection when set is the collection that a record of every changed
+	// count is written to, and RunID identifies the run in those records.
+	AuditCollection string
+	RunID           string
+
+	// DeadLetterCollection when set is the name of the collection that documents
+	// that could not be processed are recorded in. Comments that can not be
+	// decoded and documents that can not be written are then skipped rather
+	// than aborting the run.
+	DeadLetterCollection string
+
+	// LimitStories and LimitUsers when greater than zero are the most stories
+	// and users that are counted when every story or user is processed.
+	LimitStories int
+	LimitUsers   int
+
+	// UsersFilter, UsersRoles, and UsersCommentedWithin when set select the
+	// users that SelectedUsers processes: the users matching the filter on the
+	// users collection, with one of the roles (such as STAFF or MODERATOR), and
+	// who have commented on the site within the duration.
+	UsersFilter          bson.D
+	UsersRoles           []string
+	UsersCommentedWithin time.Duration
+
+	// StreamUsers when true will scan the comments sorted by their author, so
+	// each user's counts are complete once the scan moves past their comments
+	// and can be written then. Only the users waiting to be written are held in
+	// memory, rather than every user on the site.
+	StreamUsers bool
+
+	// OnlyDrift when true will only write the stories and users whose stored
+	// counts differ from the computed counts.
+	OnlyDrift bool
+
+	// EstimateChanges when true will have dry runs compare the computed counts
+	// with the stored counts, to report how many stories and users a real run
+	// would change rather than how many updates it would issue.
+	EstimateChanges bool
+
+	// UpsertStories when true will create story documents for stories that have
+	// comments but no story document. The created documents only contain the
+	// story's ID's and counts, which Coral may not expect.
+	UpsertStories bool
+
+	// UpdateDuplicateStories when true will update every story document with a
+	// story's ID rather than only one of them, so that duplicate story documents
+	// don't keep stale counts. The site's counts only include each story once.
+	UpdateDuplicateStories bool
+
+	// Transactional when true will write the stories and the site together in
+	// a transaction with StoriesTransaction, rather than separately.
+	Transactional bool
+
+	// OptimisticWrites when true will read the counts of the stories before
+	// their comments are counted, and only write the counts of each story when
+	// its counts are still the ones that were read. A story whose counts were
+	// changed in the meantime isn't overwritten, and is returned as conflicted
+	// so it can be recounted instead.
+	OptimisticWrites bool
+
+	// PreserveExtraFields when true will set each of the known counts within the
+	// commentCounts rather than replacing the whole commentCounts, so fields
+	// that Coral (or a plugin) stores alongside them are kept.
+	PreserveExtraFields bool
+
+	// StampRecomputeMarker when true will set the RecomputeAtField and the
+	// RecomputeRunIDField alongside the commentCounts in every update to the
+	// stories, sites, and users.
+	StampRecomputeMarker bool
+
+	// DetectOrphanedUsers when true will check that every author of the comments
+	// counted for users has a user document, and StrictOrphanedUsers when true
+	// will fail processing the users when any don't.
+	DetectOrphanedUsers bool
+	StrictOrphanedUsers bool
+
+	// SnapshotHistory when true will record a snapshot of the site's counts in
+	// the HistoryCollection each time every story on the site is counted.
+	SnapshotHistory bool
+
+	// TopStories when set will log this many of the stories with the most
+	// comments once every story on the site has been counted.
+	TopStories int
+
+	// Hints when true will hint the index to use for story and user updates.
+	// Updates to the suffixed collections are never hinted.
+	Hints bool
+
+	// Destination is the Sink that the counts of every story and user are
+	// written to.
+	Destination Sink
+
+	// Events when set is the Publisher that the counts of each story and user
+	// are published with after they're written. PublishOnly when true will
+	// publish them even though DryRun is enabled, and PublishFailurePolicy is
+	// what happens when they could not be published.
+	Events               Publisher
+	PublishOnly          bool
+	PublishFailurePolicy string
+
+	// Lag when set pauses the bulk writes while the replication lag of the
+	// cluster is too high.
+	Lag *LagMonitor
+
+	// TenantScan when set counts the site's stories with the stories of the
+	// other sites of the scan, when it's one of them.
+	TenantScan *TenantScan
+
+	// Metrics is the Recorder that metrics about processing are recorded with,
+	// and SlowQueryThreshold when set is the duration after which a single bulk
+	// write or find batch is logged as slow.
+	Metrics            Recorder
+	SlowQueryThreshold time.Duration
+
+	// Timeouts are the deadlines of the cursor closes and the batch writes,
+	// which aren't bounded by the run itself.
+	Timeouts PhaseTimeouts
+
+	// slowBatches is the number of batches that took longer than the
+	// SlowQueryThreshold, which is shared by the copies of the Processor.
+	slowBatches *int64
+}
+
+// NewProcessor will create a Processor for the site that counts the comments
+// with the rules, and is otherwise configured with the defaults.
+func NewProcessor(db *mongo.Database, tenantID, siteID string, dryRun bool, rules Rules) *Processor {
+	return &Processor{
+		DB:                   db,
+		TenantID:             tenantID,
+		SiteID:               siteID,
+		DryRun:               dryRun,
+		Rules:                rules,
+		BatchSize:            DefaultBatchSize,
+		WriteQueueDepth:      DefaultWriteQueueDepth,
+		WriteConcurrency:     DefaultWriteConcurrency,
+		ScanSort:             ScanSortNatural,
+		ScanShards:           1,
+		Hints:                true,
+		Destination:          MongoSink{},
+		PublishFailurePolicy: PublishFailureWarn,
+		Metrics:              noopRecorder{},
+		Timeouts:             DefaultTimeouts,
+		slowBatches:          new(int64),
+	}
+}
+
+// reader returns a copy of the Processor that doesn't write, for the steps that
+// only read from the database. Any comments that can't be decoded aren't
+// recorded either.
+func (p *Processor) reader() *Processor {
+	reader := *p
+	reader.DryRun = true
+
+	return &reader
+}
+
+// ProcessStories will iterate over each stories comments and aggregate the
+// results to update the cached counts for each story. `storyID`'s are optional,
+// and will limit the total stories that are processed.
+func ProcessStories(ctx context.Context, db *mongo.Database, tenantID, siteID string, storyIDs []string, dryRun bool) (*StoriesResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).Stories(ctx, storyIDs)
+}
+
+// Stories will count the comments on the site's stories and update their
+// counts. `storyID`'s are optional, and will limit the stories that are
+// processed.
+func (p *Processor) Stories(ctx context.Context, storyIDs []string) (*StoriesResult, error) {
+	// Count the comments on the stories.
+	stories, versions, err := p.loadStories(ctx, storyIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.writeStories(ctx, storyIDs, stories, versions)
+}
+
+// outputCollection will return the collection that writes destined for the
+// named collection should be made against.
+func (p *Processor) outputCollection(name string) *mongo.Collection {
+	return p.DB.Collection(name + p.OutputCollectionSuffix)
+}
+
+// shadowing returns true when writes are being redirected away from the
+// original collections. As the shadow collections won't have the documents or
+// the indexes of the original collections, writes to them are upserted and not
+// hinted.
+func (p *Processor) shadowing() bool {
+	return p.OutputCollectionSuffix != ""
+}
+
+// hinting returns true when updates should hint the index to use.
+func (p *Processor) hinting() bool {
+	return p.Hints && !p.shadowing()
+}
+
+// upsertingStories returns true when story updates should create missing story
+// documents.
+func (p *Processor) upsertingStories() bool {
+	return p.UpsertStories || p.shadowing()
+}
+
+// commentsCollection returns the named comments collection configured to be
+// scanned with the ReadConcern and ReadPreference.
+func (p *Processor) commentsCollection(name string) *mongo.Collection {
+	opts := options.Collection()
+	if p.ReadConcern != nil {
+		opts.SetReadConcern(p.ReadConcern)
+	}
+	if p.ReadPreference != nil {
+		opts.SetReadPreference(p.ReadPreference)
+	}
+
+	return p.DB.Collection(name, opts)
+}
+
+// commentsCollections returns the collections that the comments are scanned
+// from. Glob patterns are matched against the collections in the database, and
+// it's an error for a pattern to not match any of them.
+func (p *Processor) commentsCollections(ctx context.Context) ([]*mongo.Collection, error) {
+	if len(p.CommentsCollections) == 0 {
+		return []*mongo.Collection{p.commentsCollection("comments")}, nil
+	}
+
+	// Only list the collections when there's a pattern to match against them.
+	var existing []string
+	for _, pattern := range p.CommentsCollections {
+		if hasGlob(pattern) {
+			names, err := p.DB.ListCollectionNames(ctx, bson.D{})
+			if err != nil {
+				return nil, errors.Wrap(err, "could not list the collections")
+			}
+
+			existing = names
+			sort.Strings(existing)
+			break
+		}
+	}
+
+	seen := make(map[string]struct{})
+	var collections []*mongo.Collection
+	add := func(name string) {
+		if _, ok := seen[name]; ok {
+			return
+		}
+
+		seen[name] = struct{}{}
+		collections = append(collections, p.commentsCollection(name))
+	}
+
+	for _, pattern := range p.CommentsCollections {
+		if !hasGlob(pattern) {
+			add(pattern)
+			continue
+		}
+
+		matched := false
+		for _, name := range existing {
+			if ok, err := path.Match(pattern, name); err != nil {
+				return nil, errors.Wrapf(err, "could not match the comments collection pattern %s", pattern)
+			} else if ok {
+				add(name)
+				matched = true
+			}
+		}
+
+		if !matched {
+			return nil, errors.Errorf("no collections in the %s database match the comments collection pattern %s", p.DB.Name(), pattern)
+		}
+	}
+
+	return collections, nil
+}
+
+// findComments will find the comments matching the filter in each of the
+// comments collections in turn, and call fn with the cursor for each of them.
+// Each cursor is closed once fn returns.
+func (p *Processor) findComments(ctx context.Context, filter bson.D, opts *options.FindOptions, fn func(collection string, cursor *mongo.Cursor) error) error {
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter = p.mergeCommentFilter(filter)
+
+	for _, collection := range collections {
+		if err := func() error {
+			var (
+				cursor *mongo.Cursor
+				err    error
+			)
+
+			started := time.Now()
+			if p.AtClusterTime.IsZero() {
+				cursor, err = collection.Find(ctx, filter, opts)
+			} else {
+				cursor, err = p.findSnapshot(ctx, collection, filter, opts)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "could not create the cursor for %s", collection.Name())
+			}
+			p.checkSlowBatch("find", collection.Name(), cursor.RemainingBatchLength(), time.Since(started))
+			defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+			if err := fn(collection.Name(), cursor); err != nil {
+				if !p.AtClusterTime.IsZero() && snapshotUnavailable(err) {
+					return errors.Wrapf(err, "the --atClusterTime %s fell outside of the snapshot history of the server while scanning %s", p.AtClusterTime.Format(time.RFC3339), collection.Name())
+				}
+
+				return err
+			}
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeCursor will close the cursor. It doesn't use the context of the scan as
+// that's canceled on shutdown, and a cursor that isn't exhausted can only be
+// killed on the server with a live context, so it's bounded by the timeout
+// instead. Failures are only logged, the server times out cursors that aren't
+// closed.
+func closeCursor(cursor *mongo.Cursor, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := cursor.Close(ctx); err != nil {
+		logrus.WithError(err).Warn("could not close cursor")
+	}
+}
+
+// hasGlob returns true when the collection name is a glob pattern.
+func hasGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// newBatchWriter will create a writer for the named output collection. The name
+// of the documents being written is used in logs and metrics.
+func (p *Processor) newBatchWriter(collection, name string) *batchWriter {
+	bw := &batchWriter{
+		collection:   p.outputCollection(collection),
+		name:         name,
+		tenantID:     p.TenantID,
+		siteID:       p.SiteID,
+		dryRun:       p.DryRun,
+		batchSize:    p.BatchSize,
+		maxBytes:     MaxBatchWriteBytes,
+		targetBytes:  p.TargetBatchBytes,
+		queueDepth:   p.WriteQueueDepth,
+		concurrency:  p.WriteConcurrency,
+		lag:          p.Lag,
+		writeTimeout: p.Timeouts.PerBatchWrite,
+		metrics:      p.Metrics,
+		checkSlow:    p.checkSlowBatch,
+	}
+	if p.DeadLetterCollection != "" {
+		bw.deadLetters = p.DB.Collection(p.DeadLetterCollection)
+	}
+
+	return bw
+}
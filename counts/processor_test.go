@@ -0,0 +1,191 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// collectionNames is the response to listing the collections with the names.
+func collectionNames(names ...string) bson.D {
+	docs := make([]bson.D, 0, len(names))
+	for _, name := range names {
+		docs = append(docs, bson.D{
+			primitive.E{Key: "name", Value: name},
+			primitive.E{Key: "type", Value: "collection"},
+		})
+	}
+
+	return mtest.CreateCursorResponse(0, "coral.$cmd.listCollections", mtest.FirstBatch, docs...)
+}
+
+func TestCommentsCollections(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		patterns  []string
+		existing  []string
+		want      []string
+		wantErr   string
+		wantLists int
+	}{
+		{
+			name: "default collection",
+			want: []string{"comments"},
+		},
+		{
+			name:     "named collections",
+			patterns: []string{"comments_2024", "comments_2025", "comments_2024"},
+			want:     []string{"comments_2024", "comments_2025"},
+		},
+		{
+			name:      "glob pattern",
+			patterns:  []string{"comments_*"},
+			existing:  []string{"stories", "comments_2025", "comments_2024", "users"},
+			want:      []string{"comments_2024", "comments_2025"},
+			wantLists: 1,
+		},
+		{
+			name:      "glob pattern and name",
+			patterns:  []string{"comments", "comments_202?"},
+			existing:  []string{"comments", "comments_2024"},
+			want:      []string{"comments", "comments_2024"},
+			wantLists: 1,
+		},
+		{
+			name:      "glob pattern without a match",
+			patterns:  []string{"archive_*"},
+			existing:  []string{"comments"},
+			wantErr:   "match the comments collection pattern archive_*",
+			wantLists: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			if tt.wantLists > 0 {
+				mt.AddMockResponses(collectionNames(tt.existing...))
+			}
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.CommentsCollections = tt.patterns
+
+			collections, err := p.commentsCollections(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make([]string, 0, len(collections))
+			for _, collection := range collections {
+				got = append(got, collection.Name())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected %v, got %v", tt.want, got)
+			}
+
+			if lists := len(mt.GetAllStartedEvents()); lists != tt.wantLists {
+				mt.Errorf("expected %d commands to list the collections, got %d", tt.wantLists, lists)
+			}
+		})
+	}
+}
+
+func TestScanStoriesAcrossCollections(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(id, storyID, status string) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "storyID", Value: storyID},
+			primitive.E{Key: "status", Value: status},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		collections [][]bson.D
+		want        map[string]CommentStatusCounts
+	}{
+		{
+			name: "stories in different collections",
+			collections: [][]bson.D{
+				{comment("c1", "a", "APPROVED")},
+				{comment("c2", "b", "REJECTED")},
+			},
+			want: map[string]CommentStatusCounts{
+				"a": {Approved: 1},
+				"b": {Rejected: 1},
+			},
+		},
+		{
+			name: "story spread across collections",
+			collections: [][]bson.D{
+				{comment("c1", "a", "APPROVED"), comment("c2", "a", "NONE")},
+				{comment("c3", "a", "APPROVED"), comment("c4", "b", "PREMOD")},
+			},
+			want: map[string]CommentStatusCounts{
+				"a": {Approved: 2, None: 1},
+				"b": {Premod: 1},
+			},
+		},
+		{
+			name: "empty collection",
+			collections: [][]bson.D{
+				{},
+				{comment("c1", "a", "APPROVED")},
+			},
+			want: map[string]CommentStatusCounts{
+				"a": {Approved: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.CommentsCollections = nil
+
+			for i, comments := range tt.collections {
+				name := "comments_" + string(rune('a'+i))
+				p.CommentsCollections = append(p.CommentsCollections, name)
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral."+name, mtest.FirstBatch, comments...))
+			}
+
+			stories, err := p.scanStories(context.Background(), bson.D{}, bson.D{}, 0)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(stories) != len(tt.want) {
+				mt.Fatalf("expected %d stories, got %d", len(tt.want), len(stories))
+			}
+			for storyID, want := range tt.want {
+				story, ok := stories[storyID]
+				if !ok {
+					mt.Fatalf("expected story %s to be counted", storyID)
+				}
+				if story.CommentCounts.Status != want {
+					mt.Errorf("expected story %s to have %+v, got %+v", storyID, want, story.CommentCounts.Status)
+				}
+			}
+
+			if finds := len(mt.GetAllStartedEvents()); finds != len(tt.collections) {
+				mt.Errorf("expected a find on each of the %d collections, got %d", len(tt.collections), finds)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package counts
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// commentProjection will return the projection of the fields of the comments,
+// skipping any that are empty (such as an OpenFlags that isn't configured) or
+// repeated. Fields that a scan reads must be projected, as a field that isn't
+// decodes to its zero value rather than failing.
+func commentProjection(fields ...string) bson.D {
+	projection := make(bson.D, 0, len(fields))
+	seen := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+
+		if _, ok := seen[field]; ok {
+			continue
+		}
+		seen[field] = struct{}{}
+
+		projection = append(projection, primitive.E{Key: field, Value: 1})
+	}
+
+	return projection
+}
+
+// storyFields returns the fields of the comments that Story.Increment reads with
+// the rules.
+func (r *Rules) storyFields() []string {
+	fields := []string{
+		r.Fields.StoryID,
+		r.Fields.Status,
+		r.Fields.ActionCounts,
+		r.Fields.OpenFlags,
+	}
+
+	if r.CountBySource {
+		fields = append(fields, r.Fields.Source)
+	}
+
+	if r.CountDistinctAuthors {
+		fields = append(fields, r.Fields.AuthorID)
+	}
+
+	if r.CountRatings {
+		fields = append(fields, r.Fields.Rating)
+	}
+
+	if r.MaxCommentAge > 0 {
+		fields = append(fields, r.Fields.CreatedAt)
+	}
+
+	if r.CheckCreatedAt {
+		fields = append(fields, r.Fields.ID, r.Fields.CreatedAt)
+	}
+
+	return fields
+}
+
+// userFields returns the fields of the comments that User.Increment reads.
+func (r *Rules) userFields() []string {
+	return []string{
+		r.Fields.AuthorID,
+		r.Fields.Status,
+	}
+}
+
+// storyProjection returns the projection of the comments for counting them on
+// their stories with the rules.
+func (r *Rules) storyProjection() bson.D {
+	return commentProjection(r.storyFields()...)
+}
+
+// userProjection returns the projection of the comments for counting them for
+// their authors.
+func (r *Rules) userProjection() bson.D {
+	return commentProjection(r.userFields()...)
+}
@@ -0,0 +1,75 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// projectedFields returns the fields of the projection in order.
+func projectedFields(rules *Rules) []string {
+	projection := rules.storyProjection()
+
+	fields := make([]string, 0, len(projection))
+	for _, e := range projection {
+		fields = append(fields, e.Key)
+	}
+
+	return fields
+}
+
+func TestStoryProjection(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     func(rules *Rules)
+		openFlags string
+		want      []string
+	}{
+		{
+			name: "default",
+			want: []string{"storyID", "status", "actionCounts"},
+		},
+		{
+			name:      "open flags",
+			openFlags: "openFlags",
+			want:      []string{"storyID", "status", "actionCounts", "openFlags"},
+		},
+		{
+			name:  "by source",
+			rules: func(rules *Rules) { rules.CountBySource = true },
+			want:  []string{"storyID", "status", "actionCounts", "source"},
+		},
+		{
+			name:  "distinct authors",
+			rules: func(rules *Rules) { rules.CountDistinctAuthors = true },
+			want:  []string{"storyID", "status", "actionCounts", "authorID"},
+		},
+		{
+			name:  "ratings",
+			rules: func(rules *Rules) { rules.CountRatings = true },
+			want:  []string{"storyID", "status", "actionCounts", "rating"},
+		},
+		{
+			name: "stale and checked createdAt projected once",
+			rules: func(rules *Rules) {
+				rules.MaxCommentAge = time.Hour
+				rules.CheckCreatedAt = true
+			},
+			want: []string{"storyID", "status", "actionCounts", "createdAt", "id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.Fields.OpenFlags = tt.openFlags
+			if tt.rules != nil {
+				tt.rules(&rules)
+			}
+
+			if got := projectedFields(&rules); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package counts
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimingBuckets are the upper bounds in seconds of the buckets of the
+// histograms that timings are recorded in by the PrometheusRecorder.
+var TimingBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PrometheusRecorder is a Recorder that keeps the metrics in memory so they can
+// be scraped by Prometheus from its ServeHTTP. Counts are exposed as counters
+// with a _total suffix, and timings as histograms in seconds with a _seconds
+// suffix.
+type PrometheusRecorder struct {
+	prefix string
+
+	mux        sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+// histogram is the buckets, sum, and count of the timings recorded for a name.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewPrometheusRecorder will create a Recorder that exposes the metrics with
+// each metric name prefixed by prefix.
+func NewPrometheusRecorder(prefix string) *PrometheusRecorder {
+	return &PrometheusRecorder{
+		prefix:     prefix,
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (r *PrometheusRecorder) Count(name string, value int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.counters[name] += value
+}
+
+func (r *PrometheusRecorder) Gauge(name string, value float64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.gauges[name] = value
+}
+
+func (r *PrometheusRecorder) Timing(name string, d time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	h, ok := r.histograms[name]
+	if !ok {
+		h = &histogram{
+			buckets: make([]uint64, len(TimingBuckets)),
+		}
+		r.histograms[name] = h
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range TimingBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metricName will return the name of the metric in the form Prometheus
+// expects, replacing the characters it doesn't allow with underscores.
+func (r *PrometheusRecorder) metricName(name string) string {
+	if r.prefix != "" {
+		name = r.prefix + "_" + name
+	}
+
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == ':' {
+			return c
+		}
+
+		return '_'
+	}, name)
+}
+
+// ServeHTTP will write the metrics in the Prometheus text exposition format.
+func (r *PrometheusRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	r.WriteTo(w)
+}
+
+// WriteTo will write the metrics in the Prometheus text exposition format,
+// sorted by their name so scrapes are stable.
+func (r *PrometheusRecorder) WriteTo(w io.Writer) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var b strings.Builder
+
+	for _, name := range metricNames(r.counters) {
+		metric := r.metricName(name) + "_total"
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s %d\n", metric, metric, r.counters[name])
+	}
+
+	for _, name := range metricNames(r.gauges) {
+		metric := r.metricName(name)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %g\n", metric, metric, r.gauges[name])
+	}
+
+	for _, name := range metricNames(r.histograms) {
+		h := r.histograms[name]
+		metric := r.metricName(name) + "_seconds"
+
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", metric)
+		for i, bound := range TimingBuckets {
+			fmt.Fprintf(&b, "%s_bucket{le=\"%g\"} %d\n", metric, bound, h.buckets[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", metric, h.count)
+		fmt.Fprintf(&b, "%s_sum %g\n", metric, h.sum)
+		fmt.Fprintf(&b, "%s_count %d\n", metric, h.count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// metricNames returns the names of the metrics in order.
+func metricNames(metrics interface{}) []string {
+	var keys []string
+	switch m := metrics.(type) {
+	case map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]float64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,67 @@
+package counts
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRecorder(t *testing.T) {
+	recorder := NewPrometheusRecorder("coral_counts")
+	recorder.Count("stories.processed", 3)
+	recorder.Count("stories.processed", 2)
+	recorder.Gauge("watcher.dirty-stories", 7)
+	recorder.Timing("stories.load", 20*time.Millisecond)
+	recorder.Timing("stories.load", 2*time.Second)
+
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("could not scrape the metrics: %v", err)
+	}
+	defer res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("expected the text exposition format, got %s", contentType)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("could not read the metrics: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"counter type", "# TYPE coral_counts_stories_processed_total counter"},
+		{"counter", "coral_counts_stories_processed_total 5"},
+		{"gauge type", "# TYPE coral_counts_watcher_dirty_stories gauge"},
+		{"gauge", "coral_counts_watcher_dirty_stories 7"},
+		{"histogram type", "# TYPE coral_counts_stories_load_seconds histogram"},
+		{"bucket below both", `coral_counts_stories_load_seconds_bucket{le="0.01"} 0`},
+		{"bucket above one", `coral_counts_stories_load_seconds_bucket{le="0.025"} 1`},
+		{"bucket above both", `coral_counts_stories_load_seconds_bucket{le="2.5"} 2`},
+		{"infinite bucket", `coral_counts_stories_load_seconds_bucket{le="+Inf"} 2`},
+		{"sum", "coral_counts_stories_load_seconds_sum 2.02"},
+		{"count", "coral_counts_stories_load_seconds_count 2"},
+	}
+
+	lines := strings.Split(string(body), "\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, line := range lines {
+				if line == tt.line {
+					return
+				}
+			}
+
+			t.Errorf("expected the line %q in the metrics:\n%s", tt.line, body)
+		})
+	}
+}
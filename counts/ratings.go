@@ -0,0 +1,126 @@
+package counts
+
+import (
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CommentRatingCounts are the counts of the ratings of the comments.
+type CommentRatingCounts struct {
+	// Count is the number of comments with a rating, and Sum is the sum of their
+	// ratings.
+	Count int `bson:"count"`
+	Sum   int `bson:"sum"`
+
+	// Average is the Sum divided by the Count, or zero when there are no
+	// ratings. It's recomputed whenever the other counts change.
+	Average float64 `bson:"average"`
+
+	// Histogram is the number of comments with each rating, keyed by the
+	// rating.
+	Histogram map[string]int `bson:"histogram,omitempty"`
+}
+
+func (crc *CommentRatingCounts) Increment(comment *Comment) {
+	if comment.Rating == nil {
+		return
+	}
+
+	if comment.Status != "APPROVED" && comment.Status != "NONE" {
+		return
+	}
+
+	if crc.Histogram == nil {
+		crc.Histogram = make(map[string]int)
+	}
+
+	crc.Count++
+	crc.Sum += *comment.Rating
+	crc.Histogram[strconv.Itoa(*comment.Rating)]++
+	crc.average()
+}
+
+// Merge will add the passed counts to these counts.
+func (crc *CommentRatingCounts) Merge(counts *CommentRatingCounts) {
+	crc.Count += counts.Count
+	crc.Sum += counts.Sum
+	for key, count := range counts.Histogram {
+		if crc.Histogram == nil {
+			crc.Histogram = make(map[string]int)
+		}
+
+		crc.Histogram[key] += count
+	}
+	crc.average()
+}
+
+// Subtract will remove the passed counts from these counts.
+func (crc *CommentRatingCounts) Subtract(counts *CommentRatingCounts) {
+	crc.Count -= counts.Count
+	crc.Sum -= counts.Sum
+	for key, count := range counts.Histogram {
+		if crc.Histogram == nil {
+			crc.Histogram = make(map[string]int)
+		}
+
+		crc.Histogram[key] -= count
+	}
+	crc.average()
+}
+
+func (crc *CommentRatingCounts) average() {
+	if crc.Count <= 0 {
+		crc.Average = 0
+		return
+	}
+
+	crc.Average = float64(crc.Sum) / float64(crc.Count)
+}
+
+// incUpdate will return the update that applies the $inc document. When ratings
+// are counted the average can't be incremented, so the update is instead a
+// pipeline that adds each count and then recomputes the average from the new
+// sum and count, which requires MongoDB 4.2.
+func (p *Processor) incUpdate(inc bson.D) interface{} {
+	if !p.Rules.CountRatings {
+		return bson.D{
+			primitive.E{Key: "$inc", Value: inc},
+		}
+	}
+
+	set := make(bson.D, 0, len(inc))
+	for _, field := range inc {
+		set = append(set, primitive.E{Key: field.Key, Value: bson.D{
+			primitive.E{Key: "$add", Value: bson.A{
+				bson.D{
+					primitive.E{Key: "$ifNull", Value: bson.A{"$" + field.Key, 0}},
+				},
+				field.Value,
+			}},
+		}})
+	}
+
+	return mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$set", Value: set},
+		},
+		bson.D{
+			primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: "commentCounts.ratings.average", Value: bson.D{
+					primitive.E{Key: "$cond", Value: bson.A{
+						bson.D{
+							primitive.E{Key: "$gt", Value: bson.A{"$commentCounts.ratings.count", 0}},
+						},
+						bson.D{
+							primitive.E{Key: "$divide", Value: bson.A{"$commentCounts.ratings.sum", "$commentCounts.ratings.count"}},
+						},
+						0,
+					}},
+				}},
+			}},
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestStoryIncrementRatings(t *testing.T) {
+	rating := func(n int) *int { return &n }
+
+	tests := []struct {
+		name         string
+		countRatings bool
+		comments     []Comment
+		want         *CommentRatingCounts
+	}{
+		{
+			name:         "disabled",
+			countRatings: false,
+			comments: []Comment{
+				{Status: "APPROVED", Rating: rating(5)},
+			},
+		},
+		{
+			name:         "no ratings",
+			countRatings: true,
+			comments: []Comment{
+				{Status: "APPROVED"},
+				{Status: "NONE"},
+			},
+			want: &CommentRatingCounts{},
+		},
+		{
+			name:         "mix of ratings and comments without one",
+			countRatings: true,
+			comments: []Comment{
+				{Status: "APPROVED", Rating: rating(5)},
+				{Status: "NONE", Rating: rating(4)},
+				{Status: "APPROVED"},
+				{Status: "APPROVED", Rating: rating(5)},
+				{Status: "NONE", Rating: rating(1)},
+			},
+			want: &CommentRatingCounts{
+				Count:     4,
+				Sum:       15,
+				Average:   3.75,
+				Histogram: map[string]int{"1": 1, "4": 1, "5": 2},
+			},
+		},
+		{
+			name:         "only visible comments",
+			countRatings: true,
+			comments: []Comment{
+				{Status: "APPROVED", Rating: rating(2)},
+				{Status: "REJECTED", Rating: rating(5)},
+				{Status: "PREMOD", Rating: rating(5)},
+			},
+			want: &CommentRatingCounts{
+				Count:     1,
+				Sum:       2,
+				Average:   2,
+				Histogram: map[string]int{"2": 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountRatings = tt.countRatings
+
+			story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+			for i := range tt.comments {
+				story.Increment(&tt.comments[i], &rules)
+			}
+
+			if !reflect.DeepEqual(story.CommentCounts.Ratings, tt.want) {
+				t.Errorf("expected ratings %+v, got %+v", tt.want, story.CommentCounts.Ratings)
+			}
+		})
+	}
+}
+
+func TestStoryCommentCountsMergeRatings(t *testing.T) {
+	a := StoryCommentCounts{Ratings: &CommentRatingCounts{Count: 2, Sum: 9, Average: 4.5, Histogram: map[string]int{"4": 1, "5": 1}}}
+	b := StoryCommentCounts{Ratings: &CommentRatingCounts{Count: 1, Sum: 3, Average: 3, Histogram: map[string]int{"3": 1}}}
+
+	// The site starts without ratings and sums the histograms of its stories.
+	site := StoryCommentCounts{Action: make(CommentActionCounts)}
+	site.Merge(&a)
+	site.Merge(&b)
+
+	want := &CommentRatingCounts{Count: 3, Sum: 12, Average: 4, Histogram: map[string]int{"3": 1, "4": 1, "5": 1}}
+	if !reflect.DeepEqual(site.Ratings, want) {
+		t.Errorf("expected merged ratings %+v, got %+v", want, site.Ratings)
+	}
+
+	// Removing every story leaves no ratings, and no average.
+	site.Subtract(&a)
+	site.Subtract(&b)
+
+	want = &CommentRatingCounts{Histogram: map[string]int{"3": 0, "4": 0, "5": 0}}
+	if !reflect.DeepEqual(site.Ratings, want) {
+		t.Errorf("expected subtracted ratings %+v, got %+v", want, site.Ratings)
+	}
+}
+
+func TestIncUpdate(t *testing.T) {
+	inc := bson.D{
+		primitive.E{Key: "commentCounts.status.APPROVED", Value: 1},
+		primitive.E{Key: "commentCounts.ratings.count", Value: 1},
+	}
+
+	tests := []struct {
+		name         string
+		countRatings bool
+		wantPipeline bool
+	}{
+		{"without ratings", false, false},
+		{"with ratings", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountRatings = tt.countRatings
+
+			p := NewProcessor(nil, "tenant", "site", true, rules)
+
+			switch update := p.incUpdate(inc).(type) {
+			case mongo.Pipeline:
+				if !tt.wantPipeline {
+					t.Fatalf("expected an $inc update, got a pipeline")
+				}
+
+				if len(update) != 2 {
+					t.Fatalf("expected a pipeline with 2 stages, got %d", len(update))
+				}
+
+				// The counts are added first, and the average computed from them after.
+				if got := update[0][0].Value.(bson.D); len(got) != len(inc) {
+					t.Errorf("expected %d fields to be added, got %d", len(inc), len(got))
+				}
+				if got := update[1][0].Value.(bson.D)[0].Key; got != "commentCounts.ratings.average" {
+					t.Errorf("expected the average to be set, got %s", got)
+				}
+			case bson.D:
+				if tt.wantPipeline {
+					t.Fatalf("expected a pipeline, got an $inc update")
+				}
+
+				if !reflect.DeepEqual(update, bson.D{primitive.E{Key: "$inc", Value: inc}}) {
+					t.Errorf("expected an $inc of %v, got %v", inc, update)
+				}
+			default:
+				t.Fatalf("unexpected update type %T", update)
+			}
+		})
+	}
+}
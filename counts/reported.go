@@ -0,0 +1,230 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reportedField is the path of the reported queue count within a story or
+// site document.
+const reportedField = "commentCounts.moderationQueue.queues.reported"
+
+// reportedApprovedField is the path of the count of the reported comments that
+// are approved within a story or site document.
+const reportedApprovedField = "commentCounts.moderationQueue.queues.reportedApproved"
+
+// reportedAutomatedField and reportedUserField are the paths of the counts of
+// the reported comments by who reported them within a story or site document.
+const (
+	reportedAutomatedField = "commentCounts.moderationQueue.queues.reportedAutomated"
+	reportedUserField      = "commentCounts.moderationQueue.queues.reportedUser"
+)
+
+// ProcessReported will recount only the reported moderation queue for each of
+// the site's stories and the site.
+func ProcessReported(ctx context.Context, db *mongo.Database, tenantID, siteID string, dryRun bool) error {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).Reported(ctx)
+}
+
+// Reported will recount only the reported moderation queue for each of the
+// site's stories and the site. Only comments that have been flagged are
+// scanned, which is much faster than scanning every comment when only the
+// reported queue is stale. Only the reported queue count is updated, every
+// other count is left as is, so this does not correct any other drift.
+func (p *Processor) Reported(ctx context.Context) error {
+	// Only comments that are flagged and haven't been moderated (or have the
+	// other statuses the ReportedPolicy counts) can be in the reported queue. A
+	// comment's open flags are a subset of its flags, so this also finds every
+	// comment with open flags.
+	var status interface{} = bson.D{
+		primitive.E{Key: "$in", Value: p.Rules.reportedStatuses()},
+	}
+
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: p.Rules.Fields.Status, Value: status},
+	}
+
+	// The flags can only be filtered on when their key has one casing, otherwise
+	// every comment with the statuses is read and the flags are counted under
+	// the normalized key.
+	if p.Rules.ActionKeyCase == "" {
+		filter = append(filter, primitive.E{Key: p.Rules.Fields.ActionCounts + ".FLAG", Value: bson.D{
+			primitive.E{Key: "$gt", Value: 0},
+		}})
+	}
+
+	projection := commentProjection(
+		p.Rules.Fields.StoryID,
+		p.Rules.Fields.Status,
+		p.Rules.Fields.ActionCounts,
+		p.Rules.Fields.OpenFlags,
+	)
+
+	started := time.Now()
+	logrus.WithField("siteID", p.SiteID).Info("loading reported stories from flagged comments")
+
+	// Count the reported comments on each story using the same rules as the
+	// full count.
+	queues := make(map[string]*CommentModerationQueue)
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		next := p.cursorComments(ctx, collection, cursor)
+		for {
+			comment, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+
+			if p.Rules.Excluded(comment) {
+				continue
+			}
+
+			storyID := p.Rules.normalizeStoryID(comment.StoryID)
+
+			queue, ok := queues[storyID]
+			if !ok {
+				queue = &CommentModerationQueue{}
+				queues[storyID] = queue
+			}
+
+			queue.Increment(comment, &p.Rules)
+		}
+	}); err != nil {
+		return err
+	}
+
+	// Stories that are currently counted as having reported comments but no
+	// longer have any need to have their count reset.
+	previous, err := p.loadReportedStories(ctx)
+	if err != nil {
+		return err
+	}
+
+	reported := make(map[string]*CommentModerationQueue, len(queues)+len(previous))
+	for _, storyID := range previous {
+		reported[storyID] = &CommentModerationQueue{}
+	}
+
+	var site CommentModerationQueue
+	for storyID, queue := range queues {
+		reported[storyID] = queue
+		site.Queues.Reported += queue.Queues.Reported
+		site.Queues.ReportedApproved += queue.Queues.ReportedApproved
+		site.Queues.ReportedAutomated += queue.Queues.ReportedAutomated
+		site.Queues.ReportedUser += queue.Queues.ReportedUser
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"stories":  len(reported),
+		"reported": site.Queues.Reported,
+		"took":     time.Since(started),
+	}).Info("loaded reported stories from flagged comments")
+
+	writer := p.newBatchWriter("stories", "story")
+
+	res, err := writer.write(ctx, func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+		for storyID, queue := range reported {
+			if err := emit(storyID, p.newStoryUpdate(storyID, bson.D{
+				primitive.E{Key: "$set", Value: reportedUpdate(queue, &p.Rules)},
+			})); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not write story updates")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"failed":   res.Failed,
+	}).Info("finished writing story updates")
+
+	if p.DryRun {
+		logrus.WithField("reported", site.Queues.Reported).Info("not writing site update as --dryRun is enabled")
+		return nil
+	}
+
+	if _, err := p.outputCollection("sites").UpdateOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "id", Value: p.SiteID},
+	}, p.stampMarker(bson.D{
+		primitive.E{Key: "$set", Value: reportedUpdate(&site, &p.Rules)},
+	}), options.Update().SetUpsert(p.shadowing())); err != nil {
+		return errors.Wrap(err, "could not update the site")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":       p.SiteID,
+		"reported": site.Queues.Reported,
+	}).Info("site updated")
+
+	return nil
+}
+
+// reportedUpdate returns the fields to set for the reported queue. The counts of
+// the reported comments that are approved, and by who reported them, are only
+// set when they're counted with the rules.
+func reportedUpdate(queue *CommentModerationQueue, rules *Rules) bson.D {
+	update := bson.D{
+		primitive.E{Key: reportedField, Value: queue.Queues.Reported},
+	}
+
+	if rules.countsApproved() {
+		update = append(update, primitive.E{Key: reportedApprovedField, Value: queue.Queues.ReportedApproved})
+	}
+
+	if len(rules.AutomatedFlagKeys) > 0 {
+		update = append(update,
+			primitive.E{Key: reportedAutomatedField, Value: queue.Queues.ReportedAutomated},
+			primitive.E{Key: reportedUserField, Value: queue.Queues.ReportedUser},
+		)
+	}
+
+	return update
+}
+
+// loadReportedStories will return the ID's of the site's stories that are
+// currently counted as having reported comments.
+func (p *Processor) loadReportedStories(ctx context.Context) ([]string, error) {
+	cursor, err := p.outputCollection("stories").Find(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: reportedField, Value: bson.D{
+			primitive.E{Key: "$exists", Value: true},
+			primitive.E{Key: "$ne", Value: 0},
+		}},
+	}, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not find reported stories")
+	}
+
+	var stories []Story
+	if err := cursor.All(ctx, &stories); err != nil {
+		return nil, errors.Wrap(err, "could not decode reported stories")
+	}
+
+	storyIDs := make([]string, 0, len(stories))
+	for _, story := range stories {
+		storyIDs = append(storyIDs, story.ID)
+	}
+
+	return storyIDs, nil
+}
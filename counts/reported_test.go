@@ -0,0 +1,153 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRulesReported(t *testing.T) {
+	open := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		policy    QueuePolicy
+		flags     int
+		openFlags *int
+		want      bool
+	}{
+		{name: "flagged without open flags field", policy: QueuePolicyCoralV7, flags: 1, want: true},
+		{name: "not flagged", policy: QueuePolicyCoralV7, want: false},
+		{name: "open flags", policy: QueuePolicyCoralV7, flags: 2, openFlags: open(1), want: true},
+		{name: "flags all resolved", policy: QueuePolicyCoralV7, flags: 2, openFlags: open(0), want: false},
+		{name: "flags resolved under legacy", policy: QueuePolicyLegacy, flags: 2, openFlags: open(0), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.ReportedPolicy = tt.policy
+
+			comment := Comment{
+				Status:       "NONE",
+				ActionCounts: map[string]int{"FLAG": tt.flags},
+				OpenFlags:    tt.openFlags,
+			}
+			if got := rules.Reported(&comment); got != tt.want {
+				t.Errorf("Reported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportedUpdate(t *testing.T) {
+	queue := CommentModerationQueue{}
+	queue.Queues.Reported = 3
+	queue.Queues.ReportedApproved = 1
+	queue.Queues.ReportedAutomated = 2
+	queue.Queues.ReportedUser = 1
+
+	tests := []struct {
+		name  string
+		rules func(rules *Rules)
+		want  bson.D
+	}{
+		{
+			name: "only reported",
+			want: bson.D{
+				primitive.E{Key: reportedField, Value: 3},
+			},
+		},
+		{
+			name:  "reported approved",
+			rules: func(rules *Rules) { rules.CountReportedApproved = true },
+			want: bson.D{
+				primitive.E{Key: reportedField, Value: 3},
+				primitive.E{Key: reportedApprovedField, Value: 1},
+			},
+		},
+		{
+			name:  "reported approved by the policy",
+			rules: func(rules *Rules) { rules.ReportedPolicy = QueuePolicyCoralV8 },
+			want: bson.D{
+				primitive.E{Key: reportedField, Value: 3},
+				primitive.E{Key: reportedApprovedField, Value: 1},
+			},
+		},
+		{
+			name:  "automated flags",
+			rules: func(rules *Rules) { rules.AutomatedFlagKeys = []string{"FLAG__TOXIC"} },
+			want: bson.D{
+				primitive.E{Key: reportedField, Value: 3},
+				primitive.E{Key: reportedAutomatedField, Value: 2},
+				primitive.E{Key: reportedUserField, Value: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			if tt.rules != nil {
+				tt.rules(&rules)
+			}
+
+			if got := reportedUpdate(&queue, &rules); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCommentFieldsDecodeOpenFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		doc   bson.D
+		want  *int
+	}{
+		{
+			name: "no open flags field",
+			doc:  bson.D{primitive.E{Key: "openFlags", Value: int32(2)}},
+		},
+		{
+			name:  "open flags missing",
+			field: "flags.open",
+			doc:   bson.D{primitive.E{Key: "id", Value: "c1"}},
+		},
+		{
+			name:  "open flags read",
+			field: "flags.open",
+			doc: bson.D{primitive.E{Key: "flags", Value: bson.D{
+				primitive.E{Key: "open", Value: int32(2)},
+			}}},
+			want: func(n int) *int { return &n }(2),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := DefaultCommentFields
+			fields.OpenFlags = tt.field
+
+			data, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var comment Comment
+			if err := fields.Decode(data, &comment); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch {
+			case tt.want == nil && comment.OpenFlags != nil:
+				t.Errorf("expected no open flags, got %d", *comment.OpenFlags)
+			case tt.want != nil && (comment.OpenFlags == nil || *comment.OpenFlags != *tt.want):
+				t.Errorf("expected %d open flags, got %v", *tt.want, comment.OpenFlags)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package counts
+
+import (
+	"sync"
+	"time"
+)
+
+// Rules are the rules for how comments are counted. They're held by the
+// Processor rather than the package, so each site processed by a run is
+// counted with the rules it was given.
+type Rules struct {
+	// Fields are the paths of the fields that comments are read from.
+	Fields CommentFields
+
+	// ExcludedStatuses are the comment statuses that will be treated as if
+	// comments with them do not exist. Excluding any statuses will produce
+	// counts that intentionally differ from the ones that Coral would compute.
+	ExcludedStatuses map[string]struct{}
+
+	// ActionQueueRules are the additional moderation queues that comments will
+	// be counted in. These are in addition to the built-in queues.
+	ActionQueueRules []ActionQueueRule
+
+	// StatusQueueRules are the additional moderation queues that comments will
+	// be counted in based on their status. These are in addition to the
+	// built-in queues, and aren't counted in the total.
+	StatusQueueRules []StatusQueueRule
+
+	// ReportedPolicy is the policy used to count the reported queue.
+	ReportedPolicy QueuePolicy
+
+	// CountReportedApproved when true will count approved comments that still
+	// have open flags in the reported queue, as they still need a moderator's
+	// attention even though they're published. They aren't unmoderated, so
+	// they're not counted in the total.
+	CountReportedApproved bool
+
+	// AutomatedFlagKeys are the action keys of the flags that are made by
+	// automated detection rather than by users, such as
+	// FLAG__COMMENT_DETECTED_TOXIC. When set, the reported queue is broken down
+	// into the comments reported by automated detection and the comments
+	// reported by users.
+	AutomatedFlagKeys []string
+
+	// ActionKeyCase when set is the casing that the keys of the comments'
+	// actionCounts are normalized to before they're counted, either
+	// ActionKeysUpper or ActionKeysLower, so that keys with inconsistent casing
+	// (such as flag and FLAG) are counted under the same key. When empty the
+	// keys are counted as they are.
+	ActionKeyCase string
+
+	// StoryIDNormalizer when set will be applied to the story ID of each
+	// comment before it's counted, so that comments stored with different
+	// formats of the same story's ID (such as with a trailing slash, or URL
+	// encoded) are counted on the same story. The counts are written to the
+	// story with the normalized ID, so the stored story documents must use the
+	// normalized IDs for the writes to match them.
+	StoryIDNormalizer func(storyID string) string
+
+	// MaxCommentAge is the age after which a comment that is still waiting to
+	// be moderated is considered stale. When zero, stale comments are not
+	// detected.
+	MaxCommentAge time.Duration
+
+	// CheckCreatedAt when true will check the createdAt of each comment as it's
+	// counted on its story, and report the comments whose createdAt is missing,
+	// in the future, or before the EarliestCreatedAt. These are usually from
+	// imports that wrote the wrong timestamps, which would put the comments in
+	// nonsense buckets of anything that's based on when comments were created.
+	CheckCreatedAt bool
+
+	// EarliestCreatedAt is the earliest createdAt that's plausible for a
+	// comment, comments created before it are reported when CheckCreatedAt is
+	// enabled.
+	EarliestCreatedAt time.Time
+
+	// CountBySource when true will count the comments on each story by the
+	// source they were submitted from.
+	CountBySource bool
+
+	// CountRatings when true will count the star ratings of the comments on
+	// each story, for deployments that use Coral's ratings and reviews. Only
+	// the ratings of published (approved or unmoderated) comments are counted,
+	// and comments without a rating are ignored.
+	CountRatings bool
+
+	// CountDistinctAuthors when true will count the number of different users
+	// that have commented on each story. This keeps the ID of every author on
+	// every story in memory while the stories are counted.
+	CountDistinctAuthors bool
+
+	// normalizedActionKeys are the action keys that have already been logged
+	// as normalized, so each is only logged once. It's shared by the copies of
+	// the rules.
+	normalizedActionKeys *sync.Map
+}
+
+// DefaultRules returns the rules that count the comments the way Coral does.
+func DefaultRules() Rules {
+	return Rules{
+		Fields:            DefaultCommentFields,
+		ExcludedStatuses:  map[string]struct{}{},
+		ReportedPolicy:    QueuePolicyCoralV7,
+		EarliestCreatedAt: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+
+		normalizedActionKeys: &sync.Map{},
+	}
+}
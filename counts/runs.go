@@ -0,0 +1,208 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunsCollection is the collection that a document for each run is stored in,
+// which is kept up to date as the run progresses.
+const RunsCollection = "coral_counts_runs"
+
+// The statuses of a run. A run that is still running but hasn't sent a
+// heartbeat within the ttl it was started with has crashed, and is marked as abandoned by the
+// next run on the site.
+const (
+	RunRunning   = "running"
+	RunCompleted = "completed"
+	RunFailed    = "failed"
+	RunAbandoned = "abandoned"
+)
+
+// RunDocument is a run stored in the RunsCollection. Every site of a run shares
+// its RunID, so a run has a document for each site, identified by the RunID
+// along with the TenantID and SiteID.
+type RunDocument struct {
+	RunID       string     `bson:"runID"`
+	TenantID    string     `bson:"tenantID"`
+	SiteID      string     `bson:"siteID"`
+	Host        string     `bson:"host"`
+	Status      string     `bson:"status"`
+	StartedAt   time.Time  `bson:"startedAt"`
+	HeartbeatAt time.Time  `bson:"heartbeatAt"`
+	FinishedAt  *time.Time `bson:"finishedAt,omitempty"`
+	Error       string     `bson:"error,omitempty"`
+}
+
+// Run is a run being tracked in the RunsCollection. Its heartbeat is updated in
+// the background until it's finished.
+type Run struct {
+	collection *mongo.Collection
+	runID      string
+
+	// filter matches the run's document for its site.
+	filter bson.D
+	ttl    time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartRun will record that the run identified by the runID has started on the
+// site. Any earlier runs on the site whose heartbeat is older than the ttl are
+// marked as abandoned first, and the run's heartbeat is updated well within it.
+// Running the same runID again on the site is safe, it's restarted rather than
+// duplicated.
+func StartRun(ctx context.Context, db *mongo.Database, runID, tenantID, siteID string, ttl time.Duration) (*Run, error) {
+	collection := db.Collection(RunsCollection)
+
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				primitive.E{Key: "tenantID", Value: 1},
+				primitive.E{Key: "siteID", Value: 1},
+				primitive.E{Key: "startedAt", Value: -1},
+			},
+		},
+		{
+			Keys: bson.D{
+				primitive.E{Key: "runID", Value: 1},
+				primitive.E{Key: "tenantID", Value: 1},
+				primitive.E{Key: "siteID", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not create the runs indexes")
+	}
+
+	now := time.Now()
+
+	res, err := collection.UpdateMany(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "siteID", Value: siteID},
+		primitive.E{Key: "status", Value: RunRunning},
+		primitive.E{Key: "heartbeatAt", Value: bson.D{
+			primitive.E{Key: "$lt", Value: now.Add(-ttl)},
+		}},
+	}, bson.D{
+		primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "status", Value: RunAbandoned},
+			primitive.E{Key: "finishedAt", Value: now},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not mark the stale runs as abandoned")
+	}
+
+	if res.ModifiedCount > 0 {
+		logrus.WithField("runs", res.ModifiedCount).Warn("marked the runs on the site whose heartbeat stopped as abandoned")
+	}
+
+	filter := bson.D{
+		primitive.E{Key: "runID", Value: runID},
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "siteID", Value: siteID},
+	}
+
+	hostname, _ := os.Hostname()
+	if _, err := collection.ReplaceOne(ctx, filter, RunDocument{
+		RunID:       runID,
+		TenantID:    tenantID,
+		SiteID:      siteID,
+		Host:        fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		Status:      RunRunning,
+		StartedAt:   now,
+		HeartbeatAt: now,
+	}, options.Replace().SetUpsert(true)); err != nil {
+		return nil, errors.Wrap(err, "could not record the run")
+	}
+
+	run := &Run{
+		collection: collection,
+		runID:      runID,
+		filter:     filter,
+		ttl:        ttl,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	logrus.WithField("runID", runID).Info("recorded the start of the run")
+
+	go run.heartbeat()
+
+	return run, nil
+}
+
+// heartbeat will update the run's heartbeat until it's finished.
+func (r *Run) heartbeat() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		filter := append(bson.D{
+			primitive.E{Key: "status", Value: RunRunning},
+		}, r.filter...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.ttl/3)
+		_, err := r.collection.UpdateOne(ctx, filter, bson.D{
+			primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: "heartbeatAt", Value: time.Now()},
+			}},
+		})
+		cancel()
+
+		if err != nil {
+			logrus.WithError(err).Warn("could not update the heartbeat of the run")
+		}
+	}
+}
+
+// Finish will stop the run's heartbeat and record that it completed, or that it
+// failed with the error when it isn't nil.
+func (r *Run) Finish(ctx context.Context, runErr error) error {
+	close(r.stop)
+	<-r.done
+
+	set := bson.D{
+		primitive.E{Key: "status", Value: RunCompleted},
+		primitive.E{Key: "finishedAt", Value: time.Now()},
+	}
+	if runErr != nil {
+		set = bson.D{
+			primitive.E{Key: "status", Value: RunFailed},
+			primitive.E{Key: "finishedAt", Value: time.Now()},
+			primitive.E{Key: "error", Value: runErr.Error()},
+		}
+	}
+
+	if _, err := r.collection.UpdateOne(ctx, r.filter, bson.D{
+		primitive.E{Key: "$set", Value: set},
+	}); err != nil {
+		return errors.Wrap(err, "could not record the end of the run")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"runID":  r.runID,
+		"status": set[0].Value,
+	}).Info("recorded the end of the run")
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package counts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// updated is the response to an update that modified n documents.
+func updated(n int) bson.D {
+	return mtest.CreateSuccessResponse(
+		primitive.E{Key: "n", Value: int32(n)},
+		primitive.E{Key: "nModified", Value: int32(n)},
+	)
+}
+
+// lastUpdate returns the first update statement of the last update command.
+func lastUpdate(mt *mtest.T) bson.Raw {
+	var update bson.Raw
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "update" {
+			update = event.Command.Lookup("updates").Array().Index(0).Value().Document()
+		}
+	}
+	if update == nil {
+		mt.Fatalf("expected an update command")
+	}
+
+	return update
+}
+
+func TestRunTransitions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name       string
+		runErr     error
+		wantStatus string
+		wantError  string
+	}{
+		{name: "running to completed", wantStatus: RunCompleted},
+		{name: "running to failed", runErr: errors.New("could not write stories"), wantStatus: RunFailed, wantError: "could not write stories"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(),
+				updated(0),
+				updated(1),
+			)
+
+			ctx := context.Background()
+
+			run, err := StartRun(ctx, mt.DB, "run-1", "tenant", "site", DefaultLockTTL)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			// The run is recorded as running.
+			replace := lastUpdate(mt)
+			if status := replace.Lookup("u", "status").StringValue(); status != RunRunning {
+				mt.Errorf("expected the run recorded as %s, got %s", RunRunning, status)
+			}
+			if upsert, _ := replace.Lookup("upsert").BooleanOK(); !upsert {
+				mt.Errorf("expected the run to be upserted so it's restarted rather than duplicated")
+			}
+
+			mt.AddMockResponses(updated(1))
+
+			if err := run.Finish(ctx, tt.runErr); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			finish := lastUpdate(mt)
+			if runID := finish.Lookup("q", "runID").StringValue(); runID != "run-1" {
+				mt.Errorf("expected run-1 to be finished, got %s", runID)
+			}
+			if siteID := finish.Lookup("q", "siteID").StringValue(); siteID != "site" {
+				mt.Errorf("expected the run on the site to be finished, got %s", siteID)
+			}
+			if status := finish.Lookup("u", "$set", "status").StringValue(); status != tt.wantStatus {
+				mt.Errorf("expected the run finished as %s, got %s", tt.wantStatus, status)
+			}
+			if message, _ := finish.Lookup("u", "$set", "error").StringValueOK(); message != tt.wantError {
+				mt.Errorf("expected the error %q, got %q", tt.wantError, message)
+			}
+			if _, ok := finish.Lookup("u", "$set", "finishedAt").DateTimeOK(); !ok {
+				mt.Errorf("expected the finishedAt to be set")
+			}
+		})
+	}
+}
+
+func TestStartRunAbandonsStaleRuns(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name  string
+		stale int
+	}{
+		{name: "no stale runs"},
+		{name: "stale runs", stale: 2},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(),
+				updated(tt.stale),
+				updated(1),
+				updated(1),
+			)
+
+			ctx := context.Background()
+
+			started := time.Now()
+			run, err := StartRun(ctx, mt.DB, "run-1", "tenant", "site", DefaultLockTTL)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+			defer run.Finish(ctx, nil)
+
+			// The runs on the site that are still running without a heartbeat
+			// within the ttl are marked as abandoned.
+			var abandon bson.Raw
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName == "update" {
+					abandon = event.Command.Lookup("updates").Array().Index(0).Value().Document()
+					break
+				}
+			}
+			if abandon == nil {
+				mt.Fatalf("expected the stale runs to be updated")
+			}
+
+			if status := abandon.Lookup("q", "status").StringValue(); status != RunRunning {
+				mt.Errorf("expected the %s runs to be matched, got %s", RunRunning, status)
+			}
+			if siteID := abandon.Lookup("q", "siteID").StringValue(); siteID != "site" {
+				mt.Errorf("expected the runs on the site to be matched, got %s", siteID)
+			}
+			stale := abandon.Lookup("q", "heartbeatAt", "$lt").Time()
+			if cutoff := started.Add(-DefaultLockTTL); stale.Before(cutoff.Add(-time.Second)) || stale.After(cutoff.Add(time.Second)) {
+				mt.Errorf("expected the heartbeats before %s to be stale, got %s", cutoff, stale)
+			}
+			if status := abandon.Lookup("u", "$set", "status").StringValue(); status != RunAbandoned {
+				mt.Errorf("expected the stale runs marked as %s, got %s", RunAbandoned, status)
+			}
+		})
+	}
+}
+
+func TestRunSites(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("sites", func(mt *mtest.T) {
+		ctx := context.Background()
+
+		// Every site of the run shares the runID.
+		runs := make(map[string]*Run)
+		for _, siteID := range []string{"site-a", "site-b"} {
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(),
+				updated(0),
+				updated(1),
+			)
+
+			run, err := StartRun(ctx, mt.DB, "run-1", "tenant", siteID, DefaultLockTTL)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			// Each site's run is recorded in its own document.
+			replace := lastUpdate(mt)
+			if runID := replace.Lookup("q", "runID").StringValue(); runID != "run-1" {
+				mt.Errorf("expected run-1 to be recorded, got %s", runID)
+			}
+			if got := replace.Lookup("q", "siteID").StringValue(); got != siteID {
+				mt.Errorf("expected the run on %s to be recorded, got %s", siteID, got)
+			}
+			if _, err := replace.LookupErr("q", "_id"); err == nil {
+				mt.Errorf("expected the run not to be recorded by its runID alone")
+			}
+
+			runs[siteID] = run
+		}
+
+		// Finishing one site's run leaves the other's running.
+		mt.AddMockResponses(updated(1))
+		if err := runs["site-a"].Finish(ctx, errors.New("could not write stories")); err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+		if siteID := lastUpdate(mt).Lookup("q", "siteID").StringValue(); siteID != "site-a" {
+			mt.Errorf("expected the run on site-a to be finished, got %s", siteID)
+		}
+
+		mt.AddMockResponses(updated(1))
+		if err := runs["site-b"].Finish(ctx, nil); err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+		if siteID := lastUpdate(mt).Lookup("q", "siteID").StringValue(); siteID != "site-b" {
+			mt.Errorf("expected the run on site-b to be finished, got %s", siteID)
+		}
+	})
+}
+
+func TestRunHeartbeat(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	ttl := 30 * time.Millisecond
+
+	mt.Run("heartbeat", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),
+			updated(0),
+			updated(1),
+		)
+		for i := 0; i < 10; i++ {
+			mt.AddMockResponses(updated(1))
+		}
+
+		ctx := context.Background()
+
+		run, err := StartRun(ctx, mt.DB, "run-1", "tenant", "site", ttl)
+		if err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+
+		// Wait for a few heartbeats.
+		time.Sleep(3 * ttl / 2)
+
+		if err := run.Finish(ctx, nil); err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+
+		var heartbeats int
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName != "update" {
+				continue
+			}
+
+			update := event.Command.Lookup("updates").Array().Index(0).Value().Document()
+			if _, ok := update.Lookup("u", "$set", "heartbeatAt").DateTimeOK(); !ok {
+				continue
+			}
+
+			heartbeats++
+
+			// Only a run that's still running has its heartbeat updated, so a
+			// run that was marked as abandoned isn't revived.
+			if status := update.Lookup("q", "status").StringValue(); status != RunRunning {
+				mt.Errorf("expected the heartbeat to only update a %s run, got %s", RunRunning, status)
+			}
+		}
+
+		if heartbeats == 0 {
+			mt.Errorf("expected the heartbeat to be updated while the run is running")
+		}
+	})
+}
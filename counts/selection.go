@@ -0,0 +1,193 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxUserIDsPerQuery is the largest number of selected users whose comments are
+// scanned with a single query.
+const MaxUserIDsPerQuery = 1000
+
+// SelectingUsers returns true when only the selected users should be processed.
+func (p *Processor) SelectingUsers() bool {
+	return len(p.UsersFilter) > 0 || len(p.UsersRoles) > 0 || p.UsersCommentedWithin > 0
+}
+
+// ProcessSelectedUsers will resolve the users selected by the UsersFilter,
+// UsersRoles, and UsersCommentedWithin, and then process only those users.
+func ProcessSelectedUsers(ctx context.Context, db *mongo.Database, tenantID, siteID string, dryRun bool) (*UsersResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).SelectedUsers(ctx)
+}
+
+// SelectedUsers will resolve the users selected by the UsersFilter, UsersRoles,
+// and UsersCommentedWithin, and then count the comments by only those users.
+// The users are processed in groups of MaxUserIDsPerQuery so the query for
+// each group stays small.
+func (p *Processor) SelectedUsers(ctx context.Context) (*UsersResult, error) {
+	authorIDs, err := p.selectUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsersResult{}
+	if len(authorIDs) == 0 {
+		logrus.Info("no users were selected")
+		return result, nil
+	}
+
+	for start := 0; start < len(authorIDs); start += MaxUserIDsPerQuery {
+		end := start + MaxUserIDsPerQuery
+		if end > len(authorIDs) {
+			end = len(authorIDs)
+		}
+
+		res, err := p.Users(ctx, authorIDs[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		result.Users += res.Users
+		result.Batches += res.Batches
+		result.Updates += res.Updates
+		result.Modified += res.Modified
+		result.Failed += res.Failed
+		result.Drifted += res.Drifted
+		result.Approved += res.Approved
+	}
+
+	return result, nil
+}
+
+// selectUsers will return the ID's of the users that match every one of the
+// selections that are set.
+func (p *Processor) selectUsers(ctx context.Context) ([]string, error) {
+	started := time.Now()
+
+	var selected map[string]struct{}
+
+	if len(p.UsersFilter) > 0 || len(p.UsersRoles) > 0 {
+		ids, err := p.selectUsersByFilter(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		selected = ids
+	}
+
+	if p.UsersCommentedWithin > 0 {
+		ids, err := p.selectUsersByComments(ctx, time.Now().Add(-p.UsersCommentedWithin))
+		if err != nil {
+			return nil, err
+		}
+
+		if selected == nil {
+			selected = ids
+		} else {
+			for id := range selected {
+				if _, ok := ids[id]; !ok {
+					delete(selected, id)
+				}
+			}
+		}
+	}
+
+	authorIDs := make([]string, 0, len(selected))
+	for id := range selected {
+		authorIDs = append(authorIDs, id)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"users": len(authorIDs),
+		"took":  time.Since(started),
+	}).Info("selected users")
+
+	return authorIDs, nil
+}
+
+// selectUsersByFilter will return the ID's of the users on the tenant that match
+// the UsersFilter and have one of the UsersRoles.
+func (p *Processor) selectUsersByFilter(ctx context.Context) (map[string]struct{}, error) {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+	}
+
+	if len(p.UsersRoles) > 0 {
+		filter = append(filter, primitive.E{Key: "role", Value: bson.D{
+			primitive.E{Key: "$in", Value: p.UsersRoles},
+		}})
+	}
+
+	if len(p.UsersFilter) > 0 {
+		filter = bson.D{
+			primitive.E{Key: "$and", Value: bson.A{filter, p.UsersFilter}},
+		}
+	}
+
+	cursor, err := p.DB.Collection("users").Find(ctx, filter, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	ids := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var user struct {
+			ID string `bson:"id"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return nil, errors.Wrap(err, "could not decode result")
+		}
+
+		ids[user.ID] = struct{}{}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	return ids, nil
+}
+
+// selectUsersByComments will return the ID's of the users who have commented on
+// the site since the time.
+func (p *Processor) selectUsersByComments(ctx context.Context, since time.Time) (map[string]struct{}, error) {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: p.Rules.Fields.CreatedAt, Value: bson.D{
+			primitive.E{Key: "$gte", Value: since},
+		}},
+	}
+
+	projection := commentProjection(p.Rules.Fields.AuthorID)
+
+	ids := make(map[string]struct{})
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		next := p.cursorComments(ctx, collection, cursor)
+		for {
+			comment, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+
+			ids[comment.AuthorID] = struct{}{}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,110 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSelectUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	users := func(ids ...string) bson.D {
+		docs := make([]bson.D, 0, len(ids))
+		for _, id := range ids {
+			docs = append(docs, bson.D{primitive.E{Key: "id", Value: id}})
+		}
+
+		return mtest.CreateCursorResponse(0, "coral.users", mtest.FirstBatch, docs...)
+	}
+	authors := func(ids ...string) bson.D {
+		docs := make([]bson.D, 0, len(ids))
+		for _, id := range ids {
+			docs = append(docs, bson.D{primitive.E{Key: "authorID", Value: id}})
+		}
+
+		return mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, docs...)
+	}
+
+	tests := []struct {
+		name      string
+		filter    bson.D
+		roles     []string
+		within    time.Duration
+		responses []bson.D
+		want      []string
+		wantRoles bool
+	}{
+		{
+			name:      "by role",
+			roles:     []string{"STAFF"},
+			responses: []bson.D{users("u1", "u2")},
+			want:      []string{"u1", "u2"},
+			wantRoles: true,
+		},
+		{
+			name:      "by filter",
+			filter:    bson.D{primitive.E{Key: "email", Value: "a@example.com"}},
+			responses: []bson.D{users("u1")},
+			want:      []string{"u1"},
+		},
+		{
+			name:      "by comments",
+			within:    time.Hour,
+			responses: []bson.D{authors("u1", "u3", "u1")},
+			want:      []string{"u1", "u3"},
+		},
+		{
+			name:      "by role and comments",
+			roles:     []string{"STAFF"},
+			within:    time.Hour,
+			responses: []bson.D{users("u1", "u2"), authors("u2", "u3")},
+			want:      []string{"u2"},
+			wantRoles: true,
+		},
+		{
+			name:      "nothing selected",
+			roles:     []string{"ADMIN"},
+			responses: []bson.D{users()},
+			want:      []string{},
+			wantRoles: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.UsersFilter = tt.filter
+			p.UsersRoles = tt.roles
+			p.UsersCommentedWithin = tt.within
+
+			got, err := p.selectUsers(context.Background())
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected %v, got %v", tt.want, got)
+			}
+
+			started := mt.GetStartedEvent()
+			if started == nil {
+				mt.Fatalf("expected a find to be sent")
+			}
+			_, err = started.Command.LookupErr("filter", "role")
+			if gotRoles := err == nil; gotRoles != tt.wantRoles {
+				mt.Errorf("expected the users filter on the role %v, got %v", tt.wantRoles, gotRoles)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// selfTestComments are the comments seeded by the self test, and the counts
+// they're expected to produce are in selfTestExpectations. The seventh comment is
+// deliberately missing its author, so the approved comments counted on the
+// stories are expected to be one more than those counted for the users. The
+// author of the last comment is one of the selfTestOrphanedUsers. Of the flags,
+// the automated ones are from automated detection, and the rest are from users.
+var selfTestComments = []struct {
+	id, storyID, authorID, status string
+	flags, automated              int
+}{
+	{"comment-1", "story-1", "user-1", "APPROVED", 0, 0},
+	{"comment-2", "story-1", "user-2", "NONE", 2, 1},
+	{"comment-3", "story-1", "user-1", "REJECTED", 0, 0},
+	{"comment-4", "story-2", "user-2", "PREMOD", 0, 0},
+	{"comment-5", "story-2", "user-1", "NONE", 0, 0},
+	{"comment-6", "story-2", "user-2", "APPROVED", 1, 1},
+	{"comment-7", "story-1", "", "APPROVED", 0, 0},
+	{"comment-8", "story-2", "user-3", "REJECTED", 0, 0},
+}
+
+// SelfTestAutomatedFlagKey is the action key of the flags from automated
+// detection on the selfTestComments, which the self test expects to be one of
+// the AutomatedFlagKeys.
+const SelfTestAutomatedFlagKey = "FLAG__COMMENT_DETECTED_TOXIC"
+
+// selfTestOrphanedUsers are the authors of selfTestComments that are not given a
+// user document, which are expected to be detected as orphaned.
+var selfTestOrphanedUsers = map[string]struct{}{
+	"user-3": {},
+}
+
+// selfTestCreatedAt is when the selfTestComments were created, apart from those
+// in selfTestCreatedSince.
+var selfTestCreatedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// selfTestSince is the time that the comments changed since are found from.
+var selfTestSince = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// selfTestUpdatedAt are the times the selfTestComments that have been changed
+// were last updated at, one before and one after the selfTestSince.
+var selfTestUpdatedAt = map[string]time.Time{
+	"comment-1": time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+	"comment-3": time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// selfTestCreatedSince are the times the selfTestComments that were created after
+// the selfTestSince were created at. They don't have an updatedAt.
+var selfTestCreatedSince = map[string]time.Time{
+	"comment-8": time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// selfTestChangedSince are the stories and users of the selfTestComments that
+// were changed since the selfTestSince.
+var selfTestChangedSince = DirtyKeys{
+	StoryIDs: []string{"story-1", "story-2"},
+	UserIDs:  []string{"user-1", "user-3"},
+}
+
+// selfTestApprovedMismatch is the expected difference between the approved
+// comments counted for the users and on the stories.
+const selfTestApprovedMismatch = -1
+
+// selfTestExpectation is a count that the self test expects to find on a
+// document after processing.
+type selfTestExpectation struct {
+	collection string
+	id         string
+	field      string
+	value      int64
+}
+
+// selfTestExpectations are the counts that were computed by hand for the
+// selfTestComments.
+var selfTestExpectations = []selfTestExpectation{
+	{"stories", "story-1", "commentCounts.status.APPROVED", 2},
+	{"stories", "story-1", "commentCounts.status.NONE", 1},
+	{"stories", "story-1", "commentCounts.status.REJECTED", 1},
+	{"stories", "story-1", "commentCounts.action.FLAG", 2},
+	{"stories", "story-1", "commentCounts.action." + SelfTestAutomatedFlagKey, 1},
+	{"stories", "story-1", "commentCounts.moderationQueue.total", 1},
+	{"stories", "story-1", "commentCounts.moderationQueue.queues.reported", 1},
+	{"stories", "story-1", "commentCounts.moderationQueue.queues.reportedAutomated", 1},
+	{"stories", "story-1", "commentCounts.moderationQueue.queues.reportedUser", 1},
+	{"stories", "story-2", "commentCounts.status.APPROVED", 1},
+	{"stories", "story-2", "commentCounts.status.PREMOD", 1},
+	{"stories", "story-2", "commentCounts.status.NONE", 1},
+	{"stories", "story-2", "commentCounts.status.REJECTED", 1},
+	{"stories", "story-2", "commentCounts.action.FLAG", 1},
+	{"stories", "story-2", "commentCounts.action." + SelfTestAutomatedFlagKey, 1},
+	{"stories", "story-2", "commentCounts.moderationQueue.total", 2},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.unmoderated", 2},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.pending", 1},
+	{"sites", "", "commentCounts.status.APPROVED", 3},
+	{"sites", "", "commentCounts.status.NONE", 2},
+	{"sites", "", "commentCounts.status.PREMOD", 1},
+	{"sites", "", "commentCounts.status.REJECTED", 2},
+	{"sites", "", "commentCounts.action.FLAG", 3},
+	{"sites", "", "commentCounts.action." + SelfTestAutomatedFlagKey, 2},
+	{"sites", "", "commentCounts.moderationQueue.total", 3},
+	{"sites", "", "commentCounts.moderationQueue.queues.unmoderated", 3},
+	{"sites", "", "commentCounts.moderationQueue.queues.pending", 1},
+	{"users", "user-1", "commentCounts.status.APPROVED", 1},
+	{"users", "user-1", "commentCounts.status.NONE", 1},
+	{"users", "user-1", "commentCounts.status.REJECTED", 1},
+	{"users", "user-2", "commentCounts.status.APPROVED", 1},
+	{"users", "user-2", "commentCounts.status.NONE", 1},
+	{"users", "user-2", "commentCounts.status.PREMOD", 1},
+}
+
+// selfTestReportedExpectations are the reported queue counts for the
+// selfTestComments. The approved comment with a flag is only in the reported
+// queue when the ReportedPolicy counts approved comments, which is checked by
+// selfTestReportedApprovedExpectations instead.
+var selfTestReportedExpectations = []selfTestExpectation{
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reported", 0},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reportedAutomated", 0},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reportedUser", 0},
+	{"sites", "", "commentCounts.moderationQueue.queues.reported", 1},
+	{"sites", "", "commentCounts.moderationQueue.queues.reportedAutomated", 1},
+	{"sites", "", "commentCounts.moderationQueue.queues.reportedUser", 1},
+}
+
+// selfTestDistinctAuthorsExpectations are the distinct authors counted on the
+// stories for the selfTestComments when CountDistinctAuthors is enabled. Both
+// stories have an author with more than one comment, and the comment without an
+// author isn't counted.
+var selfTestDistinctAuthorsExpectations = []selfTestExpectation{
+	{"stories", "story-1", "commentCounts.distinctAuthors", 2},
+	{"stories", "story-2", "commentCounts.distinctAuthors", 3},
+}
+
+// selfTestReportedApprovedExpectations are the reported queue counts for the
+// selfTestComments when the ReportedPolicy counts approved comments.
+var selfTestReportedApprovedExpectations = []selfTestExpectation{
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reported", 1},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reportedApproved", 1},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reportedAutomated", 1},
+	{"stories", "story-2", "commentCounts.moderationQueue.queues.reportedUser", 0},
+	{"sites", "", "commentCounts.moderationQueue.queues.reported", 2},
+	{"sites", "", "commentCounts.moderationQueue.queues.reportedApproved", 1},
+	{"sites", "", "commentCounts.moderationQueue.queues.reportedAutomated", 2},
+	{"sites", "", "commentCounts.moderationQueue.queues.reportedUser", 1},
+}
+
+// SelfTest will seed the Processor's database with a small site, process it,
+// and check that the counts match the counts that were computed by hand, before
+// dropping the database. As the database is dropped, it must not already have
+// any collections. The expected counts assume the DefaultRules, apart from the
+// ReportedPolicy and CountDistinctAuthors, so the rules should not change any
+// of the others. The orphaned users are only checked when DetectOrphanedUsers
+// is enabled, and the reported queue is expected to be broken down by the
+// SelfTestAutomatedFlagKey. The stories and users of the comments changed since
+// the selfTestSince are also checked, as is the recompute marker of every
+// written document when StampRecomputeMarker is enabled.
+func SelfTest(ctx context.Context, p *Processor) error {
+	db, tenantID, siteID, rules := p.DB, p.TenantID, p.SiteID, p.Rules
+
+	names, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return errors.Wrap(err, "could not list the collections")
+	}
+
+	if len(names) > 0 {
+		return errors.Errorf("the %s database has collections, the self test must be run against an empty database as it is dropped", db.Name())
+	}
+
+	defer func() {
+		if err := db.Drop(context.Background()); err != nil {
+			logrus.WithError(err).WithField("database", db.Name()).Error("could not drop the self test database")
+		}
+	}()
+
+	if err := seedSelfTest(ctx, db, tenantID, siteID); err != nil {
+		return err
+	}
+
+	logrus.WithField("database", db.Name()).Info("seeded the self test database")
+
+	stories, err := p.Stories(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not process stories")
+	}
+
+	if err := p.Site(ctx); err != nil {
+		return errors.Wrap(err, "could not process site")
+	}
+
+	users, err := p.Users(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not process users")
+	}
+
+	expectations := append([]selfTestExpectation{}, selfTestExpectations...)
+	if rules.countsApproved() {
+		expectations = append(expectations, selfTestReportedApprovedExpectations...)
+	} else {
+		expectations = append(expectations, selfTestReportedExpectations...)
+	}
+	if rules.CountDistinctAuthors {
+		expectations = append(expectations, selfTestDistinctAuthorsExpectations...)
+	}
+
+	var failures []string
+	for _, expectation := range expectations {
+		value, err := loadSelfTestCount(ctx, p, tenantID, siteID, expectation)
+		if err != nil {
+			return err
+		}
+
+		if value != expectation.value {
+			failures = append(failures, fmt.Sprintf("%s %s %s: expected %d, found %d", expectation.collection, expectation.id, expectation.field, expectation.value, value))
+		}
+	}
+
+	if mismatch := p.CheckApprovedTotals(stories, users); mismatch != selfTestApprovedMismatch {
+		failures = append(failures, fmt.Sprintf("approved mismatch between users and stories: expected %d, found %d", selfTestApprovedMismatch, mismatch))
+	}
+
+	if p.DetectOrphanedUsers && users.Orphaned != len(selfTestOrphanedUsers) {
+		failures = append(failures, fmt.Sprintf("orphaned users: expected %d, found %d", len(selfTestOrphanedUsers), users.Orphaned))
+	}
+
+	dirty, err := p.ChangedSince(ctx, selfTestSince)
+	if err != nil {
+		return errors.Wrap(err, "could not load the comments changed since")
+	}
+
+	if expected, found := strings.Join(selfTestChangedSince.StoryIDs, ","), strings.Join(dirty.StoryIDs, ","); expected != found {
+		failures = append(failures, fmt.Sprintf("stories changed since: expected %s, found %s", expected, found))
+	}
+	if expected, found := strings.Join(selfTestChangedSince.UserIDs, ","), strings.Join(dirty.UserIDs, ","); expected != found {
+		failures = append(failures, fmt.Sprintf("users changed since: expected %s, found %s", expected, found))
+	}
+
+	if p.StampRecomputeMarker {
+		for _, collection := range []string{"stories", "sites", "users"} {
+			unstamped, err := p.unstampedCounts(ctx, collection)
+			if err != nil {
+				return err
+			}
+
+			if unstamped > 0 {
+				failures = append(failures, fmt.Sprintf("%s without the recompute marker of run %s: expected 0, found %d", collection, p.RunID, unstamped))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.Errorf("self test found incorrect counts: %s", strings.Join(failures, "; "))
+	}
+
+	logrus.WithField("checked", len(expectations)).Info("self test counts are correct")
+
+	return nil
+}
+
+// seedSelfTest will create the indexes that processing uses, and insert the
+// site, its stories and users, and the selfTestComments.
+func seedSelfTest(ctx context.Context, db *mongo.Database, tenantID, siteID string) error {
+	for _, collection := range []string{"stories", "users"} {
+		if _, err := db.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{
+				primitive.E{Key: "tenantID", Value: 1},
+				primitive.E{Key: "id", Value: 1},
+			},
+		}); err != nil {
+			return errors.Wrapf(err, "could not create the %s index", collection)
+		}
+	}
+
+	if _, err := db.Collection("sites").InsertOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "id", Value: siteID},
+	}); err != nil {
+		return errors.Wrap(err, "could not insert the site")
+	}
+
+	stories := make(map[string]struct{})
+	users := make(map[string]struct{})
+	comments := make([]interface{}, 0, len(selfTestComments))
+	for _, comment := range selfTestComments {
+		stories[comment.storyID] = struct{}{}
+		if _, orphaned := selfTestOrphanedUsers[comment.authorID]; comment.authorID != "" && !orphaned {
+			users[comment.authorID] = struct{}{}
+		}
+
+		actionCounts := bson.D{}
+		if comment.flags > 0 {
+			actionCounts = append(actionCounts, primitive.E{Key: "FLAG", Value: comment.flags})
+		}
+		if comment.automated > 0 {
+			actionCounts = append(actionCounts, primitive.E{Key: SelfTestAutomatedFlagKey, Value: comment.automated})
+		}
+
+		createdAt := selfTestCreatedAt
+		if created, ok := selfTestCreatedSince[comment.id]; ok {
+			createdAt = created
+		}
+
+		doc := bson.D{
+			primitive.E{Key: "tenantID", Value: tenantID},
+			primitive.E{Key: "siteID", Value: siteID},
+			primitive.E{Key: "id", Value: comment.id},
+			primitive.E{Key: "storyID", Value: comment.storyID},
+			primitive.E{Key: "authorID", Value: comment.authorID},
+			primitive.E{Key: "status", Value: comment.status},
+			primitive.E{Key: "actionCounts", Value: actionCounts},
+			primitive.E{Key: "createdAt", Value: createdAt},
+		}
+		if updatedAt, ok := selfTestUpdatedAt[comment.id]; ok {
+			doc = append(doc, primitive.E{Key: "updatedAt", Value: updatedAt})
+		}
+
+		comments = append(comments, doc)
+	}
+
+	for storyID := range stories {
+		if _, err := db.Collection("stories").InsertOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: tenantID},
+			primitive.E{Key: "siteID", Value: siteID},
+			primitive.E{Key: "id", Value: storyID},
+		}); err != nil {
+			return errors.Wrap(err, "could not insert the stories")
+		}
+	}
+
+	for userID := range users {
+		if _, err := db.Collection("users").InsertOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: tenantID},
+			primitive.E{Key: "id", Value: userID},
+		}); err != nil {
+			return errors.Wrap(err, "could not insert the users")
+		}
+	}
+
+	if _, err := db.Collection("comments").InsertMany(ctx, comments); err != nil {
+		return errors.Wrap(err, "could not insert the comments")
+	}
+
+	return nil
+}
+
+// loadSelfTestCount will return the count for the expectation from the
+// processed document. Missing counts are returned as zero.
+func loadSelfTestCount(ctx context.Context, p *Processor, tenantID, siteID string, expectation selfTestExpectation) (int64, error) {
+	id := expectation.id
+	if expectation.collection == "sites" {
+		id = siteID
+	}
+
+	var document bson.Raw
+	if err := p.outputCollection(expectation.collection).FindOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "id", Value: id},
+	}, options.FindOne().SetProjection(bson.D{
+		primitive.E{Key: expectation.field, Value: 1},
+	})).Decode(&document); err != nil {
+		return 0, errors.Wrapf(err, "could not find %s %s", expectation.collection, id)
+	}
+
+	value, err := document.LookupErr(strings.Split(expectation.field, ".")...)
+	if err != nil {
+		return 0, nil
+	}
+
+	count, ok := value.AsInt64OK()
+	if !ok {
+		return 0, errors.Errorf("expected %s on %s %s to be a number, found %s", expectation.field, expectation.collection, id, value.Type)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,84 @@
+package counts
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/sync/errgroup"
+)
+
+// MaxScanShards is the largest number of shards the scan can be split into, as
+// comments are assigned to a shard by the last hex digit of their story's ID.
+const MaxScanShards = 16
+
+// scanShardFilter returns the filter that matches the comments in the shard.
+// Comments are assigned to a shard by the last hex digit of their story's ID,
+// which is uniformly distributed for the UUID's that Coral uses, and every
+// comment on a story is in the same shard. Story ID's that don't end in a hex
+// digit are all assigned to the first shard.
+func (p *Processor) scanShardFilter(shard int) primitive.E {
+	storyID := "$" + p.Rules.Fields.StoryID
+
+	digit := bson.D{
+		primitive.E{Key: "$indexOfBytes", Value: bson.A{
+			"0123456789abcdef",
+			bson.D{
+				primitive.E{Key: "$substrBytes", Value: bson.A{
+					bson.D{primitive.E{Key: "$toLower", Value: storyID}},
+					bson.D{primitive.E{Key: "$subtract", Value: bson.A{
+						bson.D{primitive.E{Key: "$strLenBytes", Value: storyID}},
+						1,
+					}}},
+					1,
+				}},
+			},
+		}},
+	}
+
+	return primitive.E{Key: "$expr", Value: bson.D{
+		primitive.E{Key: "$eq", Value: bson.A{
+			bson.D{primitive.E{Key: "$mod", Value: bson.A{
+				bson.D{primitive.E{Key: "$max", Value: bson.A{digit, 0}}},
+				p.ScanShards,
+			}}},
+			shard,
+		}},
+	}}
+}
+
+// scanStoryShards will count the comments matching the filter on their stories
+// using ScanShards parallel cursors. As every comment on a story is in the same
+// shard, the stories counted by each shard don't overlap.
+func (p *Processor) scanStoryShards(ctx context.Context, filter, projection bson.D) (map[string]*Story, error) {
+	g, ctx := errgroup.WithContext(ctx)
+
+	var mux sync.Mutex
+	aggregator := NewAggregator(&p.Rules)
+
+	for shard := 0; shard < p.ScanShards; shard++ {
+		shardFilter := make(bson.D, len(filter), len(filter)+1)
+		copy(shardFilter, filter)
+		shardFilter = append(shardFilter, p.scanShardFilter(shard))
+
+		g.Go(func() error {
+			stories, err := p.scanStories(ctx, shardFilter, projection, 0)
+			if err != nil {
+				return err
+			}
+
+			mux.Lock()
+			aggregator.Merge(stories)
+			mux.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return aggregator.Stories(), nil
+}
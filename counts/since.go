@@ -0,0 +1,109 @@
+package counts
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChangedSince will find the stories and users of the comments on the site that
+// were changed since the time, so only they need to be recounted to catch up on
+// the changes made while the tool wasn't running. Comments without an updatedAt
+// have never been changed, so they're found by their createdAt instead. This
+// only reads from the database.
+func (p *Processor) ChangedSince(ctx context.Context, since time.Time) (*DirtyKeys, error) {
+	filter := sinceFilter(&p.Rules.Fields, p.TenantID, p.SiteID, since)
+	projection := commentProjection(p.Rules.Fields.StoryID, p.Rules.Fields.AuthorID)
+
+	storyIDs := make(map[string]struct{})
+	userIDs := make(map[string]struct{})
+	var comments int
+
+	started := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"siteID": p.SiteID,
+		"since":  since,
+	}).Info("loading comments changed since")
+
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		for p.nextTimed(ctx, cursor, collection) {
+			var comment Comment
+			if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+				return errors.Wrap(err, "could not decode result")
+			}
+
+			comments++
+
+			if comment.StoryID != "" {
+				storyIDs[comment.StoryID] = struct{}{}
+			}
+			if comment.AuthorID != "" {
+				userIDs[comment.AuthorID] = struct{}{}
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return errors.Wrap(err, "could not iterate on cursor")
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	dirty := DirtyKeys{
+		StoryIDs: sortedKeys(storyIDs),
+		UserIDs:  sortedKeys(userIDs),
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"comments": comments,
+		"stories":  len(dirty.StoryIDs),
+		"users":    len(dirty.UserIDs),
+		"took":     time.Since(started),
+	}).Info("loaded comments changed since")
+
+	return &dirty, nil
+}
+
+// sinceFilter returns the filter for the comments on the site that were updated
+// at or after the time, or were created at or after it when they don't have an
+// updatedAt. The times are read from the paths in the fields.
+func sinceFilter(fields *CommentFields, tenantID, siteID string, since time.Time) bson.D {
+	return bson.D{
+		primitive.E{Key: "tenantID", Value: tenantID},
+		primitive.E{Key: "siteID", Value: siteID},
+		primitive.E{Key: "$or", Value: bson.A{
+			bson.D{
+				primitive.E{Key: fields.UpdatedAt, Value: bson.D{
+					primitive.E{Key: "$gte", Value: since},
+				}},
+			},
+			bson.D{
+				primitive.E{Key: fields.UpdatedAt, Value: nil},
+				primitive.E{Key: fields.CreatedAt, Value: bson.D{
+					primitive.E{Key: "$gte", Value: since},
+				}},
+			},
+		}},
+	}
+}
+
+// sortedKeys returns the keys of the set in order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
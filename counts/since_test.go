@@ -0,0 +1,111 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestChangedSince(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(storyID, authorID string) bson.D {
+		return bson.D{
+			primitive.E{Key: "storyID", Value: storyID},
+			primitive.E{Key: "authorID", Value: authorID},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		comments    []bson.D
+		wantStories []string
+		wantUsers   []string
+	}{
+		{
+			name:        "no changes",
+			wantStories: []string{},
+			wantUsers:   []string{},
+		},
+		{
+			name:        "sorted and deduplicated",
+			comments:    []bson.D{comment("s2", "u1"), comment("s1", "u2"), comment("s2", "u2")},
+			wantStories: []string{"s1", "s2"},
+			wantUsers:   []string{"u1", "u2"},
+		},
+		{
+			name:        "missing story or author",
+			comments:    []bson.D{comment("", "u1"), comment("s1", "")},
+			wantStories: []string{"s1"},
+			wantUsers:   []string{"u1"},
+		},
+	}
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, tt.comments...))
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+
+			dirty, err := p.ChangedSince(context.Background(), since)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(dirty.StoryIDs, tt.wantStories) {
+				mt.Errorf("expected stories %v, got %v", tt.wantStories, dirty.StoryIDs)
+			}
+			if !reflect.DeepEqual(dirty.UserIDs, tt.wantUsers) {
+				mt.Errorf("expected users %v, got %v", tt.wantUsers, dirty.UserIDs)
+			}
+		})
+	}
+}
+
+func TestSinceFilter(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		fields        func(f *CommentFields)
+		wantUpdatedAt string
+		wantCreatedAt string
+	}{
+		{"default fields", func(f *CommentFields) {}, "updatedAt", "createdAt"},
+		{"mapped fields", func(f *CommentFields) { f.UpdatedAt, f.CreatedAt = "meta.updated", "meta.created" }, "meta.updated", "meta.created"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := DefaultCommentFields
+			tt.fields(&fields)
+
+			filter := sinceFilter(&fields, "tenant", "site", since)
+
+			want := bson.D{
+				primitive.E{Key: "tenantID", Value: "tenant"},
+				primitive.E{Key: "siteID", Value: "site"},
+				primitive.E{Key: "$or", Value: bson.A{
+					bson.D{
+						primitive.E{Key: tt.wantUpdatedAt, Value: bson.D{primitive.E{Key: "$gte", Value: since}}},
+					},
+					bson.D{
+						primitive.E{Key: tt.wantUpdatedAt, Value: nil},
+						primitive.E{Key: tt.wantCreatedAt, Value: bson.D{primitive.E{Key: "$gte", Value: since}}},
+					},
+				}},
+			}
+			if !reflect.DeepEqual(filter, want) {
+				t.Errorf("sinceFilter() = %v, want %v", filter, want)
+			}
+		})
+	}
+}
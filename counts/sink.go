@@ -0,0 +1,60 @@
+package counts
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sink writes the counts computed for every story or user. The stored counts
+// are replaced with the computed counts, so writes can be repeated.
+type Sink interface {
+	// Write will write the counts of each story or user keyed by their ID, where
+	// kind is either "story" or "user". The Processor is the one that computed
+	// the counts, and configures how they're written.
+	Write(ctx context.Context, p *Processor, kind string, counts map[string]interface{}) (*WriteResult, error)
+}
+
+// sinkCollections are the collections that each kind of counts are stored in.
+var sinkCollections = map[string]string{
+	"story": "stories",
+	"user":  "users",
+}
+
+// MongoSink is a Sink that writes the counts to the stories and users in the
+// database in batches.
+type MongoSink struct{}
+
+func (MongoSink) Write(ctx context.Context, p *Processor, kind string, counts map[string]interface{}) (*WriteResult, error) {
+	collection, ok := sinkCollections[kind]
+	if !ok {
+		return nil, errors.Errorf("can not write %s counts", kind)
+	}
+
+	writer := p.newBatchWriter(collection, kind)
+
+	return writer.write(ctx, func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+		for id, count := range counts {
+			// Create the new update with the counts.
+			update, err := p.countsUpdate(count)
+			if err != nil {
+				return errors.Wrapf(err, "could not create the %s update", kind)
+			}
+
+			var model mongo.WriteModel
+			if kind == "story" {
+				model = p.newStoryUpdate(id, update)
+			} else {
+				model = p.newUserUpdate(id, update)
+			}
+
+			// Add the new update model.
+			if err := emit(id, model); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -17,13 +17,57 @@ type Site struct {
 	CommentCounts StoryCommentCounts `bson:"commentCounts"`
 }
 
+// ResolveSites will return the ID's of the tenant's sites that match the
+// filter, sorted so they're processed in a stable order. The cursor is closed
+// within the cursorClose timeout.
+func ResolveSites(ctx context.Context, db *mongo.Database, tenantID string, filter bson.D, cursorClose time.Duration) ([]string, error) {
+	cursor, err := db.Collection("sites").Find(ctx, bson.D{
+		primitive.E{Key: "$and", Value: bson.A{
+			bson.D{primitive.E{Key: "tenantID", Value: tenantID}},
+			filter,
+		}},
+	}, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+	}).SetSort(bson.D{
+		primitive.E{Key: "id", Value: 1},
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(cursor, cursorClose)
+
+	var siteIDs []string
+	for cursor.Next(ctx) {
+		var site struct {
+			ID string `bson:"id"`
+		}
+		if err := cursor.Decode(&site); err != nil {
+			return nil, errors.Wrap(err, "could not decode site")
+		}
+
+		siteIDs = append(siteIDs, site.ID)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	return siteIDs, nil
+}
+
 // ProcessSite will update a given site's counts based on the story documents
 // that compose the values for that.
 func ProcessSite(ctx context.Context, db *mongo.Database, tenantID, siteID string, dryRun bool) error {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).Site(ctx)
+}
+
+// Site will update the site's counts based on the story documents that
+// compose the values for that.
+func (p *Processor) Site(ctx context.Context) error {
 	// Create the filter that will limit the documents processed.
 	filter := bson.D{
-		primitive.E{Key: "tenantID", Value: tenantID},
-		primitive.E{Key: "siteID", Value: siteID},
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
 	}
 
 	// Configure the projection to only get fields we care about.
@@ -32,45 +76,105 @@ func ProcessSite(ctx context.Context, db *mongo.Database, tenantID, siteID strin
 		primitive.E{Key: "commentCounts", Value: 1},
 	}
 
-	// Start querying.
-	cursor, err := db.Collection("stories").Find(ctx, filter, options.Find().SetProjection(projection))
+	// Start querying the stories that were written, which are the shadow stories
+	// when the output is redirected.
+	cursor, err := p.outputCollection("stories").Find(ctx, filter, options.Find().SetProjection(projection))
 	if err != nil {
 		return errors.Wrap(err, "could not create the cursor")
 	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-
-		if err := cursor.Close(ctx); err != nil {
-			panic(err)
-		}
-	}()
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
 
 	// Store all the counts for this site.
 	var site Site
 	site.CommentCounts.Action = make(map[string]int)
 
+	var stories, legacy, unknown int
+
+	// Track the stories we've seen so duplicate story documents are only counted
+	// once.
+	seen := make(map[string]struct{})
+
 	started := time.Now()
 	logrus.Info("loading counts from site stories")
 
 	// While there is still results to handle, decode the results.
 	for cursor.Next(ctx) {
-		var story Story
+		var story storedCountsDocument
 		if err := cursor.Decode(&story); err != nil {
 			return errors.Wrap(err, "could not decode result")
 		}
 
+		if p.UpdateDuplicateStories {
+			if _, ok := seen[story.ID]; ok {
+				continue
+			}
+
+			seen[story.ID] = struct{}{}
+		}
+
+		// Read the story's counts, which may have been stored by an older version
+		// of Coral in a different shape.
+		counts, isLegacy, err := decodeStoredCounts(story.CommentCounts)
+		if err != nil {
+			if p.StrictInvariants || !errors.Is(err, errUnknownCountsShape) {
+				return errors.Wrapf(err, "could not read the counts of story %s", story.ID)
+			}
+
+			// Summing these would silently count the story as zero.
+			unknown++
+			logrus.WithError(err).WithField("storyID", story.ID).Error("story counts are in an unknown shape and are not included in the site counts")
+			continue
+		}
+		if isLegacy {
+			legacy++
+			logrus.WithField("storyID", story.ID).Debug("story counts are in the legacy shape")
+		}
+
 		// Increment the site document based on this story.
-		site.CommentCounts.Merge(&story.CommentCounts)
+		site.CommentCounts.Merge(&counts)
+		stories++
 	}
 
 	if err := cursor.Err(); err != nil {
 		return errors.Wrap(err, "could not iterate on cursor")
 	}
 
+	// If there are no stories, make sure that's because there are no comments
+	// rather than because the stories haven't been imported yet, otherwise we'd
+	// zero the site's counts.
+	if stories == 0 {
+		if err := p.checkSiteHasNoComments(ctx); err != nil {
+			if p.StrictInvariants {
+				return err
+			}
+
+			logrus.WithError(err).WithField("id", p.SiteID).Error("site has no stories, the site counts will be written as zero, were the stories imported?")
+		}
+	}
+
+	if legacy > 0 {
+		p.Metrics.Count("site.legacy_stories", int64(legacy))
+		logrus.WithField("stories", legacy).Warn("stories have counts stored in the legacy shape, they were read but should be recounted to rewrite them")
+	}
+	if unknown > 0 {
+		p.Metrics.Count("site.unknown_stories", int64(unknown))
+		logrus.WithField("stories", unknown).Error("stories have counts stored in an unknown shape, the site counts are missing their comments")
+	}
+
+	p.Metrics.Timing("site.load", time.Since(started))
+
 	logrus.WithField("took", time.Since(started)).Info("loaded counts from site stories")
 
-	if dryRun {
+	// Ensure that the counts we've computed are consistent before we write them.
+	if err := site.CommentCounts.Validate(&p.Rules); err != nil {
+		if p.StrictInvariants {
+			return errors.Wrap(err, "site counts failed validation")
+		}
+
+		logrus.WithError(err).WithField("id", p.SiteID).Warn("site counts failed validation, the counting rules may have a bug")
+	}
+
+	if p.DryRun {
 		logrus.WithFields(logrus.Fields{
 			"commentCounts": site.CommentCounts,
 		}).Info("not writing site update as --dryRun is enabled")
@@ -79,24 +183,111 @@ func ProcessSite(ctx context.Context, db *mongo.Database, tenantID, siteID strin
 		started = time.Now()
 		logrus.Info("updating site")
 
+		update, err := p.countsUpdate(site.CommentCounts)
+		if err != nil {
+			return errors.Wrap(err, "could not create the site update")
+		}
+
 		// Update the site.
-		if _, err := db.Collection("sites").UpdateOne(ctx, bson.D{
-			primitive.E{Key: "tenantID", Value: tenantID},
-			primitive.E{Key: "id", Value: siteID},
-		}, bson.D{
-			primitive.E{Key: "$set", Value: bson.D{
-				primitive.E{Key: "commentCounts", Value: site.CommentCounts},
-			}},
-		}); err != nil {
+		if _, err := p.outputCollection("sites").UpdateOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "id", Value: p.SiteID},
+		}, p.stampMarker(update), options.Update().SetUpsert(p.shadowing())); err != nil {
 			return errors.Wrap(err, "could not update the site")
 		}
 
+		p.Metrics.Count("site.updates", 1)
+		p.Metrics.Timing("site.write", time.Since(started))
+
 		logrus.WithFields(logrus.Fields{
-			"id":   siteID,
+			"id":   p.SiteID,
 			"took": time.Since(started),
 		}).Info("site updated")
 
 	}
 
+	if p.SnapshotHistory {
+		if err := p.recordHistory(ctx, &site.CommentCounts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ProcessSiteDelta will apply the change in the counts of some of the site's
+// stories to the site's counts. This avoids reprocessing every story on the site
+// when only a few of them have changed.
+func ProcessSiteDelta(ctx context.Context, db *mongo.Database, tenantID, siteID string, delta *StoryCommentCounts, dryRun bool) error {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).SiteDelta(ctx, delta)
+}
+
+// SiteDelta will apply the change in the counts of some of the site's stories
+// to the site's counts.
+func (p *Processor) SiteDelta(ctx context.Context, delta *StoryCommentCounts) error {
+	inc, err := incDocument("commentCounts", delta)
+	if err != nil {
+		return errors.Wrap(err, "could not create the site update")
+	}
+
+	if len(inc) == 0 {
+		logrus.WithField("id", p.SiteID).Info("site counts have not changed")
+
+		return nil
+	}
+
+	if p.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"inc": inc,
+		}).Info("not writing site update as --dryRun is enabled")
+
+		return nil
+	}
+
+	started := time.Now()
+	logrus.Info("updating site")
+
+	// Update the site.
+	if _, err := p.outputCollection("sites").UpdateOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "id", Value: p.SiteID},
+	}, p.stampMarker(p.incUpdate(inc)), options.Update().SetUpsert(p.shadowing())); err != nil {
+		return errors.Wrap(err, "could not update the site")
+	}
+
+	p.Metrics.Count("site.updates", 1)
+	p.Metrics.Timing("site.write", time.Since(started))
+
+	logrus.WithFields(logrus.Fields{
+		"id":   p.SiteID,
+		"took": time.Since(started),
+	}).Info("site updated")
+
+	return nil
+}
+
+// checkSiteHasNoComments will return an error if the site has any comments in
+// any of the comments collections that are counted. This is used to detect when
+// comments have been imported before their stories.
+func (p *Processor) checkSiteHasNoComments(ctx context.Context) error {
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		comments, err := collection.CountDocuments(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "siteID", Value: p.SiteID},
+		}, options.Count().SetLimit(1))
+		if err != nil {
+			return errors.Wrapf(err, "could not check for comments on the site in %s", collection.Name())
+		}
+
+		if comments > 0 {
+			return errors.Errorf("site has comments in %s but no stories", collection.Name())
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,118 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// countResponse is the response to a CountDocuments that counted n documents.
+func countResponse(ns string, n int) bson.D {
+	if n == 0 {
+		return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch)
+	}
+
+	return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+		primitive.E{Key: "n", Value: int32(n)},
+	})
+}
+
+func TestSiteWithoutStories(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name     string
+		comments int
+		wantErr  string
+	}{
+		{name: "no comments"},
+		{name: "comments without stories", comments: 3, wantErr: "site has comments in comments but no stories"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch),
+				countResponse("coral.comments", tt.comments),
+			)
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.StrictInvariants = true
+
+			err := p.Site(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					mt.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				mt.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestResolveSites(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	site := func(id string) bson.D {
+		return bson.D{primitive.E{Key: "id", Value: id}}
+	}
+
+	tests := []struct {
+		name  string
+		sites []bson.D
+		want  []string
+	}{
+		{name: "no sites"},
+		{name: "matching sites", sites: []bson.D{site("a"), site("b")}, want: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.sites", mtest.FirstBatch, tt.sites...))
+
+			filter := bson.D{primitive.E{Key: "name", Value: "news"}}
+			got, err := ResolveSites(context.Background(), mt.DB, "tenant", filter, DefaultTimeouts.CursorClose)
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				mt.Errorf("expected sites %v, got %v", tt.want, got)
+			}
+
+			// The filter can't match the sites of another tenant.
+			and, _ := mt.GetStartedEvent().Command.Lookup("filter", "$and").Array().Values()
+			if len(and) != 2 {
+				mt.Fatalf("expected the tenant and the filter, got %v", and)
+			}
+			if tenantID := and[0].Document().Lookup("tenantID").StringValue(); tenantID != "tenant" {
+				mt.Errorf("expected the tenantID to be filtered, got %s", and[0])
+			}
+			if name := and[1].Document().Lookup("name").StringValue(); name != "news" {
+				mt.Errorf("expected the site filter, got %s", and[1])
+			}
+		})
+	}
+
+	mt.Run("find failed", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+			Code:    2,
+			Message: "bad filter",
+		}))
+
+		if _, err := ResolveSites(context.Background(), mt.DB, "tenant", bson.D{}, DefaultTimeouts.CursorClose); err == nil {
+			mt.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package counts
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SlowBatches returns the number of batches that have taken longer than the
+// SlowQueryThreshold.
+func (p *Processor) SlowBatches() int64 {
+	return atomic.LoadInt64(p.slowBatches)
+}
+
+// checkSlowBatch will log a warning and count the batch when it took longer
+// than the SlowQueryThreshold.
+func (p *Processor) checkSlowBatch(operation, collection string, size int, took time.Duration) {
+	if p.SlowQueryThreshold <= 0 || took < p.SlowQueryThreshold {
+		return
+	}
+
+	atomic.AddInt64(p.slowBatches, 1)
+	p.Metrics.Count("slow_batches", 1)
+
+	logrus.WithFields(logrus.Fields{
+		"operation":  operation,
+		"collection": collection,
+		"size":       size,
+		"took":       took,
+		"threshold":  p.SlowQueryThreshold,
+	}).Warn("batch was slower than the --slowQueryThreshold")
+}
+
+// nextTimed will advance the cursor like cursor.Next. When the cursor has used
+// up its current batch, the next call fetches a new batch from the server, so
+// it's timed and checked against the SlowQueryThreshold.
+func (p *Processor) nextTimed(ctx context.Context, cursor *mongo.Cursor, collection string) bool {
+	if cursor.RemainingBatchLength() > 0 {
+		return cursor.Next(ctx)
+	}
+
+	started := time.Now()
+	ok := cursor.Next(ctx)
+	if ok {
+		p.checkSlowBatch("find", collection, cursor.RemainingBatchLength()+1, time.Since(started))
+	}
+
+	return ok
+}
@@ -0,0 +1,73 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snapshotUnavailable returns true when the error is because the cluster time
+// is no longer (or not yet) within the snapshot history of the server.
+func snapshotUnavailable(err error) bool {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	// SnapshotTooOld and SnapshotUnavailable.
+	return se.HasErrorCode(239) || se.HasErrorCode(246)
+}
+
+// findSnapshot will find the documents matching the filter in the collection as
+// they were at the AtClusterTime. The driver doesn't support setting the time of
+// a snapshot read, so the find command is run directly. Only the projection,
+// sort, hint, and batch size of the options are used.
+func (p *Processor) findSnapshot(ctx context.Context, collection *mongo.Collection, filter bson.D, opts *options.FindOptions) (*mongo.Cursor, error) {
+	cmd := bson.D{
+		primitive.E{Key: "find", Value: collection.Name()},
+		primitive.E{Key: "filter", Value: filter},
+	}
+
+	if opts != nil {
+		if opts.Projection != nil {
+			cmd = append(cmd, primitive.E{Key: "projection", Value: opts.Projection})
+		}
+		if opts.Sort != nil {
+			cmd = append(cmd, primitive.E{Key: "sort", Value: opts.Sort})
+		}
+		if opts.Hint != nil {
+			cmd = append(cmd, primitive.E{Key: "hint", Value: opts.Hint})
+		}
+		if opts.BatchSize != nil {
+			cmd = append(cmd, primitive.E{Key: "batchSize", Value: *opts.BatchSize})
+		}
+	}
+
+	cmd = append(cmd, primitive.E{Key: "readConcern", Value: bson.D{
+		primitive.E{Key: "level", Value: "snapshot"},
+		primitive.E{Key: "atClusterTime", Value: primitive.Timestamp{
+			T: uint32(p.AtClusterTime.Unix()),
+		}},
+	}})
+
+	runOpts := options.RunCmd()
+	if p.ReadPreference != nil {
+		runOpts.SetReadPreference(p.ReadPreference)
+	}
+
+	cursor, err := p.DB.RunCommandCursor(ctx, cmd, runOpts)
+	if err != nil {
+		if snapshotUnavailable(err) {
+			return nil, errors.Wrapf(err, "the --atClusterTime %s is outside of the snapshot history of the server", p.AtClusterTime.Format(time.RFC3339))
+		}
+
+		return nil, err
+	}
+
+	return cursor, nil
+}
@@ -0,0 +1,89 @@
+package counts
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestFindSnapshot(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	atClusterTime := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		opts     *options.FindOptions
+		code     int32
+		wantKeys []string
+		wantErr  string
+	}{
+		{
+			name:     "no options",
+			wantKeys: []string{"find", "filter", "readConcern"},
+		},
+		{
+			name:     "projection and sort",
+			opts:     options.Find().SetProjection(bson.D{primitive.E{Key: "id", Value: 1}}).SetSort(bson.D{primitive.E{Key: "storyID", Value: 1}}),
+			wantKeys: []string{"find", "filter", "projection", "sort", "readConcern"},
+		},
+		{
+			name:    "snapshot too old",
+			code:    239,
+			wantErr: "is outside of the snapshot history of the server",
+		},
+		{
+			name:    "other failure",
+			code:    13,
+			wantErr: "not authorized",
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			if tt.code != 0 {
+				mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+					Code:    tt.code,
+					Message: "not authorized",
+				}))
+			} else {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch))
+			}
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.AtClusterTime = atClusterTime
+
+			cursor, err := p.findSnapshot(context.Background(), mt.DB.Collection("comments"), bson.D{}, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+			defer closeCursor(cursor, DefaultTimeouts.CursorClose)
+
+			command := mt.GetStartedEvent().Command
+			for _, key := range tt.wantKeys {
+				if _, err := command.LookupErr(key); err != nil {
+					mt.Errorf("expected the command to have %s, got %s", key, command)
+				}
+			}
+
+			level, _ := command.Lookup("readConcern", "level").StringValueOK()
+			ts, _ := command.Lookup("readConcern", "atClusterTime").Timestamp()
+			if level != "snapshot" || int64(ts) != atClusterTime.Unix() {
+				mt.Errorf("expected a snapshot at %d, got %s at %d", atClusterTime.Unix(), level, ts)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package counts
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,6 +19,18 @@ type StoryCommentCounts struct {
 	Action          CommentActionCounts    `bson:"action"`
 	Status          CommentStatusCounts    `bson:"status"`
 	ModerationQueue CommentModerationQueue `bson:"moderationQueue"`
+
+	// Source is only counted when CountBySource is enabled.
+	Source CommentSourceCounts `bson:"source,omitempty"`
+
+	// DistinctAuthors is the number of different users that have commented on
+	// the story, which is only counted when CountDistinctAuthors is enabled. It
+	// can't be summed, so it's left out when counts are merged, and the site
+	// doesn't have one.
+	DistinctAuthors int `bson:"distinctAuthors,omitempty"`
+
+	// Ratings are only counted when CountRatings is enabled.
+	Ratings *CommentRatingCounts `bson:"ratings,omitempty"`
 }
 
 func (scc *StoryCommentCounts) Merge(counts *StoryCommentCounts) {
@@ -36,41 +51,565 @@ func (scc *StoryCommentCounts) Merge(counts *StoryCommentCounts) {
 	scc.ModerationQueue.Queues.Unmoderated += counts.ModerationQueue.Queues.Unmoderated
 	scc.ModerationQueue.Queues.Reported += counts.ModerationQueue.Queues.Reported
 	scc.ModerationQueue.Queues.Pending += counts.ModerationQueue.Queues.Pending
+	scc.ModerationQueue.Queues.ReportedApproved += counts.ModerationQueue.Queues.ReportedApproved
+	scc.ModerationQueue.Queues.ReportedAutomated += counts.ModerationQueue.Queues.ReportedAutomated
+	scc.ModerationQueue.Queues.ReportedUser += counts.ModerationQueue.Queues.ReportedUser
+	for key, count := range counts.ModerationQueue.Queues.Custom {
+		if scc.ModerationQueue.Queues.Custom == nil {
+			scc.ModerationQueue.Queues.Custom = make(map[string]int)
+		}
+
+		scc.ModerationQueue.Queues.Custom[key] += count
+	}
+
+	// Source
+	for key, count := range counts.Source {
+		if scc.Source == nil {
+			scc.Source = make(CommentSourceCounts)
+		}
+
+		scc.Source[key] += count
+	}
+
+	// Ratings
+	if counts.Ratings != nil {
+		if scc.Ratings == nil {
+			scc.Ratings = &CommentRatingCounts{}
+		}
+
+		scc.Ratings.Merge(counts.Ratings)
+	}
+}
+
+// Subtract will remove the passed counts from these counts.
+func (scc *StoryCommentCounts) Subtract(counts *StoryCommentCounts) {
+	// Action
+	for key, count := range counts.Action {
+		scc.Action[key] -= count
+	}
+
+	// Status
+	scc.Status.Approved -= counts.Status.Approved
+	scc.Status.None -= counts.Status.None
+	scc.Status.Premod -= counts.Status.Premod
+	scc.Status.Rejected -= counts.Status.Rejected
+	scc.Status.SystemWithheld -= counts.Status.SystemWithheld
+
+	// ModerationQueue
+	scc.ModerationQueue.Total -= counts.ModerationQueue.Total
+	scc.ModerationQueue.Queues.Unmoderated -= counts.ModerationQueue.Queues.Unmoderated
+	scc.ModerationQueue.Queues.Reported -= counts.ModerationQueue.Queues.Reported
+	scc.ModerationQueue.Queues.Pending -= counts.ModerationQueue.Queues.Pending
+	scc.ModerationQueue.Queues.ReportedApproved -= counts.ModerationQueue.Queues.ReportedApproved
+	scc.ModerationQueue.Queues.ReportedAutomated -= counts.ModerationQueue.Queues.ReportedAutomated
+	scc.ModerationQueue.Queues.ReportedUser -= counts.ModerationQueue.Queues.ReportedUser
+	for key, count := range counts.ModerationQueue.Queues.Custom {
+		if scc.ModerationQueue.Queues.Custom == nil {
+			scc.ModerationQueue.Queues.Custom = make(map[string]int)
+		}
+
+		scc.ModerationQueue.Queues.Custom[key] -= count
+	}
+
+	// Source
+	for key, count := range counts.Source {
+		if scc.Source == nil {
+			scc.Source = make(CommentSourceCounts)
+		}
+
+		scc.Source[key] -= count
+	}
+
+	// Ratings
+	if counts.Ratings != nil {
+		if scc.Ratings == nil {
+			scc.Ratings = &CommentRatingCounts{}
+		}
+
+		scc.Ratings.Subtract(counts.Ratings)
+	}
+}
+
+// Validate will check that the counts are internally consistent with the
+// invariants that Coral maintains between the status counts and the moderation
+// queues, and that none of them are negative. Which comments can be reported
+// depends on the ReportedPolicy of the rules they were counted with.
+func (scc *StoryCommentCounts) Validate(rules *Rules) error {
+	violations := negativeCounts(scc.fields())
+
+	// Every comment in the moderation queue is in the unmoderated queue.
+	if scc.ModerationQueue.Total != scc.ModerationQueue.Queues.Unmoderated {
+		violations = append(violations, fmt.Sprintf("moderationQueue.total (%d) != moderationQueue.queues.unmoderated (%d)", scc.ModerationQueue.Total, scc.ModerationQueue.Queues.Unmoderated))
+	}
+
+	// Unmoderated comments are those with the NONE, PREMOD, or SYSTEM_WITHHELD
+	// status.
+	if unmoderated := scc.Status.None + scc.Status.Premod + scc.Status.SystemWithheld; scc.ModerationQueue.Queues.Unmoderated != unmoderated {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.unmoderated (%d) != status.NONE + status.PREMOD + status.SYSTEM_WITHHELD (%d)", scc.ModerationQueue.Queues.Unmoderated, unmoderated))
+	}
+
+	// Pending comments are those with the PREMOD or SYSTEM_WITHHELD status.
+	if pending := scc.Status.Premod + scc.Status.SystemWithheld; scc.ModerationQueue.Queues.Pending != pending {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.pending (%d) != status.PREMOD + status.SYSTEM_WITHHELD (%d)", scc.ModerationQueue.Queues.Pending, pending))
+	}
+
+	// Reported comments are a subset of the comments with the NONE status, apart
+	// from the reported comments that are approved, and those that are withheld
+	// when the ReportedPolicy counts them.
+	reportable, statuses := scc.Status.None, "status.NONE"
+	if rules.ReportedPolicy.ReportedWithheld {
+		reportable += scc.Status.SystemWithheld
+		statuses += " + status.SYSTEM_WITHHELD"
+	}
+	if reported := scc.ModerationQueue.Queues.Reported - scc.ModerationQueue.Queues.ReportedApproved; reported > reportable {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.reported - moderationQueue.queues.reportedApproved (%d) > %s (%d)", reported, statuses, reportable))
+	}
+
+	// Reported comments that are approved are a subset of the comments with the
+	// APPROVED status.
+	if scc.ModerationQueue.Queues.ReportedApproved > scc.Status.Approved {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.reportedApproved (%d) > status.APPROVED (%d)", scc.ModerationQueue.Queues.ReportedApproved, scc.Status.Approved))
+	}
+
+	// Reported comments broken down by who reported them are each a subset of
+	// the reported comments.
+	if scc.ModerationQueue.Queues.ReportedAutomated > scc.ModerationQueue.Queues.Reported {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.reportedAutomated (%d) > moderationQueue.queues.reported (%d)", scc.ModerationQueue.Queues.ReportedAutomated, scc.ModerationQueue.Queues.Reported))
+	}
+	if scc.ModerationQueue.Queues.ReportedUser > scc.ModerationQueue.Queues.Reported {
+		violations = append(violations, fmt.Sprintf("moderationQueue.queues.reportedUser (%d) > moderationQueue.queues.reported (%d)", scc.ModerationQueue.Queues.ReportedUser, scc.ModerationQueue.Queues.Reported))
+	}
+
+	if len(violations) > 0 {
+		return errors.Errorf("invalid comment counts: %s", strings.Join(violations, "; "))
+	}
+
+	return nil
 }
 
 // Story is a Story in Coral.
 type Story struct {
 	ID            string             `bson:"id"`
 	CommentCounts StoryCommentCounts `bson:"commentCounts"`
+
+	// StaleComments is the number of comments on the story that have been
+	// waiting to be moderated for longer than the MaxCommentAge. It is not
+	// stored.
+	StaleComments int `bson:"-"`
+
+	// CreatedAt counts the comments on the story with an implausible createdAt,
+	// which are only checked when CheckCreatedAt is enabled. It is not stored.
+	CreatedAt CreatedAtHealth `bson:"-"`
+
+	// authors are the ID's of the users that have commented on the story, which
+	// are only kept when CountDistinctAuthors is enabled.
+	authors map[string]struct{}
 }
 
-// Increment will increment the comment counts based on the passed comment.
-func (s *Story) Increment(comment *Comment) {
+// Increment will increment the comment counts based on the passed comment,
+// following the rules.
+func (s *Story) Increment(comment *Comment, rules *Rules) {
+	if rules.Excluded(comment) {
+		return
+	}
+
 	// Action
-	s.CommentCounts.Action.Increment(comment)
+	s.CommentCounts.Action.Increment(comment, rules)
 
 	// Status
 	s.CommentCounts.Status.Increment(comment)
 
 	// ModerationQueue
-	s.CommentCounts.ModerationQueue.Increment(comment)
+	s.CommentCounts.ModerationQueue.Increment(comment, rules)
+
+	// Source
+	if rules.CountBySource {
+		if s.CommentCounts.Source == nil {
+			s.CommentCounts.Source = make(CommentSourceCounts)
+		}
+
+		s.CommentCounts.Source.Increment(comment)
+	}
+
+	// Ratings
+	if rules.CountRatings {
+		if s.CommentCounts.Ratings == nil {
+			s.CommentCounts.Ratings = &CommentRatingCounts{}
+		}
+
+		s.CommentCounts.Ratings.Increment(comment)
+	}
+
+	// DistinctAuthors
+	if rules.CountDistinctAuthors && comment.AuthorID != "" {
+		if s.authors == nil {
+			s.authors = make(map[string]struct{})
+		}
+
+		s.authors[comment.AuthorID] = struct{}{}
+		s.CommentCounts.DistinctAuthors = len(s.authors)
+	}
+
+	if rules.Stale(comment) {
+		s.StaleComments++
+	}
+
+	if rules.CheckCreatedAt {
+		s.CreatedAt.Check(comment, rules.EarliestCreatedAt)
+	}
+}
+
+// StoriesResult describes the outcome of processing stories.
+type StoriesResult struct {
+	WriteResult
+
+	// Stories is the number of stories that had counts computed.
+	Stories int
+
+	// StaleComments is the number of comments that have been waiting to be
+	// moderated for longer than the MaxCommentAge.
+	StaleComments int
+
+	// CreatedAt counts the comments with an implausible createdAt. It is only
+	// checked when CheckCreatedAt is enabled.
+	CreatedAt CreatedAtHealth
+
+	// Delta is the change between the previously stored counts and the newly
+	// computed counts summed across all the processed stories. It is only
+	// computed when specific stories are processed.
+	Delta *StoryCommentCounts
+
+	// Drifted is the number of stories whose stored counts differed from the
+	// computed counts. It is only computed when only drifted stories are
+	// written.
+	Drifted int
+
+	// Approved is the number of approved comments on the stories, not counting
+	// the comments without a story.
+	Approved int
+
+	// Changed is the number of stories whose stored counts differ from the
+	// computed counts. It is only computed when dry runs estimate the changes.
+	Changed int
+
+	// Conflicted are the ID's of the stories that weren't written as their
+	// counts changed while their comments were counted. They're only found with
+	// OptimisticWrites.
+	Conflicted []string
+}
+
+// ProcessStoriesFrom will count the comments returned by next and update the
+// cached counts for each of their stories. This allows the comments to come
+// from somewhere other than the comments collection. Stories without any
+// comments from next are not updated.
+func ProcessStoriesFrom(ctx context.Context, db *mongo.Database, tenantID, siteID string, next CommentIterator, dryRun bool) (*StoriesResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).StoriesFrom(ctx, next)
+}
+
+// StoriesFrom will count the comments returned by next and update the cached
+// counts for each of their stories. This allows the comments to come from
+// somewhere other than the comments collection. Stories without any comments
+// from next are not updated.
+func (p *Processor) StoriesFrom(ctx context.Context, next CommentIterator) (*StoriesResult, error) {
+	stories, err := NewAggregator(&p.Rules).Aggregate(next)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count comments")
+	}
+
+	return p.writeStories(ctx, nil, stories, nil)
+}
+
+// writeStories will write the counts for each of the stories. When `storyID`'s
+// are specified, the change to the site's counts is computed as well. When the
+// versions that the stories were counted over were read, the stories are only
+// written over those versions.
+func (p *Processor) writeStories(ctx context.Context, storyIDs []string, stories map[string]*Story, versions map[string]bson.RawValue) (*StoriesResult, error) {
+	result := StoriesResult{
+		Stories:  len(stories),
+		Approved: approvedOnStories(stories),
+	}
+	for _, story := range stories {
+		result.StaleComments += story.StaleComments
+		result.CreatedAt.Merge(&story.CreatedAt)
+	}
+	logCreatedAtHealth(&result.CreatedAt, p.Rules.EarliestCreatedAt)
+
+	// Ensure that the counts we've computed are consistent before we write them.
+	if err := p.validateStories(stories); err != nil {
+		return nil, err
+	}
+
+	// Report where the comments are concentrated when every story was counted.
+	if p.TopStories > 0 && len(storyIDs) == 0 {
+		logTopStories(stories, p.TopStories)
+	}
+
+	// If we're processing specific stories, compute the change between the
+	// counts that are stored and the counts we're about to write so that the
+	// site can be updated without reprocessing all of its stories.
+	if len(storyIDs) > 0 {
+		delta, err := p.storyDelta(ctx, storyIDs, stories)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Delta = delta
+	}
+
+	// Only write the stories whose counts have drifted.
+	if p.OnlyDrift {
+		drifted, err := p.driftedStories(ctx, stories)
+		if err != nil {
+			return nil, err
+		}
+
+		stories = drifted
+		result.Drifted = len(drifted)
+	}
+
+	// Load the counts that are about to be replaced so the changes to them can
+	// be recorded.
+	var previous map[string]bson.Raw
+	if p.auditing() {
+		ids, _ := storyCounts(stories)
+		previous = p.loadAuditCounts(ctx, "stories", ids)
+	}
+
+	// Write the counts for each story.
+	_, written := storyCounts(stories)
+
+	// Estimate how many of the stories a real run would change.
+	if p.estimateChanges() {
+		changed, err := p.changed(ctx, "stories", written)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not estimate the changed stories")
+		}
+
+		result.Changed = changed
+	}
+
+	var (
+		res *WriteResult
+		err error
+	)
+	if p.optimistic() && versions != nil {
+		// The change to the site only includes the stories that were written,
+		// which is computed from the versions they were written over.
+		var delta *StoryCommentCounts
+		res, result.Conflicted, delta, err = p.writeOptimistic(ctx, stories, versions)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not write story updates")
+		}
+
+		if result.Delta != nil {
+			result.Delta = delta
+		}
+
+		if len(result.Conflicted) > 0 {
+			logrus.WithField("conflicted", len(result.Conflicted)).Warn("the counts of some stories changed while their comments were counted, they were not written and will be recounted")
+		}
+	} else {
+		res, err = p.Destination.Write(ctx, p, "story", written)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not write story updates")
+		}
+	}
+
+	result.WriteResult = *res
+
+	logrus.WithFields(logrus.Fields{
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"failed":   res.Failed,
+	}).Info("finished writing story updates")
+
+	if previous != nil {
+		p.recordAudit(ctx, "stories", previous, written)
+	}
+
+	if p.publishing() {
+		if err := p.publishCounts(ctx, "story", written); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// storyDelta will compute the change between the counts that are stored for the
+// specified stories and the counts that are about to be written for them. Any of
+// the specified stories that no longer have comments are added to the stories
+// so that their counts are written too.
+func (p *Processor) storyDelta(ctx context.Context, storyIDs []string, stories map[string]*Story) (*StoryCommentCounts, error) {
+	// Stories that no longer have any comments still need to have their counts
+	// written.
+	for _, storyID := range storyIDs {
+		if _, ok := stories[storyID]; !ok {
+			story := &Story{}
+			story.CommentCounts.Action = make(map[string]int)
+
+			stories[storyID] = story
+		}
+	}
+
+	previous, err := p.loadStoryCounts(ctx, p.outputCollection("stories"), storyIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load previous story counts")
+	}
+
+	delta := &StoryCommentCounts{
+		Action: make(map[string]int),
+	}
+
+	for storyID, story := range stories {
+		counts, ok := previous[storyID]
+		if !ok && !p.upsertingStories() {
+			// The story document doesn't exist, so the write won't match it and it
+			// won't contribute to the site.
+			continue
+		}
+
+		delta.Merge(&story.CommentCounts)
+		if ok {
+			delta.Subtract(counts)
+
+			if diff := Diff(*counts, story.CommentCounts); !diff.Empty() {
+				logrus.WithFields(logrus.Fields{
+					"storyID": storyID,
+					"changes": diff.String(),
+				}).Debug("story counts changed")
+			}
+		}
+	}
+
+	return delta, nil
+}
+
+// loadStoryCounts will load the currently stored counts for the specified
+// stories keyed by their ID. Stories that do not exist are not returned.
+func (p *Processor) loadStoryCounts(ctx context.Context, collection *mongo.Collection, storyIDs []string) (map[string]*StoryCommentCounts, error) {
+	cursor, err := collection.Find(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: "id", Value: bson.D{
+			primitive.E{Key: "$in", Value: storyIDs},
+		}},
+	}, options.Find().SetProjection(bson.D{
+		primitive.E{Key: "id", Value: 1},
+		primitive.E{Key: "commentCounts", Value: 1},
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	counts := make(map[string]*StoryCommentCounts)
+	for cursor.Next(ctx) {
+		var story Story
+		if err := cursor.Decode(&story); err != nil {
+			return nil, errors.Wrap(err, "could not decode result")
+		}
+
+		counts[story.ID] = &story.CommentCounts
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	return counts, nil
+}
+
+// newStoryUpdate will create the model that applies the update to the story.
+// When UpdateDuplicateStories is enabled, the update is applied to every story
+// document with the story's ID.
+func (p *Processor) newStoryUpdate(storyID string, update interface{}) mongo.WriteModel {
+	update = p.stampMarker(update)
+
+	// Select the story we're updating.
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+		primitive.E{Key: "id", Value: storyID},
+	}
+
+	hint := bson.D{
+		primitive.E{Key: "tenantID", Value: 1},
+		primitive.E{Key: "id", Value: 1},
+	}
+
+	if p.UpdateDuplicateStories {
+		model := mongo.NewUpdateManyModel().SetFilter(filter).SetUpdate(update)
+		if p.upsertingStories() {
+			model.SetUpsert(true)
+		}
+		if p.hinting() {
+			model.SetHint(hint)
+		}
+
+		return model
+	}
+
+	model := mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)
+	if p.upsertingStories() {
+		model.SetUpsert(true)
+	}
+	if p.hinting() {
+		model.SetHint(hint)
+	}
+
+	return model
+}
+
+// negativeCounts returns a violation for each of the counts that is negative,
+// sorted by the path of the count.
+func negativeCounts(fields map[string]int) []string {
+	var violations []string
+	for key, count := range fields {
+		if count < 0 {
+			violations = append(violations, fmt.Sprintf("%s (%d) < 0", key, count))
+		}
+	}
+
+	sort.Strings(violations)
+
+	return violations
+}
+
+// validateStories will validate the counts of each story, returning the first
+// error when StrictInvariants is enabled, otherwise logging each story that
+// failed validation.
+func (p *Processor) validateStories(stories map[string]*Story) error {
+	for storyID, story := range stories {
+		if err := story.CommentCounts.Validate(&p.Rules); err != nil {
+			if p.StrictInvariants {
+				return errors.Wrapf(err, "story %s counts failed validation", storyID)
+			}
+
+			logrus.WithError(err).WithField("id", storyID).Warn("story counts failed validation, the counting rules may have a bug")
+		}
+	}
+
+	return nil
 }
 
-// ProcessStories will iterate over each stories comments and aggregate the
-// results to update the cached counts for each story. `storyID`'s are optional,
-// and will limit the total stories that are processed.
-func ProcessStories(ctx context.Context, db *mongo.Database, tenantID, siteID string, storyIDs []string, dryRun bool) error {
+// loadStories will count the comments on each story on the site. `storyID`'s
+// are optional, and will limit the stories that are counted. When writing with
+// optimistic concurrency, the versions of the stories are returned as well,
+// which are read before their comments are counted.
+func (p *Processor) loadStories(ctx context.Context, storyIDs []string) (map[string]*Story, map[string]bson.RawValue, error) {
 	// Create the filter that will limit the documents processed.
 	filter := bson.D{
-		primitive.E{Key: "tenantID", Value: tenantID},
-		primitive.E{Key: "siteID", Value: siteID},
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
 	}
 
 	// If storyID's are specified (and contains id's), then we should limit this
 	// query to only those comments that are from those stories.
 	if len(storyIDs) > 0 {
 		filter = append(filter, primitive.E{
-			Key: "storyID",
+			Key: p.Rules.Fields.StoryID,
 			Value: bson.D{
 				primitive.E{
 					Key:   "$in",
@@ -81,140 +620,209 @@ func ProcessStories(ctx context.Context, db *mongo.Database, tenantID, siteID st
 	}
 
 	// Configure the projection to only get fields we care about.
-	projection := bson.D{
-		primitive.E{Key: "storyID", Value: 1},
-		primitive.E{Key: "status", Value: 1},
-		primitive.E{Key: "actionCounts", Value: 1},
+	projection := p.Rules.storyProjection()
+
+	// Read the counts that the stories will be written over before counting, so
+	// the stories that change while their comments are counted aren't
+	// overwritten.
+	var versions map[string]bson.RawValue
+	if p.optimistic() {
+		var err error
+		if versions, err = p.loadStoryVersions(ctx, storyIDs); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Start querying.
-	cursor, err := db.Collection("comments").Find(ctx, filter, options.Find().SetProjection(projection))
+	started := time.Now()
+	logrus.WithField("siteID", p.SiteID).Info("loading stories from comments")
+
+	// Count each of the comments on their story, splitting the scan into shards
+	// when every story on the site is being counted.
+	var (
+		stories map[string]*Story
+		err     error
+	)
+	if p.AggregationMode {
+		stories, err = p.aggregateStories(ctx, filter)
+	} else if p.LimitStories == 0 && len(storyIDs) == 0 && p.TenantScan.scanning(p.SiteID) {
+		stories, err = p.tenantScanStories(ctx)
+	} else if p.LimitStories > 0 && len(storyIDs) == 0 {
+		stories, err = p.scanStories(ctx, filter, projection, p.LimitStories)
+	} else if p.ScanShards > 1 && len(storyIDs) == 0 {
+		stories, err = p.scanStoryShards(ctx, filter, projection)
+	} else {
+		stories, err = p.scanStories(ctx, filter, projection, 0)
+	}
 	if err != nil {
-		return errors.Wrap(err, "could not create the cursor")
+		return nil, nil, err
 	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
 
-		if err := cursor.Close(ctx); err != nil {
-			panic(err)
+	for storyID, story := range stories {
+		if story.StaleComments > 0 {
+			logrus.WithFields(logrus.Fields{
+				"storyID":       storyID,
+				"staleComments": story.StaleComments,
+				"maxCommentAge": p.Rules.MaxCommentAge,
+			}).Warn("story has comments that have been waiting to be moderated for too long")
 		}
-	}()
+	}
 
-	// Store all the stories in this map.
-	stories := make(map[string]*Story)
+	p.Metrics.Count("stories.processed", int64(len(stories)))
+	p.Metrics.Timing("stories.load", time.Since(started))
 
-	started := time.Now()
-	logrus.WithField("siteID", siteID).Info("loading stories from comments")
+	logrus.WithFields(logrus.Fields{
+		"stories":  len(stories),
+		"scanSort": p.ScanSort,
+		"took":     time.Since(started),
+	}).Info("loaded stories from comments")
 
-	// While there is still results to handle, decode the results.
-	for cursor.Next(ctx) {
-		var comment Comment
-		if err := cursor.Decode(&comment); err != nil {
-			return errors.Wrap(err, "could not decode result")
-		}
+	return stories, versions, nil
+}
 
-		// Create the story in the map if it isn't already.
-		story, ok := stories[comment.StoryID]
-		if !ok {
-			story = &Story{}
-			stories[comment.StoryID] = story
+// scanStories will count the comments matching the filter on their stories.
+// When limit is greater than zero, at most limit stories are counted.
+func (p *Processor) scanStories(ctx context.Context, filter, projection bson.D, limit int) (map[string]*Story, error) {
+	opts := options.Find().SetProjection(projection)
+	if sort := p.scanSortOptions(); sort != nil {
+		opts.SetSort(sort)
+	}
 
-			story.CommentCounts.Action = make(map[string]int)
+	// When the comments in the only collection are sorted by their story, every
+	// comment after the first one that isn't accepted is on a story that won't
+	// be counted, so the scan can stop there.
+	stopAtLimit := limit > 0 && p.ScanSort == ScanSortStoryID && len(p.CommentsCollections) == 0
+
+	// Count the comments from every collection together, as the comments on a
+	// story can be spread across them.
+	aggregator := NewLimitedAggregator(limit, &p.Rules)
+	if err := p.findComments(ctx, filter, opts, func(collection string, cursor *mongo.Cursor) error {
+		if !stopAtLimit {
+			_, err := aggregator.Aggregate(p.cursorComments(ctx, collection, cursor))
+			return err
 		}
 
-		// Increment the story document based on this comment.
-		story.Increment(&comment)
-	}
+		next := p.cursorComments(ctx, collection, cursor)
+		for {
+			comment, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
 
-	if err := cursor.Err(); err != nil {
-		return errors.Wrap(err, "could not iterate on cursor")
-	}
+			if !aggregator.Accepts(comment) {
+				logrus.WithField("limitStories", limit).Info("stopped scanning comments as the limit of stories was reached")
+				return nil
+			}
 
-	logrus.WithFields(logrus.Fields{
-		"stories": len(stories),
-		"took":    time.Since(started),
-	}).Info("loaded stories from comments")
+			aggregator.Add(comment)
+		}
+	}); err != nil {
+		return nil, err
+	}
 
-	// We will collect all the bulk write operations that we'll use to update the
-	// stories here.
-	updates := make([]mongo.WriteModel, 0)
+	return aggregator.Stories(), nil
+}
 
-	// Iterate over the stories in the map.
-	for storyID, story := range stories {
-		// Create the new update.
-		update := mongo.NewUpdateOneModel()
-
-		// Select the story we're updating.
-		update.SetFilter(bson.D{
-			primitive.E{Key: "tenantID", Value: tenantID},
-			primitive.E{Key: "siteID", Value: siteID},
-			primitive.E{Key: "id", Value: storyID},
-		})
+// VerifyStorySample will recount the comments on a random sample of the site's
+// stories and log each story where the stored counts differ from the recounted
+// ones. Run right after the stories are written, this measures how much the
+// counts drifted from comments that changed while they were being scanned. It
+// returns the number of stories that were checked and the number that drifted.
+// This only reads from the database.
+func (p *Processor) VerifyStorySample(ctx context.Context, sampleSize int) (int, int, error) {
+	// Nothing is written here, so any comments that can't be decoded aren't
+	// recorded.
+	p = p.reader()
 
-		// Update it with the counts.
-		update.SetUpdate(bson.D{
-			primitive.E{Key: "$set", Value: bson.D{
-				primitive.E{Key: "commentCounts", Value: story.CommentCounts},
+	started := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"siteID":     p.SiteID,
+		"sampleSize": sampleSize,
+	}).Info("verifying sampled story counts")
+
+	// Sample the stories to verify.
+	cursor, err := p.outputCollection("stories").Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.D{
+				primitive.E{Key: "tenantID", Value: p.TenantID},
+				primitive.E{Key: "siteID", Value: p.SiteID},
 			}},
-		})
-
-		update.SetHint(bson.D{
-			primitive.E{Key: "tenantID", Value: 1},
-			primitive.E{Key: "id", Value: 1},
-		})
-
-		// Add the new update model.
-		updates = append(updates, update)
-
-		// If we have more updates than the max size, then process them now.
-		if len(updates) >= MaxBatchWriteSize {
-			if dryRun {
-				logrus.WithFields(logrus.Fields{
-					"updates": len(updates),
-				}).Info("not writing bulk story updates as --dryRun is enabled")
-
-				// Reset the updates slice.
-				updates = make([]mongo.WriteModel, 0)
+		},
+		bson.D{
+			primitive.E{Key: "$sample", Value: bson.D{
+				primitive.E{Key: "size", Value: sampleSize},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$project", Value: bson.D{
+				primitive.E{Key: "id", Value: 1},
+				primitive.E{Key: "commentCounts", Value: 1},
+			}},
+		},
+	})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not sample stories")
+	}
 
-				continue
-			}
+	var sampled []countsDocument
+	if err := cursor.All(ctx, &sampled); err != nil {
+		return 0, 0, errors.Wrap(err, "could not decode sampled stories")
+	}
 
-			res, err := db.Collection("stories").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
-			if err != nil {
-				return errors.Wrap(err, "could not bulk write story updates")
-			}
+	if len(sampled) == 0 {
+		return 0, 0, nil
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"updates":  len(updates),
-				"modified": res.ModifiedCount,
-			}).Info("wrote bulk story updates")
+	storyIDs := make([]string, 0, len(sampled))
+	for _, story := range sampled {
+		storyIDs = append(storyIDs, story.ID)
+	}
 
-			// Reset the updates slice.
-			updates = make([]mongo.WriteModel, 0)
-		}
+	// Recount the comments on the sampled stories.
+	stories, _, err := p.loadStories(ctx, storyIDs)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not recount stories")
 	}
 
-	// If we have updates leftover, process them now.
-	if len(updates) > 0 {
-		if dryRun {
-			logrus.WithFields(logrus.Fields{
-				"updates": len(updates),
-			}).Info("not writing bulk story updates as --dryRun is enabled")
+	// Compare the stored counts to the recounted ones.
+	var drifted int
+	for _, story := range sampled {
+		counts := StoryCommentCounts{
+			Action: make(map[string]int),
+		}
+		if recounted, ok := stories[story.ID]; ok {
+			counts = recounted.CommentCounts
+		}
 
-			return nil
+		raw, err := bson.Marshal(&counts)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "could not marshal recounted counts")
 		}
 
-		res, err := db.Collection("stories").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+		deltas, err := diffCounts(story.CommentCounts, raw)
 		if err != nil {
-			return errors.Wrap(err, "could not bulk write story updates")
+			return 0, 0, errors.Wrap(err, "could not compare counts")
+		}
+
+		if len(deltas) == 0 {
+			continue
 		}
 
+		drifted++
+
 		logrus.WithFields(logrus.Fields{
-			"updates":  len(updates),
-			"modified": res.ModifiedCount,
-		}).Info("wrote bulk story updates")
+			"storyID": story.ID,
+			"drift":   deltas,
+		}).Warn("story counts drifted from its comments")
 	}
 
-	return nil
+	logrus.WithFields(logrus.Fields{
+		"checked": len(sampled),
+		"drifted": drifted,
+		"took":    time.Since(started),
+	}).Info("verified sampled story counts")
+
+	return len(sampled), drifted, nil
 }
@@ -0,0 +1,325 @@
+package counts
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestStoryCommentCountsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		counts  func(scc *StoryCommentCounts)
+		wantErr string
+	}{
+		{
+			name:   "empty",
+			rules:  DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {},
+		},
+		{
+			name:  "consistent",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.None = 3
+				scc.Status.Premod = 1
+				scc.Status.Approved = 4
+				scc.ModerationQueue.Total = 4
+				scc.ModerationQueue.Queues.Unmoderated = 4
+				scc.ModerationQueue.Queues.Pending = 1
+				scc.ModerationQueue.Queues.Reported = 2
+			},
+		},
+		{
+			name:  "total differs from unmoderated",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.None = 1
+				scc.ModerationQueue.Total = 2
+				scc.ModerationQueue.Queues.Unmoderated = 1
+			},
+			wantErr: "moderationQueue.total (2) != moderationQueue.queues.unmoderated (1)",
+		},
+		{
+			name:  "unmoderated differs from statuses",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.None = 1
+				scc.ModerationQueue.Total = 2
+				scc.ModerationQueue.Queues.Unmoderated = 2
+			},
+			wantErr: "moderationQueue.queues.unmoderated (2) != status.NONE + status.PREMOD + status.SYSTEM_WITHHELD (1)",
+		},
+		{
+			name:  "pending differs from statuses",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.Premod = 1
+				scc.ModerationQueue.Total = 1
+				scc.ModerationQueue.Queues.Unmoderated = 1
+			},
+			wantErr: "moderationQueue.queues.pending (0) != status.PREMOD + status.SYSTEM_WITHHELD (1)",
+		},
+		{
+			name:  "more reported than unmoderated",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.None = 1
+				scc.ModerationQueue.Total = 1
+				scc.ModerationQueue.Queues.Unmoderated = 1
+				scc.ModerationQueue.Queues.Reported = 2
+			},
+			wantErr: "moderationQueue.queues.reported - moderationQueue.queues.reportedApproved (2) > status.NONE (1)",
+		},
+		{
+			name:  "more reported approved than approved",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.Approved = 1
+				scc.ModerationQueue.Queues.Reported = 2
+				scc.ModerationQueue.Queues.ReportedApproved = 2
+			},
+			wantErr: "moderationQueue.queues.reportedApproved (2) > status.APPROVED (1)",
+		},
+		{
+			name:  "more reported by users than reported",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.None = 1
+				scc.ModerationQueue.Total = 1
+				scc.ModerationQueue.Queues.Unmoderated = 1
+				scc.ModerationQueue.Queues.Reported = 1
+				scc.ModerationQueue.Queues.ReportedUser = 2
+			},
+			wantErr: "moderationQueue.queues.reportedUser (2) > moderationQueue.queues.reported (1)",
+		},
+		{
+			name:  "negative status",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Status.Rejected = -1
+			},
+			wantErr: "status.REJECTED (-1) < 0",
+		},
+		{
+			name:  "negative action",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.Action["FLAG"] = -2
+			},
+			wantErr: "action.FLAG (-2) < 0",
+		},
+		{
+			name:  "negative queues sorted by path",
+			rules: DefaultRules(),
+			counts: func(scc *StoryCommentCounts) {
+				scc.ModerationQueue.Total = -1
+				scc.ModerationQueue.Queues.Unmoderated = -1
+				scc.Status.None = -1
+			},
+			wantErr: "moderationQueue.queues.unmoderated (-1) < 0; moderationQueue.total (-1) < 0; status.NONE (-1) < 0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scc := StoryCommentCounts{Action: make(CommentActionCounts)}
+			tt.counts(&scc)
+
+			err := scc.Validate(&tt.rules)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestStoryIncrementValidates checks that the counts of comments with every
+// status, with and without flags, are consistent.
+func TestStoryIncrementValidates(t *testing.T) {
+	rules := DefaultRules()
+
+	story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+	for _, status := range CommentStatuses {
+		story.Increment(&Comment{Status: status}, &rules)
+		story.Increment(&Comment{Status: status, ActionCounts: map[string]int{"FLAG": 1}}, &rules)
+	}
+
+	if err := story.CommentCounts.Validate(&rules); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestIncrementExcludedStatuses(t *testing.T) {
+	rules := DefaultRules()
+	rules.ExcludedStatuses["REJECTED"] = struct{}{}
+
+	story := Story{CommentCounts: StoryCommentCounts{Action: make(CommentActionCounts)}}
+	var user User
+	for _, comment := range []Comment{
+		{Status: "APPROVED", ActionCounts: map[string]int{"REACTION": 1}},
+		{Status: "REJECTED", ActionCounts: map[string]int{"FLAG": 2}},
+	} {
+		story.Increment(&comment, &rules)
+		user.Increment(&comment, &rules)
+	}
+
+	if got := story.CommentCounts.Status; got.Approved != 1 || got.Rejected != 0 {
+		t.Errorf("expected only the approved comment on the story, got %+v", got)
+	}
+	if got := story.CommentCounts.Action; got["FLAG"] != 0 || got["REACTION"] != 1 {
+		t.Errorf("expected only the actions of the approved comment on the story, got %v", got)
+	}
+	if got := user.CommentCounts.Status; got.Approved != 1 || got.Rejected != 0 {
+		t.Errorf("expected only the approved comment on the user, got %+v", got)
+	}
+}
+
+func TestNewStoryUpdateUpsert(t *testing.T) {
+	tests := []struct {
+		name          string
+		upsertStories bool
+		suffix        string
+		wantUpsert    bool
+		wantHint      bool
+	}{
+		{name: "default", wantHint: true},
+		{name: "upsert stories", upsertStories: true, wantUpsert: true, wantHint: true},
+		{name: "suffixed collections", suffix: "_shadow", wantUpsert: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.UpsertStories = tt.upsertStories
+			p.OutputCollectionSuffix = tt.suffix
+
+			model, ok := p.newStoryUpdate("story", bson.D{}).(*mongo.UpdateOneModel)
+			if !ok {
+				t.Fatalf("expected an UpdateOneModel, got %T", model)
+			}
+
+			if got := model.Upsert != nil && *model.Upsert; got != tt.wantUpsert {
+				t.Errorf("expected upsert %v, got %v", tt.wantUpsert, got)
+			}
+			if got := model.Hint != nil; got != tt.wantHint {
+				t.Errorf("expected hint %v, got %v", tt.wantHint, got)
+			}
+		})
+	}
+}
+
+func TestStoryIncrementDistinctAuthors(t *testing.T) {
+	tests := []struct {
+		name      string
+		count     bool
+		authorIDs []string
+		want      int
+	}{
+		{name: "not counted", authorIDs: []string{"u1", "u2"}, want: 0},
+		{name: "different authors", count: true, authorIDs: []string{"u1", "u2", "u3"}, want: 3},
+		{name: "repeated authors", count: true, authorIDs: []string{"u1", "u2", "u1", "u1"}, want: 2},
+		{name: "comments without an author", count: true, authorIDs: []string{"", "u1", ""}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultRules()
+			rules.CountDistinctAuthors = tt.count
+
+			var story Story
+			story.CommentCounts.Action = make(map[string]int)
+			for _, authorID := range tt.authorIDs {
+				story.Increment(&Comment{AuthorID: authorID, Status: "APPROVED"}, &rules)
+			}
+
+			if story.CommentCounts.DistinctAuthors != tt.want {
+				t.Errorf("expected %d distinct authors, got %d", tt.want, story.CommentCounts.DistinctAuthors)
+			}
+		})
+	}
+}
+
+func TestUserCommentCountsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  CommentStatusCounts
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "positive", status: CommentStatusCounts{Approved: 2, Rejected: 1}},
+		{name: "negative", status: CommentStatusCounts{Approved: 2, Rejected: -1}, wantErr: "status.REJECTED (-1) < 0"},
+		{
+			name:    "several negative",
+			status:  CommentStatusCounts{None: -1, Approved: -2},
+			wantErr: "invalid comment counts: status.APPROVED (-2) < 0; status.NONE (-1) < 0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ucc := UserCommentCounts{Status: tt.status}
+
+			err := ucc.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateStories(t *testing.T) {
+	story := func(rejected int) *Story {
+		return &Story{CommentCounts: StoryCommentCounts{
+			Action: make(CommentActionCounts),
+			Status: CommentStatusCounts{Rejected: rejected},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		stories map[string]*Story
+		wantErr string
+	}{
+		{name: "valid", strict: true, stories: map[string]*Story{"a": story(1)}},
+		{name: "negative only logged", stories: map[string]*Story{"a": story(1), "b": story(-1)}},
+		{name: "negative with strict invariants", strict: true, stories: map[string]*Story{"a": story(1), "b": story(-1)}, wantErr: "story b counts failed validation"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+			p.StrictInvariants = tt.strict
+
+			err := p.validateStories(tt.stories)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// streamUsers will count the comments by each of the site's users in order of
+// their ID, writing the users that have been counted a batch at a time.
+func (p *Processor) streamUsers(ctx context.Context) (*UsersResult, error) {
+	// Users are only complete in sorted order within a single collection.
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) > 1 {
+		return nil, errors.Errorf("users can only be streamed from a single comments collection, found %d", len(collections))
+	}
+
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+	}
+
+	opts := options.Find().
+		SetProjection(p.Rules.userProjection()).
+		SetSort(bson.D{
+			primitive.E{Key: p.Rules.Fields.AuthorID, Value: 1},
+		}).
+		SetAllowDiskUse(true)
+
+	stream := newUserStream(p)
+
+	started := time.Now()
+	logrus.WithField("siteID", p.SiteID).Info("streaming users from comments")
+
+	if err := p.findComments(ctx, filter, opts, func(collection string, cursor *mongo.Cursor) error {
+		scanned := scanCounter{name: "users.comments_scanned", metrics: p.Metrics}
+
+		for p.nextTimed(ctx, cursor, collection) {
+			scanned.read(cursor)
+
+			var comment Comment
+			if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+				if p.DeadLetterCollection == "" {
+					return errors.Wrap(err, "could not decode result")
+				}
+
+				recordDeadLetter(ctx, p.DB.Collection(p.DeadLetterCollection), p.DryRun, DeadLetter{
+					TenantID:   p.TenantID,
+					SiteID:     p.SiteID,
+					Collection: collection,
+					DocumentID: documentID(cursor.Current),
+					Error:      err.Error(),
+				})
+
+				continue
+			}
+
+			more, err := stream.add(ctx, &comment)
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return errors.Wrap(err, "could not iterate on cursor")
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// The last user is only counted once the comments have run out.
+	if err := stream.close(ctx); err != nil {
+		return nil, err
+	}
+	result := stream.result
+
+	p.Metrics.Count("users.processed", int64(result.Users))
+	p.Metrics.Timing("users.load", time.Since(started))
+
+	logrus.WithFields(logrus.Fields{
+		"users":    result.Users,
+		"batches":  result.Batches,
+		"modified": result.Modified,
+		"took":     time.Since(started),
+	}).Info("streamed users from comments")
+
+	return &result, nil
+}
+
+// userStream counts the comments of each user in the order of their author, so
+// each user is complete once the comments move past them, and writes the users
+// that have been counted a batch at a time.
+type userStream struct {
+	p      *Processor
+	result UsersResult
+
+	// pending are the users that are waiting to be written, and current is the
+	// user with the ID that's being counted.
+	pending map[string]*User
+	current *User
+	userID  string
+	counted int
+}
+
+func newUserStream(p *Processor) *userStream {
+	return &userStream{
+		p:       p,
+		pending: make(map[string]*User),
+	}
+}
+
+// add will count the comment on its author. It returns false when the
+// LimitUsers have been counted, and the rest of the comments should be skipped.
+func (s *userStream) add(ctx context.Context, comment *Comment) (bool, error) {
+	// The comments have moved on to the next user, so the current user has been
+	// counted.
+	if s.current == nil || comment.AuthorID != s.userID {
+		if err := s.finish(ctx); err != nil {
+			return false, err
+		}
+
+		if s.p.LimitUsers > 0 && s.counted >= s.p.LimitUsers {
+			return false, nil
+		}
+
+		s.current = &User{}
+		s.userID = comment.AuthorID
+	}
+
+	s.current.Increment(comment, &s.p.Rules)
+
+	return true, nil
+}
+
+// finish will mark the current user as counted, writing the pending users once
+// there's a batch of them.
+func (s *userStream) finish(ctx context.Context) error {
+	if s.current == nil {
+		return nil
+	}
+
+	s.pending[s.userID] = s.current
+	s.current = nil
+	s.counted++
+
+	if len(s.pending) >= s.p.BatchSize {
+		return s.write(ctx)
+	}
+
+	return nil
+}
+
+// write will write the users that are pending.
+func (s *userStream) write(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	res, err := s.p.writeUsers(ctx, s.pending)
+	if err != nil {
+		return err
+	}
+
+	s.result.add(res)
+	s.pending = make(map[string]*User)
+
+	return nil
+}
+
+// close will finish the last user and write every user that's still pending.
+func (s *userStream) close(ctx context.Context) error {
+	if err := s.finish(ctx); err != nil {
+		return err
+	}
+
+	return s.write(ctx)
+}
@@ -0,0 +1,132 @@
+package counts
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestStreamUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(authorID, status string) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: authorID + status},
+			primitive.E{Key: "authorID", Value: authorID},
+			primitive.E{Key: "status", Value: status},
+		}
+	}
+	sorted := []bson.D{
+		comment("u1", "APPROVED"),
+		comment("u1", "REJECTED"),
+		comment("u2", "APPROVED"),
+		comment("u3", "NONE"),
+	}
+
+	tests := []struct {
+		name        string
+		comments    []bson.D
+		collections []string
+		batchSize   int
+		limit       int
+		wantUsers   int
+		wantBatches int
+		wantErr     string
+	}{
+		{name: "no comments", batchSize: 2},
+		{name: "one batch", comments: sorted, batchSize: 10, wantUsers: 3, wantBatches: 1},
+		{name: "written a batch at a time", comments: sorted, batchSize: 2, wantUsers: 3, wantBatches: 2},
+		{name: "each user in a batch", comments: sorted, batchSize: 1, wantUsers: 3, wantBatches: 3},
+		{name: "limited users", comments: sorted, batchSize: 10, limit: 2, wantUsers: 2, wantBatches: 1},
+		{
+			name:        "several collections",
+			collections: []string{"comments", "comments_archive"},
+			batchSize:   2,
+			wantErr:     "users can only be streamed from a single comments collection",
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, tt.comments...))
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+			p.BatchSize = tt.batchSize
+			p.LimitUsers = tt.limit
+			p.CommentsCollections = tt.collections
+
+			res, err := p.streamUsers(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if res.Users != tt.wantUsers || res.Batches != tt.wantBatches {
+				mt.Errorf("expected %d users in %d batches, got %d in %d", tt.wantUsers, tt.wantBatches, res.Users, res.Batches)
+			}
+
+			// The comments are scanned in the order of their author.
+			sort := mt.GetStartedEvent().Command.Lookup("sort").Document()
+			if order, ok := sort.Lookup("authorID").AsInt64OK(); !ok || order != 1 {
+				mt.Errorf("expected the comments sorted by authorID, got %s", sort)
+			}
+		})
+	}
+}
+
+// BenchmarkUserStream counts the comments of users in author order and writes
+// them a batch at a time, as --streamUsers does. The run is dry, so the writes
+// only go as far as the batch writer.
+func BenchmarkUserStream(b *testing.B) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	p := NewProcessor(client.Database("coral"), "tenant", "site", true, DefaultRules())
+	p.BatchSize = 1000
+
+	// Each of the users has a handful of comments.
+	comments := make([]Comment, 0, 50000)
+	statuses := []string{"APPROVED", "NONE", "REJECTED", "APPROVED", "PREMOD"}
+	for i := 0; len(comments) < cap(comments); i++ {
+		authorID := "user-" + strconv.Itoa(i)
+		for _, status := range statuses {
+			comments = append(comments, Comment{AuthorID: authorID, Status: status})
+		}
+	}
+
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		stream := newUserStream(p)
+		for j := range comments {
+			if _, err := stream.add(ctx, &comments[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := stream.close(ctx); err != nil {
+			b.Fatal(err)
+		}
+
+		if stream.result.Users != len(comments)/len(statuses) {
+			b.Fatalf("expected %d users, got %d", len(comments)/len(statuses), stream.result.Users)
+		}
+	}
+}
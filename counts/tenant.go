@@ -0,0 +1,138 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TenantCountsCollection is the collection that the counts of every site on a
+// tenant are stored in. They're kept apart from the sites so they can never
+// replace the counts of a real site.
+const TenantCountsCollection = "tenant_counts"
+
+// TenantCounts is the sum of the counts of every story on a tenant.
+type TenantCounts struct {
+	TenantID      string             `bson:"tenantID"`
+	CommentCounts StoryCommentCounts `bson:"commentCounts"`
+
+	// Sites and Stories are the number of sites and stories that were summed.
+	Sites     int       `bson:"sites"`
+	Stories   int       `bson:"stories"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// ProcessTenantTotals will sum the counts of the stories on every site of the
+// tenant and store them in the TenantCountsCollection.
+func ProcessTenantTotals(ctx context.Context, db *mongo.Database, tenantID string, dryRun bool) error {
+	return NewProcessor(db, tenantID, "", dryRun, DefaultRules()).TenantTotals(ctx)
+}
+
+// TenantTotals will sum the counts of the stories on every site of the tenant
+// and store them in the TenantCountsCollection. The stories of the other sites
+// are summed as they're stored, so they're only as current as the last time
+// their sites were processed.
+func (p *Processor) TenantTotals(ctx context.Context) error {
+	// Configure the projection to only get fields we care about.
+	projection := bson.D{
+		primitive.E{Key: "id", Value: 1},
+		primitive.E{Key: "siteID", Value: 1},
+		primitive.E{Key: "commentCounts", Value: 1},
+	}
+
+	// Sum the stories that were written, which are the shadow stories when the
+	// output is redirected.
+	cursor, err := p.outputCollection("stories").Find(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+	}, options.Find().SetProjection(projection))
+	if err != nil {
+		return errors.Wrap(err, "could not create the cursor")
+	}
+	defer closeCursor(cursor, p.Timeouts.CursorClose)
+
+	tenant := TenantCounts{
+		TenantID: p.TenantID,
+	}
+	tenant.CommentCounts.Action = make(map[string]int)
+
+	// Track the sites, and the stories on each site so duplicate story documents
+	// are only counted once.
+	sites := make(map[string]map[string]struct{})
+
+	started := time.Now()
+	logrus.WithField("tenantID", p.TenantID).Info("loading counts from tenant stories")
+
+	for cursor.Next(ctx) {
+		var story struct {
+			Story  `bson:",inline"`
+			SiteID string `bson:"siteID"`
+		}
+		if err := cursor.Decode(&story); err != nil {
+			return errors.Wrap(err, "could not decode result")
+		}
+
+		seen, ok := sites[story.SiteID]
+		if !ok {
+			seen = make(map[string]struct{})
+			sites[story.SiteID] = seen
+		}
+
+		if p.UpdateDuplicateStories {
+			if _, ok := seen[story.ID]; ok {
+				continue
+			}
+
+			seen[story.ID] = struct{}{}
+		}
+
+		tenant.CommentCounts.Merge(&story.CommentCounts)
+		tenant.Stories++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(err, "could not iterate on cursor")
+	}
+
+	tenant.Sites = len(sites)
+
+	logrus.WithFields(logrus.Fields{
+		"sites":   tenant.Sites,
+		"stories": tenant.Stories,
+		"took":    time.Since(started),
+	}).Info("loaded counts from tenant stories")
+
+	// Ensure that the counts we've computed are consistent before we write them.
+	if err := tenant.CommentCounts.Validate(&p.Rules); err != nil {
+		if p.StrictInvariants {
+			return errors.Wrap(err, "tenant counts failed validation")
+		}
+
+		logrus.WithError(err).WithField("tenantID", p.TenantID).Warn("tenant counts failed validation, the counting rules may have a bug")
+	}
+
+	if p.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"commentCounts": tenant.CommentCounts,
+		}).Info("not writing tenant counts as --dryRun is enabled")
+
+		return nil
+	}
+
+	tenant.UpdatedAt = time.Now()
+
+	if _, err := p.outputCollection(TenantCountsCollection).ReplaceOne(ctx, bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+	}, tenant, options.Replace().SetUpsert(true)); err != nil {
+		return errors.Wrap(err, "could not update the tenant counts")
+	}
+
+	logrus.WithField("tenantID", p.TenantID).Info("tenant counts updated")
+
+	return nil
+}
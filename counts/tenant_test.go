@@ -0,0 +1,97 @@
+package counts
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTenantTotals(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	story := func(siteID, storyID string, approved int) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: storyID},
+			primitive.E{Key: "siteID", Value: siteID},
+			primitive.E{Key: "commentCounts", Value: bson.D{
+				primitive.E{Key: "status", Value: bson.D{
+					primitive.E{Key: "APPROVED", Value: int32(approved)},
+				}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		duplicates   bool
+		stories      []bson.D
+		wantSites    int
+		wantStories  int
+		wantApproved int
+	}{
+		{
+			name:         "no stories",
+			wantSites:    0,
+			wantStories:  0,
+			wantApproved: 0,
+		},
+		{
+			name:         "stories on every site",
+			stories:      []bson.D{story("a", "s1", 2), story("a", "s2", 1), story("b", "s3", 4)},
+			wantSites:    2,
+			wantStories:  3,
+			wantApproved: 7,
+		},
+		{
+			name:         "duplicate stories summed",
+			stories:      []bson.D{story("a", "s1", 2), story("a", "s1", 2)},
+			wantSites:    1,
+			wantStories:  2,
+			wantApproved: 4,
+		},
+		{
+			name:         "duplicate stories summed once",
+			duplicates:   true,
+			stories:      []bson.D{story("a", "s1", 2), story("a", "s1", 2), story("b", "s1", 1)},
+			wantSites:    2,
+			wantStories:  2,
+			wantApproved: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, tt.stories...),
+				mtest.CreateSuccessResponse(),
+			)
+
+			p := NewProcessor(mt.DB, "tenant", "", false, DefaultRules())
+			p.UpdateDuplicateStories = tt.duplicates
+			if err := p.TenantTotals(context.Background()); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			events := mt.GetAllStartedEvents()
+			if len(events) != 2 || events[1].CommandName != "update" {
+				mt.Fatalf("expected the tenant counts to be replaced, got %d commands", len(events))
+			}
+
+			var tenant TenantCounts
+			if err := events[1].Command.Lookup("updates", "0", "u").Unmarshal(&tenant); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if tenant.TenantID != "tenant" || tenant.Sites != tt.wantSites || tenant.Stories != tt.wantStories {
+				mt.Errorf("expected %d sites and %d stories, got %+v", tt.wantSites, tt.wantStories, tenant)
+			}
+			if tenant.CommentCounts.Status.Approved != tt.wantApproved {
+				mt.Errorf("expected %d approved, got %d", tt.wantApproved, tenant.CommentCounts.Status.Approved)
+			}
+		})
+	}
+}
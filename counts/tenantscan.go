@@ -0,0 +1,164 @@
+package counts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TenantScan counts the stories of its sites together with a single scan of
+// the tenant's comments, rather than a scan for each site. The scan is run the
+// first time every story on one of the sites is loaded, and the stories of each
+// of the other sites are kept until they're loaded in turn.
+//
+// This saves a query for each site when a tenant has many small sites, but the
+// stories of every site are held in memory until their site is processed, so
+// the memory used grows with the stories across all of the sites.
+type TenantScan struct {
+	// Sites are the sites whose stories are counted by the scan.
+	Sites []string
+
+	mux sync.Mutex
+
+	// startedAt is when the scan started, which is zero until it has run.
+	// stories are the stories counted by the scan that haven't been loaded by
+	// their site yet, keyed by their site's ID.
+	startedAt time.Time
+	stories   map[string]map[string]*Story
+}
+
+// NewTenantScan will return a scan that counts the stories of the sites.
+func NewTenantScan(siteIDs []string) *TenantScan {
+	return &TenantScan{
+		Sites: siteIDs,
+	}
+}
+
+// scanning returns true when the site's stories are counted by the scan.
+func (s *TenantScan) scanning(siteID string) bool {
+	if s == nil {
+		return false
+	}
+
+	for _, id := range s.Sites {
+		if id == siteID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StartedAt returns when the scan of the tenant's comments started, or the zero
+// time when it hasn't run yet. Changes made to comments after this may not be
+// reflected in the stories it counted.
+func (s *TenantScan) StartedAt() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.startedAt
+}
+
+// tenantScanStories will return the stories of the site counted by the
+// Processor's TenantScan, running the scan if it hasn't been run yet. The site's
+// stories are only returned once, later loads of them scan the site again.
+func (p *Processor) tenantScanStories(ctx context.Context) (map[string]*Story, error) {
+	scan := p.TenantScan
+
+	scan.mux.Lock()
+	defer scan.mux.Unlock()
+
+	if scan.stories == nil {
+		sites, err := p.scanTenant(ctx, scan)
+		if err != nil {
+			return nil, err
+		}
+
+		scan.stories = sites
+	}
+
+	stories, ok := scan.stories[p.SiteID]
+	if !ok {
+		// The site's stories were already loaded, so they're scanned again.
+		return p.scanStories(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "siteID", Value: p.SiteID},
+		}, p.Rules.storyProjection(), 0)
+	}
+
+	delete(scan.stories, p.SiteID)
+
+	return stories, nil
+}
+
+// scanTenant will count the comments on every one of the Sites of the scan with
+// a single scan, returning the stories of each site keyed by the site's ID.
+func (p *Processor) scanTenant(ctx context.Context, scan *TenantScan) (map[string]map[string]*Story, error) {
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: bson.D{
+			primitive.E{Key: "$in", Value: scan.Sites},
+		}},
+	}
+	projection := commentProjection(append(p.Rules.storyFields(), "siteID")...)
+
+	scan.startedAt = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"tenantID": p.TenantID,
+		"sites":    len(scan.Sites),
+	}).Info("loading stories from the comments of every site")
+
+	// Count the comments of each site with their own aggregator, so the stories
+	// of each site are kept apart. Every site of a run has the same rules, so
+	// they're all counted with the rules of the site that ran the scan.
+	aggregators := make(map[string]*Aggregator, len(scan.Sites))
+	for _, siteID := range scan.Sites {
+		aggregators[siteID] = NewAggregator(&p.Rules)
+	}
+
+	var comments int
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		next := p.cursorComments(ctx, collection, cursor)
+		for {
+			comment, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+
+			aggregator, ok := aggregators[comment.SiteID]
+			if !ok {
+				continue
+			}
+
+			aggregator.Add(comment)
+			comments++
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	sites := make(map[string]map[string]*Story, len(aggregators))
+	var stories int
+	for siteID, aggregator := range aggregators {
+		sites[siteID] = aggregator.Stories()
+		stories += len(sites[siteID])
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"sites":    len(sites),
+		"stories":  stories,
+		"comments": comments,
+		"took":     time.Since(scan.startedAt),
+	}).Info("loaded stories from the comments of every site")
+
+	return sites, nil
+}
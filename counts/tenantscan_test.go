@@ -0,0 +1,111 @@
+package counts
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTenantScanStories(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(siteID, storyID string) bson.D {
+		return bson.D{
+			primitive.E{Key: "siteID", Value: siteID},
+			primitive.E{Key: "storyID", Value: storyID},
+			primitive.E{Key: "status", Value: "APPROVED"},
+		}
+	}
+	tenant := mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch,
+		comment("a", "a1"),
+		comment("b", "b1"),
+		comment("a", "a2"),
+		comment("a", "a1"),
+		comment("other", "o1"),
+	)
+	rescan := mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch,
+		comment("a", "a1"),
+	)
+
+	// Each site loads its stories in turn. Only the first load scans the tenant,
+	// and a site that loads its stories again scans only itself.
+	loads := []struct {
+		siteID      string
+		responses   []bson.D
+		wantFinds   int
+		wantStories map[string]int
+	}{
+		{siteID: "a", responses: []bson.D{tenant}, wantFinds: 1, wantStories: map[string]int{"a1": 2, "a2": 1}},
+		{siteID: "b", wantFinds: 0, wantStories: map[string]int{"b1": 1}},
+		{siteID: "a", responses: []bson.D{rescan}, wantFinds: 1, wantStories: map[string]int{"a1": 1}},
+	}
+
+	mt.Run("loads", func(mt *mtest.T) {
+		scan := NewTenantScan([]string{"a", "b"})
+
+		for i, load := range loads {
+			mt.ClearEvents()
+			mt.AddMockResponses(load.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", load.siteID, true, DefaultRules())
+			p.TenantScan = scan
+
+			stories, err := p.tenantScanStories(context.Background())
+			if err != nil {
+				mt.Fatalf("load %d of %s: unexpected error: %v", i, load.siteID, err)
+			}
+
+			if finds := len(mt.GetAllStartedEvents()); finds != load.wantFinds {
+				mt.Errorf("load %d of %s: expected %d finds, got %d", i, load.siteID, load.wantFinds, finds)
+			}
+
+			if len(stories) != len(load.wantStories) {
+				mt.Errorf("load %d of %s: expected %d stories, got %d", i, load.siteID, len(load.wantStories), len(stories))
+			}
+			for storyID, want := range load.wantStories {
+				story, ok := stories[storyID]
+				if !ok {
+					mt.Errorf("load %d of %s: expected story %s", i, load.siteID, storyID)
+					continue
+				}
+
+				if got := story.CommentCounts.Status.Approved; got != want {
+					mt.Errorf("load %d of %s: expected story %s to have %d comments, got %d", i, load.siteID, storyID, want, got)
+				}
+			}
+
+			if scan.StartedAt().IsZero() {
+				mt.Errorf("load %d of %s: expected the tenant scan to have started", i, load.siteID)
+			}
+		}
+	})
+}
+
+func TestTenantScanning(t *testing.T) {
+	scan := NewTenantScan([]string{"a", "b"})
+
+	tests := []struct {
+		siteID string
+		want   bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"c", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := scan.scanning(tt.siteID); got != tt.want {
+			t.Errorf("scanning(%q) = %v, want %v", tt.siteID, got, tt.want)
+		}
+	}
+
+	var disabled *TenantScan
+	if disabled.scanning("a") {
+		t.Error("expected no sites to be scanned without a tenant scan")
+	}
+}
@@ -0,0 +1,39 @@
+package counts
+
+import "time"
+
+// PhaseTimeouts are the deadlines of each of the operations against MongoDB
+// that aren't bounded by the run itself. A zero PerBatchWrite leaves the batch
+// writes without a deadline.
+type PhaseTimeouts struct {
+	// Connect is the deadline for connecting to MongoDB.
+	Connect time.Duration
+
+	// Ping is the deadline for pinging MongoDB once connected.
+	Ping time.Duration
+
+	// PerBatchWrite is the deadline for writing each batch of updates. It isn't
+	// applied to the batches written in a transaction, which are bounded by the
+	// transaction instead.
+	PerBatchWrite time.Duration
+
+	// CursorClose is the deadline for closing a cursor once it's been read.
+	CursorClose time.Duration
+
+	// Disconnect is the deadline for disconnecting from MongoDB.
+	Disconnect time.Duration
+
+	// Cleanup is the deadline for each of the writes made once the run has
+	// ended, such as releasing the lock and recording the end of the run. They
+	// don't use the run's context as it may have been canceled.
+	Cleanup time.Duration
+}
+
+// DefaultTimeouts are the deadlines used when they aren't configured.
+var DefaultTimeouts = PhaseTimeouts{
+	Connect:     time.Minute,
+	Ping:        time.Minute,
+	CursorClose: 10 * time.Second,
+	Disconnect:  10 * time.Second,
+	Cleanup:     10 * time.Second,
+}
@@ -0,0 +1,89 @@
+package counts
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// storyHeap is a min-heap of stories by their total comments, so the story with
+// the fewest comments is the one that's replaced when a larger one is found.
+type storyHeap []*Story
+
+func (h storyHeap) Len() int { return len(h) }
+
+func (h storyHeap) Less(i, j int) bool {
+	return storyRanksBefore(h[j], h[i])
+}
+
+func (h storyHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *storyHeap) Push(x interface{}) { *h = append(*h, x.(*Story)) }
+
+func (h *storyHeap) Pop() interface{} {
+	old := *h
+	story := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return story
+}
+
+// storyRanksBefore returns true when story a has more comments than story b,
+// with ties broken by the story ID so the ranking is stable.
+func storyRanksBefore(a, b *Story) bool {
+	at, bt := a.CommentCounts.Status.Total(), b.CommentCounts.Status.Total()
+	if at != bt {
+		return at > bt
+	}
+
+	return a.ID < b.ID
+}
+
+// topStories returns up to n of the stories with the most comments, ordered from
+// the most comments to the fewest. Only n stories are kept at a time.
+func topStories(stories map[string]*Story, n int) []*Story {
+	if n <= 0 {
+		return nil
+	}
+
+	h := make(storyHeap, 0, n)
+	for storyID, story := range stories {
+		// Comments without a story aren't on a story to investigate.
+		if storyID == "" {
+			continue
+		}
+
+		if h.Len() < n {
+			heap.Push(&h, story)
+		} else if storyRanksBefore(story, h[0]) {
+			h[0] = story
+			heap.Fix(&h, 0)
+		}
+	}
+
+	top := []*Story(h)
+	sort.Slice(top, func(i, j int) bool {
+		return storyRanksBefore(top[i], top[j])
+	})
+
+	return top
+}
+
+// logTopStories will log up to n of the stories with the most comments, with the
+// breakdown of their comments by status.
+func logTopStories(stories map[string]*Story, n int) {
+	for rank, story := range topStories(stories, n) {
+		status := story.CommentCounts.Status
+		logrus.WithFields(logrus.Fields{
+			"rank":           rank + 1,
+			"storyID":        story.ID,
+			"comments":       status.Total(),
+			"approved":       status.Approved,
+			"none":           status.None,
+			"premod":         status.Premod,
+			"rejected":       status.Rejected,
+			"systemWithheld": status.SystemWithheld,
+		}).Info("top story by comments")
+	}
+}
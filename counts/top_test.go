@@ -0,0 +1,56 @@
+package counts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopStories(t *testing.T) {
+	story := func(id string, approved, rejected int) *Story {
+		return &Story{ID: id, CommentCounts: StoryCommentCounts{
+			Status: CommentStatusCounts{Approved: approved, Rejected: rejected},
+		}}
+	}
+
+	stories := map[string]*Story{
+		"a": story("a", 1, 0),
+		"b": story("b", 5, 2),
+		"c": story("c", 3, 0),
+		"d": story("d", 0, 3),
+		"e": story("e", 10, 0),
+		"":  story("", 50, 0),
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{"none", 0, nil},
+		{"negative", -1, nil},
+		{"most comments", 1, []string{"e"}},
+		{"ties ranked by ID", 4, []string{"e", "b", "c", "d"}},
+		{"more than the stories", 10, []string{"e", "b", "c", "d", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, story := range topStories(stories, tt.n) {
+				got = append(got, story.ID)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topStories(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommentStatusCountsTotal(t *testing.T) {
+	csc := CommentStatusCounts{Approved: 1, None: 2, Premod: 3, Rejected: 4, SystemWithheld: 5}
+
+	if got := csc.Total(); got != 15 {
+		t.Errorf("expected a total of 15, got %d", got)
+	}
+}
@@ -0,0 +1,317 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MaxTransactionSize is the largest estimated size in bytes of the updates that
+// will be written in a single transaction. MongoDB limits the oplog entry of a
+// transaction to 16MB before 4.2, and while later versions can split a
+// transaction across entries, large transactions hold locks and cache for their
+// whole duration, so the same limit is kept.
+const MaxTransactionSize = 16 * 1024 * 1024
+
+// errTransactionTooLarge is returned when the updates for a site can not fit in
+// a single transaction.
+var errTransactionTooLarge = errors.New("site is too large to write in a single transaction, run without --transactional")
+
+// transactionUpdates will create the updates for each of the stories, keeping
+// track of how large they are along with the site update so we can fail before
+// starting a transaction that can't be committed. It returns the updates and
+// their estimated size in bytes.
+func (p *Processor) transactionUpdates(stories map[string]*Story, siteUpdate interface{}, maxSize int) ([]mongo.WriteModel, int, error) {
+	// The update is wrapped in a document as it may be a pipeline.
+	data, err := bson.Marshal(bson.D{
+		primitive.E{Key: "u", Value: siteUpdate},
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not create the site update")
+	}
+
+	models := make([]mongo.WriteModel, 0, len(stories))
+	size := len(data)
+	for storyID, story := range stories {
+		update, err := p.countsUpdate(story.CommentCounts)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "could not create the story update")
+		}
+
+		data, err := bson.Marshal(update)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "could not create the story update")
+		}
+
+		size += len(data) + len(storyID)
+		if size > maxSize {
+			return nil, 0, errors.Wrapf(errTransactionTooLarge, "updates for %d stories exceed %d bytes", len(stories), maxSize)
+		}
+
+		models = append(models, p.newStoryUpdate(storyID, update))
+	}
+
+	return models, size, nil
+}
+
+// ProcessStoriesTransaction will count the comments on the site's stories like
+// ProcessStories, and then write the story counts and the site counts together
+// in a single transaction.
+func ProcessStoriesTransaction(ctx context.Context, db *mongo.Database, tenantID, siteID string, storyIDs []string, dryRun bool) (*StoriesResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).StoriesTransaction(ctx, storyIDs)
+}
+
+// StoriesTransaction will count the comments on the site's stories like
+// Stories, and then write the story counts and the site counts together in a
+// single transaction. When `storyID`'s are specified, only those stories are
+// processed and the change in their counts is applied to the site, otherwise
+// the site's counts are replaced with the sum of its stories.
+//
+// The comments are scanned before the transaction starts so that the
+// transaction only has to hold the writes. The writes are issued one batch at a
+// time as operations in a transaction can not be run concurrently.
+func (p *Processor) StoriesTransaction(ctx context.Context, storyIDs []string) (*StoriesResult, error) {
+	// Count the comments on the stories.
+	stories, _, err := p.loadStories(ctx, storyIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := StoriesResult{
+		Stories:  len(stories),
+		Approved: approvedOnStories(stories),
+	}
+	for _, story := range stories {
+		result.StaleComments += story.StaleComments
+		result.CreatedAt.Merge(&story.CreatedAt)
+	}
+	logCreatedAtHealth(&result.CreatedAt, p.Rules.EarliestCreatedAt)
+
+	// Ensure that the counts we've computed are consistent before we write them.
+	if err := p.validateStories(stories); err != nil {
+		return nil, err
+	}
+
+	// Report where the comments are concentrated when every story was counted.
+	if p.TopStories > 0 && len(storyIDs) == 0 {
+		logTopStories(stories, p.TopStories)
+	}
+
+	// Create the site update, either applying the change in the counts of the
+	// specified stories or replacing the counts with the sum of all stories.
+	var siteUpdate interface{}
+	var siteCounts *StoryCommentCounts
+	if len(storyIDs) > 0 {
+		delta, err := p.storyDelta(ctx, storyIDs, stories)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Delta = delta
+
+		inc, err := incDocument("commentCounts", delta)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create the site update")
+		}
+
+		if len(inc) > 0 {
+			siteUpdate = p.incUpdate(inc)
+		}
+	} else {
+		site := StoryCommentCounts{
+			Action: make(map[string]int),
+		}
+		for _, story := range stories {
+			site.Merge(&story.CommentCounts)
+		}
+
+		// Ensure that the counts we've computed are consistent before we write
+		// them.
+		if err := site.Validate(&p.Rules); err != nil {
+			if p.StrictInvariants {
+				return nil, errors.Wrap(err, "site counts failed validation")
+			}
+
+			logrus.WithError(err).WithField("id", p.SiteID).Warn("site counts failed validation, the counting rules may have a bug")
+		}
+
+		update, err := p.countsUpdate(site)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create the site update")
+		}
+
+		siteUpdate = update
+		siteCounts = &site
+	}
+
+	// Only write the stories whose counts have drifted. The site is still
+	// updated from every story.
+	if p.OnlyDrift {
+		drifted, err := p.driftedStories(ctx, stories)
+		if err != nil {
+			return nil, err
+		}
+
+		stories = drifted
+		result.Drifted = len(drifted)
+	}
+
+	models, size, err := p.transactionUpdates(stories, siteUpdate, MaxTransactionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"updates": len(models),
+			"size":    size,
+		}).Info("not writing story and site updates in a transaction as --dryRun is enabled")
+
+		if p.estimateChanges() {
+			_, written := storyCounts(stories)
+			changed, err := p.changed(ctx, "stories", written)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not estimate the changed stories")
+			}
+
+			result.Changed = changed
+		}
+
+		if p.publishing() {
+			_, written := storyCounts(stories)
+			if err := p.publishCounts(ctx, "story", written); err != nil {
+				return nil, err
+			}
+		}
+
+		return &result, nil
+	}
+
+	// Load the counts that are about to be replaced so the changes to them can
+	// be recorded.
+	var previous map[string]bson.Raw
+	if p.auditing() {
+		ids, _ := storyCounts(stories)
+		previous = p.loadAuditCounts(ctx, "stories", ids)
+	}
+
+	// Wait while the replication lag is too high, the transaction can't be paused
+	// once it has started.
+	if p.Lag != nil {
+		if err := p.Lag.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	session, err := p.DB.Client().StartSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start the session")
+	}
+	defer session.EndSession(ctx)
+
+	started := time.Now()
+	logrus.WithField("updates", len(models)).Info("writing story and site updates in a transaction")
+
+	// The callback may be retried if the transaction has a transient error, so
+	// the result is only filled in from the run that commits.
+	var res WriteResult
+	if _, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		res = WriteResult{}
+
+		for start := 0; start < len(models); start += p.BatchSize {
+			end := start + p.BatchSize
+			if end > len(models) {
+				end = len(models)
+			}
+
+			batchStarted := time.Now()
+			bulk, err := p.outputCollection("stories").BulkWrite(ctx, models[start:end])
+			if err != nil {
+				return nil, errors.Wrap(err, "could not bulk write story updates")
+			}
+			took := time.Since(batchStarted)
+			p.checkSlowBatch("bulk_write", p.outputCollection("stories").Name(), end-start, took)
+
+			p.Metrics.Timing("story.bulk_write", took)
+			p.Metrics.Count("story.bulk_writes", 1)
+			p.Metrics.Count("story.updates", int64(end-start))
+
+			res.Batches++
+			res.Updates += end - start
+			res.Modified += bulk.ModifiedCount
+		}
+
+		if siteUpdate == nil {
+			return nil, nil
+		}
+
+		if _, err := p.outputCollection("sites").UpdateOne(ctx, bson.D{
+			primitive.E{Key: "tenantID", Value: p.TenantID},
+			primitive.E{Key: "id", Value: p.SiteID},
+		}, p.stampMarker(siteUpdate), options.Update().SetUpsert(p.shadowing())); err != nil {
+			return nil, errors.Wrap(err, "could not update the site")
+		}
+
+		return nil, nil
+	}, options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))); err != nil {
+		if transactionTooLarge(err) {
+			return nil, errors.Wrap(errTransactionTooLarge, err.Error())
+		}
+
+		return nil, errors.Wrap(err, "could not commit the transaction")
+	}
+
+	result.WriteResult = res
+
+	logrus.WithFields(logrus.Fields{
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"took":     time.Since(started),
+	}).Info("committed story and site updates")
+
+	if previous != nil || p.publishing() {
+		_, written := storyCounts(stories)
+
+		if previous != nil {
+			p.recordAudit(ctx, "stories", previous, written)
+		}
+
+		if p.publishing() {
+			if err := p.publishCounts(ctx, "story", written); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p.SnapshotHistory && siteCounts != nil {
+		if err := p.recordHistory(ctx, siteCounts); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// transactionTooLarge returns true if the error was caused by the transaction
+// exceeding the server's size limits.
+func transactionTooLarge(err error) bool {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	// TransactionTooLarge (257) is returned when the transaction's oplog entry is
+	// too large, BSONObjectTooLarge (10334) when a single document is.
+	return se.HasErrorCode(257) || se.HasErrorCode(10334)
+}
@@ -0,0 +1,47 @@
+package counts
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTransactionUpdates(t *testing.T) {
+	stories := make(map[string]*Story)
+	for i := 0; i < 10; i++ {
+		stories[fmt.Sprintf("story-%d", i)] = &Story{
+			CommentCounts: StoryCommentCounts{Action: CommentActionCounts{"FLAG": i}},
+		}
+	}
+
+	p := NewProcessor(nil, "tenant", "site", false, DefaultRules())
+
+	models, size, err := p.transactionUpdates(stories, bson.D{}, MaxTransactionSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(models) != len(stories) {
+		t.Errorf("expected an update for each of the %d stories, got %d", len(stories), len(models))
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int
+		wantErr bool
+	}{
+		{name: "fits exactly", maxSize: size},
+		{name: "too large", maxSize: size - 1, wantErr: true},
+		{name: "site update alone too large", maxSize: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := p.transactionUpdates(stories, bson.D{}, tt.maxSize)
+			if got := errors.Is(err, errTransactionTooLarge); got != tt.wantErr {
+				t.Fatalf("expected errTransactionTooLarge %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
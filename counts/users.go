@@ -2,6 +2,7 @@ package counts
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,26 +17,104 @@ type UserCommentCounts struct {
 	Status CommentStatusCounts `bson:"status"`
 }
 
+// Validate will check that none of the counts are negative.
+func (ucc *UserCommentCounts) Validate() error {
+	violations := negativeCounts(map[string]int{
+		"status.APPROVED":        ucc.Status.Approved,
+		"status.NONE":            ucc.Status.None,
+		"status.PREMOD":          ucc.Status.Premod,
+		"status.REJECTED":        ucc.Status.Rejected,
+		"status.SYSTEM_WITHHELD": ucc.Status.SystemWithheld,
+	})
+
+	if len(violations) > 0 {
+		return errors.Errorf("invalid comment counts: %s", strings.Join(violations, "; "))
+	}
+
+	return nil
+}
+
+// Merge will add the passed counts to these counts.
+func (ucc *UserCommentCounts) Merge(counts *UserCommentCounts) {
+	ucc.Status.Approved += counts.Status.Approved
+	ucc.Status.None += counts.Status.None
+	ucc.Status.Premod += counts.Status.Premod
+	ucc.Status.Rejected += counts.Status.Rejected
+	ucc.Status.SystemWithheld += counts.Status.SystemWithheld
+}
+
+// Subtract will remove the passed counts from these counts.
+func (ucc *UserCommentCounts) Subtract(counts *UserCommentCounts) {
+	ucc.Status.Approved -= counts.Status.Approved
+	ucc.Status.None -= counts.Status.None
+	ucc.Status.Premod -= counts.Status.Premod
+	ucc.Status.Rejected -= counts.Status.Rejected
+	ucc.Status.SystemWithheld -= counts.Status.SystemWithheld
+}
+
 type User struct {
 	CommentCounts UserCommentCounts `bson:"commentCounts"`
 }
 
-func (u *User) Increment(comment *Comment) {
+func (u *User) Increment(comment *Comment, rules *Rules) {
+	if rules.Excluded(comment) {
+		return
+	}
+
 	u.CommentCounts.Status.Increment(comment)
 }
 
-func ProcessUsers(ctx context.Context, db *mongo.Database, tenantID, siteID string, authorIDs []string, dryRun bool) error {
+// UsersResult describes the outcome of processing users.
+type UsersResult struct {
+	WriteResult
+
+	// Users is the number of users that had counts computed.
+	Users int
+
+	// Drifted is the number of users whose stored counts differed from the
+	// computed counts. It is only computed when only drifted users are written.
+	Drifted int
+
+	// Approved is the number of approved comments by the users, not counting
+	// the comments without an author.
+	Approved int
+
+	// Orphaned is the number of users that have comments but no user document.
+	// It is only computed when DetectOrphanedUsers is enabled.
+	Orphaned int
+
+	// Changed is the number of users whose stored counts differ from the
+	// computed counts. It is only computed when dry runs estimate the changes.
+	Changed int
+}
+
+// ProcessUsers will iterate over each users comments and aggregate the results
+// to update the cached counts for each user. `authorIDs`'s are optional, and
+// will limit the total users that are processed.
+func ProcessUsers(ctx context.Context, db *mongo.Database, tenantID, siteID string, authorIDs []string, dryRun bool) (*UsersResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).Users(ctx, authorIDs)
+}
+
+// Users will count the comments by each of the site's users and update their
+// counts. `authorIDs`'s are optional, and will limit the users that are
+// processed.
+func (p *Processor) Users(ctx context.Context, authorIDs []string) (*UsersResult, error) {
+	// Stream every user rather than holding them all in memory.
+	if p.StreamUsers && len(authorIDs) == 0 {
+		return p.streamUsers(ctx)
+	}
+
 	// Create the filter that will limit the documents processed.
 	filter := bson.D{
-		primitive.E{Key: "tenantID", Value: tenantID},
-		primitive.E{Key: "siteID", Value: siteID},
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
 	}
 
 	// If storyID's are specified (and contains id's), then we should limit this
 	// query to only those comments that are from those users.
 	if len(authorIDs) > 0 {
 		filter = append(filter, primitive.E{
-			Key: "authorID",
+			Key: p.Rules.Fields.AuthorID,
 			Value: bson.D{
 				primitive.E{
 					Key:   "$in",
@@ -46,132 +125,272 @@ func ProcessUsers(ctx context.Context, db *mongo.Database, tenantID, siteID stri
 	}
 
 	// Configure the projection to only get fields we care about.
-	projection := bson.D{
-		primitive.E{Key: "authorID", Value: 1},
-		primitive.E{Key: "status", Value: 1},
-	}
-
-	// Start querying.
-	cursor, err := db.Collection("comments").Find(ctx, filter, options.Find().SetProjection(projection))
-	if err != nil {
-		return errors.Wrap(err, "could not create the cursor")
-	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-
-		if err := cursor.Close(ctx); err != nil {
-			panic(err)
-		}
-	}()
+	projection := p.Rules.userProjection()
 
 	// Store all the users in this map.
 	users := make(map[string]*User)
 
+	// Only limit the users when every user is being counted.
+	limit := p.LimitUsers
+	if len(authorIDs) > 0 {
+		limit = 0
+	}
+
 	started := time.Now()
-	logrus.WithField("siteID", siteID).Info("loading users from comments")
+	logrus.WithField("siteID", p.SiteID).Info("loading users from comments")
+
+	// Start querying each of the comments collections.
+	if err := p.findComments(ctx, filter, options.Find().SetProjection(projection), func(collection string, cursor *mongo.Cursor) error {
+		scanned := scanCounter{name: "users.comments_scanned", metrics: p.Metrics}
+
+		// While there is still results to handle, decode the results.
+		for p.nextTimed(ctx, cursor, collection) {
+			scanned.read(cursor)
+
+			var comment Comment
+			if err := p.Rules.Fields.Decode(cursor.Current, &comment); err != nil {
+				if p.DeadLetterCollection == "" {
+					return errors.Wrap(err, "could not decode result")
+				}
+
+				recordDeadLetter(ctx, p.DB.Collection(p.DeadLetterCollection), p.DryRun, DeadLetter{
+					TenantID:   p.TenantID,
+					SiteID:     p.SiteID,
+					Collection: collection,
+					DocumentID: documentID(cursor.Current),
+					Error:      err.Error(),
+				})
+
+				continue
+			}
+
+			// Create the user in the map if it isn't already, unless the limit of
+			// users has been reached.
+			user, ok := users[comment.AuthorID]
+			if !ok {
+				if limit > 0 && len(users) >= limit {
+					continue
+				}
+
+				user = &User{}
+				users[comment.AuthorID] = user
+			}
 
-	// While there is still results to handle, decode the results.
-	for cursor.Next(ctx) {
-		var comment Comment
-		if err := cursor.Decode(&comment); err != nil {
-			return errors.Wrap(err, "could not decode result")
+			// Increment the user document based on this comment.
+			user.Increment(&comment, &p.Rules)
 		}
 
-		// Create the user in the map if it isn't already.
-		user, ok := users[comment.AuthorID]
-		if !ok {
-			user = &User{}
-			users[comment.AuthorID] = user
+		// A cursor that failed part way through would otherwise be treated as a
+		// complete scan, and undercount the users.
+		if err := cursor.Err(); err != nil {
+			return errors.Wrap(err, "could not iterate on cursor")
 		}
 
-		// Increment the user document based on this comment.
-		user.Increment(&comment)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
+	p.Metrics.Count("users.processed", int64(len(users)))
+	p.Metrics.Timing("users.load", time.Since(started))
+
 	logrus.WithFields(logrus.Fields{
 		"users": len(users),
 		"took":  time.Since(started),
 	}).Info("loaded users from comments")
 
-	// We will collect all the bulk write operations that we'll use to update the
-	// users here.
-	updates := make([]mongo.WriteModel, 0)
+	return p.writeUsers(ctx, users)
+}
 
-	// Iterate over the users in the map.
+// writeUsers will write the counts of the users that were counted.
+func (p *Processor) writeUsers(ctx context.Context, users map[string]*User) (*UsersResult, error) {
+	// Ensure that the counts we've computed are consistent before we write them.
 	for userID, user := range users {
-		// Create the new update.
-		update := mongo.NewUpdateOneModel()
+		if err := user.CommentCounts.Validate(); err != nil {
+			if p.StrictInvariants {
+				return nil, errors.Wrapf(err, "user %s counts failed validation", userID)
+			}
 
-		// Select the story we're updating.
-		update.SetFilter(bson.D{
-			primitive.E{Key: "tenantID", Value: tenantID},
-			primitive.E{Key: "id", Value: userID},
-		})
+			logrus.WithError(err).WithField("id", userID).Warn("user counts failed validation, the counting rules may have a bug")
+		}
+	}
 
-		// Update it with the counts.
-		update.SetUpdate(bson.D{
-			primitive.E{Key: "$set", Value: bson.D{
-				primitive.E{Key: "commentCounts", Value: user.CommentCounts},
-			}},
-		})
+	// Check for authors that don't have a user document to write their counts
+	// to.
+	var orphaned int
+	if p.DetectOrphanedUsers || p.StrictOrphanedUsers {
+		ids, err := p.orphanedUsers(ctx, users)
+		if err != nil {
+			return nil, err
+		}
 
-		update.SetHint(bson.D{
-			primitive.E{Key: "tenantID", Value: 1},
-			primitive.E{Key: "id", Value: 1},
-		})
+		if len(ids) > 0 && p.StrictOrphanedUsers {
+			return nil, errors.Errorf("found %d authors with comments but no user document", len(ids))
+		}
 
-		// Add the new update model.
-		updates = append(updates, update)
+		orphaned = len(ids)
+	}
 
-		// If we have more updates than the max size, then process them now.
-		if len(updates) >= MaxBatchWriteSize {
-			if dryRun {
-				logrus.WithFields(logrus.Fields{
-					"updates": len(updates),
-				}).Info("not writing bulk user updates as --dryRun is enabled")
+	// Only write the users whose counts have drifted.
+	computed := len(users)
+	approved := approvedByUsers(users)
+	var drifted int
+	if p.OnlyDrift {
+		filtered, err := p.driftedUsers(ctx, users)
+		if err != nil {
+			return nil, err
+		}
 
-				// Reset the updates slice.
-				updates = make([]mongo.WriteModel, 0)
+		users = filtered
+		drifted = len(users)
+	}
 
-				continue
-			}
+	// Load the counts that are about to be replaced so the changes to them can
+	// be recorded.
+	var previous map[string]bson.Raw
+	if p.auditing() {
+		ids := make([]string, 0, len(users))
+		for userID := range users {
+			ids = append(ids, userID)
+		}
 
-			res, err := db.Collection("users").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
-			if err != nil {
-				return errors.Wrap(err, "could not bulk write user updates")
-			}
+		previous = p.loadAuditCounts(ctx, "users", ids)
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"updates":  len(updates),
-				"modified": res.ModifiedCount,
-			}).Info("wrote bulk user updates")
+	// Write the counts for each user.
+	written := make(map[string]interface{}, len(users))
+	for userID, user := range users {
+		written[userID] = user.CommentCounts
+	}
 
-			// Reset the updates slice.
-			updates = make([]mongo.WriteModel, 0)
+	// Estimate how many of the users a real run would change.
+	var changed int
+	if p.estimateChanges() {
+		n, err := p.changed(ctx, "users", written)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not estimate the changed users")
 		}
+
+		changed = n
+	}
+
+	res, err := p.Destination.Write(ctx, p, "user", written)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not write user updates")
 	}
 
-	// If we have updates leftover, process them now.
-	if len(updates) > 0 {
-		if dryRun {
-			logrus.WithFields(logrus.Fields{
-				"updates": len(updates),
-			}).Info("not writing bulk story updates as --dryRun is enabled")
+	logrus.WithFields(logrus.Fields{
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"failed":   res.Failed,
+	}).Info("finished writing user updates")
+
+	if previous != nil {
+		p.recordAudit(ctx, "users", previous, written)
+	}
 
-			return nil
+	if p.publishing() {
+		if err := p.publishCounts(ctx, "user", written); err != nil {
+			return nil, err
 		}
+	}
 
-		res, err := db.Collection("users").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
-		if err != nil {
-			return errors.Wrap(err, "could not bulk write user updates")
+	return &UsersResult{
+		WriteResult: *res,
+		Users:       computed,
+		Drifted:     drifted,
+		Approved:    approved,
+		Orphaned:    orphaned,
+		Changed:     changed,
+	}, nil
+}
+
+// add will add the other result to this one.
+func (r *UsersResult) add(other *UsersResult) {
+	r.Batches += other.Batches
+	r.Updates += other.Updates
+	r.Modified += other.Modified
+	r.Failed += other.Failed
+	r.Users += other.Users
+	r.Drifted += other.Drifted
+	r.Approved += other.Approved
+	r.Orphaned += other.Orphaned
+	r.Changed += other.Changed
+}
+
+// newUserUpdate will create the model that applies the update to the user.
+func (p *Processor) newUserUpdate(userID string, update bson.D) mongo.WriteModel {
+	model := mongo.NewUpdateOneModel()
+
+	// Select the user we're updating.
+	model.SetFilter(bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "id", Value: userID},
+	})
+	model.SetUpdate(p.stampMarker(update))
+
+	if p.shadowing() {
+		model.SetUpsert(true)
+	} else {
+		model.SetHint(bson.D{
+			primitive.E{Key: "tenantID", Value: 1},
+			primitive.E{Key: "id", Value: 1},
+		})
+	}
+
+	return model
+}
+
+// ProcessUserDeltas will apply the changes to the counts of each user to their
+// stored counts, rather than recounting every one of their comments.
+func ProcessUserDeltas(ctx context.Context, db *mongo.Database, tenantID, siteID string, deltas map[string]*UserCommentCounts, dryRun bool) (*UsersResult, error) {
+	return NewProcessor(db, tenantID, siteID, dryRun, DefaultRules()).UserDeltas(ctx, deltas)
+}
+
+// UserDeltas will apply the changes to the counts of each user, keyed by their
+// ID, to their stored counts.
+func (p *Processor) UserDeltas(ctx context.Context, deltas map[string]*UserCommentCounts) (*UsersResult, error) {
+	writer := p.newBatchWriter("users", "user")
+
+	res, err := writer.write(ctx, func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+		for userID, delta := range deltas {
+			inc, err := incDocument("commentCounts", delta)
+			if err != nil {
+				return errors.Wrap(err, "could not create the user update")
+			}
+
+			// Changes that cancel out, such as a comment that was approved and then
+			// rejected and approved again, don't need to be written.
+			if len(inc) == 0 {
+				continue
+			}
+
+			update := p.newUserUpdate(userID, bson.D{
+				primitive.E{Key: "$inc", Value: inc},
+			})
+
+			if err := emit(userID, update); err != nil {
+				return err
+			}
 		}
 
-		logrus.WithFields(logrus.Fields{
-			"updates":  len(updates),
-			"modified": res.ModifiedCount,
-		}).Info("wrote bulk user updates")
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not write user updates")
 	}
 
-	return nil
+	logrus.WithFields(logrus.Fields{
+		"users":    len(deltas),
+		"batches":  res.Batches,
+		"updates":  res.Updates,
+		"modified": res.Modified,
+		"failed":   res.Failed,
+	}).Info("finished writing user deltas")
+
+	return &UsersResult{
+		WriteResult: *res,
+		Users:       len(deltas),
+	}, nil
 }
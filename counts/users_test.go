@@ -0,0 +1,110 @@
+package counts
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUsersCursorError(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	comment := func(id, authorID string) bson.D {
+		return bson.D{
+			primitive.E{Key: "id", Value: id},
+			primitive.E{Key: "authorID", Value: authorID},
+			primitive.E{Key: "status", Value: "APPROVED"},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		responses []bson.D
+		wantUsers int
+		wantErr   string
+	}{
+		{
+			name: "complete scan",
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment("c1", "u1"), comment("c2", "u2")),
+			},
+			wantUsers: 2,
+		},
+		{
+			name: "cursor fails part way through",
+			responses: []bson.D{
+				mtest.CreateCursorResponse(1, "coral.comments", mtest.FirstBatch, comment("c1", "u1"), comment("c2", "u2")),
+				mtest.CreateCommandErrorResponse(mtest.CommandError{
+					Code:    43,
+					Name:    "CursorNotFound",
+					Message: "cursor id 1 not found",
+				}),
+				// The cursor is killed once the scan has failed.
+				mtest.CreateSuccessResponse(),
+			},
+			wantErr: "could not iterate on cursor",
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			p := NewProcessor(mt.DB, "tenant", "site", true, DefaultRules())
+
+			res, err := p.Users(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if res.Users != tt.wantUsers {
+				mt.Errorf("expected %d users, got %d", tt.wantUsers, res.Users)
+			}
+		})
+	}
+}
+
+func TestProcessUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("counts with the default rules", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch,
+			bson.D{
+				primitive.E{Key: "id", Value: "c1"},
+				primitive.E{Key: "authorID", Value: "u1"},
+				primitive.E{Key: "status", Value: "APPROVED"},
+			},
+			bson.D{
+				primitive.E{Key: "id", Value: "c2"},
+				primitive.E{Key: "authorID", Value: "u1"},
+				primitive.E{Key: "status", Value: "REJECTED"},
+			},
+		))
+
+		res, err := ProcessUsers(context.Background(), mt.DB, "tenant", "site", nil, true)
+		if err != nil {
+			mt.Fatalf("unexpected error: %v", err)
+		}
+		if res.Users != 1 || res.Approved != 1 {
+			mt.Errorf("expected 1 user with 1 approved comment, got %d users with %d approved", res.Users, res.Approved)
+		}
+
+		// The comments are scanned from the site on the tenant.
+		filter := mt.GetStartedEvent().Command.Lookup("filter")
+		if siteID := filter.Document().Lookup("siteID").StringValue(); siteID != "site" {
+			mt.Errorf("expected the comments on the site to be scanned, got %s", filter)
+		}
+	})
+}
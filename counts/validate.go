@@ -0,0 +1,127 @@
+package counts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// serverVersion is the version of a MongoDB server.
+type serverVersion []int32
+
+// AtLeast returns true if the version is at least major.minor.
+func (v serverVersion) AtLeast(major, minor int32) bool {
+	if len(v) < 2 {
+		return false
+	}
+
+	if v[0] != major {
+		return v[0] > major
+	}
+
+	return v[1] >= minor
+}
+
+func (v serverVersion) String() string {
+	if len(v) < 3 {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// ValidateWatcherSupport will check that the deployment db is connected to
+// supports the change streams used by the Watcher. If preImages is true, it will
+// also check that the comments collection is recording the pre-images needed to
+// recover the comment from events that don't carry the full document.
+func ValidateWatcherSupport(ctx context.Context, db *mongo.Database, preImages bool) error {
+	// Check that the server is new enough to support change streams.
+	var buildInfo struct {
+		VersionArray serverVersion `bson:"versionArray"`
+	}
+	if err := db.RunCommand(ctx, bson.D{
+		primitive.E{Key: "buildInfo", Value: 1},
+	}).Decode(&buildInfo); err != nil {
+		return errors.Wrap(err, "could not get the server build info")
+	}
+
+	if !buildInfo.VersionArray.AtLeast(3, 6) {
+		return errors.Errorf("change streams require MongoDB 3.6 or newer, found %s, use --disableWatcher to run without the watcher", buildInfo.VersionArray)
+	}
+
+	if preImages && !buildInfo.VersionArray.AtLeast(6, 0) {
+		return errors.Errorf("change stream pre-images require MongoDB 6.0 or newer, found %s", buildInfo.VersionArray)
+	}
+
+	// Check that the server is a member of a replica set or a mongos, as change
+	// streams are not supported on standalone servers.
+	var isMaster struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := db.RunCommand(ctx, bson.D{
+		primitive.E{Key: "isMaster", Value: 1},
+	}).Decode(&isMaster); err != nil {
+		return errors.Wrap(err, "could not get the server topology")
+	}
+
+	if isMaster.SetName == "" && isMaster.Msg != "isdbgrid" {
+		return errors.New("change streams require a replica set or a sharded cluster but the server is a standalone, use --disableWatcher to run without the watcher")
+	}
+
+	// Check that the comments collection exists and get its options.
+	cursor, err := db.ListCollections(ctx, bson.D{
+		primitive.E{Key: "name", Value: "comments"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not list the collections")
+	}
+
+	var collections []struct {
+		Options struct {
+			ChangeStreamPreAndPostImages struct {
+				Enabled bool `bson:"enabled"`
+			} `bson:"changeStreamPreAndPostImages"`
+		} `bson:"options"`
+	}
+	if err := cursor.All(ctx, &collections); err != nil {
+		return errors.Wrap(err, "could not decode the collections")
+	}
+
+	if len(collections) == 0 {
+		return errors.Errorf("the comments collection does not exist in the %s database", db.Name())
+	}
+
+	if preImages && !collections[0].Options.ChangeStreamPreAndPostImages.Enabled {
+		return errors.New("the comments collection does not have pre-images enabled, enable them with: db.runCommand({ collMod: \"comments\", changeStreamPreAndPostImages: { enabled: true } })")
+	}
+
+	return nil
+}
+
+// OldestOplogTime returns the time of the oldest entry in the oplog of the
+// replica set that db is connected to. Changes from before then can't be
+// replayed by a change stream. The oplog can only be read when connected
+// directly to a replica set by a user that can read the local database.
+func OldestOplogTime(ctx context.Context, db *mongo.Database) (time.Time, error) {
+	var entry struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	if err := db.Client().Database("local").Collection("oplog.rs").FindOne(ctx, bson.D{}, options.FindOne().
+		SetSort(bson.D{
+			primitive.E{Key: "$natural", Value: 1},
+		}).
+		SetProjection(bson.D{
+			primitive.E{Key: "ts", Value: 1},
+		})).Decode(&entry); err != nil {
+		return time.Time{}, errors.Wrap(err, "could not find the oldest oplog entry")
+	}
+
+	return time.Unix(int64(entry.TS.T), 0), nil
+}
@@ -0,0 +1,28 @@
+package counts
+
+import (
+	"context"
+)
+
+// VerifyStories will count the comments on each of the site's stories and
+// compare the counts with the counts stored on the stories, without writing
+// anything. Each story whose stored counts differ is logged with the change in
+// each count that drifted. It returns the number of stories that were checked
+// and the number that had drifted.
+func (p *Processor) VerifyStories(ctx context.Context) (int, int, error) {
+	p = p.reader()
+
+	stories, _, err := p.loadStories(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, computed := storyCounts(stories)
+
+	drifted, err := p.drifted(ctx, "stories", computed, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(computed), len(drifted), nil
+}
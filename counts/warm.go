@@ -0,0 +1,46 @@
+package counts
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WarmCache will count the site's comments and stories so the indexes used to
+// find them are read into the database's cache before they're scanned. The
+// counts can be answered from the indexes alone, so this is much cheaper than
+// the scans that follow it.
+func (p *Processor) WarmCache(ctx context.Context) error {
+
+	filter := bson.D{
+		primitive.E{Key: "tenantID", Value: p.TenantID},
+		primitive.E{Key: "siteID", Value: p.SiteID},
+	}
+
+	collections, err := p.commentsCollections(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range append(collections, p.DB.Collection("stories")) {
+		started := time.Now()
+		logrus.WithField("collection", collection.Name()).Info("warming cache")
+
+		count, err := collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return errors.Wrapf(err, "could not warm cache for %s", collection.Name())
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"collection": collection.Name(),
+			"documents":  count,
+			"took":       time.Since(started),
+		}).Info("warmed cache")
+	}
+
+	return nil
+}
@@ -3,52 +3,194 @@ package counts
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // NewWatcher will return a watcher that can watch for collection changes to
-// ensure we're in sync.
-func NewWatcher(db *mongo.Database, tenantID, siteID string) *Watcher {
-	events := make([]WatchEvent, 0)
-
+// ensure we're in sync. The changes to the users' counts are counted with the
+// rules.
+func NewWatcher(db *mongo.Database, tenantID, siteID string, rules Rules) *Watcher {
 	return &Watcher{
-		db:       db,
-		tenantID: tenantID,
-		siteID:   siteID,
-		events:   events,
-		ready:    make(chan struct{}),
+		db:           db,
+		tenantID:     tenantID,
+		siteID:       siteID,
+		rules:        rules,
+		Metrics:      noopRecorder{},
+		CloseTimeout: DefaultTimeouts.Cleanup,
+		storyIDs:     make(map[string]struct{}),
+		userIDs:      make(map[string]struct{}),
+		userDeltas:   make(map[string]*UserCommentCounts),
+		flushed:      newDirtySets(),
+		ready:        make(chan struct{}),
+		failed:       make(chan struct{}),
 	}
 }
 
 // WatchEvent is used to return which record has been modified.
 type WatchEvent struct {
-	OperationType string `bson:"operationType"`
-	FullDocument  struct {
-		ID       string `bson:"id"`
-		AuthorID string `bson:"authorID"`
-		StoryID  string `bson:"storyID"`
-	} `bson:"fullDocument"`
+	OperationType string   `bson:"operationType"`
+	FullDocument  *Comment `bson:"fullDocument"`
+
+	// FullDocumentBeforeChange is the comment before the change, which is only
+	// requested when the Watcher's UserDeltas or WatchDeletes is enabled.
+	FullDocumentBeforeChange *Comment `bson:"fullDocumentBeforeChange"`
+}
+
+// Comment returns the comment that was changed, which for a delete is the
+// comment before it was deleted. It's nil when the change didn't include it.
+func (e *WatchEvent) Comment() *Comment {
+	if e.OperationType == "delete" {
+		return e.FullDocumentBeforeChange
+	}
+
+	return e.FullDocument
+}
+
+// decodeEvent will decode the change stream event, reading the comments in it
+// from the paths in the Fields of the Watcher's rules.
+func (w *Watcher) decodeEvent(raw bson.Raw) (*WatchEvent, error) {
+	var change struct {
+		OperationType            string        `bson:"operationType"`
+		FullDocument             bson.RawValue `bson:"fullDocument"`
+		FullDocumentBeforeChange bson.RawValue `bson:"fullDocumentBeforeChange"`
+	}
+	if err := bson.Unmarshal(raw, &change); err != nil {
+		return nil, err
+	}
+
+	after, err := w.decodeComment(change.FullDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := w.decodeComment(change.FullDocumentBeforeChange)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WatchEvent{
+		OperationType:            change.OperationType,
+		FullDocument:             after,
+		FullDocumentBeforeChange: before,
+	}, nil
+}
+
+// decodeComment will decode a comment from the change stream event, which is
+// nil when the event didn't include it.
+func (w *Watcher) decodeComment(value bson.RawValue) (*Comment, error) {
+	if value.Type != bsontype.EmbeddedDocument {
+		return nil, nil
+	}
+
+	var comment Comment
+	if err := w.rules.Fields.Decode(value.Document(), &comment); err != nil {
+		return nil, err
+	}
+
+	return &comment, nil
 }
 
 // Watcher can be used to monitor for dirty stories/sites to trigger future
 // update operations.
 type Watcher struct {
+	// UserDeltas when true will record the change that each changed comment made
+	// to its author's counts, so that the change can be applied to the stored
+	// counts rather than recounting every comment by the author. This requires
+	// the comments collection to record pre-images and post-images, as the
+	// change can only be known from the comment as it was before and after it.
+	//
+	// An inserted comment only adds to its author's counts, so it doesn't need a
+	// pre-image. A comment whose status changed removes the old status from its
+	// author's counts and adds the new one, so it needs the pre-image. Changes
+	// without the images they need, and changes made before or while the author
+	// is being recounted (which the recount may or may not have seen), mark the
+	// author as dirty to be recounted instead.
+	UserDeltas bool
+
+	// WatchDeletes when true will mark the story and author of each deleted
+	// comment as dirty. A delete doesn't include the comment, so its story and
+	// author are read from the pre-image of the change, which requires MongoDB
+	// 6.0 and pre-images enabled on the comments collection. Deletes whose
+	// pre-image isn't available are logged, and can't be marked as dirty.
+	WatchDeletes bool
+
+	// StartAtTime when set will start the change stream from this time rather
+	// than from when it's started, so the changes to comments since then are
+	// replayed and marked as dirty. The time must still be within the oplog,
+	// see OldestOplogTime.
+	StartAtTime time.Time
+
+	// EventLog when set is the EventLog that every decoded event is recorded in,
+	// so what the watcher saw can be replayed when debugging.
+	EventLog *EventLog
+
+	// Metrics is the Recorder that the events are counted with.
+	Metrics Recorder
+
+	// CloseTimeout is the deadline for closing the change stream once the
+	// watcher stops. The watcher's context is canceled by then, so the close
+	// is bounded by this instead.
+	CloseTimeout time.Duration
+
 	db       *mongo.Database
 	tenantID string
 	siteID   string
-	events   []WatchEvent
+	rules    Rules
 	ready    chan struct{}
+
+	// failed is closed when the change stream could not be started, and err is
+	// why.
+	failed chan struct{}
+	err    error
+
+	// storyIDs and userIDs are the sets of dirty ID's. Only the distinct ID's are
+	// kept so that memory is bounded by the number of stories and users that
+	// have changed rather than by the number of changes.
+	storyIDs map[string]struct{}
+	userIDs  map[string]struct{}
 	mux      sync.Mutex
+
+	// userDeltas are the changes to the counts of users that can be applied
+	// without recounting them. recounting are the users that were returned as
+	// dirty by the last call to Dirty, and deltas is true once Dirty has been
+	// called, as until then every user is being counted by the initial pass.
+	userDeltas map[string]*UserCommentCounts
+	recounting map[string]struct{}
+	deltas     bool
+
+	// flushed are the ID's marked as dirty since the last call to Flush, which
+	// are only kept until the initial pass has finished.
+	flushed dirtySets
+
+	// missingPreImages is the number of deletes that couldn't be marked as dirty
+	// as their pre-image wasn't available, which may be on any site.
+	missingPreImages int
+}
+
+// dirtySets are sets of dirty story and user ID's.
+type dirtySets struct {
+	storyIDs map[string]struct{}
+	userIDs  map[string]struct{}
+}
+
+func newDirtySets() dirtySets {
+	return dirtySets{
+		storyIDs: make(map[string]struct{}),
+		userIDs:  make(map[string]struct{}),
+	}
 }
 
 // Wait will wait until the watcher is listening for events or the context
-// expires.
+// expires. If the change stream could not be started, the error from starting
+// it is returned.
 func (w *Watcher) Wait(ctx context.Context) error {
 	for {
 		select {
@@ -56,10 +198,43 @@ func (w *Watcher) Wait(ctx context.Context) error {
 			return ctx.Err()
 		case <-w.ready:
 			return nil
+		case <-w.failed:
+			return w.err
 		}
 	}
 }
 
+// ChangeStreamsUnsupported returns true when the error is from a deployment that
+// doesn't support change streams, such as a standalone server, rather than a
+// failure of a deployment that does.
+func ChangeStreamsUnsupported(err error) bool {
+	var ce mongo.CommandError
+	if !errors.As(err, &ce) {
+		return false
+	}
+
+	switch ce.Code {
+	case 40573: // The $changeStream stage is only supported on replica sets.
+		return true
+	case 40324: // Unrecognized pipeline stage name on servers older than 3.6.
+		return true
+	}
+
+	return false
+}
+
+// closeStream will close the change stream. Like closeCursor, it doesn't use the
+// watcher's context as that's canceled when the watcher stops. Failures are only
+// logged.
+func (w *Watcher) closeStream(cs *mongo.ChangeStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.CloseTimeout)
+	defer cancel()
+
+	if err := cs.Close(ctx); err != nil {
+		logrus.WithError(err).Warn("could not close the change stream")
+	}
+}
+
 // Watch will watch for changes to the comments collection, and mark those
 // stories/sites as dirty so that we can re-run on changes.
 func (w *Watcher) Watch(ctx context.Context) error {
@@ -68,54 +243,76 @@ func (w *Watcher) Watch(ctx context.Context) error {
 	cs, err := w.db.Collection("comments").Watch(ctx, mongo.Pipeline{
 		bson.D{
 			primitive.E{
-				Key: "$match",
-				Value: bson.D{
-					primitive.E{
-						Key: "operationType",
-						Value: bson.D{
-							primitive.E{
-								Key:   "$in",
-								Value: []string{"insert", "update"},
-							},
-						},
-					},
-					primitive.E{
-						Key:   "fullDocument.tenantID",
-						Value: w.tenantID,
-					},
-					primitive.E{
-						Key:   "fullDocument.siteID",
-						Value: w.siteID,
-					},
-				},
+				Key:   "$match",
+				Value: w.changeStreamFilter(),
 			},
 		},
-	}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	}, w.changeStreamOptions())
 	if err != nil {
-		return errors.Wrap(err, "could not watch the change stream")
+		w.err = errors.Wrap(err, "could not watch the change stream")
+		close(w.failed)
+
+		return w.err
 	}
-	defer cs.Close(ctx)
+	defer w.closeStream(cs)
 
-	// We're listening to events, send the ready signal!
-	w.ready <- struct{}{}
+	// We're listening to events, send the ready signal! The caller may have
+	// stopped waiting for it when the context was canceled.
+	select {
+	case w.ready <- struct{}{}:
+	case <-ctx.Done():
+		return nil
+	}
 
 	// Continue iterating over this change stream until either the context is
 	// canceled or there is an error.
 	for cs.Next(ctx) {
-		var event WatchEvent
-		if err := cs.Decode(&event); err != nil {
+		event, err := w.decodeEvent(cs.Current)
+		if err != nil {
 			return errors.Wrap(err, "could not decode change stream event")
 		}
 
+		w.Metrics.Count("watcher.events", 1)
+
+		if w.EventLog != nil {
+			w.EventLog.Record(event)
+		}
+
+		comment := event.Comment()
+		if comment == nil && event.OperationType == "delete" {
+			// The deletes without a pre-image may be on any site, so only the first
+			// is warned about.
+			w.mux.Lock()
+			w.missingPreImages++
+			missing := w.missingPreImages
+			w.mux.Unlock()
+
+			entry := logrus.WithField("missingPreImages", missing)
+			if missing == 1 {
+				entry.Warn("a comment has been deleted but its pre-image is not available, the stories and authors of deleted comments can not be marked as dirty, enable changeStreamPreAndPostImages on the comments collection")
+			} else {
+				entry.Debug("a comment has been deleted but its pre-image is not available")
+			}
+			continue
+		}
+		if comment == nil {
+			logrus.WithField("operationType", event.OperationType).Warn("a comment has been changed but the change did not include the comment, it will not be marked as dirty")
+			continue
+		}
+
 		logrus.WithFields(logrus.Fields{
-			"commentID":     event.FullDocument.ID,
-			"storyID":       event.FullDocument.StoryID,
-			"opeartionType": event.OperationType,
+			"commentID":     comment.ID,
+			"storyID":       comment.StoryID,
+			"operationType": event.OperationType,
 		}).Info("a comment has been changed, marking it's story as dirty")
 
-		// Add this record.
+		// Mark the story and user as dirty.
 		w.mux.Lock()
-		w.events = append(w.events, event)
+		w.storyIDs[comment.StoryID] = struct{}{}
+		if !w.deltas {
+			w.flushed.storyIDs[comment.StoryID] = struct{}{}
+		}
+		w.markUsers(event)
 		w.mux.Unlock()
 	}
 
@@ -130,9 +327,144 @@ func (w *Watcher) Watch(ctx context.Context) error {
 	return nil
 }
 
+// changeStreamFilter returns the filter on the changes to the comments. Inserts
+// and updates are matched on the comment after the change. Deletes only have
+// the comment before it, and the deletes without one are matched too so they
+// can be logged, as the site they were on isn't known.
+func (w *Watcher) changeStreamFilter() bson.D {
+	filter := bson.D{
+		primitive.E{Key: "operationType", Value: bson.D{
+			primitive.E{Key: "$in", Value: []string{"insert", "update"}},
+		}},
+		primitive.E{Key: "fullDocument.tenantID", Value: w.tenantID},
+		primitive.E{Key: "fullDocument.siteID", Value: w.siteID},
+	}
+	if !w.WatchDeletes {
+		return filter
+	}
+
+	return bson.D{
+		primitive.E{Key: "$or", Value: bson.A{
+			filter,
+			bson.D{
+				primitive.E{Key: "operationType", Value: "delete"},
+				primitive.E{Key: "fullDocumentBeforeChange.tenantID", Value: w.tenantID},
+				primitive.E{Key: "fullDocumentBeforeChange.siteID", Value: w.siteID},
+			},
+			bson.D{
+				primitive.E{Key: "operationType", Value: "delete"},
+				primitive.E{Key: "fullDocumentBeforeChange", Value: nil},
+			},
+		}},
+	}
+}
+
+// changeStreamOptions returns the options for the change stream. When
+// UserDeltas is enabled the pre-image and post-image of each change are
+// requested, as the document looked up after an update may already include
+// later changes. The changes are matched on the post-image, so the collection
+// must record them, see ValidateWatcherSupport. When WatchDeletes is enabled
+// the pre-image is requested for the deleted comments.
+func (w *Watcher) changeStreamOptions() *options.ChangeStreamOptions {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if w.UserDeltas {
+		opts = options.ChangeStream().
+			SetFullDocument(options.WhenAvailable).
+			SetFullDocumentBeforeChange(options.WhenAvailable)
+	} else if w.WatchDeletes {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+
+	if !w.StartAtTime.IsZero() {
+		opts.SetStartAtOperationTime(&primitive.Timestamp{
+			T: uint32(w.StartAtTime.Unix()),
+		})
+	}
+
+	return opts
+}
+
+// markUsers will record the change to the counts of the authors of the comment
+// in the event, or mark them as dirty when the change can't be applied as a
+// delta. The mux must be held.
+func (w *Watcher) markUsers(event *WatchEvent) {
+	after, before := event.FullDocument, event.FullDocumentBeforeChange
+
+	// A deleted comment only has the pre-image, and is removed from its
+	// author's counts.
+	if event.OperationType == "delete" {
+		after = nil
+	}
+
+	// Every change other than an insert needs the pre-image.
+	if !w.UserDeltas || !w.deltas || (before == nil && event.OperationType != "insert") {
+		if after != nil {
+			w.markUserDirty(after.AuthorID)
+		}
+		if before != nil {
+			w.markUserDirty(before.AuthorID)
+		}
+
+		return
+	}
+
+	if after != nil {
+		w.addUserDelta(after.AuthorID, after, false)
+	}
+	if before != nil {
+		w.addUserDelta(before.AuthorID, before, true)
+	}
+}
+
+// markUserDirty will mark the user to be recounted, discarding any change to
+// their counts that was recorded as the recount will include it. The mux must
+// be held.
+func (w *Watcher) markUserDirty(userID string) {
+	w.userIDs[userID] = struct{}{}
+	delete(w.userDeltas, userID)
+
+	if !w.deltas {
+		w.flushed.userIDs[userID] = struct{}{}
+	}
+}
+
+// addUserDelta will add the comment's counts to the recorded change to the
+// user's counts, or remove them when subtract is true. If the user is already
+// going to be recounted, or is being recounted, they're marked as dirty instead.
+// The mux must be held.
+func (w *Watcher) addUserDelta(userID string, comment *Comment, subtract bool) {
+	if _, ok := w.userIDs[userID]; ok {
+		return
+	}
+
+	if _, ok := w.recounting[userID]; ok {
+		w.markUserDirty(userID)
+		return
+	}
+
+	delta, ok := w.userDeltas[userID]
+	if !ok {
+		delta = &UserCommentCounts{}
+		w.userDeltas[userID] = delta
+	}
+
+	var counts User
+	counts.Increment(comment, &w.rules)
+
+	if subtract {
+		delta.Subtract(&counts.CommentCounts)
+	} else {
+		delta.Merge(&counts.CommentCounts)
+	}
+}
+
 type DirtyKeys struct {
 	StoryIDs []string
 	UserIDs  []string
+
+	// UserDeltas are the changes to the counts of users that should be applied
+	// rather than recounting them, keyed by the user's ID.
+	UserDeltas map[string]*UserCommentCounts
 }
 
 // Dirty will return a list of all the story id's that are dirty.
@@ -142,37 +474,86 @@ func (w *Watcher) Dirty() *DirtyKeys {
 	defer w.mux.Unlock()
 
 	// If we have no records, then return nothing!
-	if len(w.events) == 0 {
+	if len(w.storyIDs) == 0 && len(w.userIDs) == 0 && len(w.userDeltas) == 0 {
+		// The initial pass has finished, so changes from now on can be deltas.
+		w.deltas = true
+		w.recounting = nil
+		w.flushed = dirtySets{}
+
 		return nil
 	}
 
-	dirty := DirtyKeys{}
+	dirty := DirtyKeys{
+		StoryIDs:   make([]string, 0, len(w.storyIDs)),
+		UserIDs:    make([]string, 0, len(w.userIDs)),
+		UserDeltas: w.userDeltas,
+	}
+
+	for storyID := range w.storyIDs {
+		dirty.StoryIDs = append(dirty.StoryIDs, storyID)
+	}
 
-	// Deduplicate all the story and user id's.
-	storyIDMap := make(map[string]struct{})
-	userIDMap := make(map[string]struct{})
-	for _, event := range w.events {
-		// If we've already seen this one before, don't add it.
-		if _, ok := storyIDMap[event.FullDocument.StoryID]; !ok {
-			// This is new, add it!
-			storyIDMap[event.FullDocument.StoryID] = struct{}{}
+	for userID := range w.userIDs {
+		dirty.UserIDs = append(dirty.UserIDs, userID)
+	}
 
-			// Add it to the list of dirty story id's.
-			dirty.StoryIDs = append(dirty.StoryIDs, event.FullDocument.StoryID)
-		}
+	// The users being recounted by this pass may or may not see the changes
+	// made while they're being recounted, so those changes will need to recount
+	// them again.
+	w.recounting = w.userIDs
+	w.deltas = true
+	w.flushed = dirtySets{}
 
-		// If we've already seen this one before, don't add it.
-		if _, ok := userIDMap[event.FullDocument.AuthorID]; !ok {
-			// This is new, add it!
-			userIDMap[event.FullDocument.AuthorID] = struct{}{}
+	// Reset the underlying sets.
+	w.storyIDs = make(map[string]struct{})
+	w.userIDs = make(map[string]struct{})
+	w.userDeltas = make(map[string]*UserCommentCounts)
 
-			// Add it to the list of dirty user id's.
-			dirty.UserIDs = append(dirty.UserIDs, event.FullDocument.AuthorID)
+	return &dirty
+}
+
+// MarkStoriesDirty will mark the stories as dirty so they're recounted by the
+// next dirty pass, such as when their counts couldn't be written.
+func (w *Watcher) MarkStoriesDirty(storyIDs []string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for _, storyID := range storyIDs {
+		w.storyIDs[storyID] = struct{}{}
+		if !w.deltas {
+			w.flushed.storyIDs[storyID] = struct{}{}
 		}
 	}
+}
+
+// Flush will return the story and user ID's that were marked as dirty since the
+// last call to Flush while the initial pass is still running, so they can be
+// recounted without waiting for the initial pass to finish. Unlike Dirty, they
+// stay dirty, as the initial pass may still write counts for them that it
+// scanned before they changed, so they're recounted again after it. Once Dirty
+// has been called, Flush returns nothing.
+func (w *Watcher) Flush() *DirtyKeys {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.deltas || (len(w.flushed.storyIDs) == 0 && len(w.flushed.userIDs) == 0) {
+		return nil
+	}
+
+	dirty := DirtyKeys{
+		StoryIDs: make([]string, 0, len(w.flushed.storyIDs)),
+		UserIDs:  make([]string, 0, len(w.flushed.userIDs)),
+	}
+
+	for storyID := range w.flushed.storyIDs {
+		dirty.StoryIDs = append(dirty.StoryIDs, storyID)
+	}
+
+	for userID := range w.flushed.userIDs {
+		dirty.UserIDs = append(dirty.UserIDs, userID)
+	}
 
-	// Reset the underlying slice.
-	w.events = make([]WatchEvent, 0)
+	w.flushed = newDirtySets()
 
 	return &dirty
 }
@@ -0,0 +1,361 @@
+package counts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestWatcherMarkUsers(t *testing.T) {
+	comment := func(authorID, status string) *Comment {
+		return &Comment{AuthorID: authorID, Status: status}
+	}
+
+	tests := []struct {
+		name       string
+		userDeltas bool
+		deltas     bool
+		recounting []string
+		event      WatchEvent
+		wantDirty  []string
+		wantDeltas map[string]CommentStatusCounts
+	}{
+		{
+			name:      "deltas disabled",
+			deltas:    true,
+			event:     WatchEvent{OperationType: "insert", FullDocument: comment("u1", "APPROVED")},
+			wantDirty: []string{"u1"},
+		},
+		{
+			name:       "initial pass still running",
+			userDeltas: true,
+			event:      WatchEvent{OperationType: "insert", FullDocument: comment("u1", "APPROVED")},
+			wantDirty:  []string{"u1"},
+		},
+		{
+			name:       "insert",
+			userDeltas: true,
+			deltas:     true,
+			event:      WatchEvent{OperationType: "insert", FullDocument: comment("u1", "APPROVED")},
+			wantDeltas: map[string]CommentStatusCounts{"u1": {Approved: 1}},
+		},
+		{
+			name:       "status changed",
+			userDeltas: true,
+			deltas:     true,
+			event: WatchEvent{
+				OperationType:            "update",
+				FullDocument:             comment("u1", "REJECTED"),
+				FullDocumentBeforeChange: comment("u1", "NONE"),
+			},
+			wantDeltas: map[string]CommentStatusCounts{"u1": {Rejected: 1, None: -1}},
+		},
+		{
+			name:       "update without a pre-image",
+			userDeltas: true,
+			deltas:     true,
+			event:      WatchEvent{OperationType: "update", FullDocument: comment("u1", "REJECTED")},
+			wantDirty:  []string{"u1"},
+		},
+		{
+			name:       "delete",
+			userDeltas: true,
+			deltas:     true,
+			event: WatchEvent{
+				OperationType:            "delete",
+				FullDocument:             comment("u1", "APPROVED"),
+				FullDocumentBeforeChange: comment("u1", "APPROVED"),
+			},
+			wantDeltas: map[string]CommentStatusCounts{"u1": {Approved: -1}},
+		},
+		{
+			name:       "user being recounted",
+			userDeltas: true,
+			deltas:     true,
+			recounting: []string{"u1"},
+			event:      WatchEvent{OperationType: "insert", FullDocument: comment("u1", "APPROVED")},
+			wantDirty:  []string{"u1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWatcher(nil, "tenant", "site", DefaultRules())
+			w.UserDeltas = tt.userDeltas
+			w.deltas = tt.deltas
+			if len(tt.recounting) > 0 {
+				w.recounting = make(map[string]struct{})
+				for _, userID := range tt.recounting {
+					w.recounting[userID] = struct{}{}
+				}
+			}
+
+			w.markUsers(&tt.event)
+
+			dirty := make([]string, 0, len(w.userIDs))
+			for userID := range w.userIDs {
+				dirty = append(dirty, userID)
+			}
+			if len(dirty) != len(tt.wantDirty) || (len(dirty) > 0 && !reflect.DeepEqual(dirty, tt.wantDirty)) {
+				t.Errorf("expected %v to be dirty, got %v", tt.wantDirty, dirty)
+			}
+
+			deltas := make(map[string]CommentStatusCounts, len(w.userDeltas))
+			for userID, delta := range w.userDeltas {
+				deltas[userID] = delta.Status
+			}
+			if len(deltas) != len(tt.wantDeltas) || (len(deltas) > 0 && !reflect.DeepEqual(deltas, tt.wantDeltas)) {
+				t.Errorf("expected the deltas %v, got %v", tt.wantDeltas, deltas)
+			}
+		})
+	}
+}
+
+func TestWatcherDecodeEvent(t *testing.T) {
+	rules := DefaultRules()
+	if err := rules.Fields.Set("storyID=story.id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		event      bson.D
+		wantAfter  *Comment
+		wantBefore *Comment
+	}{
+		{
+			name: "mapped fields",
+			event: bson.D{
+				primitive.E{Key: "operationType", Value: "update"},
+				primitive.E{Key: "fullDocument", Value: bson.D{
+					primitive.E{Key: "id", Value: "c1"},
+					primitive.E{Key: "story", Value: bson.D{primitive.E{Key: "id", Value: "s1"}}},
+					primitive.E{Key: "status", Value: "APPROVED"},
+				}},
+				primitive.E{Key: "fullDocumentBeforeChange", Value: bson.D{
+					primitive.E{Key: "id", Value: "c1"},
+					primitive.E{Key: "story", Value: bson.D{primitive.E{Key: "id", Value: "s1"}}},
+					primitive.E{Key: "status", Value: "NONE"},
+				}},
+			},
+			wantAfter:  &Comment{ID: "c1", StoryID: "s1", Status: "APPROVED"},
+			wantBefore: &Comment{ID: "c1", StoryID: "s1", Status: "NONE"},
+		},
+		{
+			name: "without the comments",
+			event: bson.D{
+				primitive.E{Key: "operationType", Value: "delete"},
+				primitive.E{Key: "fullDocument", Value: nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(tt.event)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := NewWatcher(nil, "tenant", "site", rules)
+			event, err := w.decodeEvent(raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(event.FullDocument, tt.wantAfter) {
+				t.Errorf("expected the full document %+v, got %+v", tt.wantAfter, event.FullDocument)
+			}
+			if !reflect.DeepEqual(event.FullDocumentBeforeChange, tt.wantBefore) {
+				t.Errorf("expected the full document before the change %+v, got %+v", tt.wantBefore, event.FullDocumentBeforeChange)
+			}
+		})
+	}
+}
+
+func TestWatcherChangeStreamOptions(t *testing.T) {
+	startAt := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		userDeltas       bool
+		watchDeletes     bool
+		startAt          time.Time
+		wantFullDocument options.FullDocument
+		wantBefore       bool
+		wantStartAt      uint32
+	}{
+		{name: "default", wantFullDocument: options.UpdateLookup},
+		{name: "user deltas", userDeltas: true, wantFullDocument: options.WhenAvailable, wantBefore: true},
+		{name: "deletes", watchDeletes: true, wantFullDocument: options.UpdateLookup, wantBefore: true},
+		{name: "start at time", startAt: startAt, wantFullDocument: options.UpdateLookup, wantStartAt: uint32(startAt.Unix())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWatcher(nil, "tenant", "site", DefaultRules())
+			w.UserDeltas = tt.userDeltas
+			w.WatchDeletes = tt.watchDeletes
+			w.StartAtTime = tt.startAt
+
+			opts := w.changeStreamOptions()
+
+			if opts.FullDocument == nil || *opts.FullDocument != tt.wantFullDocument {
+				t.Errorf("expected the full document %s, got %v", tt.wantFullDocument, opts.FullDocument)
+			}
+			if got := opts.FullDocumentBeforeChange != nil; got != tt.wantBefore {
+				t.Errorf("expected the pre-image %v, got %v", tt.wantBefore, got)
+			}
+
+			var gotStartAt uint32
+			if opts.StartAtOperationTime != nil {
+				gotStartAt = opts.StartAtOperationTime.T
+			}
+			if gotStartAt != tt.wantStartAt {
+				t.Errorf("expected to start at %d, got %d", tt.wantStartAt, gotStartAt)
+			}
+		})
+	}
+}
+
+func TestOldestOplogTime(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	oldest := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		entries []bson.D
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "oldest entry",
+			entries: []bson.D{{
+				primitive.E{Key: "ts", Value: primitive.Timestamp{T: uint32(oldest.Unix()), I: 1}},
+			}},
+			want: oldest,
+		},
+		{
+			name:    "empty oplog",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "local.oplog.rs", mtest.FirstBatch, tt.entries...))
+
+			got, err := OldestOplogTime(context.Background(), mt.DB)
+			if (err != nil) != tt.wantErr {
+				mt.Fatalf("OldestOplogTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !got.Equal(tt.want) {
+				mt.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWatcherUnsupported(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name            string
+		code            int32
+		wantUnsupported bool
+	}{
+		{name: "standalone server", code: 40573, wantUnsupported: true},
+		{name: "server older than 3.6", code: 40324, wantUnsupported: true},
+		{name: "not authorized", code: 13},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+				Code:    tt.code,
+				Message: "could not watch",
+			}))
+
+			w := NewWatcher(mt.DB, "tenant", "site", DefaultRules())
+			if err := w.Watch(context.Background()); err == nil {
+				mt.Fatalf("expected watching to fail")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := w.Wait(ctx)
+			if err == nil || errors.Is(err, context.DeadlineExceeded) {
+				mt.Fatalf("expected the error from watching, got %v", err)
+			}
+			if got := ChangeStreamsUnsupported(err); got != tt.wantUnsupported {
+				mt.Errorf("ChangeStreamsUnsupported(%v) = %v, want %v", err, got, tt.wantUnsupported)
+			}
+		})
+	}
+}
+
+func TestChangeStreamsUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"other error", errors.New("connection refused"), false},
+		{"replica sets only", errors.Wrap(mongo.CommandError{Code: 40573}, "could not watch"), true},
+		{"unrecognized stage", mongo.CommandError{Code: 40324}, true},
+		{"other command error", mongo.CommandError{Code: 13}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChangeStreamsUnsupported(tt.err); got != tt.want {
+				t.Errorf("ChangeStreamsUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcherStopsWithoutWaiter(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("canceled before ready is received", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(1, "coral.comments", mtest.FirstBatch))
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		w := NewWatcher(mt.DB, "tenant", "site", DefaultRules())
+		done := make(chan error, 1)
+		go func() {
+			done <- w.Watch(ctx)
+		}()
+
+		// Nothing waits for the watcher to be ready, like a caller whose Wait
+		// returned as the context was canceled.
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				mt.Errorf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			mt.Fatalf("expected the watcher to stop once the context was canceled")
+		}
+	})
+}
@@ -0,0 +1,389 @@
+package counts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultWriteQueueDepth is the default number of full batches that can be
+	// waiting to be written before producing more updates blocks.
+	DefaultWriteQueueDepth = 4
+
+	// DefaultWriteConcurrency is the default number of writers that will
+	// concurrently issue bulk writes from the write queue.
+	DefaultWriteConcurrency = 1
+)
+
+// ErrCanceled is returned when writing the updates stopped because the context
+// was canceled or its deadline passed, rather than because a write failed.
+var ErrCanceled = errors.New("processing was canceled")
+
+// WriteResult describes the writes that were made by a write operation.
+type WriteResult struct {
+	Batches  int
+	Updates  int
+	Modified int64
+	Failed   int
+}
+
+// batchWriter writes update models to a collection in batches.
+type batchWriter struct {
+	collection *mongo.Collection
+	name       string
+	tenantID   string
+	siteID     string
+	dryRun     bool
+
+	batchSize   int
+	maxBytes    int
+	targetBytes int
+	queueDepth  int
+	concurrency int
+
+	// deadLetters when set is the collection that the documents that could not
+	// be written are recorded in, rather than failing the write.
+	deadLetters *mongo.Collection
+
+	// lag when set pauses the writes while the replication lag is too high.
+	lag *LagMonitor
+
+	// writeTimeout when positive is the deadline for writing each batch.
+	writeTimeout time.Duration
+
+	// metrics records the writes, and checkSlow when set logs and counts each
+	// batch that was slow to write.
+	metrics   Recorder
+	checkSlow func(operation, collection string, size int, took time.Duration)
+
+	// bulkWrite when set replaces the BulkWrite of the collection, so the
+	// writes can be simulated.
+	bulkWrite func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+// batch is a group of update models and the ID's of the documents that they
+// update.
+type batch struct {
+	ids    []string
+	models []mongo.WriteModel
+
+	// bytes is the estimated size of the models.
+	bytes int
+}
+
+func newBatch(size int) *batch {
+	return &batch{
+		ids:    make([]string, 0, size),
+		models: make([]mongo.WriteModel, 0, size),
+	}
+}
+
+// write will collect the update models emitted by produce into batches of
+// batchSize (or fewer when they would exceed maxBytes) and send them to a pool
+// of concurrency writers over a queue bounded by queueDepth. This lets
+// producing the updates overlap with writing them, while ensuring a slow
+// database applies backpressure rather than letting batches pile up in memory.
+// If any write fails, the context passed to produce is canceled and the first
+// error is returned. If ctx is canceled, producing stops, the updates that were
+// already produced are still written so no batch is left half applied, and
+// ErrCanceled is returned with the result of the batches that were written.
+func (bw *batchWriter) write(ctx context.Context, produce func(ctx context.Context, emit func(id string, model mongo.WriteModel) error) error) (*WriteResult, error) {
+	parent := ctx
+	g, ctx := errgroup.WithContext(ctx)
+
+	// The writes are only canceled when one of them fails, and not when the
+	// parent is.
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+	go func() {
+		<-ctx.Done()
+		if parent.Err() == nil {
+			cancelWrites()
+		}
+	}()
+
+	batches := make(chan *batch, bw.queueDepth)
+
+	// Produce the updates and group them into batches.
+	g.Go(func() error {
+		defer close(batches)
+
+		batchSize := bw.batchSize
+		if batchSize > MaxBatchWriteOperations {
+			batchSize = MaxBatchWriteOperations
+		}
+
+		// The batch size is tuned from the first batch when there's a target.
+		tuned := bw.targetBytes <= 0
+
+		b := newBatch(batchSize)
+
+		send := func() error {
+			if !tuned {
+				tuned = true
+				batchSize = tunedBatchSize(b.bytes, len(b.models), bw.targetBytes)
+
+				logrus.WithFields(logrus.Fields{
+					"averageBytes": b.bytes / len(b.models),
+					"targetBytes":  bw.targetBytes,
+					"batchSize":    batchSize,
+				}).Infof("tuned the batch size of %s updates", bw.name)
+			}
+
+			select {
+			case batches <- b:
+				b = newBatch(batchSize)
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err := produce(ctx, func(id string, model mongo.WriteModel) error {
+			size := modelSize(model)
+
+			// If this update would take the batch over the max bytes, then send the
+			// batch without it now.
+			if bw.maxBytes > 0 && len(b.models) > 0 && b.bytes+size > bw.maxBytes {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+
+			if bw.maxBytes > 0 && size > bw.maxBytes {
+				logrus.WithFields(logrus.Fields{
+					"id":    id,
+					"bytes": size,
+				}).Warnf("%s update is larger than the max batch write bytes and will be written on its own", bw.name)
+			}
+
+			b.ids = append(b.ids, id)
+			b.models = append(b.models, model)
+			b.bytes += size
+
+			// If we have more updates than the max size, then send them now.
+			if len(b.models) >= batchSize {
+				return send()
+			}
+
+			return nil
+		}); err != nil {
+			// When the run is being stopped, the updates that were produced are
+			// still written.
+			if parent.Err() != nil && len(b.models) > 0 {
+				select {
+				case batches <- b:
+				case <-writeCtx.Done():
+				}
+			}
+
+			return err
+		}
+
+		// If we have updates leftover, send them now.
+		if len(b.models) > 0 {
+			return send()
+		}
+
+		return nil
+	})
+
+	var (
+		result WriteResult
+		mux    sync.Mutex
+	)
+
+	// Start the writers that will drain the batches.
+	for i := 0; i < bw.concurrency; i++ {
+		g.Go(func() error {
+			for b := range batches {
+				modified, failed, err := bw.writeBatch(writeCtx, b)
+				if err != nil {
+					cancelWrites()
+					return err
+				}
+
+				mux.Lock()
+				result.Batches++
+				result.Updates += len(b.models)
+				result.Modified += modified
+				result.Failed += failed
+				mux.Unlock()
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		// When the run is being stopped, the writes fail because their context was
+		// canceled and not because of the database, so this isn't a failure.
+		if parent.Err() != nil {
+			logrus.WithFields(logrus.Fields{
+				"batches": result.Batches,
+				"updates": result.Updates,
+				"reason":  parent.Err(),
+			}).Infof("stopped writing bulk %s updates as processing was canceled", bw.name)
+
+			return &result, errors.Wrapf(ErrCanceled, "stopped after writing %d batches of %s updates", result.Batches, bw.name)
+		}
+
+		return &result, err
+	}
+
+	return &result, nil
+}
+
+// tunedBatchSize returns the number of updates of the average size of the
+// updates that fit in the target bytes, which is at least one and at most
+// MaxBatchWriteOperations.
+func tunedBatchSize(bytes, updates, target int) int {
+	if bytes <= 0 || updates <= 0 {
+		return MaxBatchWriteOperations
+	}
+
+	size := target * updates / bytes
+	if size < 1 {
+		return 1
+	}
+	if size > MaxBatchWriteOperations {
+		return MaxBatchWriteOperations
+	}
+
+	return size
+}
+
+// modelSize returns the estimated size in bytes of the write model, which is the
+// size of its encoded filter, update, and document. Parts that can't be encoded
+// are left out, as they'll fail when they're written anyway.
+func modelSize(model mongo.WriteModel) int {
+	var parts []interface{}
+	switch m := model.(type) {
+	case *mongo.UpdateOneModel:
+		parts = []interface{}{m.Filter, m.Update, m.Hint}
+	case *mongo.UpdateManyModel:
+		parts = []interface{}{m.Filter, m.Update, m.Hint}
+	case *mongo.ReplaceOneModel:
+		parts = []interface{}{m.Filter, m.Replacement, m.Hint}
+	case *mongo.InsertOneModel:
+		parts = []interface{}{m.Document}
+	case *mongo.DeleteOneModel:
+		parts = []interface{}{m.Filter, m.Hint}
+	case *mongo.DeleteManyModel:
+		parts = []interface{}{m.Filter, m.Hint}
+	}
+
+	var size int
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+
+		data, err := bson.Marshal(part)
+		if err != nil {
+			continue
+		}
+
+		size += len(data)
+	}
+
+	return size
+}
+
+// writeBatch will write the batch and return the number of documents that were
+// modified and the number of documents that failed to be written.
+func (bw *batchWriter) writeBatch(ctx context.Context, b *batch) (int64, int, error) {
+	if bw.dryRun {
+		logrus.WithFields(logrus.Fields{
+			"updates": len(b.models),
+		}).Infof("not writing bulk %s updates as --dryRun is enabled", bw.name)
+
+		return 0, 0, nil
+	}
+
+	// Wait while the replication lag is too high.
+	if bw.lag != nil {
+		if err := bw.lag.Wait(ctx); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Bound the write of the batch when there's a deadline for each batch.
+	writeCtx := ctx
+	if bw.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		writeCtx, cancel = context.WithTimeout(ctx, bw.writeTimeout)
+		defer cancel()
+	}
+
+	bulkWrite := bw.collection.BulkWrite
+	if bw.bulkWrite != nil {
+		bulkWrite = bw.bulkWrite
+	}
+
+	started := time.Now()
+	res, err := bulkWrite(writeCtx, b.models, options.BulkWrite().SetOrdered(false))
+
+	took := time.Since(started)
+
+	bw.metrics.Timing(bw.name+".bulk_write", took)
+	bw.metrics.Count(bw.name+".bulk_writes", 1)
+	if bw.checkSlow != nil {
+		bw.checkSlow("bulk_write", bw.collection.Name(), len(b.models), took)
+	}
+	bw.metrics.Gauge(bw.name+".batch_size", float64(len(b.models)))
+	bw.metrics.Count(bw.name+".updates", int64(len(b.models)))
+
+	if err != nil {
+		// If we have somewhere to record the documents that failed to write, and
+		// the only failures were for individual documents, record them and
+		// continue.
+		var bwe mongo.BulkWriteException
+		if bw.deadLetters == nil || !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+			return 0, 0, errors.Wrapf(err, "could not bulk write %s updates", bw.name)
+		}
+
+		for _, we := range bwe.WriteErrors {
+			recordDeadLetter(ctx, bw.deadLetters, bw.dryRun, DeadLetter{
+				TenantID:   bw.tenantID,
+				SiteID:     bw.siteID,
+				Collection: bw.collection.Name(),
+				DocumentID: b.ids[we.Index],
+				Error:      we.Message,
+			})
+		}
+
+		var modified int64
+		if res != nil {
+			modified = res.ModifiedCount
+		}
+
+		bw.metrics.Count(bw.name+".modified", modified)
+		bw.metrics.Count(bw.name+".failed", int64(len(bwe.WriteErrors)))
+
+		logrus.WithFields(logrus.Fields{
+			"updates":  len(b.models),
+			"modified": modified,
+			"failed":   len(bwe.WriteErrors),
+		}).Warnf("wrote bulk %s updates with failures", bw.name)
+
+		return modified, len(bwe.WriteErrors), nil
+	}
+
+	bw.metrics.Count(bw.name+".modified", res.ModifiedCount)
+
+	logrus.WithFields(logrus.Fields{
+		"updates":  len(b.models),
+		"modified": res.ModifiedCount,
+	}).Infof("wrote bulk %s updates", bw.name)
+
+	return res.ModifiedCount, 0, nil
+}
@@ -0,0 +1,341 @@
+package counts
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sizedUpdate returns an update model whose update has a string of n bytes, so
+// that models of different sizes can be written.
+func sizedUpdate(id string, n int) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.D{primitive.E{Key: "id", Value: id}}).
+		SetUpdate(bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "padding", Value: strings.Repeat("x", n)},
+		}}})
+}
+
+func TestModelSize(t *testing.T) {
+	filter := bson.D{primitive.E{Key: "id", Value: "a"}}
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "n", Value: 1}}}}
+
+	size := func(doc interface{}) int {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return len(data)
+	}
+
+	tests := []struct {
+		name  string
+		model mongo.WriteModel
+		want  int
+	}{
+		{"update one", mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update), size(filter) + size(update)},
+		{"update one with hint", mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetHint(filter), 2*size(filter) + size(update)},
+		{"update many", mongo.NewUpdateManyModel().SetFilter(filter).SetUpdate(update), size(filter) + size(update)},
+		{"replace one", mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(filter), 2 * size(filter)},
+		{"insert one", mongo.NewInsertOneModel().SetDocument(filter), size(filter)},
+		{"delete one", mongo.NewDeleteOneModel().SetFilter(filter), size(filter)},
+		{"unencodable update left out", mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(make(chan int)), size(filter)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := modelSize(tt.model); got != tt.want {
+				t.Errorf("modelSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchWriterMaxBytes(t *testing.T) {
+	// Each of the updates is a little over 1000 bytes.
+	unit := modelSize(sizedUpdate("a", 1000))
+
+	tests := []struct {
+		name        string
+		sizes       []int
+		batchSize   int
+		maxBytes    int
+		wantBatches int
+	}{
+		{name: "no limit", sizes: []int{1000, 1000, 1000}, batchSize: 10, wantBatches: 1},
+		{name: "under the limit", sizes: []int{1000, 1000}, batchSize: 10, maxBytes: 3 * unit, wantBatches: 1},
+		{name: "split at the limit", sizes: []int{1000, 1000, 1000, 1000}, batchSize: 10, maxBytes: 2 * unit, wantBatches: 2},
+		{name: "split by size and count", sizes: []int{1000, 1000, 1000, 1000, 1000}, batchSize: 2, maxBytes: 3 * unit, wantBatches: 3},
+		{name: "update larger than the limit", sizes: []int{1000, 5000, 1000}, batchSize: 10, maxBytes: 2 * unit, wantBatches: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bw := batchWriter{
+				name:        "story",
+				dryRun:      true,
+				batchSize:   tt.batchSize,
+				maxBytes:    tt.maxBytes,
+				queueDepth:  1,
+				concurrency: 1,
+			}
+
+			res, err := bw.write(context.Background(), func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+				for i, size := range tt.sizes {
+					id := string(rune('a' + i))
+					if err := emit(id, sizedUpdate(id, size)); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if res.Batches != tt.wantBatches {
+				t.Errorf("expected %d batches, got %d", tt.wantBatches, res.Batches)
+			}
+			if res.Updates != len(tt.sizes) {
+				t.Errorf("expected %d updates, got %d", len(tt.sizes), res.Updates)
+			}
+		})
+	}
+}
+
+func TestTunedBatchSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		bytes   int
+		updates int
+		target  int
+		want    int
+	}{
+		{"no updates", 0, 0, 1000, MaxBatchWriteOperations},
+		{"no bytes", 0, 10, 1000, MaxBatchWriteOperations},
+		{"fits the target", 1000, 10, 500, 5},
+		{"rounds down", 1000, 10, 550, 5},
+		{"larger than the target", 1000, 1, 10, 1},
+		{"capped at the max operations", 10, 10, MaxBatchWriteOperations * 100, MaxBatchWriteOperations},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tunedBatchSize(tt.bytes, tt.updates, tt.target); got != tt.want {
+				t.Errorf("tunedBatchSize(%d, %d, %d) = %d, want %d", tt.bytes, tt.updates, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchWriterTargetBytes(t *testing.T) {
+	// Each of the updates is a little over 100 bytes.
+	unit := modelSize(sizedUpdate("a", 100))
+
+	tests := []struct {
+		name        string
+		updates     int
+		batchSize   int
+		targetBytes int
+		wantBatches int
+	}{
+		{name: "not tuned", updates: 10, batchSize: 4, wantBatches: 3},
+		{name: "tuned smaller", updates: 10, batchSize: 4, targetBytes: 2 * unit, wantBatches: 4},
+		{name: "tuned larger", updates: 10, batchSize: 2, targetBytes: 5 * unit, wantBatches: 3},
+		{name: "single batch", updates: 3, batchSize: 4, targetBytes: unit, wantBatches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bw := batchWriter{
+				name:        "story",
+				dryRun:      true,
+				batchSize:   tt.batchSize,
+				targetBytes: tt.targetBytes,
+				queueDepth:  1,
+				concurrency: 1,
+			}
+
+			res, err := bw.write(context.Background(), func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+				for i := 0; i < tt.updates; i++ {
+					id := string(rune('a' + i))
+					if err := emit(id, sizedUpdate(id, 100)); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if res.Batches != tt.wantBatches {
+				t.Errorf("expected %d batches, got %d", tt.wantBatches, res.Batches)
+			}
+			if res.Updates != tt.updates {
+				t.Errorf("expected %d updates, got %d", tt.updates, res.Updates)
+			}
+		})
+	}
+}
+
+func TestBatchWriterCanceled(t *testing.T) {
+	failed := errors.New("could not produce the updates")
+
+	tests := []struct {
+		name         string
+		emit         int
+		cancel       bool
+		produceErr   error
+		wantCanceled bool
+		wantErr      error
+		wantUpdates  int
+	}{
+		{name: "completed", emit: 3, wantUpdates: 3},
+		{name: "canceled after producing", emit: 3, cancel: true, wantCanceled: true, wantUpdates: 3},
+		{name: "canceled before producing", cancel: true, wantCanceled: true},
+		{name: "produce failed", emit: 3, produceErr: failed, wantErr: failed, wantUpdates: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bw := batchWriter{
+				name:        "story",
+				dryRun:      true,
+				batchSize:   2,
+				queueDepth:  1,
+				concurrency: 1,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			res, err := bw.write(ctx, func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+				for i := 0; i < tt.emit; i++ {
+					id := string(rune('a' + i))
+					if err := emit(id, sizedUpdate(id, 10)); err != nil {
+						return err
+					}
+				}
+
+				// The run is stopped once the updates have been produced.
+				if tt.cancel {
+					cancel()
+					return ctx.Err()
+				}
+
+				return tt.produceErr
+			})
+
+			if got := errors.Is(err, ErrCanceled); got != tt.wantCanceled {
+				t.Fatalf("expected canceled %v, got %v", tt.wantCanceled, err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantCanceled && tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if res.Updates != tt.wantUpdates {
+				t.Errorf("expected %d updates to be written, got %d", tt.wantUpdates, res.Updates)
+			}
+		})
+	}
+}
+
+// BenchmarkBatchWriter writes the story updates of a large site through the
+// batch writer, with each bulk write taking a simulated round trip to the
+// database. Queueing the batches lets the updates be produced while the last
+// batch is being written, and concurrent writers overlap the round trips.
+func BenchmarkBatchWriter(b *testing.B) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	collection := client.Database("coral").Collection("stories")
+
+	// Each batch takes a millisecond to write, and each story a few
+	// microseconds to count.
+	const (
+		stories   = 20000
+		roundTrip = time.Millisecond
+		counting  = 5 * time.Microsecond
+	)
+
+	bulkWrite := func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+		time.Sleep(roundTrip)
+		return &mongo.BulkWriteResult{ModifiedCount: int64(len(models))}, nil
+	}
+
+	models := make([]mongo.WriteModel, stories)
+	ids := make([]string, stories)
+	for i := range models {
+		ids[i] = "story-" + strconv.Itoa(i)
+		models[i] = sizedUpdate(ids[i], 200)
+	}
+
+	tests := []struct {
+		name        string
+		queueDepth  int
+		concurrency int
+	}{
+		{name: "synchronous", queueDepth: 0, concurrency: 1},
+		{name: "queued", queueDepth: 4, concurrency: 1},
+		{name: "queued and concurrent", queueDepth: 4, concurrency: 4},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			bw := batchWriter{
+				collection:  collection,
+				name:        "story",
+				batchSize:   100,
+				queueDepth:  tt.queueDepth,
+				concurrency: tt.concurrency,
+				metrics:     noopRecorder{},
+				bulkWrite:   bulkWrite,
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				res, err := bw.write(context.Background(), func(ctx context.Context, emit func(string, mongo.WriteModel) error) error {
+					for j := range models {
+						spin(counting)
+						if err := emit(ids[j], models[j]); err != nil {
+							return err
+						}
+					}
+
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.Updates != stories {
+					b.Fatalf("expected %d updates, got %d", stories, res.Updates)
+				}
+			}
+		})
+	}
+}
+
+// spin will keep the CPU busy for d, like decoding and counting comments does,
+// rather than sleeping.
+func spin(d time.Duration) {
+	for started := time.Now(); time.Since(started) < d; {
+	}
+}
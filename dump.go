@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"coral-counts/counts"
+)
+
+// dirtyDump is the watcher's dirty set as it's printed by --dumpDirty.
+type dirtyDump struct {
+	TenantID string   `json:"tenantID"`
+	SiteID   string   `json:"siteID"`
+	Window   string   `json:"window"`
+	StoryIDs []string `json:"storyIDs"`
+	UserIDs  []string `json:"userIDs"`
+
+	// UserDeltaIDs are the users whose changes would be applied rather than
+	// recounting them, when --userDeltas is used.
+	UserDeltaIDs []string `json:"userDeltaIDs,omitempty"`
+}
+
+// dumpDirty will run the watcher for the window, and then print the stories and
+// users it marked as dirty as JSON without processing them. It stops early and
+// prints what it collected when it's asked to shut down.
+func dumpDirty(watcher *counts.Watcher, tenantID, siteID string, window time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- watcher.Watch(ctx)
+	}()
+
+	if err := watcher.Wait(ctx); err != nil {
+		return errors.Wrap(err, "could not wait for watcher to start")
+	}
+
+	always().WithFields(logrus.Fields{
+		"tenantID": tenantID,
+		"siteID":   siteID,
+		"window":   window.String(),
+	}).Info("collecting the dirty stories and users")
+
+	select {
+	case <-time.After(window):
+	case <-ctx.Done():
+		logrus.Warn("stopped collecting the dirty stories and users early")
+	case err := <-failed:
+		return errors.Wrap(err, "watcher failed")
+	}
+
+	dump := newDirtyDump(tenantID, siteID, window, watcher.Dirty())
+
+	always().WithFields(logrus.Fields{
+		"stories":    len(dump.StoryIDs),
+		"users":      len(dump.UserIDs),
+		"userDeltas": len(dump.UserDeltaIDs),
+	}).Info("collected the dirty stories and users")
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(dump); err != nil {
+		return errors.Wrap(err, "could not print the dirty stories and users")
+	}
+
+	return nil
+}
+
+// newDirtyDump returns the dump of the dirty stories and users, each sorted by
+// their ID. The dirty set is nil when nothing was marked as dirty.
+func newDirtyDump(tenantID, siteID string, window time.Duration, dirty *counts.DirtyKeys) dirtyDump {
+	dump := dirtyDump{
+		TenantID: tenantID,
+		SiteID:   siteID,
+		Window:   window.String(),
+		StoryIDs: []string{},
+		UserIDs:  []string{},
+	}
+	if dirty != nil {
+		dump.StoryIDs = append(dump.StoryIDs, dirty.StoryIDs...)
+		dump.UserIDs = append(dump.UserIDs, dirty.UserIDs...)
+		for userID := range dirty.UserDeltas {
+			dump.UserDeltaIDs = append(dump.UserDeltaIDs, userID)
+		}
+	}
+	sort.Strings(dump.StoryIDs)
+	sort.Strings(dump.UserIDs)
+	sort.Strings(dump.UserDeltaIDs)
+
+	return dump
+}
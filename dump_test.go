@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"coral-counts/counts"
+)
+
+func TestNewDirtyDump(t *testing.T) {
+	tests := []struct {
+		name  string
+		dirty *counts.DirtyKeys
+		want  string
+	}{
+		{
+			name: "nothing dirty",
+			want: `{"tenantID":"tenant","siteID":"site","window":"1m0s","storyIDs":[],"userIDs":[]}`,
+		},
+		{
+			name: "sorted",
+			dirty: &counts.DirtyKeys{
+				StoryIDs: []string{"s2", "s1"},
+				UserIDs:  []string{"u3", "u1", "u2"},
+			},
+			want: `{"tenantID":"tenant","siteID":"site","window":"1m0s","storyIDs":["s1","s2"],"userIDs":["u1","u2","u3"]}`,
+		},
+		{
+			name: "user deltas",
+			dirty: &counts.DirtyKeys{
+				StoryIDs: []string{"s1"},
+				UserDeltas: map[string]*counts.UserCommentCounts{
+					"u2": {},
+					"u1": {},
+				},
+			},
+			want: `{"tenantID":"tenant","siteID":"site","window":"1m0s","storyIDs":["s1"],"userIDs":[],"userDeltaIDs":["u1","u2"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(newDirtyDump("tenant", "site", time.Minute, tt.dirty))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := string(data); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
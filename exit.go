@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"coral-counts/counts"
+)
+
+// The exit codes that distinguish the outcome of a run.
+const (
+	// ExitOK is used when the run completed successfully.
+	ExitOK = 0
+
+	// ExitError is used when the run failed for any reason that doesn't have a
+	// more specific exit code, including invalid flags.
+	ExitError = 1
+
+	// ExitDrift is used when the run completed successfully, but verifying the
+	// counts found drift.
+	ExitDrift = 2
+
+	// ExitPartial is used when the run was stopped before it completed, such as
+	// by a deadline or a shutdown.
+	ExitPartial = 3
+
+	// ExitConnection is used when the run failed because the database could not
+	// be reached.
+	ExitConnection = 4
+
+	// ExitWrite is used when the run failed because updates could not be
+	// written.
+	ExitWrite = 5
+)
+
+// errDrift is returned when the run completed, but found that counts drifted.
+var errDrift = errors.New("counts have drifted")
+
+// phaseErrors are the errors from each phase of a run that failed when the run
+// continued past them. The exit code is the most severe of theirs.
+type phaseErrors []error
+
+func (e phaseErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Is returns true if any of the errors is the target.
+func (e phaseErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stoppedError is an error from a run that was stopped by a shutdown. The run
+// is treated as stopped, unless its cause has a more severe exit code than
+// the generic failure the shutdown itself would cause.
+type stoppedError struct {
+	err error
+}
+
+// stopped will mark the error as being from a run that was stopped by a
+// shutdown, keeping it as the cause.
+func stopped(err error) error {
+	if err == nil || errors.Is(err, counts.ErrCanceled) {
+		return err
+	}
+
+	return &stoppedError{err: err}
+}
+
+func (e *stoppedError) Error() string { return e.err.Error() }
+func (e *stoppedError) Unwrap() error { return e.err }
+
+// Is returns true for ErrCanceled, as the run was stopped.
+func (e *stoppedError) Is(target error) bool { return target == counts.ErrCanceled }
+
+// phases tracks the errors from the phases of a run. When bestEffort is set,
+// the errors are collected so the run can continue past them, otherwise the
+// first one stops the run.
+type phases struct {
+	bestEffort bool
+	failed     phaseErrors
+}
+
+// check will wrap the error from a phase with the message, returning it when
+// the run should stop or collecting it when it should continue.
+func (p *phases) check(err error, message string) error {
+	if err == nil {
+		return nil
+	}
+
+	err = errors.Wrap(err, message)
+	if !p.bestEffort {
+		return err
+	}
+
+	logrus.WithError(err).Error("continuing with the initial pass as --bestEffort is enabled")
+	p.failed = append(p.failed, err)
+
+	return nil
+}
+
+// err returns the errors that were collected, or nil when every phase
+// succeeded.
+func (p *phases) err() error {
+	if len(p.failed) == 0 {
+		return nil
+	}
+
+	return p.failed
+}
+
+// exitError is an error with the exit code that should be used for it.
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode will attach the exit code to the error.
+func withExitCode(err error, code int) error {
+	return &exitError{err: err, code: code}
+}
+
+// exitCode returns the exit code for the error returned by a run.
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+
+	var se *stoppedError
+	if errors.As(err, &se) {
+		if code := exitCode(se.err); code != ExitError && severity(code) > severity(ExitPartial) {
+			return code
+		}
+
+		return ExitPartial
+	}
+
+	var pe phaseErrors
+	if errors.As(err, &pe) {
+		code := ExitOK
+		for _, err := range pe {
+			if c := exitCode(err); severity(c) > severity(code) {
+				code = c
+			}
+		}
+
+		return code
+	}
+
+	if errors.Is(err, errDrift) {
+		return ExitDrift
+	}
+
+	if errors.Is(err, counts.ErrCanceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ExitPartial
+	}
+
+	var (
+		bwe mongo.BulkWriteException
+		we  mongo.WriteException
+	)
+	if errors.As(err, &bwe) || errors.As(err, &we) {
+		return ExitWrite
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return ExitConnection
+	}
+
+	return ExitError
+}
+
+// exitSeverity is the exit codes from the least to the most severe. A failure
+// is more severe than a run that was stopped, which is more severe than drift
+// in a run that completed.
+var exitSeverity = []int{ExitOK, ExitDrift, ExitPartial, ExitError, ExitWrite, ExitConnection}
+
+// severity returns how severe the exit code is, so the most severe of the
+// errors from several phases can be used.
+func severity(code int) int {
+	for i, c := range exitSeverity {
+		if c == code {
+			return i
+		}
+	}
+
+	return len(exitSeverity)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"coral-counts/counts"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no error", nil, ExitOK},
+		{"other error", errors.New("failed"), ExitError},
+		{"drift", errors.Wrap(errDrift, "verifying"), ExitDrift},
+		{"canceled run", errors.Wrap(counts.ErrCanceled, "processing"), ExitPartial},
+		{"deadline", errors.Wrap(context.DeadlineExceeded, "processing"), ExitPartial},
+		{"canceled context", context.Canceled, ExitPartial},
+		{"bulk write", errors.Wrap(mongo.BulkWriteException{}, "writing"), ExitWrite},
+		{"write", errors.Wrap(mongo.WriteException{}, "writing"), ExitWrite},
+		{"network", errors.Wrap(mongo.CommandError{Labels: []string{"NetworkError"}}, "connecting"), ExitConnection},
+		{"explicit code", withExitCode(errDrift, ExitConnection), ExitConnection},
+		{"most severe phase error", phaseErrors{errDrift, mongo.WriteException{}}, ExitWrite},
+		{"most severe phase error wrapped", errors.Wrap(phaseErrors{errors.Wrap(mongo.WriteException{}, "writing"), errDrift}, "run"), ExitWrite},
+		{"phase error after a generic error", phaseErrors{errors.New("failed"), errors.Wrap(mongo.WriteException{}, "writing")}, ExitWrite},
+		{"phase failure after a shutdown", phaseErrors{errors.Wrap(counts.ErrCanceled, "site a"), errors.New("failed")}, ExitError},
+		{"phase shutdown after drift", phaseErrors{errDrift, errors.Wrap(counts.ErrCanceled, "site b")}, ExitPartial},
+		{"phase explicit code", phaseErrors{errors.New("failed"), withExitCode(errors.New("unreachable"), ExitConnection)}, ExitConnection},
+		{"stopped", stopped(errors.New("could not iterate on cursor")), ExitPartial},
+		{"stopped after drift", stopped(errDrift), ExitPartial},
+		{"stopped by a write failure", stopped(errors.Wrap(mongo.WriteException{}, "writing")), ExitWrite},
+		{"stopped by a network failure", errors.Wrap(stopped(mongo.CommandError{Labels: []string{"NetworkError"}}), "site a"), ExitConnection},
+		{"phase stopped by a write failure", phaseErrors{errDrift, stopped(mongo.WriteException{})}, ExitWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPhaseErrorsError(t *testing.T) {
+	err := phaseErrors{errors.New("could not verify"), errors.New("could not write")}
+
+	if got, want := err.Error(), "could not verify; could not write"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestPhaseErrorsIs(t *testing.T) {
+	err := errors.Wrap(phaseErrors{errors.New("failed"), errors.Wrap(counts.ErrCanceled, "site b")}, "run")
+
+	if !errors.Is(err, counts.ErrCanceled) {
+		t.Errorf("expected a shutdown in any phase to be found")
+	}
+	if errors.Is(err, errDrift) {
+		t.Errorf("expected drift not to be found")
+	}
+}
+
+func TestStoppedError(t *testing.T) {
+	cause := errors.Wrap(mongo.WriteException{}, "could not write stories")
+	err := errors.Wrap(stopped(cause), "site a")
+
+	if !errors.Is(err, counts.ErrCanceled) {
+		t.Errorf("expected the run to be stopped")
+	}
+
+	var we mongo.WriteException
+	if !errors.As(err, &we) {
+		t.Errorf("expected the cause to be kept")
+	}
+
+	if got, want := err.Error(), "site a: could not write stories: "+(mongo.WriteException{}).Error(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if stopped(nil) != nil {
+		t.Errorf("expected no error when the run succeeded")
+	}
+}
+
+func TestPhasesCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		bestEffort bool
+		errs       []error
+		wantStop   int
+		wantFailed int
+		wantCode   int
+	}{
+		{"no errors", false, []error{nil, nil}, -1, 0, ExitOK},
+		{"stops on the first error", false, []error{nil, errDrift, mongo.WriteException{}}, 1, 0, ExitDrift},
+		{"best effort without errors", true, []error{nil, nil}, -1, 0, ExitOK},
+		{"best effort collects every error", true, []error{mongo.WriteException{}, nil, errDrift}, -1, 2, ExitWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &phases{bestEffort: tt.bestEffort}
+
+			stop, code := -1, ExitOK
+			for i, err := range tt.errs {
+				if err := p.check(err, "phase"); err != nil {
+					stop, code = i, exitCode(err)
+					break
+				}
+			}
+			if stop < 0 {
+				code = exitCode(p.err())
+			}
+
+			if stop != tt.wantStop {
+				t.Errorf("expected to stop at phase %d, stopped at %d", tt.wantStop, stop)
+			}
+			if len(p.failed) != tt.wantFailed {
+				t.Errorf("expected %d failed phases, got %d", tt.wantFailed, len(p.failed))
+			}
+			if code != tt.wantCode {
+				t.Errorf("expected exit code %d, got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// flags returns the flags of the app.
+func flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "tenantID",
+			Usage:    "ID for the Tenant we're refreshing counts on",
+			Required: true,
+			EnvVars:  []string{"TENANT_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "siteID",
+			Usage:   "ID for the Site we're refreshing counts on, required unless --siteFilter or --allSites is used",
+			EnvVars: []string{"SITE_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "siteFilter",
+			Usage:   "an extended JSON filter on the tenant's sites, such as {\"active\": true}, each matching site is processed in turn instead of the --siteID",
+			EnvVars: []string{"SITE_FILTER"},
+		},
+		&cli.BoolFlag{
+			Name:    "allSites",
+			Usage:   "when used, every site of the tenant is processed in turn instead of the --siteID, like a --siteFilter that matches every site",
+			EnvVars: []string{"ALL_SITES"},
+		},
+		&cli.BoolFlag{
+			Name:    "tenantScan",
+			Usage:   "when used with --siteFilter or --allSites, the stories of every matching site are counted with a single scan of the tenant's comments rather than a scan for each site, which holds the stories of every site in memory until their site is processed",
+			EnvVars: []string{"TENANT_SCAN"},
+		},
+		&cli.StringFlag{
+			Name:     "mongoDBURI",
+			Usage:    "URI for the MongoDB instance that we're refreshing counts on",
+			Required: true,
+			EnvVars:  []string{"MONGODB_URI"},
+		},
+		&cli.BoolFlag{
+			Name:    "dryRun",
+			Usage:   "when used, this tool will not write any data to the database",
+			EnvVars: []string{"DRY_RUN"},
+		},
+		&cli.BoolFlag{
+			Name:    "disableWatcher",
+			Usage:   "when used, this tool will not attempt to watch for changes to prevent races",
+			EnvVars: []string{"DISABLE_WATCHER"},
+		},
+		&cli.IntFlag{
+			Name:    "batchSize",
+			Usage:   "specify the batch size to write the update for the stories, between 1 and 100000 (larger values are capped at 100000)",
+			Value:   1000,
+			EnvVars: []string{"BATCH_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "targetBatchBytes",
+			Usage:   "tune the batch size after the first batch so each batch write is around this many bytes, based on the average update size (0 uses --batchSize)",
+			EnvVars: []string{"TARGET_BATCH_BYTES"},
+		},
+		&cli.DurationFlag{
+			Name:    "mongoDBConnectTimeout",
+			Usage:   "used to specify the timeout for connecting to MongoDB",
+			Value:   counts.DefaultTimeouts.Connect,
+			EnvVars: []string{"MONGODB_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "mongoDBPingTimeout",
+			Usage:   "used to specify the timeout for pinging MongoDB once connected (defaults to the --mongoDBConnectTimeout)",
+			EnvVars: []string{"MONGODB_PING_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "batchWriteTimeout",
+			Usage:   "used to specify the timeout for writing each batch of updates, outside of transactions (0 is no timeout)",
+			EnvVars: []string{"BATCH_WRITE_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "cursorCloseTimeout",
+			Usage:   "used to specify the timeout for closing each cursor once it has been read",
+			Value:   counts.DefaultTimeouts.CursorClose,
+			EnvVars: []string{"CURSOR_CLOSE_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "mongoDBDisconnectTimeout",
+			Usage:   "used to specify the timeout for disconnecting from MongoDB",
+			Value:   counts.DefaultTimeouts.Disconnect,
+			EnvVars: []string{"MONGODB_DISCONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "cleanupTimeout",
+			Usage:   "used to specify the timeout for each of the writes made once the run has ended, such as releasing the lock and recording the end of the run",
+			Value:   counts.DefaultTimeouts.Cleanup,
+			EnvVars: []string{"CLEANUP_TIMEOUT"},
+		},
+		&cli.Uint64Flag{
+			Name:    "maxPoolSize",
+			Usage:   "specify the most connections to MongoDB in the pool, which should be more than the --concurrency and --scanShards, overriding the --mongoDBURI (100 by default, 0 is unlimited)",
+			EnvVars: []string{"MAX_POOL_SIZE"},
+		},
+		&cli.Uint64Flag{
+			Name:    "minPoolSize",
+			Usage:   "specify the fewest connections to MongoDB kept in the pool, overriding the --mongoDBURI",
+			EnvVars: []string{"MIN_POOL_SIZE"},
+		},
+		&cli.Uint64Flag{
+			Name:    "maxConnecting",
+			Usage:   "specify the most connections to MongoDB that can be established at once, overriding the --mongoDBURI (2 by default)",
+			EnvVars: []string{"MAX_CONNECTING"},
+		},
+		&cli.BoolFlag{
+			Name:    "poolMonitor",
+			Usage:   "when used, the events of the connection pool (such as connections being created, checked out, or timing out waiting) will be logged at the debug level",
+			EnvVars: []string{"POOL_MONITOR"},
+		},
+		&cli.DurationFlag{
+			Name:    "maxReplicationLag",
+			Usage:   "specify the most replication lag of the secondaries before writes are paused until it recovers, this needs the clusterMonitor role, 0 disables this",
+			EnvVars: []string{"MAX_REPLICATION_LAG"},
+		},
+		&cli.DurationFlag{
+			Name:    "replicationLagInterval",
+			Usage:   "specify how often the replication lag is checked when --maxReplicationLag is used",
+			Value:   10 * time.Second,
+			EnvVars: []string{"REPLICATION_LAG_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "strictInvariants",
+			Usage:   "when used, this tool will fail instead of warn when the computed counts are inconsistent",
+			EnvVars: []string{"STRICT_INVARIANTS"},
+		},
+		&cli.StringFlag{
+			Name:    "outputCollectionSuffix",
+			Usage:   "when specified, writes will be made to collections with this suffix (e.g. stories_shadow) instead of the original collections",
+			EnvVars: []string{"OUTPUT_COLLECTION_SUFFIX"},
+		},
+		&cli.IntFlag{
+			Name:    "writeQueueDepth",
+			Usage:   "specify the number of batches that can be waiting to be written before scanning is paused",
+			Value:   4,
+			EnvVars: []string{"WRITE_QUEUE_DEPTH"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "specify the number of concurrent bulk writers",
+			Value:   1,
+			EnvVars: []string{"CONCURRENCY"},
+		},
+		&cli.BoolFlag{
+			Name:    "validateOnStartup",
+			Usage:   "when used, this tool will check that the deployment supports the watcher before processing",
+			EnvVars: []string{"VALIDATE_ON_STARTUP"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "excludeStatuses",
+			Usage:   "comma separated comment statuses that will not be counted, this will produce counts that differ from Coral's",
+			EnvVars: []string{"EXCLUDE_STATUSES"},
+		},
+		&cli.StringFlag{
+			Name:    "dlqCollection",
+			Usage:   "when specified (e.g. coral_counts_dlq), comments that can't be decoded and documents that can't be written will be recorded in this collection and skipped instead of stopping the run",
+			EnvVars: []string{"DLQ_COLLECTION"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "actionQueue",
+			Usage:   "additional moderation queue in the form queueName:actionKey:threshold that unmoderated comments are counted in when the action count exceeds the threshold",
+			EnvVars: []string{"ACTION_QUEUE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "statusQueue",
+			Usage:   "additional moderation queue in the form queueName:statuses or queueName:statuses:actionKey:threshold that comments with any of the |-separated statuses are counted in, optionally only when the action count exceeds the threshold",
+			EnvVars: []string{"STATUS_QUEUE"},
+		},
+		&cli.StringFlag{
+			Name:    "logLevel",
+			Usage:   "specify the level to log at (trace, debug, info, warn, error)",
+			Value:   "info",
+			EnvVars: []string{"LOG_LEVEL"},
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Usage:   "when used, only warnings, errors, and the start and end of run summary will be logged",
+			EnvVars: []string{"QUIET"},
+		},
+		&cli.StringFlag{
+			Name:    "commentFilter",
+			Usage:   "an extended JSON filter that the comments must also match to be counted, such as {\"importBatchID\": \"2021-01\"}, which produces partial counts",
+			EnvVars: []string{"COMMENT_FILTER"},
+		},
+		&cli.BoolFlag{
+			Name:    "incremental",
+			Usage:   "when used, only comments created since the last run will be counted and added to the stored counts, changes to existing comments are not reflected",
+			EnvVars: []string{"INCREMENTAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify",
+			Usage:   "when used, the counts of every story are computed and compared with the stored counts, and the stories that drifted are logged with the change in each count, nothing is written and the exit code is 2 if any drifted",
+			EnvVars: []string{"VERIFY"},
+		},
+		&cli.BoolFlag{
+			Name:    "verifyActions",
+			Usage:   "when used, a sample of comments will have their action counts compared against the commentActions collection and any differences logged",
+			EnvVars: []string{"VERIFY_ACTIONS"},
+		},
+		&cli.IntFlag{
+			Name:    "verifyActionsSampleSize",
+			Usage:   "specify the number of comments sampled from each of the comments collections by --verifyActions",
+			Value:   1000,
+			EnvVars: []string{"VERIFY_ACTIONS_SAMPLE_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "upsertStories",
+			Usage:   "when used, stories with comments but no story document will have a partial story document created with only their counts",
+			EnvVars: []string{"UPSERT_STORIES"},
+		},
+		&cli.StringFlag{
+			Name:    "reportFile",
+			Usage:   "when specified, a JSON report of the run will be written to this file",
+			EnvVars: []string{"REPORT_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "compareCollections",
+			Usage:   "when used, the counts in the collections with the --outputCollectionSuffix will be compared with the original collections instead of processing",
+			EnvVars: []string{"COMPARE_COLLECTIONS"},
+		},
+		&cli.IntFlag{
+			Name:    "verifySample",
+			Usage:   "specify a number of stories to recount after the initial pass to measure how far their counts drifted during the scan, 0 disables this",
+			EnvVars: []string{"VERIFY_SAMPLE"},
+		},
+		&cli.BoolFlag{
+			Name:    "monitor",
+			Usage:   "when used, a --verifySample of stories is recounted every --monitorInterval and the drift recorded in the metrics, until stopped, without ever writing, the exit code is 2 if the last check found drift",
+			EnvVars: []string{"MONITOR"},
+		},
+		&cli.DurationFlag{
+			Name:    "monitorInterval",
+			Usage:   "specify how often the counts are checked for drift with --monitor",
+			Value:   5 * time.Minute,
+			EnvVars: []string{"MONITOR_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "bestEffort",
+			Usage:   "when used, the site and users will still be processed when processing the stories fails (and the users when the site fails), and the errors are returned together after the initial pass, by default processing stops at the first error",
+			EnvVars: []string{"BEST_EFFORT"},
+		},
+		&cli.StringFlag{
+			Name:    "storyIDsFile",
+			Usage:   "specify a file of story ID's (one per line, blank lines and lines starting with # are skipped) to only process those stories, the change in their counts is applied to the site",
+			EnvVars: []string{"STORY_IDS_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "userIDsFile",
+			Usage:   "specify a file of user ID's (one per line, blank lines and lines starting with # are skipped) to only process those users",
+			EnvVars: []string{"USER_IDS_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "transactional",
+			Usage:   "when used, the stories and the site will be written in a single transaction, this requires a replica set and fails if the site's updates are larger than 16MB",
+			EnvVars: []string{"TRANSACTIONAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "optimisticWrites",
+			Usage:   "when used, each story is only written if its stored counts haven't changed since they were read, the stories that changed are recounted by the watcher",
+			EnvVars: []string{"OPTIMISTIC_WRITES"},
+		},
+		&cli.IntFlag{
+			Name:    "maxDirtyPasses",
+			Usage:   "specify the most dirty passes to run after the initial pass, so the run finishes on a site where comments keep changing, the stories and users still dirty after them are left for the next run, 0 runs passes until nothing is dirty",
+			EnvVars: []string{"MAX_DIRTY_PASSES"},
+		},
+		&cli.DurationFlag{
+			Name:    "dirtyFlushInterval",
+			Usage:   "specify how often the stories and users that change while the initial pass runs are recounted, rather than waiting for the initial pass to finish, they're recounted again after it, 0 disables this",
+			EnvVars: []string{"DIRTY_FLUSH_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "tenantTotals",
+			Usage:   "when used, the counts of the stories on every site of the tenant will be summed into the tenant_counts collection after the site is processed, the other sites are summed as they're stored",
+			EnvVars: []string{"TENANT_TOTALS"},
+		},
+		&cli.BoolFlag{
+			Name:    "snapshotHistory",
+			Usage:   "when used, a snapshot of the site's counts will be recorded in the site_count_history collection for the current day (in UTC) whenever every story on the site is counted, reruns on the same day replace that day's snapshot",
+			EnvVars: []string{"SNAPSHOT_HISTORY"},
+		},
+		&cli.BoolFlag{
+			Name:    "countBySource",
+			Usage:   "when used, the comments on each story and site will also be counted by their source (such as web, AMP, or app) under commentCounts.source",
+			EnvVars: []string{"COUNT_BY_SOURCE"},
+		},
+		&cli.IntFlag{
+			Name:    "limitStories",
+			Usage:   "when specified, at most this many stories will be counted for testing against a real site, as the site's counts would be partial this enables --dryRun, use with --scanSort=storyID to stop scanning once the limit is reached",
+			EnvVars: []string{"LIMIT_STORIES"},
+		},
+		&cli.IntFlag{
+			Name:    "limitUsers",
+			Usage:   "when specified, at most this many users will be counted for testing against a real site, this enables --dryRun",
+			EnvVars: []string{"LIMIT_USERS"},
+		},
+		&cli.BoolFlag{
+			Name:    "estimateChanges",
+			Usage:   "when used with --dryRun, the computed counts will be compared with the stored counts to report how many stories and users a real run would change, this reads every stored count",
+			EnvVars: []string{"ESTIMATE_CHANGES"},
+		},
+		&cli.BoolFlag{
+			Name:    "streamUsers",
+			Usage:   "when used, the comments are scanned in order of their author so each user is written once their comments are counted, bounding memory on sites with many users, this should have an index on {tenantID, siteID, authorID}",
+			EnvVars: []string{"STREAM_USERS"},
+		},
+		&cli.BoolFlag{
+			Name:    "preserveExtraFields",
+			Usage:   "when used, each known count is set on its own rather than replacing the whole commentCounts, so fields stored in it by Coral or plugins that aren't known are kept",
+			EnvVars: []string{"PRESERVE_EXTRA_FIELDS"},
+		},
+		&cli.BoolFlag{
+			Name:    "onlyDrift",
+			Usage:   "when used, the computed counts will be compared with the stored counts and only the stories and users whose counts have drifted will be written",
+			EnvVars: []string{"ONLY_DRIFT"},
+		},
+		&cli.StringFlag{
+			Name:    "actionKeyCase",
+			Usage:   "specify the casing (upper or lower) that the keys of each comment's actionCounts are normalized to before they're counted, so keys with inconsistent casing are counted together, Coral uses upper",
+			EnvVars: []string{"ACTION_KEY_CASE"},
+		},
+		&cli.BoolFlag{
+			Name:    "countRatings",
+			Usage:   "when used, the star ratings of the published comments on each story and site will be counted under commentCounts.ratings with their average and a histogram, changes to the counts need MongoDB 4.2 or newer",
+			EnvVars: []string{"COUNT_RATINGS"},
+		},
+		&cli.BoolFlag{
+			Name:    "stampRecomputeMarker",
+			Usage:   "when used, every story, site, and user update will also set " + counts.RecomputeAtField + " and " + counts.RecomputeRunIDField + " to the time and the ID of the run, so change stream consumers can tell recomputed counts apart",
+			EnvVars: []string{"STAMP_RECOMPUTE_MARKER"},
+		},
+		&cli.BoolFlag{
+			Name:    "countDistinctAuthors",
+			Usage:   "when used, the number of different users that commented on each story will be counted under commentCounts.distinctAuthors, this keeps every author on every story in memory while counting and isn't counted for the site",
+			EnvVars: []string{"COUNT_DISTINCT_AUTHORS"},
+		},
+		&cli.BoolFlag{
+			Name:    "countReportedApproved",
+			Usage:   "when used, approved comments that still have open flags will be counted in the reported queue and under moderationQueue.queues.reportedApproved, but not in the total",
+			EnvVars: []string{"COUNT_REPORTED_APPROVED"},
+		},
+		&cli.StringFlag{
+			Name:    "queuePolicy",
+			Usage:   "specify the rules for which flagged comments are counted in the reported queue to match the version of Coral, coral-v7 counts comments without a decision (and approved comments with --countReportedApproved), coral-v8 also counts approved and system withheld comments, and legacy counts comments without a decision by every flag they've had, ignoring the --openFlagsField",
+			Value:   counts.QueuePolicyCoralV7.Name,
+			EnvVars: []string{"QUEUE_POLICY"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "automatedFlagKeys",
+			Usage:   "the action keys of flags from automated detection, such as FLAG__COMMENT_DETECTED_TOXIC, when specified the reported queue is broken down into moderationQueue.queues.reportedAutomated and reportedUser",
+			EnvVars: []string{"AUTOMATED_FLAG_KEYS"},
+		},
+		&cli.StringFlag{
+			Name:    "readConcern",
+			Usage:   "specify the read concern (local, available, majority, or linearizable) used to scan comments, use majority on sharded clusters to avoid counting orphaned documents from chunk migrations",
+			EnvVars: []string{"READ_CONCERN"},
+		},
+		&cli.StringFlag{
+			Name:    "atClusterTime",
+			Usage:   "when specified, the comments will be scanned as they were at this cluster time (in RFC3339 format, such as 2021-01-02T03:00:00Z) with the snapshot read concern for a reproducible run, this requires MongoDB 5.0 or newer and the time must be within the snapshot history the server keeps (5 minutes by default)",
+			EnvVars: []string{"AT_CLUSTER_TIME"},
+		},
+		&cli.StringFlag{
+			Name:    "readPreference",
+			Usage:   "specify the read preference (primary, primaryPreferred, secondary, secondaryPreferred, or nearest) used to scan comments",
+			EnvVars: []string{"READ_PREFERENCE"},
+		},
+		&cli.BoolFlag{
+			Name:    "disableLock",
+			Usage:   "when used, the lock that prevents two runs from processing the same site at the same time will not be acquired",
+			EnvVars: []string{"DISABLE_LOCK"},
+		},
+		&cli.BoolFlag{
+			Name:    "disableRunHistory",
+			Usage:   "when used, the run will not be recorded in the " + counts.RunsCollection + " collection, where each run's status is kept with a heartbeat so crashed runs can be found",
+			EnvVars: []string{"DISABLE_RUN_HISTORY"},
+		},
+		&cli.DurationFlag{
+			Name:    "lockWait",
+			Usage:   "specify how long to wait for another run to release the lock for the site before failing",
+			EnvVars: []string{"LOCK_WAIT"},
+		},
+		&cli.StringFlag{
+			Name:    "metricsAddr",
+			Usage:   "when specified, a server is started on this host:port that exposes the metrics for Prometheus to scrape at /metrics",
+			EnvVars: []string{"METRICS_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "statsdAddr",
+			Usage:   "when specified, metrics will be sent to the statsd server at this host:port over UDP",
+			EnvVars: []string{"STATSD_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "statsdPrefix",
+			Usage:   "specify the prefix for the names of the metrics sent to statsd",
+			Value:   "coral_counts",
+			EnvVars: []string{"STATSD_PREFIX"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "kafkaBrokers",
+			Usage:   "when specified, the counts computed for each story and user will be published as JSON events to kafka using these brokers (host:port), can be repeated",
+			EnvVars: []string{"KAFKA_BROKERS"},
+		},
+		&cli.StringFlag{
+			Name:    "kafkaTopic",
+			Usage:   "specify the kafka topic that the count events are published to",
+			Value:   "coral-counts",
+			EnvVars: []string{"KAFKA_TOPIC"},
+		},
+		&cli.BoolFlag{
+			Name:    "kafkaOnly",
+			Usage:   "when used, the counts will only be published to kafka and not written to mongo",
+			EnvVars: []string{"KAFKA_ONLY"},
+		},
+		&cli.StringFlag{
+			Name:    "kafkaFailurePolicy",
+			Usage:   "specify what happens when count events can not be published to kafka, either warn to log them and continue or fail to stop processing",
+			Value:   "warn",
+			EnvVars: []string{"KAFKA_FAILURE_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:    "export",
+			Usage:   "when specified, the computed counts are written to this file as newline delimited JSON instead of to the database, use - for stdout",
+			EnvVars: []string{"EXPORT"},
+		},
+		&cli.BoolFlag{
+			Name:    "exportGzip",
+			Usage:   "when used, the --export is gzipped",
+			EnvVars: []string{"EXPORT_GZIP"},
+		},
+		&cli.StringFlag{
+			Name:    "coralAPIURL",
+			Usage:   "specify the url of a coral admin endpoint that the counts of each story and user are POSTed to instead of being written to the database, the site's counts are still written to the database",
+			EnvVars: []string{"CORAL_API_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "coralAPIToken",
+			Usage:   "specify the token sent as the bearer token with each request to the --coralAPIURL",
+			EnvVars: []string{"CORAL_API_TOKEN"},
+		},
+		&cli.DurationFlag{
+			Name:    "coralAPITimeout",
+			Usage:   "specify the timeout for each request to the --coralAPIURL",
+			Value:   30 * time.Second,
+			EnvVars: []string{"CORAL_API_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:    "coralAPIRetries",
+			Usage:   "specify the number of times to retry a request to the --coralAPIURL if it fails",
+			Value:   3,
+			EnvVars: []string{"CORAL_API_RETRIES"},
+		},
+		&cli.DurationFlag{
+			Name:    "maxCommentAge",
+			Usage:   "when specified, comments that have been waiting to be moderated for longer than this will be counted and logged for each story as a sign that the moderation queue is stuck",
+			EnvVars: []string{"MAX_COMMENT_AGE"},
+		},
+		&cli.BoolFlag{
+			Name:    "checkCreatedAt",
+			Usage:   "when used, comments whose createdAt is missing, in the future, or before the --earliestCreatedAt will be counted and logged with a sample of their ID's, as a sign of an import with the wrong timestamps",
+			EnvVars: []string{"CHECK_CREATED_AT"},
+		},
+		&cli.StringFlag{
+			Name:    "earliestCreatedAt",
+			Usage:   "specify the earliest createdAt (in RFC3339 format) that's plausible for a comment when --checkCreatedAt is used",
+			Value:   counts.DefaultRules().EarliestCreatedAt.Format(time.RFC3339),
+			EnvVars: []string{"EARLIEST_CREATED_AT"},
+		},
+		&cli.DurationFlag{
+			Name:    "slowQueryThreshold",
+			Usage:   "when specified, each bulk write or find batch that takes longer than this will be logged with its size and duration",
+			EnvVars: []string{"SLOW_QUERY_THRESHOLD"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "commentField",
+			Usage:   "specify the path a comment field is read from in the form field=path (such as storyID=story.id) for versions of Coral with different field names, can be repeated",
+			EnvVars: []string{"COMMENT_FIELD"},
+		},
+		&cli.BoolFlag{
+			Name:    "warmCache",
+			Usage:   "when used, the indexes for the site's comments and stories will be read into the database's cache before they're scanned, which can speed up the first run on a cold cluster",
+			EnvVars: []string{"WARM_CACHE"},
+		},
+		&cli.BoolFlag{
+			Name:    "aggregationMode",
+			Usage:   "when used, the comments on each story are counted by a $group aggregation on the server rather than in memory, so memory grows with the stories rather than the comments, this can't be used with the options that count sources, ratings, distinct authors, or stale comments",
+			EnvVars: []string{"AGGREGATION_MODE"},
+		},
+		&cli.IntFlag{
+			Name:    "scanShards",
+			Usage:   "specify the number of parallel cursors (up to 16) the scan of the site's comments is split across by story, which requires MongoDB 3.6",
+			Value:   1,
+			EnvVars: []string{"SCAN_SHARDS"},
+		},
+		&cli.BoolFlag{
+			Name:    "detectDuplicateStories",
+			Usage:   "when used, stories with more than one story document with the same ID will be logged before processing",
+			EnvVars: []string{"DETECT_DUPLICATE_STORIES"},
+		},
+		&cli.BoolFlag{
+			Name:    "detectOrphanedUsers",
+			Usage:   "when used, the authors of comments that don't have a user document will be logged and included in the report, their counts can't be written",
+			EnvVars: []string{"DETECT_ORPHANED_USERS"},
+		},
+		&cli.BoolFlag{
+			Name:    "strictOrphanedUsers",
+			Usage:   "when used, processing users will fail if any authors of comments don't have a user document, this implies --detectOrphanedUsers",
+			EnvVars: []string{"STRICT_ORPHANED_USERS"},
+		},
+		&cli.BoolFlag{
+			Name:    "updateDuplicateStories",
+			Usage:   "when used, every story document with a story's ID will be updated rather than only one, and the site's counts will only include each story once",
+			EnvVars: []string{"UPDATE_DUPLICATE_STORIES"},
+		},
+		&cli.BoolFlag{
+			Name:    "reportedOnly",
+			Usage:   "when used, only the reported moderation queue counts will be recounted from flagged comments, every other count is left as is",
+			EnvVars: []string{"REPORTED_ONLY"},
+		},
+		&cli.StringFlag{
+			Name:    "scanSort",
+			Usage:   "specify the order the comments are scanned in, either createdAt for sequential reads on a {tenantID, siteID, createdAt} index or storyID to keep each story's comments together, only one order can be used and by default the natural order is used",
+			EnvVars: []string{"SCAN_SORT"},
+		},
+		&cli.BoolFlag{
+			Name:    "summaryLine",
+			Usage:   "when used, a single line of key=value pairs describing the outcome of the run is printed to stdout when it finishes or fails",
+			EnvVars: []string{"SUMMARY_LINE"},
+		},
+		&cli.StringFlag{
+			Name:    "webhookURL",
+			Usage:   "when specified, a JSON summary of the run will be POSTed to this URL when the run finishes or fails",
+			EnvVars: []string{"WEBHOOK_URL"},
+		},
+		&cli.DurationFlag{
+			Name:    "webhookTimeout",
+			Usage:   "specify the timeout for each attempt to notify the --webhookURL",
+			Value:   10 * time.Second,
+			EnvVars: []string{"WEBHOOK_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:    "webhookRetries",
+			Usage:   "specify the number of times to retry notifying the --webhookURL if it fails",
+			Value:   3,
+			EnvVars: []string{"WEBHOOK_RETRIES"},
+		},
+		&cli.StringFlag{
+			Name:    "openFlagsField",
+			Usage:   "when specified, comments will only be counted in the reported queue when the count of unresolved flags at this path is greater than zero, comments without the field fall back to their FLAG action count",
+			EnvVars: []string{"OPEN_FLAGS_FIELD"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "commentsCollections",
+			Usage:   "specify the collections the comments are scanned from, which can be glob patterns such as comments_* for comments partitioned by date, and the counts from each collection are added together, can be repeated",
+			EnvVars: []string{"COMMENTS_COLLECTIONS"},
+		},
+		&cli.StringFlag{
+			Name:    "selfTest",
+			Usage:   "specify the name of an empty throwaway database to seed with a small site, process with the default counting rules, check the counts, and then drop, instead of processing the --siteID",
+			EnvVars: []string{"SELF_TEST"},
+		},
+		&cli.StringFlag{
+			Name:    "auditCollection",
+			Usage:   "when specified, a record of every story and user count changed by the run, with its old and new value and the run's ID, will be written to this collection",
+			EnvVars: []string{"AUDIT_COLLECTION"},
+		},
+		&cli.StringFlag{
+			Name:    "usersFilter",
+			Usage:   "specify a filter on the users collection as extended JSON (such as {\"createdAt\": {\"$gte\": {\"$date\": \"2024-01-01T00:00:00Z\"}}}) to only process the users that match it rather than every user",
+			EnvVars: []string{"USERS_FILTER"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "usersRole",
+			Usage:   "specify a role (such as STAFF) to only process the users with that role rather than every user, can be repeated",
+			EnvVars: []string{"USERS_ROLE"},
+		},
+		&cli.DurationFlag{
+			Name:    "usersCommentedWithin",
+			Usage:   "specify a duration (such as 24h) to only process the users who have commented on the site within it rather than every user",
+			EnvVars: []string{"USERS_COMMENTED_WITHIN"},
+		},
+		&cli.BoolFlag{
+			Name:    "readOnly",
+			Usage:   "when used, the run will never write to the database and will fail if a write is attempted, it enables --dryRun and doesn't require the primary so it can be used with read only credentials",
+			EnvVars: []string{"READ_ONLY"},
+		},
+		&cli.StringFlag{
+			Name:    "storyIDPattern",
+			Usage:   "when specified, each match of this regular expression in the story ID of a comment will be replaced with the --storyIDReplacement before it's counted, so the same story with different ID formats is counted once, the story documents must use the normalized ID's",
+			EnvVars: []string{"STORY_ID_PATTERN"},
+		},
+		&cli.StringFlag{
+			Name:    "storyIDReplacement",
+			Usage:   "specify the replacement for the matches of the --storyIDPattern, which can refer to its groups like $1",
+			EnvVars: []string{"STORY_ID_REPLACEMENT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "storyIDMapping",
+			Usage:   "specify a story ID that is counted as another in the form from=to, applied after the --storyIDPattern, can be repeated",
+			EnvVars: []string{"STORY_ID_MAPPING"},
+		},
+		&cli.StringFlag{
+			Name:    "watcherEventLog",
+			Usage:   "specify a file that every event received by the watcher is appended to as newline delimited JSON, to debug which stories and users were marked as dirty",
+			EnvVars: []string{"WATCHER_EVENT_LOG"},
+		},
+		&cli.StringFlag{
+			Name:    "watcherStartAtTime",
+			Usage:   "when specified, the watcher will replay the changes to comments since this time (in RFC3339 format, such as 2021-01-02T03:00:00Z) and mark them as dirty, the time must still be within the oplog",
+			EnvVars: []string{"WATCHER_START_AT_TIME"},
+		},
+		&cli.StringFlag{
+			Name:    "since",
+			Usage:   "when specified, only the stories and users of the comments updated (or created, when they have no updatedAt) since this time (in RFC3339 format, such as 2021-01-02T03:00:00Z) are recounted rather than every story and user, to catch up on the changes made while the tool wasn't running",
+			EnvVars: []string{"SINCE"},
+		},
+		&cli.DurationFlag{
+			Name:    "dumpDirty",
+			Usage:   "when specified, the watcher is run for this long and the stories and users it marked as dirty are printed as JSON, without processing them",
+			EnvVars: []string{"DUMP_DIRTY"},
+		},
+		&cli.IntFlag{
+			Name:    "topStories",
+			Usage:   "specify how many of the stories with the most comments are logged with their comments by status once every story has been counted, 0 disables this",
+			EnvVars: []string{"TOP_STORIES"},
+		},
+		&cli.BoolFlag{
+			Name:    "userDeltas",
+			Usage:   "when used, the changes that changed comments made to their authors' counts will be applied to the dirty users rather than recounting them, which requires MongoDB 6.0 and pre-images and post-images enabled on the comments collection, and is checked before processing",
+			EnvVars: []string{"USER_DELTAS"},
+		},
+		&cli.BoolFlag{
+			Name:    "watchDeletes",
+			Usage:   "when used, the stories and authors of the comments deleted while the site is processed are marked as dirty, which requires MongoDB 6.0 and pre-images enabled on the comments collection",
+			EnvVars: []string{"WATCH_DELETES"},
+		},
+	}
+}
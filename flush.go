@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"coral-counts/counts"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// dirtyFlusher periodically recounts the stories and users that the watcher
+// marked as dirty while the initial pass runs, so changes on active sites are
+// reflected without waiting for the whole initial pass to finish. Only one flush
+// runs at a time, and each flush only recounts what changed since the last.
+type dirtyFlusher struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	// flushing is held while a flush runs, and while the flusher is paused.
+	flushing sync.Mutex
+
+	// passes and err are only read after done is closed.
+	passes []PassReport
+	err    error
+}
+
+// startDirtyFlusher will start flushing the watcher every interval, recounting
+// the dirty stories and users with process.
+func startDirtyFlusher(ctx context.Context, watcher *counts.Watcher, interval time.Duration, process func(ctx context.Context, dirty *counts.DirtyKeys, stats *PassReport) error) *dirtyFlusher {
+	f := &dirtyFlusher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(f.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := f.flush(ctx, watcher, process); err != nil {
+				f.err = errors.Wrap(err, "could not flush dirty documents")
+				return
+			}
+		}
+	}()
+
+	return f
+}
+
+// flush will recount the stories and users that changed since the last flush,
+// unless the flusher is paused, in which case it waits to be resumed.
+func (f *dirtyFlusher) flush(ctx context.Context, watcher *counts.Watcher, process func(ctx context.Context, dirty *counts.DirtyKeys, stats *PassReport) error) error {
+	f.flushing.Lock()
+	defer f.flushing.Unlock()
+
+	dirty := watcher.Flush()
+	if dirty == nil {
+		return nil
+	}
+
+	started := time.Now()
+	stats := PassReport{
+		Pass:    len(f.passes) + 1,
+		Flush:   true,
+		Stories: len(dirty.StoryIDs),
+		Users:   len(dirty.UserIDs),
+	}
+
+	if err := process(ctx, dirty, &stats); err != nil {
+		return err
+	}
+
+	stats.Took = time.Since(started).String()
+	f.passes = append(f.passes, stats)
+
+	logrus.WithFields(logrus.Fields{
+		"flush":           stats.Pass,
+		"stories":         stats.Stories,
+		"users":           stats.Users,
+		"modifiedStories": stats.ModifiedStories,
+		"modifiedUsers":   stats.ModifiedUsers,
+		"took":            stats.Took,
+	}).Info("flushed dirty documents during the initial pass")
+
+	return nil
+}
+
+// Pause will wait for a flush that is running to finish, and stop any more from
+// running until Resume is called. The site is summed from its stories while the
+// flusher is paused, as a flush rewriting a story and applying its change to the
+// site while the site is summed can count the change twice. It's safe to call on
+// a nil dirtyFlusher.
+func (f *dirtyFlusher) Pause() {
+	if f == nil {
+		return
+	}
+
+	f.flushing.Lock()
+}
+
+// Resume will let the flushes run again after Pause. It's safe to call on a nil
+// dirtyFlusher.
+func (f *dirtyFlusher) Resume() {
+	if f == nil {
+		return
+	}
+
+	f.flushing.Unlock()
+}
+
+// Stop will stop flushing, waiting for a flush that is running to finish, and
+// return the passes made by each flush. It's safe to call more than once.
+func (f *dirtyFlusher) Stop() ([]PassReport, error) {
+	f.once.Do(func() {
+		close(f.stop)
+	})
+	<-f.done
+
+	return f.passes, f.err
+}
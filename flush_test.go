@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"coral-counts/counts"
+)
+
+// TestDirtyFlusherPause checks that summing the site never interleaves with a
+// flush: Pause waits for the flush that is running, and no flush starts until
+// Resume.
+func TestDirtyFlusherPause(t *testing.T) {
+	watcher := counts.NewWatcher(nil, "tenant", "site", counts.DefaultRules())
+	watcher.MarkStoriesDirty([]string{"a"})
+
+	started := make(chan []string, 10)
+	release := make(chan struct{})
+	var summing int32
+
+	flusher := startDirtyFlusher(context.Background(), watcher, time.Millisecond, func(ctx context.Context, dirty *counts.DirtyKeys, stats *PassReport) error {
+		if atomic.LoadInt32(&summing) == 1 {
+			t.Error("flush ran while the site was being summed")
+		}
+
+		started <- dirty.StoryIDs
+		<-release
+
+		return nil
+	})
+
+	// Wait for the first flush to start, and then pause while it's running.
+	if got := <-started; len(got) != 1 || got[0] != "a" {
+		t.Fatalf("expected the first flush to recount [a], got %v", got)
+	}
+
+	paused := make(chan struct{})
+	go func() {
+		flusher.Pause()
+		close(paused)
+	}()
+
+	select {
+	case <-paused:
+		t.Fatal("Pause returned while a flush was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	<-paused
+
+	// Nothing is flushed while the site is summed, even once there's more to
+	// flush.
+	atomic.StoreInt32(&summing, 1)
+	watcher.MarkStoriesDirty([]string{"b"})
+
+	select {
+	case got := <-started:
+		t.Fatalf("flush of %v started while paused", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&summing, 0)
+	flusher.Resume()
+
+	select {
+	case got := <-started:
+		if len(got) != 1 || got[0] != "b" {
+			t.Fatalf("expected the flush after Resume to recount [b], got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush didn't run after Resume")
+	}
+
+	passes, err := flusher.Stop()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(passes) != 2 {
+		t.Fatalf("expected 2 flushes, got %d", len(passes))
+	}
+}
+
+// TestDirtyFlusherNil checks that a flusher that wasn't started can be paused
+// and resumed.
+func TestDirtyFlusherNil(t *testing.T) {
+	var flusher *dirtyFlusher
+
+	flusher.Pause()
+	flusher.Resume()
+}
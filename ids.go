@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+
+	"coral-counts/counts"
+
+	"github.com/pkg/errors"
+)
+
+// readIDFile will read the ID's from the file at path, one per line. Each line
+// is trimmed of whitespace (including the carriage return of CRLF line endings),
+// blank lines and lines starting with # are skipped, and repeated ID's are only
+// returned once, in the order they first appear.
+func readIDFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the id file")
+	}
+	defer file.Close()
+
+	var ids []string
+	seen := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" || strings.HasPrefix(id, "#") {
+			continue
+		}
+
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		ids = append(ids, id)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read the id file %s", path)
+	}
+
+	return ids, nil
+}
+
+// chunkIDs will split the ID's into chunks of at most size, so each chunk can be
+// queried with a bounded $in.
+func chunkIDs(ids []string, size int) [][]string {
+	var chunks [][]string
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		chunks = append(chunks, ids[start:end])
+	}
+
+	return chunks
+}
+
+// processStoryIDs will process the stories in chunks, applying the change in
+// their counts to the site after each chunk.
+func processStoryIDs(ctx context.Context, p *counts.Processor, storyIDs []string) (*counts.StoriesResult, error) {
+	var result counts.StoriesResult
+	for _, chunk := range chunkIDs(storyIDs, p.BatchSize) {
+		var (
+			res *counts.StoriesResult
+			err error
+		)
+		if p.Transactional {
+			res, err = p.StoriesTransaction(ctx, chunk)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not process stories and site")
+			}
+		} else {
+			res, err = p.Stories(ctx, chunk)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not process stories")
+			}
+
+			if err := p.SiteDelta(ctx, res.Delta); err != nil {
+				return nil, errors.Wrap(err, "could not process site")
+			}
+		}
+
+		result.Stories += res.Stories
+		result.StaleComments += res.StaleComments
+		result.CreatedAt.Merge(&res.CreatedAt)
+		result.Drifted += res.Drifted
+		result.Approved += res.Approved
+		result.Changed += res.Changed
+		result.Batches += res.Batches
+		result.Updates += res.Updates
+		result.Modified += res.Modified
+		result.Failed += res.Failed
+		result.Conflicted = append(result.Conflicted, res.Conflicted...)
+	}
+
+	return &result, nil
+}
+
+// processUserIDs will process the users in chunks.
+func processUserIDs(ctx context.Context, p *counts.Processor, userIDs []string) (*counts.UsersResult, error) {
+	var result counts.UsersResult
+	for _, chunk := range chunkIDs(userIDs, p.BatchSize) {
+		res, err := p.Users(ctx, chunk)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not process users")
+		}
+
+		result.Users += res.Users
+		result.Drifted += res.Drifted
+		result.Approved += res.Approved
+		result.Orphaned += res.Orphaned
+		result.Changed += res.Changed
+		result.Batches += res.Batches
+		result.Updates += res.Updates
+		result.Modified += res.Modified
+		result.Failed += res.Failed
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadIDFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{"empty", "", nil},
+		{"one per line", "a\nb\nc\n", []string{"a", "b", "c"}},
+		{"no trailing newline", "a\nb", []string{"a", "b"}},
+		{"crlf", "a\r\nb\r\nc\r\n", []string{"a", "b", "c"}},
+		{"whitespace", "  a \n\tb\t\n", []string{"a", "b"}},
+		{"blank lines", "\na\n\n  \nb\n", []string{"a", "b"}},
+		{"comments", "# stories\na\n  # skipped\nb\n", []string{"a", "b"}},
+		{"duplicates keep the first position", "b\na\nb\r\nc\na\n", []string{"b", "a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ids.txt")
+			if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readIDFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readIDFile(%q) = %q, want %q", tt.contents, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := readIDFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestChunkIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		size int
+		want [][]string
+	}{
+		{"none", nil, 2, nil},
+		{"smaller than a chunk", []string{"a"}, 2, [][]string{{"a"}}},
+		{"exact chunks", []string{"a", "b", "c", "d"}, 2, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"partial last chunk", []string{"a", "b", "c"}, 2, [][]string{{"a", "b"}, {"c"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkIDs(tt.ids, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunkIDs(%q, %d) = %q, want %q", tt.ids, tt.size, got, tt.want)
+			}
+		})
+	}
+}
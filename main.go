@@ -6,158 +6,1043 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"golang.org/x/sync/errgroup"
 )
 
-func run(c *cli.Context) error {
-	// Grab the parameters from the flags.
-	tenantID := c.String("tenantID")
-	siteID := c.String("siteID")
-	databaseURI := c.String("mongoDBURI")
-	dryRun := c.Bool("dryRun")
-	disableWatcher := c.Bool("disableWatcher")
-	mongoDBConnectTimeout := c.Duration("mongoDBConnectTimeout")
+// always will return a logger that logs at the info level regardless of the
+// level configured on the standard logger. It is used for the lines that must be
+// emitted even when --quiet is used.
+func always() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(logrus.StandardLogger().Out)
+	logger.SetFormatter(logrus.StandardLogger().Formatter)
 
-	// Set the batch size.
-	counts.MaxBatchWriteSize = c.Int("batchSize")
+	return logger
+}
+
+// runWithWebhook will run the --siteID, or each of the sites matching the
+// --siteFilter (or every site with --allSites), and then notify the
+// --webhookURL of the outcome of each.
+func runWithWebhook(c *cli.Context) error {
+	// Configure the log level.
+	level, err := logrus.ParseLevel(c.String("logLevel"))
+	if err != nil {
+		return errors.Wrap(err, "can not parse the --logLevel")
+	}
+	if c.Bool("quiet") {
+		level = logrus.WarnLevel
+	}
+	logrus.SetLevel(level)
 
-	// Parse the database name out of the path component of the uri.
+	if _, err := parseTimeouts(c); err != nil {
+		return err
+	}
+
+	// Identify the run once, so every site processed by it is stamped, locked,
+	// audited, and recorded with the same run ID.
+	runID, err := newRunID()
+	if err != nil {
+		return err
+	}
+
+	// Every site of the tenant is processed as the sites matching an empty
+	// filter.
+	if c.Bool("allSites") {
+		if c.String("siteID") != "" {
+			return errors.New("--siteID can not be used with --allSites")
+		}
+		if c.String("siteFilter") != "" {
+			return errors.New("--siteFilter can not be used with --allSites")
+		}
+		if err := c.Set("siteFilter", "{}"); err != nil {
+			return errors.Wrap(err, "could not set the --siteFilter")
+		}
+	}
+
+	if c.String("siteFilter") == "" && c.String("siteID") == "" {
+		return errors.New("--siteID is required unless --siteFilter or --allSites is used")
+	}
+	if c.String("siteFilter") != "" && c.String("siteID") != "" {
+		return errors.New("--siteID can not be used with --siteFilter")
+	}
+	if c.Bool("tenantScan") && c.String("siteFilter") == "" {
+		return errors.New("--tenantScan requires --siteFilter or --allSites")
+	}
+
+	// Record the metrics of every site processed by the run.
+	metrics, closeMetrics, err := openMetrics(c)
+	if err != nil {
+		return err
+	}
+	defer closeMetrics()
+
+	if c.Bool("monitor") {
+		return runMonitor(c, metrics)
+	}
+
+	if c.String("siteFilter") != "" {
+		return runSites(c, runID, metrics)
+	}
+
+	return runSite(c, nil, runID, metrics, nil)
+}
+
+// parseDatabaseName will parse the database name out of the path component of
+// the uri.
+func parseDatabaseName(databaseURI string) (string, error) {
 	u, err := url.Parse(databaseURI)
 	if err != nil {
-		return errors.Wrap(err, "can not parse the --mongoDBURI")
+		return "", errors.Wrap(err, "can not parse the --mongoDBURI")
 	}
 	if len(u.Path) < 2 {
-		return errors.Errorf("expected database name in path component of --mongoDBURI, found %s", u.Path)
+		return "", errors.Errorf("expected database name in path component of --mongoDBURI, found %s", u.Path)
 	}
-	databaseName := u.Path[1:]
 
-	// Create a context for connecting to MongoDB.
-	ctx, cancel := context.WithTimeout(context.Background(), mongoDBConnectTimeout)
-	defer cancel()
+	return u.Path[1:], nil
+}
+
+// runSite will process the --siteID as part of the run, notifying the webhook
+// of the outcome. The tenant scan is set when the site's stories are counted
+// with the other sites of the run.
+func runSite(c *cli.Context, conn *connection, runID string, metrics counts.Recorder, tenantScan *counts.TenantScan) error {
+	var report RunReport
+
+	started := time.Now()
+	err := run(c, conn, runID, metrics, tenantScan, &report)
+
+	if url := c.String("webhookURL"); url != "" {
+		payload := newWebhookPayload(c.String("tenantID"), c.String("siteID"), time.Since(started), &report, err)
+		if err := notifyWebhook(url, c.Duration("webhookTimeout"), c.Int("webhookRetries"), payload); err != nil {
+			logrus.WithError(err).Error("could not notify webhook")
+		}
+	}
+
+	// Print the summary line regardless of the log level and format.
+	if c.Bool("summaryLine") {
+		fmt.Println(summaryLine(c.String("tenantID"), c.String("siteID"), time.Since(started), &report, err))
+	}
+
+	return err
+}
+
+// run will process the --siteID as part of the run with the run ID, recording
+// the metrics with the recorder and what was processed in the report.
+func run(c *cli.Context, conn *connection, runID string, metrics counts.Recorder, tenantScan *counts.TenantScan, report *RunReport) (err error) {
+	// Seed, process, and check a throwaway database instead of processing.
+	if database := c.String("selfTest"); database != "" {
+		if c.Bool("readOnly") {
+			return errors.New("--selfTest writes to the database and can not be used with --readOnly")
+		}
+
+		return runSelfTest(c, database, runID)
+	}
+
+	opts, err := parseRunOptions(c)
+	if err != nil {
+		return err
+	}
 
-	// Connect to MongoDB now.
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(databaseURI))
+	closeOutputs, err := openOutputs(c, opts)
 	if err != nil {
-		return errors.Wrap(err, "cannot connect to mongo")
+		return err
 	}
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+		if closeErr := closeOutputs(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
 
-		if err := client.Disconnect(ctx); err != nil {
-			panic(err)
+	// Stop processing when a signal is received, the writes that are under way
+	// are finished before the run returns so none are left half applied.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	root, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	go func() {
+		select {
+		case sig := <-signals:
+			always().WithField("signal", sig).Warn("graceful shutdown requested, stopping after the writes under way are finished")
+			shutdown()
+		case <-root.Done():
 		}
 	}()
 
-	// Ensure we're connected to the primary.
-	ctx, cancel = context.WithTimeout(context.Background(), mongoDBConnectTimeout)
-	defer cancel()
+	// The errors from processing that was stopped by a signal are because of
+	// the shutdown, rather than a failure.
+	defer func() {
+		if root.Err() != nil {
+			err = stopped(err)
+		}
+	}()
+
+	// Connect to MongoDB, unless the connection is shared with the runs of the
+	// other sites.
+	if conn == nil {
+		ping, err := pingPreference(c)
+		if err != nil {
+			return err
+		}
 
-	if err := client.Ping(ctx, readpref.Primary()); err != nil {
-		return errors.Wrap(err, "cannot ping mongo")
+		conn, err = connect(c, opts.readOnly, ping)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
 	}
 
-	// Get the database handle for the database we're connecting to.
-	db := client.Database(databaseName)
+	// Assert that none of the writes over the connection were from this run.
+	if opts.readOnly {
+		if conn.writes == nil {
+			return errors.New("--readOnly can only be used with a read only connection")
+		}
 
-	// Create the watcher, and start it.
-	watcher := counts.NewWatcher(db, tenantID, siteID)
+		attempted := conn.writes.Writes()
+		defer func() {
+			if writes := conn.writes.Writes() - attempted; err == nil && writes > 0 {
+				err = errors.Errorf("%d writes were attempted while --readOnly is enabled", writes)
+			}
+		}()
+	}
 
-	if !disableWatcher {
-		logrus.Info("starting watcher")
+	db := conn.db
+	p := opts.processor
+	p.DB = db
+	p.RunID = runID
+	p.Metrics = metrics
+	p.Timeouts = conn.timeouts
+	p.TenantScan = tenantScan
 
-		// Start monitoring for updates to the comments collection to ensure that we
-		// can tag any stories/sites that might have gotten dirty since we started.
-		ctx, cancel := context.WithCancel(context.Background())
+	if err := checkDeployment(root, c, conn, opts); err != nil {
+		return err
+	}
+
+	// Print the stories and users the watcher marks as dirty over a window
+	// instead of processing.
+	if window := c.Duration("dumpDirty"); window > 0 {
+		if opts.disableWatcher {
+			return errors.New("--dumpDirty can not be used with --disableWatcher or the options that disable the watcher")
+		}
+		if c.String("export") == "-" {
+			return errors.New("--dumpDirty can not be used when the --export is written to stdout")
+		}
+
+		return dumpDirty(opts.newWatcher(), opts.tenantID, opts.siteID, window)
+	}
+
+	// Compare the counts from a previous run written to the suffixed collections
+	// with the counts in the original collections instead of processing.
+	if c.Bool("compareCollections") {
+		return compareCollections(root, p)
+	}
+
+	// Track if any of the verifications found drift so it's reflected in the
+	// exit code.
+	var drifted bool
+
+	// Check a sample of the comment action counts to diagnose any problems with
+	// the counts the story counts are derived from.
+	if c.Bool("verifyActions") {
+		ctx, cancel := context.WithCancel(root)
+		defer cancel()
+
+		_, mismatched, err := p.VerifyActionCounts(ctx, c.Int("verifyActionsSampleSize"))
+		if err != nil {
+			return errors.Wrap(err, "could not verify action counts")
+		}
+
+		drifted = drifted || mismatched > 0
+	}
+
+	// Only compare the counts of the stories with the stored counts, and report
+	// the drift without writing anything.
+	if c.Bool("verify") {
+		return verifyStories(root, p, drifted)
+	}
+
+	// Acquire the lock for the site so another run can't process it at the same
+	// time. Dry runs don't write, so they don't need the lock.
+	if opts.dryRun {
+		logrus.Info("not acquiring the lock for the site as --dryRun is enabled")
+	} else if c.Bool("disableLock") {
+		logrus.Warn("not acquiring the lock for the site, --disableLock was used")
+	} else {
+		ctx, cancel := context.WithCancel(root)
 		defer cancel()
 
-		go func() {
-			// Cancel the context also if the watcher exits early.
+		lock, err := counts.AcquireLock(ctx, db, runID, opts.tenantID, opts.siteID, counts.DefaultLockTTL, c.Duration("lockWait"))
+		if err != nil {
+			return errors.Wrap(err, "could not acquire the lock for the site")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), conn.timeouts.Cleanup)
 			defer cancel()
 
-			if err := watcher.Watch(ctx); err != nil {
-				logrus.WithError(err).Warn("watcher has failed to start")
+			if err := lock.Release(ctx); err != nil {
+				logrus.WithError(err).Warn("could not release the lock for the site")
 			}
 		}()
+	}
+
+	// Record the run so operators can see the history of the runs on the site,
+	// and which of them crashed. Dry runs don't write, so they aren't recorded.
+	if !opts.dryRun && !c.Bool("disableRunHistory") {
+		ctx, cancel := context.WithTimeout(context.Background(), conn.timeouts.Ping)
+		defer cancel()
+
+		tracked, startErr := counts.StartRun(ctx, db, runID, opts.tenantID, opts.siteID, counts.DefaultLockTTL)
+		if startErr != nil {
+			return errors.Wrap(startErr, "could not record the run")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), conn.timeouts.Cleanup)
+			defer cancel()
+
+			// The run's error is the one returned, so it's read once the run ends.
+			if finishErr := tracked.Finish(ctx, err); finishErr != nil {
+				logrus.WithError(finishErr).Warn("could not record the end of the run")
+			}
+		}()
+	}
+
+	// Recount only the reported queue instead of every count.
+	if c.Bool("reportedOnly") {
+		return processReported(root, p, drifted)
+	}
+
+	// When processing incrementally and the site has been processed before, only
+	// the comments created since then need to be counted.
+	if opts.incremental {
+		processed, err := processIncremental(root, p, drifted)
+		if processed || err != nil {
+			return err
+		}
+	}
+
+	return processWithWatcher(root, c, p, opts, drifted, report)
+}
+
+// checkDeployment will check that the deployment can support the run before
+// processing starts, so it doesn't fail part way through, and start monitoring
+// the replication lag when the writes should be paused while the secondaries
+// are behind. The lag is monitored until the root context is canceled.
+func checkDeployment(root context.Context, c *cli.Context, conn *connection, opts *runOptions) error {
+	// The checks of the deployment before processing are bounded like the ping.
+	ctx, cancel := context.WithTimeout(context.Background(), conn.timeouts.Ping)
+	defer cancel()
+
+	// Pause the writes while the secondaries are too far behind.
+	if maxLag := c.Duration("maxReplicationLag"); maxLag > 0 {
+		interval := c.Duration("replicationLagInterval")
+		if interval <= 0 {
+			return errors.Errorf("expected --replicationLagInterval to be positive, found %s", interval)
+		}
+
+		if opts.dryRun {
+			logrus.Info("not monitoring the replication lag as --dryRun is enabled")
+		} else {
+			opts.processor.Lag = counts.NewLagMonitor(counts.ReplicationLag(conn.client), maxLag, interval)
+			opts.processor.Lag.Metrics = opts.processor.Metrics
+
+			go opts.processor.Lag.Run(root)
+		}
+	}
+
+	// Validate that the deployment supports the watcher before we start so we
+	// don't fail part way through the run. With --userDeltas the changes are
+	// only matched on their post-images, so the changes to a collection without
+	// them would be silently dropped, and it's always validated. The pre-images
+	// are needed by both --userDeltas and --watchDeletes.
+	if c.Bool("validateOnStartup") || opts.userDeltas {
+		if opts.disableWatcher {
+			logrus.Info("not validating watcher support, --disableWatcher was used")
+		} else if err := counts.ValidateWatcherSupport(ctx, conn.db, opts.userDeltas || opts.watchDeletes); err != nil {
+			return errors.Wrap(err, "deployment does not support the watcher")
+		}
+	}
+
+	// Check that the changes the watcher replays are still in the oplog.
+	if !opts.watcherStartAtTime.IsZero() {
+		oldest, err := counts.OldestOplogTime(ctx, conn.db)
+		if err != nil {
+			logrus.WithError(err).Warn("could not check that the --watcherStartAtTime is within the oplog window, changes from before the oldest oplog entry will not be replayed")
+		} else if opts.watcherStartAtTime.Before(oldest) {
+			logrus.WithFields(logrus.Fields{
+				"watcherStartAtTime": opts.watcherStartAtTime,
+				"oldestOplogEntry":   oldest,
+			}).Warn("the --watcherStartAtTime is older than the oldest oplog entry, the changes from before then may have rolled off and the watcher may fail to start")
+		}
+	}
+
+	return nil
+}
+
+// compareCollections will compare the counts from a previous run written to
+// the suffixed collections with the counts in the original collections.
+func compareCollections(root context.Context, p *counts.Processor) error {
+	if p.OutputCollectionSuffix == "" {
+		return errors.New("--compareCollections requires the --outputCollectionSuffix of the collections to compare")
+	}
+
+	ctx, cancel := context.WithCancel(root)
+	defer cancel()
+
+	results, err := counts.CompareCollections(ctx, p.DB, p.TenantID, p.SiteID, p.OutputCollectionSuffix, p.Timeouts.CursorClose)
+	if err != nil {
+		return errors.Wrap(err, "could not compare collections")
+	}
+
+	var compared, mismatched, missing int
+	for _, result := range results {
+		compared += result.Compared
+		mismatched += result.Mismatched
+		missing += result.Missing
+	}
+
+	always().WithFields(logrus.Fields{
+		"compared":   compared,
+		"mismatched": mismatched,
+		"missing":    missing,
+	}).Info("finished comparing collections")
+
+	if mismatched > 0 || missing > 0 {
+		return errDrift
+	}
+
+	return nil
+}
+
+// verifyStories will compare the counts of the stories with the stored counts,
+// and report the drift without writing anything. The drift found by the
+// earlier verifications is reported as well.
+func verifyStories(root context.Context, p *counts.Processor, drifted bool) error {
+	ctx, cancel := context.WithCancel(root)
+	defer cancel()
+
+	started := time.Now()
+	always().WithFields(logrus.Fields{
+		"tenantID": p.TenantID,
+		"siteID":   p.SiteID,
+	}).Info("started verifying story counts")
+
+	checked, driftedStories, err := p.VerifyStories(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not verify story counts")
+	}
+
+	always().WithFields(logrus.Fields{
+		"stories": checked,
+		"drifted": driftedStories,
+		"took":    time.Since(started).String(),
+	}).Info("finished verifying story counts")
+
+	if drifted || driftedStories > 0 {
+		return errDrift
+	}
+
+	return nil
+}
+
+// processReported will recount only the reported queue instead of every count.
+func processReported(root context.Context, p *counts.Processor, drifted bool) error {
+	ctx, cancel := context.WithCancel(root)
+	defer cancel()
+
+	started := time.Now()
+	always().WithFields(logrus.Fields{
+		"tenantID": p.TenantID,
+		"siteID":   p.SiteID,
+	}).Info("started processing reported queue")
+
+	if err := p.Reported(ctx); err != nil {
+		return errors.Wrap(err, "could not process reported queue")
+	}
+
+	always().WithField("took", time.Since(started).String()).Info("finished processing")
+
+	if drifted {
+		return errDrift
+	}
+
+	return nil
+}
+
+// processIncremental will count only the comments created since the site was
+// last processed, returning true when it did. The watcher isn't used as the
+// changes it would catch will be counted on the next run. When the site hasn't
+// been processed before, nothing is processed and every comment should be
+// counted instead.
+func processIncremental(root context.Context, p *counts.Processor, drifted bool) (bool, error) {
+	ctx, cancel := context.WithCancel(root)
+	defer cancel()
+
+	mark, err := counts.LoadHighWaterMark(ctx, p.DB, p.TenantID, p.SiteID)
+	if err != nil {
+		return false, errors.Wrap(err, "could not load high-water mark")
+	}
+
+	if mark == nil {
+		if len(p.CommentFilter) > 0 && !p.DryRun && p.OutputCollectionSuffix == "" {
+			return false, errors.New("no high-water mark was found for the site, --commentFilter can not replace the full counts")
+		}
+
+		logrus.Info("no high-water mark was found for the site, processing all comments")
+
+		return false, nil
+	}
+
+	if p.Transactional {
+		logrus.Warn("--transactional is not supported when processing incrementally, the stories and site will be written separately")
+	}
+
+	started := time.Now()
+	always().WithFields(logrus.Fields{
+		"tenantID":      p.TenantID,
+		"siteID":        p.SiteID,
+		"highWaterMark": mark.CreatedAt,
+	}).Info("started incremental processing")
+
+	if err := p.Incremental(ctx, *mark); err != nil {
+		return true, errors.Wrap(err, "could not process incrementally")
+	}
+
+	always().WithField("took", time.Since(started).String()).Info("finished processing")
+
+	if drifted {
+		return true, errDrift
+	}
+
+	return true, nil
+}
+
+// processWithWatcher will process the site alongside the watcher. Once
+// processing has finished the watcher is stopped, and if either fails the other
+// is canceled and the first error is returned.
+func processWithWatcher(root context.Context, c *cli.Context, p *counts.Processor, opts *runOptions, drifted bool, report *RunReport) error {
+	// The watcher and the processing share a context, so a fatal failure of
+	// either will stop the other.
+	ctx, stop := context.WithCancel(root)
+	defer stop()
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Create the watcher, and start it.
+	watcher := opts.newWatcher()
 
-		// Wait for the changestream to start.
+	if !opts.disableWatcher {
+		logrus.Info("starting watcher")
+
+		// Record every event the watcher receives.
+		if path := c.String("watcherEventLog"); path != "" {
+			eventLog, err := counts.NewEventLog(path)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := eventLog.Close(); err != nil {
+					logrus.WithError(err).Error("could not close the watcher event log")
+				}
+			}()
+
+			watcher.EventLog = eventLog
+		}
+
+		// Start monitoring for updates to the comments collection to ensure that we
+		// can tag any stories/sites that might have gotten dirty since we started.
+		g.Go(func() error {
+			return watcherError(ctx, watcher.Watch(ctx))
+		})
+
+		// Wait for the changestream to start. When the deployment doesn't support
+		// change streams, continue as if --disableWatcher was used.
 		if err := watcher.Wait(ctx); err != nil {
-			logrus.WithError(err).Fatal("could not wait for watcher to start")
+			if !counts.ChangeStreamsUnsupported(err) {
+				return errors.Wrap(err, "could not wait for watcher to start")
+			}
+
+			logrus.WithError(err).Warn("not starting watcher as the deployment does not support change streams, continuing as if --disableWatcher was used")
 		}
 	} else {
 		logrus.Warn("not starting watcher, --disableWatcher was used")
 	}
 
+	g.Go(func() error {
+		defer stop()
+
+		return process(ctx, c, p, watcher, opts, drifted, report)
+	})
+
+	return g.Wait()
+}
+
+// watcherError returns the error that should stop the run once the watcher has
+// stopped with err. The watcher should only stop once processing has finished,
+// so stopping before then fails the run even without an error.
+func watcherError(ctx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		// Processing has finished, or has failed and returned its own error.
+		return nil
+	case err != nil && counts.ChangeStreamsUnsupported(err):
+		// This is handled once the watcher is waited on.
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "watcher failed")
+	default:
+		return errors.New("watcher stopped before processing finished")
+	}
+}
+
+// process will process the site, and then recount the stories and users the
+// watcher marked as dirty while it was processed until there are none left.
+func process(ctx context.Context, c *cli.Context, p *counts.Processor, watcher *counts.Watcher, opts *runOptions, drifted bool, report *RunReport) error {
 	started := time.Now()
+	always().WithFields(logrus.Fields{
+		"runID":    p.RunID,
+		"tenantID": p.TenantID,
+		"siteID":   p.SiteID,
+	}).Info("started processing")
 
 	// The watcher will collect an event for every comment that is inserted or
 	// updated since it started watching. We'll use this to trigger targeted
 	// re-runs of the recomputation to help ensure that we've scanned everything.
 
-	ctx, cancel = context.WithCancel(context.Background())
-	defer cancel()
+	*report = RunReport{
+		RunID:     p.RunID,
+		TenantID:  p.TenantID,
+		SiteID:    p.SiteID,
+		DryRun:    p.DryRun,
+		StartedAt: started,
+	}
+
+	// Find the stories with duplicate story documents.
+	if c.Bool("detectDuplicateStories") {
+		duplicates, err := p.DetectDuplicateStories(ctx)
+		if err != nil {
+			return errors.Wrap(err, "could not detect duplicate stories")
+		}
+
+		if duplicates > 0 && !p.UpdateDuplicateStories {
+			logrus.WithField("duplicates", duplicates).Warn("only one story document will be updated for stories with duplicates, use --updateDuplicateStories to update all of them")
+		}
+	}
+
+	// Read the indexes into the cache before the scans.
+	if c.Bool("warmCache") {
+		if err := p.WarmCache(ctx); err != nil {
+			return errors.Wrap(err, "could not warm cache")
+		}
+	}
+
+	// Find the high-water mark before the site is counted, so the comments
+	// created while it's counted are left for the next incremental run.
+	var mark *counts.HighWaterMark
+	if opts.incremental {
+		latest, err := p.LatestHighWaterMark(ctx)
+		if err != nil {
+			return errors.Wrap(err, "could not find high-water mark")
+		}
+
+		mark = latest
+	}
+
+	// Recount only the stories and users of the comments changed since the
+	// --since rather than every story and user. The watcher has already
+	// started, so the changes made from now on are caught by the dirty passes.
+	if !opts.since.IsZero() {
+		if err := processSince(ctx, p, watcher, opts.since, report); err != nil {
+			return err
+		}
+	} else if err := initialPass(ctx, c, p, watcher, opts, started, report); err != nil {
+		return err
+	}
+
+	// Recount a sample of the stories to measure how far the counts drifted from
+	// comments that changed while they were being scanned.
+	if size := c.Int("verifySample"); size > 0 {
+		if p.DryRun {
+			logrus.Warn("not verifying a sample of stories as --dryRun is enabled")
+		} else {
+			_, drift, err := p.VerifyStorySample(ctx, size)
+			if err != nil {
+				return errors.Wrap(err, "could not verify story sample")
+			}
+
+			drifted = drifted || drift > 0
+		}
+	}
+
+	if err := dirtyPasses(ctx, p, watcher, c.Int("maxDirtyPasses"), report); err != nil {
+		return err
+	}
+
+	// Sum the counts of every site on the tenant now that this site's are final.
+	if c.Bool("tenantTotals") {
+		if err := p.TenantTotals(ctx); err != nil {
+			return errors.Wrap(err, "could not process tenant totals")
+		}
+	}
+
+	// Record the high-water mark so the next run can process incrementally.
+	if opts.incremental {
+		if err := p.SaveHighWaterMark(ctx, mark); err != nil {
+			return errors.Wrap(err, "could not save high-water mark")
+		}
+	}
+
+	report.SlowBatches = p.SlowBatches()
+	report.Finish()
+
+	p.Metrics.Gauge("dirty_passes", float64(report.DirtyPasses()))
+	p.Metrics.Timing("run", time.Since(started))
+
+	if path := c.String("reportFile"); path != "" {
+		if err := report.Write(path); err != nil {
+			return errors.Wrap(err, "could not write report")
+		}
+	}
+
+	summary := always().WithFields(logrus.Fields{
+		"took":        report.Took,
+		"dirtyPasses": report.DirtyPasses(),
+	})
+	if p.Rules.MaxCommentAge > 0 {
+		summary = summary.WithField("staleComments", report.StaleComments)
+	}
+	if p.Rules.CheckCreatedAt {
+		summary = summary.WithField("implausibleCreatedAt", report.ImplausibleCreatedAt)
+	}
+	if p.SlowQueryThreshold > 0 {
+		summary = summary.WithField("slowBatches", report.SlowBatches)
+	}
+	summary.Info("finished processing")
+
+	if drifted {
+		return errDrift
+	}
+
+	return nil
+}
+
+// processSince will recount only the stories and users of the comments changed
+// since the --since rather than every story and user.
+func processSince(ctx context.Context, p *counts.Processor, watcher *counts.Watcher, since time.Time, report *RunReport) error {
+	started := time.Now()
+
+	dirty, err := p.ChangedSince(ctx, since)
+	if err != nil {
+		return errors.Wrap(err, "could not load the comments changed since the --since")
+	}
+
+	stats := PassReport{
+		Stories: len(dirty.StoryIDs),
+		Users:   len(dirty.UserIDs),
+	}
+
+	if err := processDirty(ctx, p, watcher, dirty, &stats); err != nil {
+		return err
+	}
+
+	stats.Took = time.Since(started).String()
+	report.Passes = append(report.Passes, stats)
+
+	always().WithFields(logrus.Fields{
+		"since":           since,
+		"stories":         stats.Stories,
+		"users":           stats.Users,
+		"modifiedStories": stats.ModifiedStories,
+		"modifiedUsers":   stats.ModifiedUsers,
+		"took":            stats.Took,
+	}).Info("recounted the stories and users changed since the --since")
+
+	return nil
+}
+
+// initialPass will process the stories, the site, and the users, recounting
+// the stories and users that change while it runs when --dirtyFlushInterval is
+// used.
+func initialPass(ctx context.Context, c *cli.Context, p *counts.Processor, watcher *counts.Watcher, opts *runOptions, started time.Time, report *RunReport) (err error) {
+	// Recount the stories and users that change while the initial pass runs.
+	var flusher *dirtyFlusher
+	if interval := c.Duration("dirtyFlushInterval"); interval > 0 {
+		flusher = startDirtyFlusher(ctx, watcher, interval, func(ctx context.Context, dirty *counts.DirtyKeys, stats *PassReport) error {
+			return processDirty(ctx, p, watcher, dirty, stats)
+		})
+		defer flusher.Stop()
+	}
+
+	// When --bestEffort is used, every phase of the initial pass is attempted
+	// even if an earlier one failed, and their errors are returned together once
+	// it has finished.
+	phase := &phases{bestEffort: c.Bool("bestEffort")}
+
+	// Process the stories and the site, applying the change in the counts of
+	// only the stories from the --storyIDsFile to the site.
+	var stories *counts.StoriesResult
+	if len(opts.storyIDs) > 0 {
+		stories, err = processStoryIDs(ctx, p, opts.storyIDs)
+		if err := phase.check(err, "could not process the stories from the --storyIDsFile"); err != nil {
+			return err
+		}
+
+		// Recount the stories that changed while they were counted.
+		if stories != nil {
+			watcher.MarkStoriesDirty(stories.Conflicted)
+		}
+	} else if p.Transactional {
+		// The transaction sums the site, so the flushes wait for it.
+		flusher.Pause()
+		stories, err = p.StoriesTransaction(ctx, nil)
+		flusher.Resume()
+		if err := phase.check(err, "could not process stories and site"); err != nil {
+			return err
+		}
+	} else {
+		stories, err = p.Stories(ctx, nil)
+		if err := phase.check(err, "could not process stories"); err != nil {
+			return err
+		}
+
+		if stories == nil {
+			logrus.Warn("processing the site although the stories failed, the site's counts may be summed from partially updated stories")
+		} else {
+			// Recount the stories that changed while they were counted.
+			watcher.MarkStoriesDirty(stories.Conflicted)
+		}
+
+		// Sum the site while no flush is changing its stories or applying their
+		// change to it.
+		flusher.Pause()
+		err = p.Site(ctx)
+		flusher.Resume()
+		if err := phase.check(err, "could not process site"); err != nil {
+			return err
+		}
+	}
+
+	// Process the users, or only the selected users when there's a selection.
+	var users *counts.UsersResult
+	if len(opts.userIDs) > 0 {
+		users, err = processUserIDs(ctx, p, opts.userIDs)
+	} else if p.SelectingUsers() {
+		users, err = p.SelectedUsers(ctx)
+	} else {
+		users, err = p.Users(ctx, nil)
+	}
+	if err := phase.check(err, "could not process users"); err != nil {
+		return err
+	}
+
+	// The results of the phases that failed are empty.
+	if stories == nil {
+		stories = &counts.StoriesResult{}
+	}
+	if users == nil {
+		users = &counts.UsersResult{}
+	}
+
+	report.StaleComments = stories.StaleComments
+	report.ImplausibleCreatedAt = stories.CreatedAt.Total()
+
+	// Check that the stories and users counted the same approved comments, which
+	// can only be compared when every story and user was counted.
+	if !p.SelectingUsers() && !p.Limiting() && len(opts.storyIDs) == 0 && len(opts.userIDs) == 0 && len(phase.failed) == 0 {
+		report.ApprovedMismatch = p.CheckApprovedTotals(stories, users)
+	}
+	report.Passes = append(report.Passes, PassReport{
+		Stories:         stories.Stories,
+		Users:           users.Users,
+		ModifiedStories: stories.Modified,
+		ModifiedUsers:   users.Modified,
+		DriftedStories:  stories.Drifted,
+		DriftedUsers:    users.Drifted,
+		OrphanedUsers:   users.Orphaned,
+		ChangedStories:  stories.Changed,
+		ChangedUsers:    users.Changed,
+		Took:            time.Since(started).String(),
+
+		ConflictedStories: len(stories.Conflicted),
+	})
 
-	// Process the stories.
-	if err := counts.ProcessStories(ctx, db, tenantID, siteID, nil, dryRun); err != nil {
-		return errors.Wrap(err, "could not process stories")
+	if p.EstimateChanges && p.DryRun && !p.OnlyDrift {
+		always().WithFields(logrus.Fields{
+			"stories":        stories.Stories,
+			"changedStories": stories.Changed,
+			"users":          users.Users,
+			"changedUsers":   users.Changed,
+		}).Info("estimated the documents a real run would change")
 	}
 
-	// Process the site.
-	if err := counts.ProcessSite(ctx, db, tenantID, siteID, dryRun); err != nil {
-		return errors.Wrap(err, "could not process site")
+	// Stop flushing now that the initial pass has finished, the dirty passes
+	// will recount everything that changed during it.
+	if flusher != nil {
+		flushes, err := flusher.Stop()
+		if err != nil {
+			return err
+		}
+
+		report.Passes = append(report.Passes, flushes...)
+	}
+
+	if err := phase.err(); err != nil {
+		return err
 	}
 
-	// Process the users.
-	if err := counts.ProcessUsers(ctx, db, tenantID, siteID, nil, dryRun); err != nil {
-		return errors.Wrap(err, "could not process users")
+	if p.OnlyDrift {
+		always().WithFields(logrus.Fields{
+			"driftedStories":   stories.Drifted,
+			"correctedStories": stories.Modified,
+			"driftedUsers":     users.Drifted,
+			"correctedUsers":   users.Modified,
+		}).Info("wrote only the drifted documents")
 	}
 
-	for {
+	return nil
+}
+
+// dirtySource is where the dirty stories and users are taken from, which is the
+// Watcher.
+type dirtySource interface {
+	Dirty() *counts.DirtyKeys
+	MarkStoriesDirty(storyIDs []string)
+}
+
+// dirtyPasses will recount the stories and users the watcher marked as dirty,
+// pass after pass, until there are none left. On a busy site comments may keep
+// changing faster than they're recounted, so the passes can be capped by
+// maxDirtyPasses to ensure the run finishes.
+func dirtyPasses(ctx context.Context, p *counts.Processor, watcher dirtySource, maxDirtyPasses int, report *RunReport) error {
+	for pass := 1; ; pass++ {
 		// Get all the dirty story ID's from the watcher. This will also flush these
 		// events from the watcher.
 		dirty := watcher.Dirty()
 		if dirty == nil {
 			logrus.Info("no dirty stories or users were found")
-			break
+			return nil
+		}
+
+		if maxDirtyPasses > 0 && pass > maxDirtyPasses {
+			report.DirtyStoriesRemaining = len(dirty.StoryIDs)
+			report.DirtyUsersRemaining = len(dirty.UserIDs) + len(dirty.UserDeltas)
+
+			logrus.WithFields(logrus.Fields{
+				"maxDirtyPasses": maxDirtyPasses,
+				"stories":        report.DirtyStoriesRemaining,
+				"users":          report.DirtyUsersRemaining,
+			}).Warn("stopping as the --maxDirtyPasses was reached, the stories and users that are still dirty were not recounted and will be corrected by the next run")
+			return nil
+		}
+
+		passStarted := time.Now()
+		stats := PassReport{
+			Pass:    pass,
+			Stories: len(dirty.StoryIDs),
+			Users:   len(dirty.UserIDs) + len(dirty.UserDeltas),
 		}
 
 		logrus.WithFields(logrus.Fields{
-			"stories": len(dirty.StoryIDs),
-			"users":   len(dirty.UserIDs),
+			"pass":       pass,
+			"stories":    len(dirty.StoryIDs),
+			"users":      len(dirty.UserIDs),
+			"userDeltas": len(dirty.UserDeltas),
 		}).Info("recalculating dirty documents")
 
-		// Process the dirty stories.
-		if len(dirty.StoryIDs) > 0 {
-			if err := counts.ProcessStories(ctx, db, tenantID, siteID, dirty.StoryIDs, dryRun); err != nil {
-				return errors.Wrap(err, "could not process dirty stories")
-			}
+		if err := processDirty(ctx, p, watcher, dirty, &stats); err != nil {
+			return err
+		}
 
-			// Process the site.
-			if err := counts.ProcessSite(ctx, db, tenantID, siteID, dryRun); err != nil {
-				return errors.Wrap(err, "could not process dirty site")
-			}
+		stats.Took = time.Since(passStarted).String()
+		p.Metrics.Timing("dirty_pass", time.Since(passStarted))
+
+		logrus.WithFields(logrus.Fields{
+			"pass":            stats.Pass,
+			"stories":         stats.Stories,
+			"users":           stats.Users,
+			"modifiedStories": stats.ModifiedStories,
+			"modifiedUsers":   stats.ModifiedUsers,
+			"took":            stats.Took,
+		}).Info("finished dirty pass")
+
+		report.Passes = append(report.Passes, stats)
+	}
+}
+
+// processDirty will recount the dirty stories and users, and apply the changes
+// to the users that don't need to be recounted, recording what was written in
+// the stats. The stories that couldn't be written as they changed while they
+// were recounted are marked as dirty on the watcher again.
+func processDirty(ctx context.Context, p *counts.Processor, watcher dirtySource, dirty *counts.DirtyKeys, stats *PassReport) error {
+	// Process the dirty stories.
+	if len(dirty.StoryIDs) > 0 && p.Transactional {
+		res, err := p.StoriesTransaction(ctx, dirty.StoryIDs)
+		if err != nil {
+			return errors.Wrap(err, "could not process dirty stories and site")
 		}
 
-		// Process the dirty users.
-		if len(dirty.UserIDs) > 0 {
-			if err := counts.ProcessUsers(ctx, db, tenantID, siteID, dirty.UserIDs, dryRun); err != nil {
-				return errors.Wrap(err, "could not process users")
-			}
+		stats.ModifiedStories = res.Modified
+		stats.DriftedStories = res.Drifted
+	} else if len(dirty.StoryIDs) > 0 {
+		res, err := p.Stories(ctx, dirty.StoryIDs)
+		if err != nil {
+			return errors.Wrap(err, "could not process dirty stories")
+		}
+
+		stats.ModifiedStories = res.Modified
+		stats.DriftedStories = res.Drifted
+		stats.ConflictedStories = len(res.Conflicted)
+		watcher.MarkStoriesDirty(res.Conflicted)
+
+		// Apply the change in the dirty stories to the site rather than
+		// reprocessing every story on the site.
+		if err := p.SiteDelta(ctx, res.Delta); err != nil {
+			return errors.Wrap(err, "could not process dirty site")
 		}
 	}
 
-	logrus.WithField("took", time.Since(started).String()).Info("finished processing")
+	// Process the dirty users.
+	if len(dirty.UserIDs) > 0 {
+		res, err := p.Users(ctx, dirty.UserIDs)
+		if err != nil {
+			return errors.Wrap(err, "could not process users")
+		}
+
+		stats.ModifiedUsers = res.Modified
+		stats.DriftedUsers = res.Drifted
+		stats.OrphanedUsers = res.Orphaned
+	}
+
+	// Apply the changes to the users that don't need to be recounted.
+	if len(dirty.UserDeltas) > 0 {
+		res, err := p.UserDeltas(ctx, dirty.UserDeltas)
+		if err != nil {
+			return errors.Wrap(err, "could not process user deltas")
+		}
+
+		stats.ModifiedUsers += res.Modified
+	}
 
 	return nil
 }
 
+// contains returns true if the value is in the values.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -169,51 +1054,17 @@ func main() {
 	app.Name = "coral-counts"
 	app.Usage = "a tool to update comment counts after a import"
 	app.Version = fmt.Sprintf("%v, commit %v, built at %v", version, commit, date)
-	app.Flags = []cli.Flag{
-		&cli.StringFlag{
-			Name:     "tenantID",
-			Usage:    "ID for the Tenant we're refreshing counts on",
-			Required: true,
-			EnvVars:  []string{"TENANT_ID"},
-		},
-		&cli.StringFlag{
-			Name:     "siteID",
-			Usage:    "ID for the Site we're refreshing counts on",
-			Required: true,
-			EnvVars:  []string{"SITE_ID"},
-		},
-		&cli.StringFlag{
-			Name:     "mongoDBURI",
-			Usage:    "URI for the MongoDB instance that we're refreshing counts on",
-			Required: true,
-			EnvVars:  []string{"MONGODB_URI"},
-		},
-		&cli.BoolFlag{
-			Name:    "dryRun",
-			Usage:   "when used, this tool will not write any data to the database",
-			EnvVars: []string{"DRY_RUN"},
-		},
-		&cli.BoolFlag{
-			Name:    "disableWatcher",
-			Usage:   "when used, this tool will not attempt to watch for changes to prevent races",
-			EnvVars: []string{"DISABLE_WATCHER"},
-		},
-		&cli.IntFlag{
-			Name:    "batchSize",
-			Usage:   "specify the batch size to write the update for the stories",
-			Value:   1000,
-			EnvVars: []string{"BATCH_SIZE"},
-		},
-		&cli.DurationFlag{
-			Name:    "mongoDBConnectTimeout",
-			Usage:   "used to specify the timeout for connecting to MongoDB",
-			Value:   1 * time.Minute,
-			EnvVars: []string{"MONGODB_CONNECT_TIMEOUT"},
-		},
-	}
-	app.Action = run
+	app.Flags = flags()
+	app.Action = runWithWebhook
 
 	if err := app.Run(os.Args); err != nil {
-		logrus.WithError(err).Fatal()
+		code := exitCode(err)
+		if code == ExitDrift || code == ExitPartial {
+			logrus.WithError(err).Warn()
+		} else {
+			logrus.WithError(err).Error()
+		}
+
+		os.Exit(code)
 	}
 }
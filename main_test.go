@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"coral-counts/counts"
+)
+
+func TestWatcherError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		err     error
+		wantErr string
+	}{
+		{
+			name: "stopped after processing finished",
+			ctx:  canceled,
+		},
+		{
+			name: "failed after processing finished",
+			ctx:  canceled,
+			err:  errors.New("connection reset"),
+		},
+		{
+			name: "change streams unsupported",
+			ctx:  context.Background(),
+			err:  mongo.CommandError{Code: 40573},
+		},
+		{
+			name:    "failed while processing",
+			ctx:     context.Background(),
+			err:     errors.New("connection reset"),
+			wantErr: "watcher failed: connection reset",
+		},
+		{
+			name:    "stopped while processing",
+			ctx:     context.Background(),
+			wantErr: "watcher stopped before processing finished",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := watcherError(tt.ctx, tt.err)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("watcherError(%v) = %v, want nil", tt.err, err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("watcherError(%v) = %v, want an error containing %q", tt.err, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// scriptedDirty is a dirtySource that returns the dirty stories of each pass in
+// turn, as a watcher would when the stories keep changing while they're
+// recounted.
+type scriptedDirty struct {
+	passes [][]string
+}
+
+func (s *scriptedDirty) Dirty() *counts.DirtyKeys {
+	if len(s.passes) == 0 {
+		return nil
+	}
+
+	storyIDs := s.passes[0]
+	s.passes = s.passes[1:]
+
+	return &counts.DirtyKeys{StoryIDs: storyIDs}
+}
+
+func (s *scriptedDirty) MarkStoriesDirty(storyIDs []string) {}
+
+func TestDirtyPasses(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name           string
+		passes         [][]string
+		maxDirtyPasses int
+		wantPasses     []int
+		wantRemaining  int
+	}{
+		{name: "nothing dirty"},
+		{
+			name:       "converges",
+			passes:     [][]string{{"a", "b", "c"}, {"a"}},
+			wantPasses: []int{3, 1},
+		},
+		{
+			name:           "converges within the cap",
+			passes:         [][]string{{"a", "b"}, {"b"}},
+			maxDirtyPasses: 2,
+			wantPasses:     []int{2, 1},
+		},
+		{
+			name:           "cap reached",
+			passes:         [][]string{{"a", "b", "c"}, {"a", "b"}, {"a", "c"}, {"a"}},
+			maxDirtyPasses: 2,
+			wantPasses:     []int{3, 2},
+			wantRemaining:  2,
+		},
+		{
+			name:       "uncapped",
+			passes:     [][]string{{"a"}, {"a"}, {"a"}, {"a"}, {"a"}},
+			wantPasses: []int{1, 1, 1, 1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			// Every pass finds the comments of the stories and the site.
+			for range tt.passes {
+				for i := 0; i < 3; i++ {
+					mt.AddMockResponses(mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch))
+				}
+			}
+
+			p := counts.NewProcessor(mt.DB, "tenant", "site", true, counts.DefaultRules())
+
+			var report RunReport
+			if err := dirtyPasses(context.Background(), p, &scriptedDirty{passes: tt.passes}, tt.maxDirtyPasses, &report); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(report.Passes) != len(tt.wantPasses) {
+				mt.Fatalf("expected %d passes, got %d", len(tt.wantPasses), len(report.Passes))
+			}
+			for i, pass := range report.Passes {
+				if pass.Pass != i+1 || pass.Stories != tt.wantPasses[i] {
+					mt.Errorf("expected pass %d to recount %d stories, got pass %d with %d", i+1, tt.wantPasses[i], pass.Pass, pass.Stories)
+				}
+			}
+
+			if report.DirtyStoriesRemaining != tt.wantRemaining {
+				mt.Errorf("expected %d stories to remain dirty, got %d", tt.wantRemaining, report.DirtyStoriesRemaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// openMetrics will open where the metrics of the run are recorded, which are
+// served for Prometheus to scrape at the --metricsAddr and sent to the
+// --statsdAddr. The metrics are discarded when neither is used. The returned
+// function stops recording them.
+func openMetrics(c *cli.Context) (counts.Recorder, func(), error) {
+	var (
+		recorders counts.MultiRecorder
+		closers   []func()
+	)
+	closeMetrics := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	// Serve the metrics for Prometheus.
+	if addr := c.String("metricsAddr"); addr != "" {
+		recorder, stop, err := serveMetrics(addr, c.Duration("cleanupTimeout"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		recorders = append(recorders, recorder)
+		closers = append(closers, stop)
+	}
+
+	// Send the metrics to statsd.
+	if addr := c.String("statsdAddr"); addr != "" {
+		recorder, err := counts.NewStatsdRecorder(addr, c.String("statsdPrefix"))
+		if err != nil {
+			closeMetrics()
+			return nil, nil, errors.Wrap(err, "can not use the --statsdAddr")
+		}
+
+		recorders = append(recorders, recorder)
+		closers = append(closers, func() { recorder.Close() })
+	}
+
+	return recorders, closeMetrics, nil
+}
+
+// serveMetrics will start a server on the addr that exposes the metrics
+// recorded with the returned recorder for Prometheus to scrape at /metrics. The
+// server is stopped by calling the returned function, which waits for up to the
+// shutdown timeout for the requests being served.
+func serveMetrics(addr string, shutdown time.Duration) (*counts.PrometheusRecorder, func(), error) {
+	recorder := counts.NewPrometheusRecorder("coral_counts")
+
+	// Listen before returning so a bad address fails the run rather than only
+	// being logged.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can not use the --metricsAddr")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", recorder)
+
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("metrics server failed")
+		}
+	}()
+
+	logrus.WithField("addr", listener.Addr().String()).Info("serving metrics at /metrics")
+
+	return recorder, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Warn("could not stop the metrics server")
+		}
+	}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMetrics(t *testing.T) {
+	// Find a free port for the server to listen on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	recorder, stop, err := serveMetrics(addr, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	recorder.Count("stories.processed", 4)
+	recorder.Gauge("replication.lag", 1.5)
+	recorder.Timing("stories.write", 30*time.Millisecond)
+
+	res, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		stop()
+		t.Fatalf("could not scrape the metrics: %v", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	stop()
+	if err != nil {
+		t.Fatalf("could not read the metrics: %v", err)
+	}
+
+	for _, want := range []string{
+		"coral_counts_stories_processed_total 4\n",
+		"coral_counts_replication_lag 1.5\n",
+		"coral_counts_stories_write_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected the metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	// The address that's in use fails rather than only being logged.
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, _, err := serveMetrics(listener.Addr().String(), time.Second); err == nil || !strings.Contains(err.Error(), "--metricsAddr") {
+		t.Errorf("expected an error for the --metricsAddr in use, got %v", err)
+	}
+}
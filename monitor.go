@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"coral-counts/counts"
+)
+
+// runMonitor will verify a sample of the stories on the --siteID, or on each of
+// the sites matching the --siteFilter, every --monitorInterval until it's
+// stopped by a signal. The drift that's found is recorded with the metrics, and
+// nothing is ever written. When the last check before it stopped found drift,
+// errDrift is returned so it's reflected in the exit code.
+func runMonitor(c *cli.Context, metrics counts.Recorder) error {
+	sampleSize := c.Int("verifySample")
+	if sampleSize <= 0 {
+		return errors.New("--monitor requires the --verifySample of stories to verify")
+	}
+
+	interval := c.Duration("monitorInterval")
+	if interval <= 0 {
+		return errors.Errorf("expected --monitorInterval to be positive, found %s", interval)
+	}
+
+	// Verify the stories with the same rules a run would count them with.
+	rules, err := parseRules(c)
+	if err != nil {
+		return err
+	}
+
+	if c.String("statsdAddr") == "" && c.String("metricsAddr") == "" {
+		logrus.Warn("--monitor is running without --statsdAddr or --metricsAddr, drift will only be logged")
+	}
+
+	// Connect with the writes recorded so we can assert that none were
+	// attempted, and ping with the read preference of the client as only reads
+	// are made.
+	conn, err := connect(c, true, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	db, writes := conn.db, conn.writes
+
+	// Stop between checks when we're asked to shut down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	always().WithFields(logrus.Fields{
+		"tenantID":   c.String("tenantID"),
+		"interval":   interval.String(),
+		"sampleSize": sampleSize,
+	}).Info("started monitoring")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var drifted bool
+	for {
+		found, err := checkDrift(ctx, c, db, metrics, rules, sampleSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			metrics.Count("monitor.errors", 1)
+			logrus.WithError(err).Error("could not check the counts for drift")
+		} else {
+			drifted = found
+		}
+
+		if n := writes.Writes(); n > 0 {
+			return errors.Errorf("%d writes were attempted while monitoring", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	always().Info("stopped monitoring")
+
+	if drifted {
+		return errDrift
+	}
+
+	return nil
+}
+
+// checkDrift will verify a sample of the stories on each of the sites being
+// monitored, and record how many drifted with the metrics. It returns true when
+// any of them drifted.
+func checkDrift(ctx context.Context, c *cli.Context, db *mongo.Database, metrics counts.Recorder, rules counts.Rules, sampleSize int) (bool, error) {
+	tenantID := c.String("tenantID")
+
+	// The sites are resolved for each check so new sites are picked up.
+	siteIDs := []string{c.String("siteID")}
+	if c.String("siteFilter") != "" {
+		filter, err := counts.ParseFilter(c.String("siteFilter"))
+		if err != nil {
+			return false, errors.Wrap(err, "can not parse the --siteFilter")
+		}
+
+		siteIDs, err = counts.ResolveSites(ctx, db, tenantID, filter, c.Duration("cursorCloseTimeout"))
+		if err != nil {
+			return false, errors.Wrap(err, "could not find the sites matching the --siteFilter")
+		}
+	}
+
+	started := time.Now()
+
+	var checked, drifted, sites int
+	for _, siteID := range siteIDs {
+		p := counts.NewProcessor(db, tenantID, siteID, true, rules)
+		p.Metrics = metrics
+
+		n, drift, err := p.VerifyStorySample(ctx, sampleSize)
+		if err != nil {
+			return false, errors.Wrapf(err, "could not verify the story sample of site %s", siteID)
+		}
+
+		checked += n
+		drifted += drift
+		if drift > 0 {
+			sites++
+		}
+	}
+
+	metrics.Gauge("monitor.sites", float64(len(siteIDs)))
+	metrics.Gauge("monitor.drifted_sites", float64(sites))
+	metrics.Gauge("monitor.checked_stories", float64(checked))
+	metrics.Gauge("monitor.drifted_stories", float64(drifted))
+	metrics.Timing("monitor.check", time.Since(started))
+
+	entry := always().WithFields(logrus.Fields{
+		"sites":          len(siteIDs),
+		"driftedSites":   sites,
+		"checkedStories": checked,
+		"driftedStories": drifted,
+		"took":           time.Since(started).String(),
+	})
+	if drifted > 0 {
+		entry.Warn("found drifted counts")
+	} else {
+		entry.Info("found no drifted counts")
+	}
+
+	return drifted > 0, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"coral-counts/counts"
+)
+
+// gaugeRecorder is a counts.Recorder that keeps the last value of each gauge.
+type gaugeRecorder struct {
+	mux    sync.Mutex
+	gauges map[string]float64
+}
+
+func (r *gaugeRecorder) Count(string, int64)          {}
+func (r *gaugeRecorder) Timing(string, time.Duration) {}
+
+func (r *gaugeRecorder) Gauge(name string, value float64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.gauges[name] = value
+}
+
+// runWithFlags will run the action with the app's flags parsed from the args.
+func runWithFlags(t *testing.T, action cli.ActionFunc, args ...string) error {
+	t.Helper()
+
+	app := cli.NewApp()
+	app.Flags = flags()
+	app.Action = action
+
+	base := []string{"coral-counts", "--tenantID", "tenant", "--mongoDBURI", "mongodb://localhost/coral"}
+
+	return app.Run(append(base, args...))
+}
+
+func TestRunMonitorOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "without a sample",
+			args:    []string{"--monitor"},
+			wantErr: "--monitor requires the --verifySample",
+		},
+		{
+			name:    "without an interval",
+			args:    []string{"--monitor", "--verifySample", "10", "--monitorInterval", "0s"},
+			wantErr: "expected --monitorInterval to be positive",
+		},
+		{
+			name:    "negative interval",
+			args:    []string{"--monitor", "--verifySample", "10", "--monitorInterval", "-1m"},
+			wantErr: "expected --monitorInterval to be positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runWithFlags(t, func(c *cli.Context) error {
+				return runMonitor(c, counts.MultiRecorder{})
+			}, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("runMonitor(%v) expected an error containing %q, got %v", tt.args, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	story := bson.D{
+		primitive.E{Key: "id", Value: "s1"},
+		primitive.E{Key: "commentCounts", Value: bson.D{
+			primitive.E{Key: "status", Value: bson.D{
+				primitive.E{Key: "APPROVED", Value: int32(1)},
+			}},
+		}},
+	}
+	comment := bson.D{
+		primitive.E{Key: "id", Value: "c1"},
+		primitive.E{Key: "storyID", Value: "s1"},
+		primitive.E{Key: "status", Value: "APPROVED"},
+	}
+	site := func(id string) bson.D {
+		return bson.D{primitive.E{Key: "id", Value: id}}
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		responses []bson.D
+		want      map[string]float64
+		drifted   bool
+	}{
+		{
+			name: "site without stories",
+			args: []string{"--siteID", "site"},
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch),
+			},
+			want: map[string]float64{"monitor.sites": 1, "monitor.drifted_sites": 0, "monitor.checked_stories": 0, "monitor.drifted_stories": 0},
+		},
+		{
+			name: "story matches its comments",
+			args: []string{"--siteID", "site"},
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, story),
+				mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch, comment),
+			},
+			want: map[string]float64{"monitor.sites": 1, "monitor.drifted_sites": 0, "monitor.checked_stories": 1, "monitor.drifted_stories": 0},
+		},
+		{
+			name: "story drifted",
+			args: []string{"--siteID", "site"},
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, story),
+				mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch),
+			},
+			want:    map[string]float64{"monitor.sites": 1, "monitor.drifted_sites": 1, "monitor.checked_stories": 1, "monitor.drifted_stories": 1},
+			drifted: true,
+		},
+		{
+			name: "sites matching the filter",
+			args: []string{"--siteFilter", `{"name": "news"}`},
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "coral.sites", mtest.FirstBatch, site("a"), site("b")),
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch, story),
+				mtest.CreateCursorResponse(0, "coral.comments", mtest.FirstBatch),
+				mtest.CreateCursorResponse(0, "coral.stories", mtest.FirstBatch),
+			},
+			want:    map[string]float64{"monitor.sites": 2, "monitor.drifted_sites": 1, "monitor.checked_stories": 1, "monitor.drifted_stories": 1},
+			drifted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+
+			recorder := &gaugeRecorder{gauges: make(map[string]float64)}
+
+			var drifted bool
+			if err := runWithFlags(t, func(c *cli.Context) error {
+				var err error
+				drifted, err = checkDrift(context.Background(), c, mt.DB, recorder, counts.DefaultRules(), 10)
+
+				return err
+			}, tt.args...); err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+
+			if drifted != tt.drifted {
+				mt.Errorf("expected drifted to be %v, got %v", tt.drifted, drifted)
+			}
+
+			for name, want := range tt.want {
+				if got := recorder.gauges[name]; got != want {
+					mt.Errorf("expected %s to be %v, got %v", name, want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"coral-counts/counts"
+)
+
+// runOptions are the options of a run of a site that are parsed from the
+// flags. Some options change others, such as --readOnly enabling --dryRun, so
+// these are the options as they're used rather than as they were given.
+type runOptions struct {
+	tenantID string
+	siteID   string
+
+	dryRun         bool
+	readOnly       bool
+	disableWatcher bool
+	incremental    bool
+
+	// storyIDs and userIDs are the stories and users from the --storyIDsFile
+	// and --userIDsFile, when only they are processed.
+	storyIDs []string
+	userIDs  []string
+
+	// since when set is the --since that only the stories and users of the
+	// comments changed after are recounted.
+	since time.Time
+
+	// userDeltas, watchDeletes, and watcherStartAtTime are what the watcher
+	// records, and the time it replays the changes from.
+	userDeltas         bool
+	watchDeletes       bool
+	watcherStartAtTime time.Time
+
+	// processor is the Processor the site is processed with. It counts the
+	// comments with the rules, and is configured with how they're read and the
+	// counts are written, but it isn't connected to the database until the run
+	// is.
+	processor *counts.Processor
+}
+
+// parseRunOptions will parse the options of the run from the flags. The
+// options that configure how the comments are read and the counts are written
+// are set on the processor as they're parsed.
+func parseRunOptions(c *cli.Context) (*runOptions, error) {
+	opts := &runOptions{
+		tenantID:       c.String("tenantID"),
+		siteID:         c.String("siteID"),
+		dryRun:         c.Bool("dryRun"),
+		readOnly:       c.Bool("readOnly"),
+		disableWatcher: c.Bool("disableWatcher"),
+		incremental:    c.Bool("incremental"),
+	}
+	opts.processor = counts.NewProcessor(nil, opts.tenantID, opts.siteID, opts.dryRun, counts.DefaultRules())
+	p := opts.processor
+
+	if opts.readOnly && !opts.dryRun {
+		logrus.Info("enabling --dryRun as --readOnly is enabled")
+		opts.dryRun = true
+	}
+	if c.Bool("kafkaOnly") {
+		if len(c.StringSlice("kafkaBrokers")) == 0 {
+			return nil, errors.New("--kafkaOnly requires --kafkaBrokers")
+		}
+		if !opts.dryRun {
+			logrus.Info("enabling --dryRun as --kafkaOnly is enabled")
+			opts.dryRun = true
+		}
+
+		p.PublishOnly = true
+	}
+
+	// Limit the stories and users counted. The site's counts would only be
+	// partial, so nothing is written.
+	p.LimitStories = c.Int("limitStories")
+	p.LimitUsers = c.Int("limitUsers")
+	if p.LimitStories < 0 || p.LimitUsers < 0 {
+		return nil, errors.Errorf("expected --limitStories and --limitUsers to not be negative, found %d and %d", p.LimitStories, p.LimitUsers)
+	}
+	if p.Limiting() && !opts.dryRun {
+		logrus.Info("enabling --dryRun as --limitStories or --limitUsers is enabled")
+		opts.dryRun = true
+	}
+
+	if err := opts.parseSelection(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.configureBatches(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.configureScan(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.parseRules(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.configureWrites(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.configureWatcher(c); err != nil {
+		return nil, err
+	}
+
+	if err := opts.configureUsers(c); err != nil {
+		return nil, err
+	}
+
+	// Set if the stories are counted by an aggregation on the server, which can
+	// only count with some of the options.
+	p.AggregationMode = c.Bool("aggregationMode")
+	if p.AggregationMode {
+		if unsupported := p.AggregationUnsupported(); len(unsupported) > 0 {
+			return nil, errors.Errorf("--aggregationMode can not be used with --%s", strings.Join(unsupported, ", --"))
+		}
+		if c.Bool("tenantScan") {
+			return nil, errors.New("--aggregationMode can not be used with --tenantScan")
+		}
+		if p.ScanShards > 1 {
+			logrus.Warn("--scanShards is ignored for stories as --aggregationMode is enabled")
+		}
+	}
+
+	p.DryRun = opts.dryRun
+
+	return opts, nil
+}
+
+// parseSelection will parse the stories and users that are processed from the
+// --storyIDsFile and --userIDsFile, or the --since that they're found from,
+// rather than processing every story and user.
+func (opts *runOptions) parseSelection(c *cli.Context) error {
+	var err error
+	if path := c.String("storyIDsFile"); path != "" {
+		if opts.storyIDs, err = readIDFile(path); err != nil {
+			return errors.Wrap(err, "can not read the --storyIDsFile")
+		}
+		if len(opts.storyIDs) == 0 {
+			return errors.Errorf("expected the --storyIDsFile %s to contain story ID's", path)
+		}
+	}
+	if path := c.String("userIDsFile"); path != "" {
+		if opts.userIDs, err = readIDFile(path); err != nil {
+			return errors.Wrap(err, "can not read the --userIDsFile")
+		}
+		if len(opts.userIDs) == 0 {
+			return errors.Errorf("expected the --userIDsFile %s to contain user ID's", path)
+		}
+	}
+	if (len(opts.storyIDs) > 0 || len(opts.userIDs) > 0) && opts.incremental {
+		return errors.New("--storyIDsFile and --userIDsFile can not be used with --incremental")
+	}
+
+	// Recount only the stories and users of the comments changed since a time,
+	// rather than every story and user, to catch up after the tool was down.
+	if value := c.String("since"); value != "" {
+		if opts.since, err = time.Parse(time.RFC3339, value); err != nil {
+			return errors.Wrap(err, "can not parse the --since")
+		}
+		if opts.since.After(time.Now()) {
+			return errors.Errorf("expected --since to not be in the future, found %s", value)
+		}
+		if len(opts.storyIDs) > 0 || len(opts.userIDs) > 0 || opts.incremental {
+			return errors.New("--since can not be used with --storyIDsFile, --userIDsFile, or --incremental")
+		}
+	}
+
+	return nil
+}
+
+// configureBatches will set the size of the batches that are written, and how
+// they're queued and written.
+func (opts *runOptions) configureBatches(c *cli.Context) error {
+	p := opts.processor
+
+	// Set the batch size.
+	p.BatchSize = c.Int("batchSize")
+	if p.BatchSize < 1 {
+		return errors.Errorf("expected --batchSize to be at least 1, found %d", p.BatchSize)
+	}
+	if p.BatchSize > counts.MaxBatchWriteOperations {
+		logrus.WithField("batchSize", p.BatchSize).Warnf("--batchSize is larger than the %d operations Mongo accepts in a batch, using %d", counts.MaxBatchWriteOperations, counts.MaxBatchWriteOperations)
+		p.BatchSize = counts.MaxBatchWriteOperations
+	}
+	p.TargetBatchBytes = c.Int("targetBatchBytes")
+	if p.TargetBatchBytes < 0 {
+		return errors.Errorf("expected --targetBatchBytes to be at least 0, found %d", p.TargetBatchBytes)
+	}
+
+	// Set how the batches are queued and written.
+	p.WriteQueueDepth = c.Int("writeQueueDepth")
+	p.WriteConcurrency = c.Int("concurrency")
+	if p.WriteQueueDepth < 0 {
+		return errors.Errorf("expected --writeQueueDepth to not be negative, found %d", p.WriteQueueDepth)
+	}
+	if p.WriteConcurrency < 1 {
+		return errors.Errorf("expected --concurrency to be at least 1, found %d", p.WriteConcurrency)
+	}
+
+	return nil
+}
+
+// configureScan will set how and where the comments are read from, and which
+// of them are counted.
+func (opts *runOptions) configureScan(c *cli.Context) error {
+	p := opts.processor
+
+	// Set how many cursors the scan of the comments is split across.
+	p.ScanShards = c.Int("scanShards")
+	if p.ScanShards < 1 || p.ScanShards > counts.MaxScanShards {
+		return errors.Errorf("expected --scanShards to be between 1 and %d, found %d", counts.MaxScanShards, p.ScanShards)
+	}
+
+	// Set the order the comments are scanned in.
+	p.ScanSort = c.String("scanSort")
+	switch p.ScanSort {
+	case counts.ScanSortNatural, counts.ScanSortCreatedAt, counts.ScanSortStoryID:
+	default:
+		return errors.Errorf("expected --scanSort to be one of %s,%s, found %s", counts.ScanSortCreatedAt, counts.ScanSortStoryID, p.ScanSort)
+	}
+
+	// Set the collections that the comments are scanned from.
+	p.CommentsCollections = c.StringSlice("commentsCollections")
+	if len(p.CommentsCollections) > 0 && !opts.disableWatcher {
+		logrus.WithField("commentsCollections", p.CommentsCollections).Warn("the watcher only watches the comments collection, changes to comments in the other --commentsCollections will not mark their stories as dirty")
+	}
+
+	// Set if invariant failures should stop processing.
+	p.StrictInvariants = c.Bool("strictInvariants")
+
+	// Set the suffix for the collections we're writing to.
+	p.OutputCollectionSuffix = c.String("outputCollectionSuffix")
+	if p.OutputCollectionSuffix != "" && !c.Bool("compareCollections") {
+		logrus.WithField("suffix", p.OutputCollectionSuffix).Warn("writing counts to suffixed collections, the original collections will not be updated")
+	}
+
+	// Set the filter that restricts the comments that are counted. The counts
+	// are partial, so they can't replace the full counts in the original
+	// collections unless they're being added to them.
+	if filter := c.String("commentFilter"); filter != "" {
+		doc, err := counts.ParseFilter(filter)
+		if err != nil {
+			return errors.Wrap(err, "can not parse the --commentFilter")
+		}
+
+		if !opts.dryRun && p.OutputCollectionSuffix == "" && !opts.incremental {
+			return errors.New("--commentFilter only counts some of the comments, use it with --dryRun, --outputCollectionSuffix, or --incremental so the full counts aren't replaced")
+		}
+
+		p.CommentFilter = doc
+		logrus.WithField("commentFilter", filter).Warn("only counting the comments matching --commentFilter, the counts will be partial")
+	}
+
+	// Set how the comments are read.
+	switch level := c.String("readConcern"); level {
+	case "":
+	case "local", "available", "majority", "linearizable":
+		p.ReadConcern = readconcern.New(readconcern.Level(level))
+	default:
+		return errors.Errorf("expected --readConcern to be one of local,available,majority,linearizable, found %s", level)
+	}
+	if value := c.String("atClusterTime"); value != "" {
+		atClusterTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return errors.Wrap(err, "can not parse the --atClusterTime")
+		}
+		if atClusterTime.After(time.Now()) {
+			return errors.Errorf("expected --atClusterTime to not be in the future, found %s", value)
+		}
+		if p.ReadConcern != nil {
+			logrus.Warn("--readConcern is ignored as the comments are read with the snapshot read concern at the --atClusterTime")
+		}
+
+		// The dirty passes would also read the comments at the cluster time, so
+		// they couldn't correct the changes made since.
+		if !opts.disableWatcher {
+			logrus.Info("enabling --disableWatcher as --atClusterTime is enabled")
+			opts.disableWatcher = true
+		}
+
+		p.AtClusterTime = atClusterTime
+	}
+	var err error
+	if p.ReadPreference, err = parseReadPreference(c); err != nil {
+		return err
+	}
+
+	// Set the duration after which batches are logged as slow.
+	p.SlowQueryThreshold = c.Duration("slowQueryThreshold")
+
+	return nil
+}
+
+// parseReadPreference will parse the --readPreference that the comments are
+// scanned with, which is nil when the read preference of the client is used.
+func parseReadPreference(c *cli.Context) (*readpref.ReadPref, error) {
+	value := c.String("readPreference")
+	if value == "" {
+		return nil, nil
+	}
+
+	mode, err := readpref.ModeFromString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse the --readPreference")
+	}
+
+	pref, err := readpref.New(mode)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse the --readPreference")
+	}
+
+	return pref, nil
+}
+
+// parseRules will parse the rules the comments are counted with, and check
+// them against the other options.
+func (opts *runOptions) parseRules(c *cli.Context) error {
+	rules, err := parseRules(c)
+	if err != nil {
+		return err
+	}
+
+	if rules.CountDistinctAuthors && opts.incremental {
+		return errors.New("--countDistinctAuthors can not be used with --incremental as the authors of the new comments may have already been counted")
+	}
+
+	// The dirty stories from the watcher can't be recounted when the story ID's
+	// are normalized, as only the comments with the exact ID that changed would
+	// be found.
+	if rules.StoryIDNormalizer != nil {
+		if !opts.since.IsZero() {
+			return errors.New("--since can not be used with --storyIDPattern or --storyIDMapping as the changed stories can't be recounted")
+		}
+
+		if !opts.disableWatcher {
+			logrus.Info("enabling --disableWatcher as the story ID's are being normalized")
+			opts.disableWatcher = true
+		}
+	}
+
+	opts.processor.Rules = rules
+
+	return nil
+}
+
+// configureWrites will set which documents are written and how.
+func (opts *runOptions) configureWrites(c *cli.Context) error {
+	p := opts.processor
+
+	// Set if only the stories and users whose counts have drifted are written.
+	p.OnlyDrift = c.Bool("onlyDrift")
+
+	// Set how many of the stories with the most comments are logged.
+	p.TopStories = c.Int("topStories")
+	if p.TopStories < 0 {
+		return errors.Errorf("expected --topStories to not be negative, found %d", p.TopStories)
+	}
+
+	// Set if dry runs estimate how many documents would change.
+	p.EstimateChanges = c.Bool("estimateChanges")
+
+	// Set if the users are written as they're counted rather than once every
+	// user has been counted.
+	p.StreamUsers = c.Bool("streamUsers")
+
+	// Set if fields stored in the commentCounts that aren't known are kept.
+	p.PreserveExtraFields = c.Bool("preserveExtraFields")
+
+	// Set if every story document with a story's ID should be updated.
+	p.UpdateDuplicateStories = c.Bool("updateDuplicateStories")
+
+	// Set if missing stories should be created.
+	p.UpsertStories = c.Bool("upsertStories")
+
+	// Set if the stories and site are written in a transaction.
+	p.Transactional = c.Bool("transactional")
+	if p.Transactional && p.WriteConcurrency > 1 {
+		logrus.WithField("concurrency", p.WriteConcurrency).Warn("--concurrency is ignored for story writes as --transactional is enabled")
+	}
+
+	// Set if the stories are only written when their counts haven't changed since
+	// they were read.
+	p.OptimisticWrites = c.Bool("optimisticWrites")
+	if p.OptimisticWrites && p.Transactional {
+		return errors.New("--optimisticWrites can not be used with --transactional")
+	}
+	if p.OptimisticWrites && p.UpdateDuplicateStories {
+		return errors.New("--optimisticWrites can not be used with --updateDuplicateStories")
+	}
+	if p.OptimisticWrites && c.Duration("dirtyFlushInterval") > 0 {
+		return errors.New("--optimisticWrites can not be used with --dirtyFlushInterval")
+	}
+	if p.OptimisticWrites && (c.String("export") != "" || c.String("coralAPIURL") != "") {
+		logrus.Warn("--optimisticWrites is ignored as the counts are not written to the database")
+	}
+
+	// Set if authors without a user document are detected.
+	p.DetectOrphanedUsers = c.Bool("detectOrphanedUsers")
+	p.StrictOrphanedUsers = c.Bool("strictOrphanedUsers")
+
+	// Set if a daily snapshot of the site's counts is recorded.
+	p.SnapshotHistory = c.Bool("snapshotHistory")
+
+	// Set where documents that fail to process are recorded.
+	p.DeadLetterCollection = c.String("dlqCollection")
+
+	// Set where changes to counts are recorded.
+	p.AuditCollection = c.String("auditCollection")
+
+	// Set if the written documents are stamped with the run that wrote them.
+	p.StampRecomputeMarker = c.Bool("stampRecomputeMarker")
+
+	return nil
+}
+
+// configureWatcher will set what the watcher records, and the time it replays
+// the changes from.
+func (opts *runOptions) configureWatcher(c *cli.Context) error {
+	// Set if the changes to dirty users are applied rather than recounting them.
+	opts.userDeltas = c.Bool("userDeltas")
+
+	// Set if the stories and authors of deleted comments are marked as dirty.
+	opts.watchDeletes = c.Bool("watchDeletes")
+
+	// Set the time the watcher replays changes from.
+	if value := c.String("watcherStartAtTime"); value != "" {
+		if opts.disableWatcher {
+			logrus.Warn("--watcherStartAtTime is ignored as --disableWatcher was used")
+		} else {
+			startAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return errors.Wrap(err, "can not parse the --watcherStartAtTime")
+			}
+			if startAt.After(time.Now()) {
+				return errors.Errorf("expected --watcherStartAtTime to not be in the future, found %s", value)
+			}
+
+			opts.watcherStartAtTime = startAt
+		}
+	}
+
+	if opts.userDeltas && opts.disableWatcher {
+		logrus.Warn("--userDeltas is ignored as --disableWatcher was used")
+	}
+
+	return nil
+}
+
+// newWatcher returns a Watcher for the site of the processor that records what
+// the options set, and replays the changes from their time.
+func (opts *runOptions) newWatcher() *counts.Watcher {
+	p := opts.processor
+
+	watcher := counts.NewWatcher(p.DB, p.TenantID, p.SiteID, p.Rules)
+	watcher.UserDeltas = opts.userDeltas
+	watcher.WatchDeletes = opts.watchDeletes
+	watcher.StartAtTime = opts.watcherStartAtTime
+
+	// When the site's stories were counted by an earlier scan of the tenant's
+	// comments, replay the changes made since that scan started so they aren't
+	// missed.
+	if watcher.StartAtTime.IsZero() && p.TenantScan != nil {
+		watcher.StartAtTime = p.TenantScan.StartedAt()
+	}
+	watcher.Metrics = p.Metrics
+	watcher.CloseTimeout = p.Timeouts.Cleanup
+
+	return watcher
+}
+
+// configureUsers will set the users that are processed when only some of them
+// should be.
+func (opts *runOptions) configureUsers(c *cli.Context) error {
+	p := opts.processor
+
+	if filter := c.String("usersFilter"); filter != "" {
+		if err := bson.UnmarshalExtJSON([]byte(filter), false, &p.UsersFilter); err != nil {
+			return errors.Wrap(err, "can not parse the --usersFilter")
+		}
+	}
+	p.UsersRoles = c.StringSlice("usersRole")
+	p.UsersCommentedWithin = c.Duration("usersCommentedWithin")
+	if p.SelectingUsers() && len(opts.userIDs) > 0 {
+		return errors.New("--userIDsFile can not be used with --usersFilter, --usersRole, or --usersCommentedWithin")
+	}
+	if p.SelectingUsers() && !opts.since.IsZero() {
+		return errors.New("--since can not be used with --usersFilter, --usersRole, or --usersCommentedWithin")
+	}
+
+	return nil
+}
+
+// openOutputs will open where the computed counts are sent other than the
+// database, and set them on the processor. The returned function
+// closes them, and returns the error from closing the --export.
+func openOutputs(c *cli.Context, opts *runOptions) (closeOutputs func() error, err error) {
+	p := opts.processor
+
+	var closers []func() error
+	closeOutputs = func() error {
+		var closeErr error
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		}
+
+		return closeErr
+	}
+
+	// Close the outputs that were opened when a later one can't be.
+	defer func() {
+		if err != nil {
+			closeOutputs()
+		}
+	}()
+
+	// Publish the computed counts to kafka.
+	if brokers := c.StringSlice("kafkaBrokers"); len(brokers) > 0 {
+		switch policy := c.String("kafkaFailurePolicy"); policy {
+		case counts.PublishFailureWarn, counts.PublishFailureFail:
+			p.PublishFailurePolicy = policy
+		default:
+			return nil, errors.Errorf("expected --kafkaFailurePolicy to be %s or %s, found %s", counts.PublishFailureWarn, counts.PublishFailureFail, policy)
+		}
+
+		publisher := counts.NewKafkaPublisher(brokers, c.String("kafkaTopic"))
+		closers = append(closers, func() error {
+			publisher.Close()
+
+			return nil
+		})
+
+		p.Events = publisher
+	}
+
+	// Send the computed counts to the coral api or export them instead of
+	// writing them.
+	if c.String("coralAPIURL") != "" && c.String("export") != "" {
+		return nil, errors.New("--coralAPIURL can not be used with --export")
+	}
+	if apiURL := c.String("coralAPIURL"); apiURL != "" {
+		if p.Transactional || opts.userDeltas || c.Bool("incremental") || c.Bool("reportedOnly") {
+			return nil, errors.New("--coralAPIURL can not be used with --transactional, --userDeltas, --incremental, or --reportedOnly as they write partial counts to the database")
+		}
+		if retries := c.Int("coralAPIRetries"); retries < 0 {
+			return nil, errors.Errorf("expected --coralAPIRetries to not be negative, found %d", retries)
+		}
+
+		p.Destination = counts.NewCoralAPISink(apiURL, c.String("coralAPIToken"), c.Duration("coralAPITimeout"), c.Int("coralAPIRetries"))
+	}
+	if path := c.String("export"); path != "" {
+		if p.Transactional || opts.userDeltas || c.Bool("incremental") || c.Bool("reportedOnly") {
+			return nil, errors.New("--export can not be used with --transactional, --userDeltas, --incremental, or --reportedOnly as they write partial counts to the database")
+		}
+		if c.String("siteFilter") != "" {
+			return nil, errors.New("--export can not be used with --siteFilter, export each site on its own")
+		}
+		if path == "-" && c.Bool("summaryLine") {
+			return nil, errors.New("--summaryLine can not be used when the --export is written to stdout")
+		}
+
+		export, err := counts.NewExportSink(path, c.Bool("exportGzip"))
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, export.Close)
+
+		p.Destination = export
+	} else if c.Bool("exportGzip") {
+		return nil, errors.New("--exportGzip requires --export")
+	}
+
+	return closeOutputs, nil
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"coral-counts/counts"
+)
+
+// parseOptions will parse the args with the app's flags and return the options
+// that parseRunOptions builds from them.
+func parseOptions(t *testing.T, args ...string) (*runOptions, error) {
+	t.Helper()
+
+	var opts *runOptions
+	app := cli.NewApp()
+	app.Flags = flags()
+	app.Action = func(c *cli.Context) error {
+		var err error
+		opts, err = parseRunOptions(c)
+
+		return err
+	}
+
+	base := []string{"coral-counts", "--tenantID", "tenant", "--siteID", "site", "--mongoDBURI", "mongodb://localhost/coral"}
+	err := app.Run(append(base, args...))
+
+	return opts, err
+}
+
+// optionsTest is a case of the options parsed from the args. When wantErr is
+// set the parse should fail with an error containing it, otherwise check is
+// called with the options.
+type optionsTest struct {
+	name    string
+	args    []string
+	wantErr string
+	check   func(t *testing.T, opts *runOptions)
+}
+
+// runOptionsTests will run each of the tests.
+func runOptionsTests(t *testing.T, tests []optionsTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseOptions(t, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRunOptions(%v) expected an error containing %q, got %v", tt.args, tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRunOptions(%v) unexpected error: %v", tt.args, err)
+			}
+
+			if tt.check != nil {
+				tt.check(t, opts)
+			}
+		})
+	}
+}
+
+func TestParseRunOptionsIncremental(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "incremental",
+			args: []string{"--incremental"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.incremental {
+					t.Error("expected incremental to be enabled")
+				}
+			},
+		},
+		{
+			name:    "with distinct authors",
+			args:    []string{"--incremental", "--countDistinctAuthors"},
+			wantErr: "--countDistinctAuthors can not be used with --incremental",
+		},
+		{
+			name:    "with since",
+			args:    []string{"--incremental", "--since", "2020-01-01T00:00:00Z"},
+			wantErr: "--since can not be used with",
+		},
+	})
+}
+
+func TestParseRunOptionsTransactional(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "transactional",
+			args: []string{"--transactional"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.processor.Transactional {
+					t.Error("expected transactional writes to be enabled")
+				}
+			},
+		},
+		{
+			name:    "with optimistic writes",
+			args:    []string{"--transactional", "--optimisticWrites"},
+			wantErr: "--optimisticWrites can not be used with --transactional",
+		},
+	})
+}
+
+func TestParseRunOptionsReads(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "client defaults",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.ReadConcern != nil || opts.processor.ReadPreference != nil {
+					t.Errorf("expected the client's read concern and preference, got %v and %v", opts.processor.ReadConcern, opts.processor.ReadPreference)
+				}
+			},
+		},
+		{
+			name: "majority from a secondary",
+			args: []string{"--readConcern", "majority", "--readPreference", "secondaryPreferred"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.ReadConcern == nil || opts.processor.ReadConcern.GetLevel() != "majority" {
+					t.Errorf("expected the majority read concern, got %v", opts.processor.ReadConcern)
+				}
+				if opts.processor.ReadPreference == nil || opts.processor.ReadPreference.Mode().String() != "secondaryPreferred" {
+					t.Errorf("expected the secondaryPreferred read preference, got %v", opts.processor.ReadPreference)
+				}
+			},
+		},
+		{
+			name:    "unknown read concern",
+			args:    []string{"--readConcern", "snapshot"},
+			wantErr: "expected --readConcern to be one of",
+		},
+		{
+			name:    "unknown read preference",
+			args:    []string{"--readPreference", "closest"},
+			wantErr: "can not parse the --readPreference",
+		},
+	})
+}
+
+func TestParseRunOptionsScanShards(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "default",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.ScanShards != 1 {
+					t.Errorf("expected 1 shard, got %d", opts.processor.ScanShards)
+				}
+			},
+		},
+		{
+			name: "most shards",
+			args: []string{"--scanShards", "16"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.ScanShards != counts.MaxScanShards {
+					t.Errorf("expected %d shards, got %d", counts.MaxScanShards, opts.processor.ScanShards)
+				}
+			},
+		},
+		{
+			name:    "no shards",
+			args:    []string{"--scanShards", "0"},
+			wantErr: "expected --scanShards to be between 1 and 16",
+		},
+		{
+			name:    "too many shards",
+			args:    []string{"--scanShards", "17"},
+			wantErr: "expected --scanShards to be between 1 and 16",
+		},
+	})
+}
+
+func TestParseRunOptionsUsersSelection(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "no selection",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.SelectingUsers() {
+					t.Errorf("expected no users to be selected")
+				}
+			},
+		},
+		{
+			name: "filter and roles",
+			args: []string{"--usersFilter", `{"email": "a@example.com"}`, "--usersRole", "STAFF", "--usersRole", "MODERATOR"},
+			check: func(t *testing.T, opts *runOptions) {
+				if len(opts.processor.UsersFilter) != 1 || opts.processor.UsersFilter[0].Key != "email" {
+					t.Errorf("expected the filter on email, got %v", opts.processor.UsersFilter)
+				}
+				if len(opts.processor.UsersRoles) != 2 {
+					t.Errorf("expected 2 roles, got %v", opts.processor.UsersRoles)
+				}
+			},
+		},
+		{
+			name: "commented within",
+			args: []string{"--usersCommentedWithin", "24h"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.UsersCommentedWithin != 24*time.Hour {
+					t.Errorf("expected 24h, got %s", opts.processor.UsersCommentedWithin)
+				}
+			},
+		},
+		{
+			name:    "invalid filter",
+			args:    []string{"--usersFilter", `{"email": `},
+			wantErr: "can not parse the --usersFilter",
+		},
+		{
+			name:    "with since",
+			args:    []string{"--usersRole", "STAFF", "--since", "2024-01-01T00:00:00Z"},
+			wantErr: "--since can not be used with --usersFilter",
+		},
+	})
+}
+
+func TestParseRunOptionsReadOnly(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "default",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.readOnly || opts.dryRun {
+					t.Errorf("expected writes, got readOnly %v and dryRun %v", opts.readOnly, opts.dryRun)
+				}
+			},
+		},
+		{
+			name: "dry run",
+			args: []string{"--dryRun"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.readOnly || !opts.dryRun {
+					t.Errorf("expected only a dry run, got readOnly %v and dryRun %v", opts.readOnly, opts.dryRun)
+				}
+			},
+		},
+		{
+			name: "read only enables dry run",
+			args: []string{"--readOnly"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.readOnly || !opts.dryRun {
+					t.Errorf("expected a read only dry run, got readOnly %v and dryRun %v", opts.readOnly, opts.dryRun)
+				}
+			},
+		},
+	})
+}
+
+func TestParseRunOptionsKafkaOnly(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "publishing only enables dry run",
+			args: []string{"--kafkaOnly", "--kafkaBrokers", "localhost:9092"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.dryRun || !opts.processor.PublishOnly {
+					t.Errorf("expected a dry run that only publishes, got dryRun %v and PublishOnly %v", opts.dryRun, opts.processor.PublishOnly)
+				}
+			},
+		},
+		{
+			name:    "publishing only without brokers",
+			args:    []string{"--kafkaOnly"},
+			wantErr: "--kafkaOnly requires --kafkaBrokers",
+		},
+	})
+}
+
+func TestParseRunOptionsWatcherStartAtTime(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "start at time",
+			args: []string{"--watcherStartAtTime", "2024-01-02T03:00:00Z"},
+			check: func(t *testing.T, opts *runOptions) {
+				if want := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC); !opts.watcherStartAtTime.Equal(want) {
+					t.Errorf("expected %s, got %s", want, opts.watcherStartAtTime)
+				}
+			},
+		},
+		{
+			name: "ignored without the watcher",
+			args: []string{"--watcherStartAtTime", "2024-01-02T03:00:00Z", "--disableWatcher"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.watcherStartAtTime.IsZero() {
+					t.Errorf("expected no start at time, got %s", opts.watcherStartAtTime)
+				}
+			},
+		},
+		{
+			name:    "invalid time",
+			args:    []string{"--watcherStartAtTime", "yesterday"},
+			wantErr: "can not parse the --watcherStartAtTime",
+		},
+		{
+			name:    "future time",
+			args:    []string{"--watcherStartAtTime", time.Now().Add(time.Hour).UTC().Format(time.RFC3339)},
+			wantErr: "expected --watcherStartAtTime to not be in the future",
+		},
+	})
+}
+
+func TestParseRunOptionsLimits(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "no limits",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.Limiting() || opts.dryRun {
+					t.Errorf("expected no limits and writes, got Limiting %v and dryRun %v", opts.processor.Limiting(), opts.dryRun)
+				}
+			},
+		},
+		{
+			name: "limit stories enables dry run",
+			args: []string{"--limitStories", "10"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.LimitStories != 10 || !opts.dryRun {
+					t.Errorf("expected 10 stories in a dry run, got %d and dryRun %v", opts.processor.LimitStories, opts.dryRun)
+				}
+			},
+		},
+		{
+			name: "limit users enables dry run",
+			args: []string{"--limitUsers", "5"},
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.LimitUsers != 5 || !opts.dryRun {
+					t.Errorf("expected 5 users in a dry run, got %d and dryRun %v", opts.processor.LimitUsers, opts.dryRun)
+				}
+			},
+		},
+		{
+			name:    "negative limit",
+			args:    []string{"--limitStories", "-1"},
+			wantErr: "expected --limitStories and --limitUsers to not be negative",
+		},
+	})
+}
+
+func TestParseRunOptionsAtClusterTime(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "cluster time disables the watcher",
+			args: []string{"--atClusterTime", "2024-01-02T03:00:00Z"},
+			check: func(t *testing.T, opts *runOptions) {
+				if want := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC); !opts.processor.AtClusterTime.Equal(want) {
+					t.Errorf("expected %s, got %s", want, opts.processor.AtClusterTime)
+				}
+				if !opts.disableWatcher {
+					t.Errorf("expected the watcher to be disabled")
+				}
+			},
+		},
+		{
+			name:    "invalid time",
+			args:    []string{"--atClusterTime", "2024-01-02"},
+			wantErr: "can not parse the --atClusterTime",
+		},
+		{
+			name:    "future time",
+			args:    []string{"--atClusterTime", time.Now().Add(time.Hour).UTC().Format(time.RFC3339)},
+			wantErr: "expected --atClusterTime to not be in the future",
+		},
+	})
+}
+
+func TestParseRunOptionsBatchSize(t *testing.T) {
+	batchSize := func(want int) func(t *testing.T, opts *runOptions) {
+		return func(t *testing.T, opts *runOptions) {
+			if opts.processor.BatchSize != want {
+				t.Errorf("expected a batch size of %d, got %d", want, opts.processor.BatchSize)
+			}
+		}
+	}
+
+	runOptionsTests(t, []optionsTest{
+		{
+			name:  "smallest batch",
+			args:  []string{"--batchSize", "1"},
+			check: batchSize(1),
+		},
+		{
+			name:  "batch size",
+			args:  []string{"--batchSize", "500"},
+			check: batchSize(500),
+		},
+		{
+			name:  "largest batch",
+			args:  []string{"--batchSize", strconv.Itoa(counts.MaxBatchWriteOperations)},
+			check: batchSize(counts.MaxBatchWriteOperations),
+		},
+		{
+			name:  "over the largest batch",
+			args:  []string{"--batchSize", strconv.Itoa(counts.MaxBatchWriteOperations + 1)},
+			check: batchSize(counts.MaxBatchWriteOperations),
+		},
+		{
+			name:    "empty batch",
+			args:    []string{"--batchSize", "0"},
+			wantErr: "expected --batchSize to be at least 1, found 0",
+		},
+		{
+			name:    "negative batch",
+			args:    []string{"--batchSize", "-10"},
+			wantErr: "expected --batchSize to be at least 1, found -10",
+		},
+		{
+			name:    "negative target bytes",
+			args:    []string{"--targetBatchBytes", "-1"},
+			wantErr: "expected --targetBatchBytes to be at least 0",
+		},
+		{
+			name:    "no writers",
+			args:    []string{"--concurrency", "0"},
+			wantErr: "expected --concurrency to be at least 1",
+		},
+		{
+			name:    "negative queue depth",
+			args:    []string{"--writeQueueDepth", "-1"},
+			wantErr: "expected --writeQueueDepth to not be negative",
+		},
+	})
+}
+
+func TestParseRunOptionsCommentFilter(t *testing.T) {
+	filter := `{"importBatchID": "2021-01"}`
+
+	hasFilter := func(t *testing.T, opts *runOptions) {
+		if len(opts.processor.CommentFilter) != 1 || opts.processor.CommentFilter[0].Key != "importBatchID" {
+			t.Errorf("expected the comment filter to be set, got %v", opts.processor.CommentFilter)
+		}
+	}
+
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "no filter",
+			check: func(t *testing.T, opts *runOptions) {
+				if opts.processor.CommentFilter != nil {
+					t.Errorf("expected no comment filter, got %v", opts.processor.CommentFilter)
+				}
+			},
+		},
+		{
+			name:  "dry run",
+			args:  []string{"--commentFilter", filter, "--dryRun"},
+			check: hasFilter,
+		},
+		{
+			name:  "output collection suffix",
+			args:  []string{"--commentFilter", filter, "--outputCollectionSuffix", "_partial"},
+			check: hasFilter,
+		},
+		{
+			name:  "incremental",
+			args:  []string{"--commentFilter", filter, "--incremental"},
+			check: hasFilter,
+		},
+		{
+			name:    "replacing the full counts",
+			args:    []string{"--commentFilter", filter},
+			wantErr: "--commentFilter only counts some of the comments",
+		},
+		{
+			name:    "invalid",
+			args:    []string{"--commentFilter", "{importBatchID", "--dryRun"},
+			wantErr: "can not parse the --commentFilter",
+		},
+	})
+}
+
+func TestParseRunOptionsSince(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "since",
+			args: []string{"--since", "2024-01-01T00:00:00Z"},
+			check: func(t *testing.T, opts *runOptions) {
+				if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !opts.since.Equal(want) {
+					t.Errorf("expected since %s, got %s", want, opts.since)
+				}
+			},
+		},
+		{
+			name: "not set",
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.since.IsZero() {
+					t.Errorf("expected no since, got %s", opts.since)
+				}
+			},
+		},
+		{
+			name:    "invalid",
+			args:    []string{"--since", "yesterday"},
+			wantErr: "can not parse the --since",
+		},
+		{
+			name:    "in the future",
+			args:    []string{"--since", time.Now().Add(time.Hour).UTC().Format(time.RFC3339)},
+			wantErr: "expected --since to not be in the future",
+		},
+		{
+			name:    "with a story ID pattern",
+			args:    []string{"--since", "2024-01-01T00:00:00Z", "--storyIDPattern", "^a"},
+			wantErr: "--since can not be used with --storyIDPattern",
+		},
+	})
+}
+
+func TestPingPreference(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantMode readpref.Mode
+		wantNil  bool
+		wantErr  string
+	}{
+		{name: "writes need the primary", wantMode: readpref.PrimaryMode},
+		{name: "writes ignore the read preference", args: []string{"--readPreference", "secondary"}, wantMode: readpref.PrimaryMode},
+		{name: "read only uses the client's", args: []string{"--readOnly"}, wantNil: true},
+		{name: "read only uses the read preference", args: []string{"--readOnly", "--readPreference", "secondaryPreferred"}, wantMode: readpref.SecondaryPreferredMode},
+		{name: "invalid read preference", args: []string{"--readOnly", "--readPreference", "nearest-ish"}, wantErr: "can not parse the --readPreference"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got *readpref.ReadPref
+				err error
+			)
+			app := cli.NewApp()
+			app.Flags = flags()
+			app.Action = func(c *cli.Context) error {
+				got, err = pingPreference(c)
+				return nil
+			}
+
+			if runErr := app.Run(append([]string{"coral-counts", "--tenantID", "tenant", "--mongoDBURI", "mongodb://localhost/coral"}, tt.args...)); runErr != nil {
+				t.Fatalf("unexpected error running the app: %v", runErr)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("expected the client's read preference, got %s", got)
+				}
+				return
+			}
+			if got == nil || got.Mode() != tt.wantMode {
+				t.Errorf("expected the %v read preference, got %v", tt.wantMode, got)
+			}
+		})
+	}
+}
+
+func TestParseRunOptionsOptimisticWrites(t *testing.T) {
+	runOptionsTests(t, []optionsTest{
+		{
+			name: "optimistic writes",
+			args: []string{"--optimisticWrites"},
+			check: func(t *testing.T, opts *runOptions) {
+				if !opts.processor.OptimisticWrites {
+					t.Error("expected optimistic writes to be enabled")
+				}
+			},
+		},
+		{
+			name:    "with duplicate stories",
+			args:    []string{"--optimisticWrites", "--updateDuplicateStories"},
+			wantErr: "--optimisticWrites can not be used with --updateDuplicateStories",
+		},
+		{
+			name:    "with a dirty flush interval",
+			args:    []string{"--optimisticWrites", "--dirtyFlushInterval", "1m"},
+			wantErr: "--optimisticWrites can not be used with --dirtyFlushInterval",
+		},
+	})
+}
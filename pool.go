@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultMaxPoolSize is the size of the driver's connection pool when neither
+// the --maxPoolSize or the --mongoDBURI sets it.
+const defaultMaxPoolSize = 100
+
+// applyPoolOptions will set the connection pool options from the flags on the
+// client options, which override any set by the --mongoDBURI. It warns when
+// there are more connections needed at once than the pool allows.
+func applyPoolOptions(c *cli.Context, clientOptions *options.ClientOptions) error {
+	if c.IsSet("maxPoolSize") {
+		clientOptions.SetMaxPoolSize(c.Uint64("maxPoolSize"))
+	}
+	if c.IsSet("minPoolSize") {
+		clientOptions.SetMinPoolSize(c.Uint64("minPoolSize"))
+	}
+	if c.IsSet("maxConnecting") {
+		if c.Uint64("maxConnecting") == 0 {
+			return errors.New("expected --maxConnecting to be at least 1, found 0")
+		}
+
+		clientOptions.SetMaxConnecting(c.Uint64("maxConnecting"))
+	}
+
+	maxPoolSize := uint64(defaultMaxPoolSize)
+	if clientOptions.MaxPoolSize != nil {
+		maxPoolSize = *clientOptions.MaxPoolSize
+	}
+	if clientOptions.MinPoolSize != nil && maxPoolSize > 0 && *clientOptions.MinPoolSize > maxPoolSize {
+		return errors.Errorf("expected --minPoolSize to not be more than the max pool size %d, found %d", maxPoolSize, *clientOptions.MinPoolSize)
+	}
+
+	// Each writer and scan shard holds a connection while it runs, and the
+	// watcher holds one more. A max pool size of zero is unlimited.
+	concurrency, scanShards := c.Int("concurrency"), c.Int("scanShards")
+	if needed := uint64(concurrency + scanShards + 1); maxPoolSize > 0 && needed > maxPoolSize {
+		logrus.WithFields(logrus.Fields{
+			"concurrency": concurrency,
+			"scanShards":  scanShards,
+			"maxPoolSize": maxPoolSize,
+		}).Warn("the --concurrency and --scanShards need more connections than the max pool size, they will wait on each other for connections")
+	}
+
+	if c.Bool("poolMonitor") {
+		clientOptions.SetPoolMonitor(&event.PoolMonitor{
+			Event: func(e *event.PoolEvent) {
+				entry := logrus.WithFields(logrus.Fields{
+					"type":    e.Type,
+					"address": e.Address,
+				})
+				if e.ConnectionID != 0 {
+					entry = entry.WithField("connectionID", e.ConnectionID)
+				}
+				if e.Reason != "" {
+					entry = entry.WithField("reason", e.Reason)
+				}
+
+				entry.Debug("connection pool event")
+			},
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestApplyPoolOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		uri         string
+		args        []string
+		wantMax     uint64
+		wantMin     uint64
+		wantMonitor bool
+		wantErr     string
+	}{
+		{
+			name:    "driver defaults",
+			wantMax: 0,
+		},
+		{
+			name:    "pool sizes",
+			args:    []string{"--maxPoolSize", "20", "--minPoolSize", "5", "--maxConnecting", "3"},
+			wantMax: 20,
+			wantMin: 5,
+		},
+		{
+			name:    "flags override the URI",
+			uri:     "?maxPoolSize=50",
+			args:    []string{"--maxPoolSize", "20"},
+			wantMax: 20,
+		},
+		{
+			name:    "min pool size over the URI max",
+			uri:     "?maxPoolSize=5",
+			args:    []string{"--minPoolSize", "10"},
+			wantErr: "expected --minPoolSize to not be more than the max pool size 5",
+		},
+		{
+			name:    "min pool size over the default max",
+			args:    []string{"--minPoolSize", "101"},
+			wantErr: "expected --minPoolSize to not be more than the max pool size 100",
+		},
+		{
+			name:    "unlimited pool",
+			args:    []string{"--maxPoolSize", "0", "--minPoolSize", "200"},
+			wantMin: 200,
+		},
+		{
+			name:    "no connections at once",
+			args:    []string{"--maxConnecting", "0"},
+			wantErr: "expected --maxConnecting to be at least 1",
+		},
+		{
+			name:        "pool monitor",
+			args:        []string{"--poolMonitor"},
+			wantMonitor: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientOptions := options.Client().ApplyURI("mongodb://localhost/coral" + tt.uri)
+
+			app := cli.NewApp()
+			app.Flags = flags()
+			app.Action = func(c *cli.Context) error {
+				return applyPoolOptions(c, clientOptions)
+			}
+
+			base := []string{"coral-counts", "--tenantID", "tenant", "--mongoDBURI", "mongodb://localhost/coral"}
+			err := app.Run(append(base, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var gotMax, gotMin uint64
+			if clientOptions.MaxPoolSize != nil {
+				gotMax = *clientOptions.MaxPoolSize
+			}
+			if clientOptions.MinPoolSize != nil {
+				gotMin = *clientOptions.MinPoolSize
+			}
+			if gotMax != tt.wantMax || gotMin != tt.wantMin {
+				t.Errorf("expected a pool of %d to %d, got %d to %d", tt.wantMin, tt.wantMax, gotMin, gotMax)
+			}
+			if got := clientOptions.PoolMonitor != nil; got != tt.wantMonitor {
+				t.Errorf("expected the pool monitor %v, got %v", tt.wantMonitor, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// writeCommands are the names of the database commands that write.
+var writeCommands = map[string]struct{}{
+	"insert":        {},
+	"update":        {},
+	"delete":        {},
+	"findAndModify": {},
+	"create":        {},
+	"createIndexes": {},
+	"drop":          {},
+	"dropDatabase":  {},
+	"dropIndexes":   {},
+	"collMod":       {},
+}
+
+// writeMonitor watches the commands sent to the database so that a --readOnly or
+// --monitor run can assert that it didn't attempt any writes.
+type writeMonitor struct {
+	writes int64
+}
+
+// Monitor returns the command monitor that records the write commands.
+func (m *writeMonitor) Monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if _, ok := writeCommands[e.CommandName]; !ok {
+				return
+			}
+
+			atomic.AddInt64(&m.writes, 1)
+
+			collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+			logrus.WithFields(logrus.Fields{
+				"command":    e.CommandName,
+				"database":   e.DatabaseName,
+				"collection": collection,
+			}).Error("a write was attempted by a read only run")
+		},
+	}
+}
+
+// Writes returns the number of write commands that were attempted.
+func (m *writeMonitor) Writes() int64 {
+	return atomic.LoadInt64(&m.writes)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func TestWriteMonitor(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		want     int64
+	}{
+		{"no commands", nil, 0},
+		{"reads", []string{"find", "aggregate", "getMore", "count"}, 0},
+		{"writes", []string{"update", "insert", "delete", "findAndModify"}, 4},
+		{"reads and writes", []string{"find", "createIndexes", "aggregate", "drop"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m writeMonitor
+			monitor := m.Monitor()
+
+			for _, name := range tt.commands {
+				command, err := bson.Marshal(bson.D{primitive.E{Key: name, Value: "stories"}})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				monitor.Started(context.Background(), &event.CommandStartedEvent{
+					Command:      command,
+					DatabaseName: "coral",
+					CommandName:  name,
+				})
+			}
+
+			if got := m.Writes(); got != tt.want {
+				t.Errorf("expected %d writes, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PassReport describes a single pass of processing.
+type PassReport struct {
+	// Pass is the number of the pass, the initial pass is 0 and each pass over
+	// the dirty stories and users after that is numbered from 1.
+	Pass int `json:"pass"`
+
+	// Flush is true for the passes made over the dirty stories and users while
+	// the initial pass was still running, which are numbered separately.
+	Flush bool `json:"flush,omitempty"`
+
+	Stories         int   `json:"stories"`
+	Users           int   `json:"users"`
+	ModifiedStories int64 `json:"modifiedStories"`
+	ModifiedUsers   int64 `json:"modifiedUsers"`
+
+	// DriftedStories and DriftedUsers are the number of stories and users whose
+	// stored counts had drifted, which are only found with --onlyDrift.
+	DriftedStories int `json:"driftedStories,omitempty"`
+	DriftedUsers   int `json:"driftedUsers,omitempty"`
+
+	// OrphanedUsers is the number of authors with comments but no user
+	// document, which are only found with --detectOrphanedUsers.
+	OrphanedUsers int `json:"orphanedUsers,omitempty"`
+
+	// ChangedStories and ChangedUsers are the number of stories and users that
+	// a real run would change, which are only estimated with --estimateChanges.
+	ChangedStories int `json:"changedStories,omitempty"`
+	ChangedUsers   int `json:"changedUsers,omitempty"`
+
+	// ConflictedStories is the number of stories that weren't written as their
+	// counts changed while they were counted, which are only found with
+	// --optimisticWrites.
+	ConflictedStories int `json:"conflictedStories,omitempty"`
+
+	Took string `json:"took"`
+}
+
+// RunReport describes the outcome of a run.
+type RunReport struct {
+	RunID      string    `json:"runID"`
+	TenantID   string    `json:"tenantID"`
+	SiteID     string    `json:"siteID"`
+	DryRun     bool      `json:"dryRun"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Took       string    `json:"took"`
+
+	// StaleComments is the number of comments found by the initial pass that
+	// have been waiting to be moderated for longer than the --maxCommentAge.
+	StaleComments int `json:"staleComments,omitempty"`
+
+	// ImplausibleCreatedAt is the number of comments found by the initial pass
+	// whose createdAt is missing, in the future, or before the
+	// --earliestCreatedAt, when --checkCreatedAt is used.
+	ImplausibleCreatedAt int `json:"implausibleCreatedAt,omitempty"`
+
+	// SlowBatches is the number of bulk write and find batches that took longer
+	// than the --slowQueryThreshold.
+	SlowBatches int64 `json:"slowBatches,omitempty"`
+
+	// ApprovedMismatch is the difference between the approved comments counted
+	// for the users and on the stories by the initial pass.
+	ApprovedMismatch int `json:"approvedMismatch,omitempty"`
+
+	// DirtyStoriesRemaining and DirtyUsersRemaining are the stories and users
+	// that were still dirty when the --maxDirtyPasses was reached, and so were
+	// not recounted.
+	DirtyStoriesRemaining int `json:"dirtyStoriesRemaining,omitempty"`
+	DirtyUsersRemaining   int `json:"dirtyUsersRemaining,omitempty"`
+
+	// Passes contains the initial pass followed by each of the dirty passes.
+	Passes []PassReport `json:"passes"`
+}
+
+// newRunID will return a random (version 4) UUID for the run.
+func newRunID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "could not generate the run ID")
+	}
+
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// DirtyPasses returns the number of passes made over dirty stories and users.
+func (r *RunReport) DirtyPasses() int {
+	if len(r.Passes) == 0 {
+		return 0
+	}
+
+	return len(r.Passes) - 1
+}
+
+// Finish will mark the run as finished.
+func (r *RunReport) Finish() {
+	r.FinishedAt = time.Now()
+	r.Took = r.FinishedAt.Sub(r.StartedAt).String()
+}
+
+// Write will write the report as JSON to the file at path.
+func (r *RunReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal the report")
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write the report")
+	}
+
+	return nil
+}
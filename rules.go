@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// parseRules will parse the rules for how the comments are counted from the
+// flags. The rules are only checked on their own, the checks of how they
+// combine with the other options are left to the run.
+func parseRules(c *cli.Context) (counts.Rules, error) {
+	rules := counts.DefaultRules()
+
+	// Set the paths of the fields that comments are read from.
+	for _, value := range c.StringSlice("commentField") {
+		if err := rules.Fields.Set(value); err != nil {
+			return counts.Rules{}, errors.Wrap(err, "can not parse the --commentField")
+		}
+	}
+
+	// Set where the count of a comment's unresolved flags is read from.
+	rules.Fields.OpenFlags = c.String("openFlagsField")
+
+	// Set the statuses of comments that should not be counted. Only the values
+	// from the environment are split by the flag, so the values from the command
+	// line are split here.
+	for _, value := range c.StringSlice("excludeStatuses") {
+		for _, status := range strings.Split(value, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if !contains(counts.CommentStatuses, status) {
+				return counts.Rules{}, errors.Errorf("expected --excludeStatuses to contain only %s, found %s", strings.Join(counts.CommentStatuses, ","), status)
+			}
+
+			rules.ExcludedStatuses[status] = struct{}{}
+		}
+	}
+	if len(rules.ExcludedStatuses) > 0 {
+		logrus.WithField("statuses", c.StringSlice("excludeStatuses")).Warn("comments with excluded statuses will not be counted, the written counts will intentionally differ from Coral's")
+	}
+
+	// Set the additional moderation queues that will be counted.
+	for _, value := range c.StringSlice("actionQueue") {
+		rule, err := counts.ParseActionQueueRule(value)
+		if err != nil {
+			return counts.Rules{}, errors.Wrap(err, "can not parse the --actionQueue")
+		}
+
+		rules.ActionQueueRules = append(rules.ActionQueueRules, rule)
+	}
+	for _, value := range c.StringSlice("statusQueue") {
+		rule, err := counts.ParseStatusQueueRule(value)
+		if err != nil {
+			return counts.Rules{}, errors.Wrap(err, "can not parse the --statusQueue")
+		}
+
+		rules.StatusQueueRules = append(rules.StatusQueueRules, rule)
+	}
+
+	// Set the age after which comments waiting to be moderated are stale.
+	rules.MaxCommentAge = c.Duration("maxCommentAge")
+
+	// Set if the createdAt of the comments are checked, and the earliest that's
+	// plausible.
+	rules.CheckCreatedAt = c.Bool("checkCreatedAt")
+	if value := c.String("earliestCreatedAt"); value != "" {
+		earliest, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return counts.Rules{}, errors.Wrap(err, "can not parse the --earliestCreatedAt")
+		}
+
+		rules.EarliestCreatedAt = earliest
+	}
+
+	// Set if comments should be counted by their source.
+	rules.CountBySource = c.Bool("countBySource")
+
+	// Set if the star ratings of comments are counted.
+	rules.CountRatings = c.Bool("countRatings")
+
+	// Set if the different users that commented on each story are counted.
+	rules.CountDistinctAuthors = c.Bool("countDistinctAuthors")
+
+	// Set if approved comments with open flags are counted in the reported queue.
+	rules.CountReportedApproved = c.Bool("countReportedApproved")
+
+	// Set the rules for which flagged comments are in the reported queue.
+	policy, err := counts.ParseQueuePolicy(c.String("queuePolicy"))
+	if err != nil {
+		return counts.Rules{}, errors.Wrap(err, "can not parse the --queuePolicy")
+	}
+	rules.ReportedPolicy = policy
+
+	// Set the flags that are from automated detection rather than users.
+	for _, key := range c.StringSlice("automatedFlagKeys") {
+		if key = strings.TrimSpace(key); key != "" {
+			rules.AutomatedFlagKeys = append(rules.AutomatedFlagKeys, key)
+		}
+	}
+
+	// Set the casing that action keys are normalized to.
+	switch actionKeyCase := c.String("actionKeyCase"); actionKeyCase {
+	case "", counts.ActionKeysUpper, counts.ActionKeysLower:
+		rules.ActionKeyCase = actionKeyCase
+	default:
+		return counts.Rules{}, errors.Errorf("expected --actionKeyCase to be %s or %s, found %s", counts.ActionKeysUpper, counts.ActionKeysLower, actionKeyCase)
+	}
+
+	// Set how the story ID's of comments are normalized.
+	if pattern, mappings := c.String("storyIDPattern"), c.StringSlice("storyIDMapping"); pattern != "" || len(mappings) > 0 {
+		normalizer, err := counts.NewStoryIDNormalizer(pattern, c.String("storyIDReplacement"), mappings)
+		if err != nil {
+			return counts.Rules{}, errors.Wrap(err, "can not use the --storyIDPattern or --storyIDMapping")
+		}
+
+		rules.StoryIDNormalizer = normalizer
+	}
+
+	return rules, nil
+}
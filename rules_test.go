@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// parseRulesArgs will parse the args with the app's flags and return the rules
+// that parseRules builds from them.
+func parseRulesArgs(t *testing.T, args ...string) (counts.Rules, error) {
+	t.Helper()
+
+	var rules counts.Rules
+	app := cli.NewApp()
+	app.Flags = flags()
+	app.Action = func(c *cli.Context) error {
+		var err error
+		rules, err = parseRules(c)
+
+		return err
+	}
+
+	base := []string{"coral-counts", "--tenantID", "tenant", "--mongoDBURI", "mongodb://localhost/coral"}
+	err := app.Run(append(base, args...))
+
+	return rules, err
+}
+
+func TestParseRulesExcludeStatuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "one", args: []string{"--excludeStatuses", "REJECTED"}, want: []string{"REJECTED"}},
+		{name: "normalized", args: []string{"--excludeStatuses", " rejected ,premod"}, want: []string{"PREMOD", "REJECTED"}},
+		{name: "repeated", args: []string{"--excludeStatuses", "REJECTED", "--excludeStatuses", "PREMOD"}, want: []string{"PREMOD", "REJECTED"}},
+		{name: "unknown", args: []string{"--excludeStatuses", "DELETED"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRulesArgs(t, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRules(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(rules.ExcludedStatuses) != len(tt.want) {
+				t.Fatalf("expected the excluded statuses %v, got %v", tt.want, rules.ExcludedStatuses)
+			}
+			for _, status := range tt.want {
+				if !rules.Excluded(&counts.Comment{Status: status}) {
+					t.Errorf("expected %s to be excluded", status)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRulesCommentFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    func(f *counts.CommentFields)
+		wantErr bool
+	}{
+		{name: "defaults", want: func(f *counts.CommentFields) {}},
+		{
+			name: "mapped",
+			args: []string{"--commentField", "storyID=story.id", "--commentField", "status=moderation.status"},
+			want: func(f *counts.CommentFields) { f.StoryID, f.Status = "story.id", "moderation.status" },
+		},
+		{name: "open flags", args: []string{"--openFlagsField", "flags.open"}, want: func(f *counts.CommentFields) { f.OpenFlags = "flags.open" }},
+		{name: "unknown field", args: []string{"--commentField", "author=user.id"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRulesArgs(t, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRules(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want := counts.DefaultCommentFields
+			tt.want(&want)
+			if rules.Fields != want {
+				t.Errorf("expected the fields %+v, got %+v", want, rules.Fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"coral-counts/counts"
+)
+
+// runSelfTest will connect to the server in the --mongoDBURI and run the self
+// test as part of the run against the named database rather than the database
+// in the uri. It's run without any of the counting options so the default
+// counting rules are tested, apart from --countReportedApproved, --queuePolicy,
+// --countDistinctAuthors, and --stampRecomputeMarker which the self test also
+// checks.
+func runSelfTest(c *cli.Context, database, runID string) error {
+	rules := counts.DefaultRules()
+	rules.CountReportedApproved = c.Bool("countReportedApproved")
+	policy, err := counts.ParseQueuePolicy(c.String("queuePolicy"))
+	if err != nil {
+		return errors.Wrap(err, "can not parse the --queuePolicy")
+	}
+	rules.ReportedPolicy = policy
+	rules.CountDistinctAuthors = c.Bool("countDistinctAuthors")
+
+	// The self test seeds flags from automated detection, so it always checks
+	// that the reported queue is broken down by them.
+	rules.AutomatedFlagKeys = []string{counts.SelfTestAutomatedFlagKey}
+
+	conn, err := connect(c, false, readpref.Primary())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	p := counts.NewProcessor(conn.client.Database(database), c.String("tenantID"), c.String("siteID"), false, rules)
+	p.RunID = runID
+	p.Timeouts = conn.timeouts
+	p.StampRecomputeMarker = c.Bool("stampRecomputeMarker")
+
+	// The self test seeds an author without a user document, so it always checks
+	// that they're detected.
+	p.DetectOrphanedUsers = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := time.Now()
+	always().WithField("database", database).Info("started self test")
+
+	if err := counts.SelfTest(ctx, p); err != nil {
+		return errors.Wrap(err, "self test failed")
+	}
+
+	always().WithFields(logrus.Fields{
+		"database": database,
+		"took":     time.Since(started),
+	}).Info("self test passed")
+
+	return nil
+}
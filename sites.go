@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"coral-counts/counts"
+)
+
+// runSites will process each of the sites matching the --siteFilter in turn.
+// A site that fails doesn't stop the sites after it, and the errors from every
+// site that failed are returned together.
+func runSites(c *cli.Context, runID string, metrics counts.Recorder) error {
+	if c.String("selfTest") != "" {
+		return errors.New("--selfTest can not be used with --siteFilter")
+	}
+
+	// Connect once, the run of each site shares the connection. It's pinged
+	// with the same read preference as the connection of a single site.
+	ping, err := pingPreference(c)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(c, c.Bool("readOnly"), ping)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	siteIDs, err := resolveSites(c, conn.db)
+	if err != nil {
+		return err
+	}
+
+	if len(siteIDs) == 0 {
+		logrus.WithField("siteFilter", c.String("siteFilter")).Warn("no sites match the --siteFilter")
+		return nil
+	}
+
+	always().WithFields(logrus.Fields{
+		"tenantID": c.String("tenantID"),
+		"sites":    len(siteIDs),
+	}).Info("processing the sites matching the --siteFilter")
+
+	// Count the stories of every site with a single scan of the tenant's
+	// comments, which is run when the first site is processed.
+	var tenantScan *counts.TenantScan
+	if c.Bool("tenantScan") {
+		tenantScan = counts.NewTenantScan(siteIDs)
+	}
+
+	var failed phaseErrors
+	for _, siteID := range siteIDs {
+		if err := c.Set("siteID", siteID); err != nil {
+			return errors.Wrap(err, "could not set the --siteID")
+		}
+
+		if err := runSite(c, conn, runID, metrics, tenantScan); err != nil {
+			// A shutdown stops the sites after this one from being processed.
+			if errors.Is(err, counts.ErrCanceled) {
+				failed = append(failed, errors.Wrapf(err, "site %s", siteID))
+				break
+			}
+
+			logrus.WithError(err).WithField("siteID", siteID).Error("could not process site")
+			failed = append(failed, errors.Wrapf(err, "site %s", siteID))
+		}
+	}
+
+	always().WithFields(logrus.Fields{
+		"sites":  len(siteIDs),
+		"failed": len(failed),
+	}).Info("finished processing the sites")
+
+	if len(failed) > 0 {
+		return failed
+	}
+
+	return nil
+}
+
+// resolveSites will return the ID's of the tenant's sites that match the
+// --siteFilter.
+func resolveSites(c *cli.Context, db *mongo.Database) ([]string, error) {
+	filter, err := counts.ParseFilter(c.String("siteFilter"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse the --siteFilter")
+	}
+
+	siteIDs, err := counts.ResolveSites(context.Background(), db, c.String("tenantID"), filter, c.Duration("cursorCloseTimeout"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not find the sites matching the --siteFilter")
+	}
+
+	return siteIDs, nil
+}
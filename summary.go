@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// summaryStatus returns the status of a run from its exit code.
+func summaryStatus(code int) string {
+	switch code {
+	case ExitOK:
+		return "ok"
+	case ExitDrift:
+		return "drift"
+	case ExitPartial:
+		return "partial"
+	default:
+		return "error"
+	}
+}
+
+// summaryValue will quote the value when it would otherwise make the summary
+// line ambiguous to parse.
+func summaryValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// summaryLine returns a single line of key=value pairs describing the outcome
+// of a run, for tools that only want to grep the result.
+func summaryLine(tenantID, siteID string, took time.Duration, report *RunReport, err error) string {
+	var (
+		stories, users int
+		modified       int64
+		drift          int
+	)
+	for _, pass := range report.Passes {
+		stories += pass.Stories
+		users += pass.Users
+		modified += pass.ModifiedStories + pass.ModifiedUsers
+		drift += pass.DriftedStories + pass.DriftedUsers
+	}
+
+	code := exitCode(err)
+
+	return fmt.Sprintf(
+		"coral-counts result tenant=%s site=%s stories=%d users=%d modified=%d drift=%d took=%s status=%s code=%d",
+		summaryValue(tenantID),
+		summaryValue(siteID),
+		stories,
+		users,
+		modified,
+		drift,
+		took.Round(time.Second),
+		summaryStatus(code),
+		code,
+	)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSummaryLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		tenantID string
+		siteID   string
+		took     time.Duration
+		report   RunReport
+		err      error
+		want     string
+	}{
+		{
+			name:     "empty run",
+			tenantID: "tenant",
+			siteID:   "site",
+			want:     "coral-counts result tenant=tenant site=site stories=0 users=0 modified=0 drift=0 took=0s status=ok code=0",
+		},
+		{
+			name:     "passes are summed",
+			tenantID: "tenant",
+			siteID:   "site",
+			took:     90*time.Second + 400*time.Millisecond,
+			report: RunReport{Passes: []PassReport{
+				{Stories: 10, Users: 5, ModifiedStories: 3, ModifiedUsers: 2, DriftedStories: 1},
+				{Stories: 2, Users: 1, ModifiedStories: 1, DriftedUsers: 1},
+			}},
+			want: "coral-counts result tenant=tenant site=site stories=12 users=6 modified=6 drift=2 took=1m30s status=ok code=0",
+		},
+		{
+			name:     "drift",
+			tenantID: "tenant",
+			siteID:   "site",
+			err:      errDrift,
+			want:     "coral-counts result tenant=tenant site=site stories=0 users=0 modified=0 drift=0 took=0s status=drift code=2",
+		},
+		{
+			name:     "partial",
+			tenantID: "tenant",
+			siteID:   "site",
+			err:      withExitCode(errors.New("stopped"), ExitPartial),
+			want:     "coral-counts result tenant=tenant site=site stories=0 users=0 modified=0 drift=0 took=0s status=partial code=3",
+		},
+		{
+			name:     "error",
+			tenantID: "tenant",
+			siteID:   "site",
+			err:      withExitCode(errors.New("failed"), ExitWrite),
+			want:     "coral-counts result tenant=tenant site=site stories=0 users=0 modified=0 drift=0 took=0s status=error code=5",
+		},
+		{
+			name:     "quoted values",
+			tenantID: "my tenant",
+			want:     `coral-counts result tenant="my tenant" site="" stories=0 users=0 modified=0 drift=0 took=0s status=ok code=0`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summaryLine(tt.tenantID, tt.siteID, tt.took, &tt.report, tt.err); got != tt.want {
+				t.Errorf("summaryLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"site", "site"},
+		{"", `""`},
+		{"a b", `"a b"`},
+		{"a=b", `"a=b"`},
+		{`a"b`, `"a\"b"`},
+		{"a\tb", `"a\tb"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := summaryValue(tt.value); got != tt.want {
+				t.Errorf("summaryValue(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
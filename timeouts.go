@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// parseTimeouts will parse the deadlines of each of the operations against
+// MongoDB from the flags. The ping uses the connect timeout unless it's set.
+func parseTimeouts(c *cli.Context) (counts.PhaseTimeouts, error) {
+	timeouts := counts.PhaseTimeouts{
+		Connect:       c.Duration("mongoDBConnectTimeout"),
+		Ping:          c.Duration("mongoDBPingTimeout"),
+		PerBatchWrite: c.Duration("batchWriteTimeout"),
+		CursorClose:   c.Duration("cursorCloseTimeout"),
+		Disconnect:    c.Duration("mongoDBDisconnectTimeout"),
+		Cleanup:       c.Duration("cleanupTimeout"),
+	}
+	if timeouts.Ping == 0 {
+		timeouts.Ping = timeouts.Connect
+	}
+
+	for _, flag := range []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"mongoDBConnectTimeout", timeouts.Connect},
+		{"mongoDBPingTimeout", timeouts.Ping},
+		{"cursorCloseTimeout", timeouts.CursorClose},
+		{"mongoDBDisconnectTimeout", timeouts.Disconnect},
+		{"cleanupTimeout", timeouts.Cleanup},
+	} {
+		if flag.timeout <= 0 {
+			return counts.PhaseTimeouts{}, errors.Errorf("expected --%s to be positive, found %s", flag.name, flag.timeout)
+		}
+	}
+	if timeouts.PerBatchWrite < 0 {
+		return counts.PhaseTimeouts{}, errors.Errorf("expected --batchWriteTimeout to not be negative, found %s", timeouts.PerBatchWrite)
+	}
+
+	return timeouts, nil
+}
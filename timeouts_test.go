@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"coral-counts/counts"
+)
+
+// timeoutsFromArgs will parse the args with the app's flags and return the
+// timeouts parsed from them.
+func timeoutsFromArgs(t *testing.T, args ...string) (counts.PhaseTimeouts, error) {
+	t.Helper()
+
+	var parsed counts.PhaseTimeouts
+	err := runWithFlags(t, func(c *cli.Context) error {
+		var err error
+		parsed, err = parseTimeouts(c)
+		return err
+	}, args...)
+
+	return parsed, err
+}
+
+func TestParseTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    counts.PhaseTimeouts
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: counts.DefaultTimeouts,
+		},
+		{
+			name: "every timeout configured",
+			args: []string{
+				"--mongoDBConnectTimeout", "2s",
+				"--mongoDBPingTimeout", "3s",
+				"--batchWriteTimeout", "4s",
+				"--cursorCloseTimeout", "5s",
+				"--mongoDBDisconnectTimeout", "6s",
+				"--cleanupTimeout", "7s",
+			},
+			want: counts.PhaseTimeouts{
+				Connect:       2 * time.Second,
+				Ping:          3 * time.Second,
+				PerBatchWrite: 4 * time.Second,
+				CursorClose:   5 * time.Second,
+				Disconnect:    6 * time.Second,
+				Cleanup:       7 * time.Second,
+			},
+		},
+		{
+			name: "ping uses the connect timeout",
+			args: []string{"--mongoDBConnectTimeout", "2s", "--mongoDBPingTimeout", "0"},
+			want: func() counts.PhaseTimeouts {
+				want := counts.DefaultTimeouts
+				want.Connect = 2 * time.Second
+				want.Ping = 2 * time.Second
+				return want
+			}(),
+		},
+		{name: "zero connect", args: []string{"--mongoDBConnectTimeout", "0"}, wantErr: true},
+		{name: "zero cursor close", args: []string{"--cursorCloseTimeout", "0"}, wantErr: true},
+		{name: "zero disconnect", args: []string{"--mongoDBDisconnectTimeout", "0"}, wantErr: true},
+		{name: "zero cleanup", args: []string{"--cleanupTimeout", "0"}, wantErr: true},
+		{name: "negative batch write", args: []string{"--batchWriteTimeout", "-1s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := timeoutsFromArgs(t, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeouts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseTimeouts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseTimeoutsFromEnv checks that the timeouts can be configured from the
+// environment as well as the flags.
+func TestParseTimeoutsFromEnv(t *testing.T) {
+	os.Setenv("CLEANUP_TIMEOUT", "42s")
+	defer os.Unsetenv("CLEANUP_TIMEOUT")
+
+	got, err := timeoutsFromArgs(t)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Cleanup != 42*time.Second {
+		t.Errorf("expected the cleanup timeout from CLEANUP_TIMEOUT, got %s", got.Cleanup)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookPayload is sent to the --webhookURL when a run finishes.
+type WebhookPayload struct {
+	TenantID string `json:"tenantID"`
+	SiteID   string `json:"siteID"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	Took     string `json:"took"`
+
+	// ModifiedStories and ModifiedUsers are the totals across every pass.
+	ModifiedStories int64 `json:"modifiedStories"`
+	ModifiedUsers   int64 `json:"modifiedUsers"`
+
+	// Report is only included when the run got as far as processing.
+	Report *RunReport `json:"report,omitempty"`
+}
+
+// newWebhookPayload will create the payload describing the outcome of a run.
+func newWebhookPayload(tenantID, siteID string, took time.Duration, report *RunReport, err error) WebhookPayload {
+	payload := WebhookPayload{
+		TenantID: tenantID,
+		SiteID:   siteID,
+		Success:  err == nil,
+		ExitCode: exitCode(err),
+		Took:     took.String(),
+	}
+
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	if !report.StartedAt.IsZero() {
+		if report.FinishedAt.IsZero() {
+			report.Finish()
+		}
+
+		for _, pass := range report.Passes {
+			payload.ModifiedStories += pass.ModifiedStories
+			payload.ModifiedUsers += pass.ModifiedUsers
+		}
+
+		payload.Report = report
+	}
+
+	return payload
+}
+
+// notifyWebhook will POST the payload as JSON to the url, retrying up to
+// retries times if it fails. Each attempt is limited to the timeout.
+func notifyWebhook(url string, timeout time.Duration, retries int, payload WebhookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal the webhook payload")
+	}
+
+	client := http.Client{
+		Timeout: timeout,
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(&client, url, data)
+		if err == nil {
+			logrus.WithField("attempts", attempt+1).Info("notified webhook")
+			return nil
+		}
+
+		if attempt >= retries {
+			return err
+		}
+
+		logrus.WithError(err).WithField("attempt", attempt+1).Warn("could not notify webhook, retrying")
+
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+func postWebhook(client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "could not create the webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not send the webhook request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "accepted", statuses: []int{http.StatusOK}, wantAttempts: 1},
+		{name: "no content", statuses: []int{http.StatusNoContent}, wantAttempts: 1},
+		{name: "failed without retries", statuses: []int{http.StatusInternalServerError}, wantAttempts: 1, wantErr: true},
+		{name: "retried after failing", statuses: []int{http.StatusBadGateway, http.StatusOK}, retries: 1, wantAttempts: 2},
+		{name: "not modified", statuses: []int{http.StatusNotModified}, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mux      sync.Mutex
+				payloads []WebhookPayload
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				defer mux.Unlock()
+
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("expected a JSON POST, got %s %s", r.Method, r.Header.Get("Content-Type"))
+				}
+
+				var payload WebhookPayload
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("could not decode the payload: %v", err)
+				}
+				payloads = append(payloads, payload)
+
+				w.WriteHeader(tt.statuses[len(payloads)-1])
+			}))
+			defer srv.Close()
+
+			payload := newWebhookPayload("tenant", "site", time.Second, &RunReport{}, nil)
+
+			err := notifyWebhook(srv.URL, time.Second, tt.retries, payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("notifyWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(payloads) != tt.wantAttempts {
+				t.Fatalf("expected %d attempts, got %d", tt.wantAttempts, len(payloads))
+			}
+			for _, got := range payloads {
+				if got.TenantID != "tenant" || got.SiteID != "site" || !got.Success {
+					t.Errorf("expected a successful payload for tenant/site, got %+v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWebhookPayload(t *testing.T) {
+	tests := []struct {
+		name         string
+		report       RunReport
+		err          error
+		wantSuccess  bool
+		wantExitCode int
+		wantReport   bool
+		wantStories  int64
+		wantUsers    int64
+	}{
+		{
+			name:        "failed before processing",
+			err:         errors.New("could not connect"),
+			wantSuccess: false, wantExitCode: ExitError,
+		},
+		{
+			name: "processed",
+			report: RunReport{
+				StartedAt: time.Now(),
+				Passes: []PassReport{
+					{Pass: 0, ModifiedStories: 3, ModifiedUsers: 2},
+					{Pass: 1, ModifiedStories: 1},
+				},
+			},
+			wantSuccess: true, wantExitCode: ExitOK, wantReport: true, wantStories: 4, wantUsers: 2,
+		},
+		{
+			name:        "drifted",
+			report:      RunReport{StartedAt: time.Now()},
+			err:         errDrift,
+			wantSuccess: false, wantExitCode: ExitDrift, wantReport: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newWebhookPayload("tenant", "site", time.Second, &tt.report, tt.err)
+
+			if got.Success != tt.wantSuccess || got.ExitCode != tt.wantExitCode {
+				t.Errorf("expected success %v and exit code %d, got %v and %d", tt.wantSuccess, tt.wantExitCode, got.Success, got.ExitCode)
+			}
+			if tt.err != nil && got.Error != tt.err.Error() {
+				t.Errorf("expected the error %q, got %q", tt.err.Error(), got.Error)
+			}
+			if (got.Report != nil) != tt.wantReport {
+				t.Fatalf("expected report %v, got %v", tt.wantReport, got.Report != nil)
+			}
+			if got.Report != nil && got.Report.FinishedAt.IsZero() {
+				t.Errorf("expected the report to be finished")
+			}
+			if got.ModifiedStories != tt.wantStories || got.ModifiedUsers != tt.wantUsers {
+				t.Errorf("expected %d stories and %d users modified, got %d and %d", tt.wantStories, tt.wantUsers, got.ModifiedStories, got.ModifiedUsers)
+			}
+		})
+	}
+}